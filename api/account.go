@@ -0,0 +1,251 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PowPool/btcpool/lightning"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+const challengeTTL = 10 * time.Minute
+const defaultAccountRequests = 10
+
+// Counts the account requests of every client in the current minute
+type accountLimiter struct {
+	mu     sync.Mutex
+	minute int64
+	counts map[string]int
+}
+
+func (l *accountLimiter) allow(ip string, max int) bool {
+	minute := time.Now().Unix() / 60
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts == nil || l.minute != minute {
+		l.minute = minute
+		l.counts = make(map[string]int)
+	}
+	l.counts[ip]++
+	return l.counts[ip] <= max
+}
+
+// Miners sign a challenge with the key of their payout address to change their settings
+func (s *ApiServer) registerAccountRoutes(r *mux.Router) {
+	r.HandleFunc("/accounts/{login:[0-9a-zA-Z:]{25,100}}/challenge", s.AccountChallenge).Methods("GET")
+	r.HandleFunc("/accounts/{login:[0-9a-zA-Z:]{25,100}}/settings", s.AccountSettingsUpdate).Methods("POST")
+}
+
+func writeAccountReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeAdminReply(w, status, reply)
+}
+
+func (s *ApiServer) accountRequests() int {
+	if s.config.AccountRequests > 0 {
+		return s.config.AccountRequests
+	}
+	return defaultAccountRequests
+}
+
+func (s *ApiServer) remoteAddr(r *http.Request) string {
+	if s.config.BehindReverseProxy {
+		ip := r.Header.Get("X-Forwarded-For")
+		if len(ip) > 0 && net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
+
+// The signature covers the settings, it can't authorize any other change
+func (s *ApiServer) challengeMessage(login, challenge string, settings *storage.MinerSettings) string {
+	data, _ := json.Marshal(settings)
+	digest := sha256.Sum256(data)
+	return fmt.Sprintf("%s payout settings for %s: %s %s", s.name, login, challenge, hex.EncodeToString(digest[:]))
+}
+
+// Settings to change from the query of a challenge request, like the body of the update
+func settingsFromQuery(query url.Values) (*storage.MinerSettings, error) {
+	settings := &storage.MinerSettings{}
+	if _, ok := query["threshold"]; ok {
+		threshold, err := strconv.ParseInt(query.Get("threshold"), 10, 64)
+		if err != nil {
+			return nil, errors.New("threshold in Satoshi required")
+		}
+		settings.Threshold = &threshold
+	}
+	for field, value := range map[string]**string{"lightning": &settings.Lightning, "webhook": &settings.Webhook, "email": &settings.Email} {
+		if _, ok := query[field]; ok {
+			v := query.Get(field)
+			*value = &v
+		}
+	}
+	return settings, nil
+}
+
+// Message the miner has to sign to change the settings in the query, valid for one settings update
+func (s *ApiServer) AccountChallenge(w http.ResponseWriter, r *http.Request) {
+	login := s.coin.NormalizeAddress(mux.Vars(r)["login"])
+
+	if !s.limiter.allow(s.remoteAddr(r), s.accountRequests()) {
+		writeAccountReply(w, http.StatusTooManyRequests, map[string]interface{}{"error": "too many requests"})
+		return
+	}
+	settings, err := settingsFromQuery(r.URL.Query())
+	if err == nil {
+		err = s.validateSettings(settings)
+	}
+	if err != nil {
+		writeAccountReply(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	exist, err := s.backend.IsMinerExists(login)
+	if err == nil && !exist {
+		writeAccountReply(w, http.StatusNotFound, map[string]interface{}{"error": "unknown miner"})
+		return
+	}
+	challenge, expires := "", int64(0)
+	if err == nil {
+		challenge, expires, err = s.backend.IssueChallenge(login, challengeTTL)
+	}
+	if err != nil {
+		Error.Printf("Failed to issue challenge for %s: %v", login, err)
+		writeAccountReply(w, http.StatusInternalServerError, map[string]interface{}{"error": "internal error"})
+		return
+	}
+	writeAccountReply(w, http.StatusOK, map[string]interface{}{
+		"message": s.challengeMessage(login, challenge, settings),
+		"expires": expires,
+	})
+}
+
+// Sets the threshold, Lightning destination, webhook or email present in the body, empty values remove them
+func (s *ApiServer) AccountSettingsUpdate(w http.ResponseWriter, r *http.Request) {
+	login := s.coin.NormalizeAddress(mux.Vars(r)["login"])
+
+	if !s.limiter.allow(s.remoteAddr(r), s.accountRequests()) {
+		writeAccountReply(w, http.StatusTooManyRequests, map[string]interface{}{"error": "too many requests"})
+		return
+	}
+
+	var body struct {
+		Signature string `json:"signature"`
+		storage.MinerSettings
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body)
+	if err != nil || len(body.Signature) == 0 {
+		writeAccountReply(w, http.StatusBadRequest, map[string]interface{}{"error": "signature of the challenge required"})
+		return
+	}
+	settings := &body.MinerSettings
+	if err = s.validateSettings(settings); err != nil {
+		writeAccountReply(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if settings.Threshold != nil && *settings.Threshold > 0 {
+		schedule, err := s.backend.GetPayoutSchedule()
+		if err != nil {
+			Error.Printf("Failed to get payout schedule from backend: %v", err)
+			writeAccountReply(w, http.StatusInternalServerError, map[string]interface{}{"error": "internal error"})
+			return
+		}
+		if schedule == nil {
+			writeAccountReply(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "payouts never ran, minimum threshold unknown"})
+			return
+		}
+		if *settings.Threshold < schedule.MinThreshold {
+			writeAccountReply(w, http.StatusBadRequest, map[string]interface{}{"error": "threshold below pool minimum", "minThreshold": schedule.MinThreshold})
+			return
+		}
+	}
+
+	challenge, err := s.backend.GetChallenge(login)
+	if err != nil {
+		Error.Printf("Failed to get challenge of %s: %v", login, err)
+		writeAccountReply(w, http.StatusInternalServerError, map[string]interface{}{"error": "internal error"})
+		return
+	}
+	if len(challenge) == 0 {
+		writeAccountReply(w, http.StatusForbidden, map[string]interface{}{"error": "no challenge or challenge expired"})
+		return
+	}
+	err = s.coin.VerifyMessage(login, s.challengeMessage(login, challenge, settings), body.Signature)
+	if err != nil {
+		writeAccountReply(w, http.StatusForbidden, map[string]interface{}{"error": "invalid signature: " + err.Error()})
+		return
+	}
+	// Only a valid signature uses up the challenge
+	taken, err := s.backend.TakeChallenge(login, challenge)
+	if err != nil {
+		Error.Printf("Failed to take challenge of %s: %v", login, err)
+		writeAccountReply(w, http.StatusInternalServerError, map[string]interface{}{"error": "internal error"})
+		return
+	}
+	if !taken {
+		writeAccountReply(w, http.StatusForbidden, map[string]interface{}{"error": "challenge already used"})
+		return
+	}
+
+	err = s.backend.UpdateMinerSettings(login, settings)
+	if err != nil {
+		Error.Printf("Failed to update settings of %s: %v", login, err)
+		writeAccountReply(w, http.StatusInternalServerError, map[string]interface{}{"error": "internal error"})
+		return
+	}
+	s.minersMu.Lock()
+	delete(s.miners, login)
+	s.minersMu.Unlock()
+
+	Info.Printf("Miner %s updated their settings", login)
+	writeAccountReply(w, http.StatusOK, map[string]interface{}{"result": true})
+}
+
+func (s *ApiServer) validateSettings(settings *storage.MinerSettings) error {
+	if settings.Threshold != nil && *settings.Threshold < 0 {
+		return errors.New("threshold in Satoshi required")
+	}
+	if settings.Lightning != nil {
+		*settings.Lightning = strings.TrimSpace(*settings.Lightning)
+		if len(*settings.Lightning) > 0 {
+			if err := lightning.ValidDestination(*settings.Lightning); err != nil {
+				return err
+			}
+		}
+	}
+	if settings.Webhook != nil {
+		*settings.Webhook = strings.TrimSpace(*settings.Webhook)
+		if len(*settings.Webhook) > 0 {
+			u, err := url.Parse(*settings.Webhook)
+			if err != nil || u.Scheme != "https" || len(u.Host) == 0 || u.User != nil || len(*settings.Webhook) > 256 {
+				return errors.New("webhook must be an https URL")
+			}
+		}
+	}
+	if settings.Email != nil {
+		*settings.Email = strings.TrimSpace(*settings.Email)
+		if len(*settings.Email) > 0 {
+			addr, err := mail.ParseAddress(*settings.Email)
+			if err != nil || addr.Address != *settings.Email || len(*settings.Email) > 254 {
+				return errors.New("invalid email address")
+			}
+		}
+	}
+	return nil
+}
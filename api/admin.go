@@ -0,0 +1,276 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/PowPool/btcpool/lightning"
+	. "github.com/PowPool/btcpool/util"
+)
+
+func (s *ApiServer) registerAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/admin/txpolicy", s.adminOnly(s.TxPolicyIndex)).Methods("GET")
+	r.HandleFunc("/admin/txpolicy/{list:priority|excluded}/{txid:[0-9a-fA-F]{64}}", s.adminOnly(s.TxPolicyUpdate)).Methods("POST", "DELETE")
+	r.HandleFunc("/admin/miners/{login:[0-9a-zA-Z:]{25,100}}/threshold", s.adminOnly(s.PayoutThresholdUpdate)).Methods("POST")
+	r.HandleFunc("/admin/miners/{login:[0-9a-zA-Z:]{25,100}}/lightning", s.adminOnly(s.LightningDestinationUpdate)).Methods("POST")
+	r.HandleFunc("/admin/miners/{login:[0-9a-zA-Z:]{25,100}}/adjust", s.adminOnly(s.BalanceAdjust)).Methods("POST")
+	r.HandleFunc("/admin/ledger", s.adminOnly(s.LedgerIndex)).Methods("GET")
+	r.HandleFunc("/admin/ledger/reconcile", s.adminOnly(s.LedgerReconcile)).Methods("GET")
+	r.HandleFunc("/admin/solvency", s.adminOnly(s.SolvencyIndex)).Methods("GET")
+	r.HandleFunc("/admin/payouts/batch", s.adminOnly(s.PayoutBatchIndex)).Methods("GET")
+	r.HandleFunc("/admin/payouts/batch/{id:[0-9]+-[0-9a-f]{8}}", s.adminOnly(s.PayoutBatchSign)).Methods("POST")
+}
+
+func (s *ApiServer) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		Error.Println("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) TxPolicyIndex(w http.ResponseWriter, r *http.Request) {
+	priority, err := s.backend.GetPriorityTxs()
+	if err != nil {
+		Error.Printf("Failed to get priority transactions from backend: %v", err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	excluded, err := s.backend.GetExcludedTxs()
+	if err != nil {
+		Error.Printf("Failed to get excluded transactions from backend: %v", err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"priority": priority, "excluded": excluded})
+}
+
+func (s *ApiServer) TxPolicyUpdate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	txId := strings.ToLower(vars["txid"])
+
+	var err error
+	switch {
+	case vars["list"] == "priority" && r.Method == "POST":
+		err = s.backend.AddPriorityTx(txId)
+	case vars["list"] == "priority":
+		err = s.backend.RemovePriorityTx(txId)
+	case r.Method == "POST":
+		err = s.backend.AddExcludedTx(txId)
+	default:
+		err = s.backend.RemoveExcludedTx(txId)
+	}
+	if err != nil {
+		Error.Printf("Failed to update %s transactions in backend: %v", vars["list"], err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	Info.Printf("Admin %s %s transaction %s", r.Method, vars["list"], txId)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"result": true})
+}
+
+func (s *ApiServer) PayoutBatchIndex(w http.ResponseWriter, r *http.Request) {
+	batch, err := s.backend.GetPayoutBatch()
+	if err != nil {
+		Error.Printf("Failed to get payout batch from backend: %v", err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"batch": batch})
+}
+
+// Accepts the PSBT signed offline, the payouts processor finalizes and broadcasts it
+func (s *ApiServer) PayoutBatchSign(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var body struct {
+		Psbt string `json:"psbt"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || len(body.Psbt) == 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]interface{}{"error": "signed psbt required"})
+		return
+	}
+	err = s.backend.SubmitSignedPsbt(id, strings.TrimSpace(body.Psbt))
+	if err != nil {
+		Error.Printf("Failed to submit signed payout batch %s: %v", id, err)
+		writeAdminReply(w, http.StatusConflict, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	Info.Printf("Admin submitted signed payout batch %s", id)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"result": true})
+}
+
+// Sets the payout threshold a miner asked for, 0 restores the pool default
+func (s *ApiServer) PayoutThresholdUpdate(w http.ResponseWriter, r *http.Request) {
+	login := s.coin.NormalizeAddress(mux.Vars(r)["login"])
+
+	var body struct {
+		Threshold int64 `json:"threshold"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Threshold < 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]interface{}{"error": "threshold in Satoshi required"})
+		return
+	}
+	schedule, err := s.backend.GetPayoutSchedule()
+	if err != nil {
+		Error.Printf("Failed to get payout schedule from backend: %v", err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if schedule == nil {
+		writeAdminReply(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "payouts never ran, minimum threshold unknown"})
+		return
+	}
+	if body.Threshold > 0 && body.Threshold < schedule.MinThreshold {
+		writeAdminReply(w, http.StatusBadRequest, map[string]interface{}{"error": "threshold below pool minimum", "minThreshold": schedule.MinThreshold})
+		return
+	}
+	exist, err := s.backend.IsMinerExists(login)
+	if err == nil && !exist {
+		writeAdminReply(w, http.StatusNotFound, map[string]interface{}{"error": "unknown miner"})
+		return
+	}
+	if err == nil {
+		err = s.backend.SetPayoutThreshold(login, body.Threshold)
+	}
+	if err != nil {
+		Error.Printf("Failed to set payout threshold of %s: %v", login, err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	Info.Printf("Admin set payout threshold of %s to %v Satoshi", login, body.Threshold)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"result": true})
+}
+
+// Sets the BOLT11 invoice, LNURL or Lightning address small balances are paid to, empty removes it
+func (s *ApiServer) LightningDestinationUpdate(w http.ResponseWriter, r *http.Request) {
+	login := s.coin.NormalizeAddress(mux.Vars(r)["login"])
+
+	var body struct {
+		Destination string `json:"destination"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeAdminReply(w, http.StatusBadRequest, map[string]interface{}{"error": "destination required"})
+		return
+	}
+	body.Destination = strings.TrimSpace(body.Destination)
+	if len(body.Destination) > 0 {
+		if err = lightning.ValidDestination(body.Destination); err != nil {
+			writeAdminReply(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+	}
+	exist, err := s.backend.IsMinerExists(login)
+	if err == nil && !exist {
+		writeAdminReply(w, http.StatusNotFound, map[string]interface{}{"error": "unknown miner"})
+		return
+	}
+	if err == nil {
+		err = s.backend.SetLightningDestination(login, body.Destination)
+	}
+	if err != nil {
+		Error.Printf("Failed to set Lightning destination of %s: %v", login, err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	Info.Printf("Admin set Lightning destination of %s to %q", login, body.Destination)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"result": true})
+}
+
+// Credits or debits a miner balance, the ledger records it with the note
+func (s *ApiServer) BalanceAdjust(w http.ResponseWriter, r *http.Request) {
+	login := s.coin.NormalizeAddress(mux.Vars(r)["login"])
+
+	var body struct {
+		Amount int64  `json:"amount"`
+		Note   string `json:"note"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Amount == 0 || len(strings.TrimSpace(body.Note)) == 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]interface{}{"error": "amount in Satoshi and note required"})
+		return
+	}
+	exist, err := s.backend.IsMinerExists(login)
+	if err == nil && !exist {
+		writeAdminReply(w, http.StatusNotFound, map[string]interface{}{"error": "unknown miner"})
+		return
+	}
+	if err == nil {
+		err = s.backend.AdjustBalance(login, body.Amount, strings.TrimSpace(body.Note))
+	}
+	if err != nil {
+		Error.Printf("Failed to adjust balance of %s: %v", login, err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	Info.Printf("Admin adjusted balance of %s by %v Satoshi: %s", login, body.Amount, body.Note)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"result": true})
+}
+
+// Ledger entries from ?start= on, at most ?limit= of them
+func (s *ApiServer) LedgerIndex(w http.ResponseWriter, r *http.Request) {
+	start, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+	limit, _ := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if start < 0 {
+		start = 0
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	entries, err := s.backend.GetLedger(start, limit)
+	if err != nil {
+		Error.Printf("Failed to get ledger from backend: %v", err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
+
+// Balances the ledger disagrees with
+func (s *ApiServer) LedgerReconcile(w http.ResponseWriter, r *http.Request) {
+	drifts, err := s.backend.ReconcileLedger()
+	if err != nil {
+		Error.Printf("Failed to reconcile ledger: %v", err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"drifts": drifts, "ok": len(drifts) == 0})
+}
+
+// Pool wallet against owed balances as last checked by the payouts processor
+func (s *ApiServer) SolvencyIndex(w http.ResponseWriter, r *http.Request) {
+	solvency, err := s.backend.GetSolvency()
+	if err != nil {
+		Error.Printf("Failed to get solvency from backend: %v", err)
+		writeAdminReply(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if solvency == nil {
+		writeAdminReply(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "solvency never checked"})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"solvency": solvency, "deficit": solvency.Surplus < 0})
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+type PoolsApiServer struct {
+	config *ApiConfig
+	pools  []*ApiServer
+}
+
+// Collect stats of every hosted pool and serve them on one listener, the first pool is the default one
+func StartPools(cfg *ApiConfig, pools []*ApiServer) {
+	if cfg.PurgeOnly {
+		Info.Printf("Starting API in purge-only mode")
+	} else {
+		Info.Printf("Starting API on %v", cfg.Listen)
+	}
+
+	for _, s := range pools {
+		Info.Printf("Starting API stats collector of pool %s", s.name)
+		s.startCollector()
+	}
+
+	if !cfg.PurgeOnly {
+		p := &PoolsApiServer{config: cfg, pools: pools}
+		p.listen()
+	}
+}
+
+func (p *PoolsApiServer) listen() {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/pools", p.PoolsIndex)
+	for _, s := range p.pools {
+		s.registerRoutes(r.PathPrefix("/api/pools/" + s.name).Subrouter())
+	}
+	if len(p.pools) > 0 {
+		p.pools[0].registerRoutes(r.PathPrefix("/api").Subrouter())
+	}
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	err := http.ListenAndServe(p.config.Listen, r)
+	if err != nil {
+		Error.Fatalf("Failed to start API: %v", err)
+	}
+}
+
+func (p *PoolsApiServer) PoolsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var pools []map[string]interface{}
+	for _, s := range p.pools {
+		pool := make(map[string]interface{})
+		pool["name"] = s.name
+		pool["coin"] = s.coin.Name
+		stats := s.getStats()
+		if stats != nil {
+			pool["hashrate"] = stats["hashrate"]
+			pool["minersTotal"] = stats["minersTotal"]
+			pool["maturedTotal"] = stats["maturedTotal"]
+			pool["immatureTotal"] = stats["immatureTotal"]
+			pool["candidatesTotal"] = stats["candidatesTotal"]
+			pool["reserve"] = stats["reserve"]
+			pool["stats"] = stats["stats"]
+		}
+		pools = append(pools, pool)
+	}
+
+	reply := make(map[string]interface{})
+	reply["now"] = MakeTimestamp()
+	reply["pools"] = pools
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		Error.Println("Error serializing API response: ", err)
+	}
+}
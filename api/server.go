@@ -4,13 +4,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"sort"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/PowPool/btcpool/bitcoin"
 	"github.com/PowPool/btcpool/storage"
 	. "github.com/PowPool/btcpool/util"
 )
@@ -27,17 +27,26 @@ type ApiConfig struct {
 	Blocks                int64  `json:"blocks"`
 	PurgeOnly             bool   `json:"purgeOnly"`
 	PurgeInterval         string `json:"purgeInterval"`
+	// Admin endpoints are disabled without a token
+	AdminToken string `json:"adminToken"`
+	// Challenge and settings requests a client may make per minute, default 10
+	AccountRequests int `json:"accountRequests"`
+	// Count account requests by X-Forwarded-For
+	BehindReverseProxy bool `json:"behindReverseProxy"`
 }
 
 type ApiServer struct {
+	name                string
 	config              *ApiConfig
-	backend             *storage.RedisClient
+	backend             storage.Backend
+	coin                *bitcoin.CoinParams
 	hashrateWindow      time.Duration
 	hashrateLargeWindow time.Duration
 	stats               atomic.Value
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
 	statsIntv           time.Duration
+	limiter             accountLimiter
 }
 
 type Entry struct {
@@ -45,13 +54,15 @@ type Entry struct {
 	updatedAt int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+func NewApiServer(cfg *ApiConfig, name string, backend storage.Backend, coin *bitcoin.CoinParams) *ApiServer {
 	hashrateWindow := MustParseDuration(cfg.HashrateWindow)
 	hashrateLargeWindow := MustParseDuration(cfg.HashrateLargeWindow)
 
 	return &ApiServer{
+		name:                name,
 		config:              cfg,
 		backend:             backend,
+		coin:                coin,
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
@@ -59,12 +70,10 @@ func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
 }
 
 func (s *ApiServer) Start() {
-	if s.config.PurgeOnly {
-		Info.Printf("Starting API in purge-only mode")
-	} else {
-		Info.Printf("Starting API on %v", s.config.Listen)
-	}
+	StartPools(s.config, []*ApiServer{s})
+}
 
+func (s *ApiServer) startCollector() {
 	s.statsIntv = MustParseDuration(s.config.StatsCollectInterval)
 	statsTimer := time.NewTimer(s.statsIntv)
 	Info.Printf("Set stats collect interval to %v", s.statsIntv)
@@ -96,23 +105,18 @@ func (s *ApiServer) Start() {
 			}
 		}
 	}()
-
-	if !s.config.PurgeOnly {
-		s.listen()
-	}
 }
 
-func (s *ApiServer) listen() {
-	r := mux.NewRouter()
-	r.HandleFunc("/api/stats", s.StatsIndex)
-	r.HandleFunc("/api/miners", s.MinersIndex)
-	r.HandleFunc("/api/blocks", s.BlocksIndex)
-	r.HandleFunc("/api/payments", s.PaymentsIndex)
-	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
-	r.NotFoundHandler = http.HandlerFunc(notFound)
-	err := http.ListenAndServe(s.config.Listen, r)
-	if err != nil {
-		Error.Fatalf("Failed to start API: %v", err)
+// Routes relative to the pool path, /api for the default pool and /api/pools/{name} for every pool
+func (s *ApiServer) registerRoutes(r *mux.Router) {
+	r.HandleFunc("/stats", s.StatsIndex)
+	r.HandleFunc("/miners", s.MinersIndex)
+	r.HandleFunc("/blocks", s.BlocksIndex)
+	r.HandleFunc("/payments", s.PaymentsIndex)
+	r.HandleFunc("/accounts/{login:[0-9a-zA-Z:]{25,100}}", s.AccountIndex)
+	s.registerAccountRoutes(r)
+	if len(s.config.AdminToken) > 0 {
+		s.registerAdminRoutes(r)
 	}
 }
 
@@ -140,6 +144,11 @@ func (s *ApiServer) collectStats() {
 		Error.Printf("Failed to fetch stats from backend: %v", err)
 		return
 	}
+	for _, key := range []string{"candidates", "immature", "matured"} {
+		if blocks, ok := stats[key].([]*storage.BlockData); ok {
+			stats[key] = publicBlocks(blocks)
+		}
+	}
 	if len(s.config.LuckWindow) > 0 {
 		stats["luck"], err = s.backend.CollectLuckStats(s.config.LuckWindow)
 		if err != nil {
@@ -151,6 +160,14 @@ func (s *ApiServer) collectStats() {
 	Info.Printf("Stats collection finished %s", time.Since(start))
 }
 
+func publicBlocks(blocks []*storage.BlockData) []*storage.BlockData {
+	result := make([]*storage.BlockData, len(blocks))
+	for i, block := range blocks {
+		result[i] = block.Public()
+	}
+	return result
+}
+
 func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -173,6 +190,7 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 		reply["maturedTotal"] = stats["maturedTotal"]
 		reply["immatureTotal"] = stats["immatureTotal"]
 		reply["candidatesTotal"] = stats["candidatesTotal"]
+		reply["reserve"] = stats["reserve"]
 	}
 
 	err = json.NewEncoder(w).Encode(reply)
@@ -250,7 +268,7 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
 
-	login := strings.ToLower(mux.Vars(r)["login"])
+	login := s.coin.NormalizeAddress(mux.Vars(r)["login"])
 	s.minersMu.Lock()
 	defer s.minersMu.Unlock()
 
@@ -287,6 +305,12 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 			stats[key] = value
 		}
 		stats["pageSize"] = s.config.Payments
+		stats["nextPayout"], err = s.nextPayout(login, stats["stats"].(map[string]interface{}))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			Error.Printf("Failed to fetch payout schedule from backend: %v", err)
+			return
+		}
 		reply = &Entry{stats: stats, updatedAt: now}
 		s.miners[login] = reply
 	}
@@ -298,6 +322,57 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Threshold and expected payout of the miner, nil until payouts publish their schedule
+func (s *ApiServer) nextPayout(login string, miner map[string]interface{}) (map[string]interface{}, error) {
+	schedule, err := s.backend.GetPayoutSchedule()
+	if err != nil || schedule == nil {
+		return nil, err
+	}
+	balance, _ := miner["balance"].(int64)
+	custom, _ := miner["threshold"].(int64)
+	threshold := schedule.PayeeThreshold(custom)
+
+	reply := map[string]interface{}{
+		"threshold":    threshold,
+		"minThreshold": schedule.MinThreshold,
+		"feeRate":      schedule.FeeRate,
+		"deferred":     schedule.Deferred,
+		"eligible":     balance > 0 && balance >= threshold,
+	}
+	if balance > 0 && balance >= threshold {
+		fee := int64(0)
+		if schedule.OutputFee {
+			fee, _ = s.coin.OutputFee(login, schedule.FeeRate)
+		}
+		reply["amount"] = balance - fee
+		reply["fee"] = fee
+		reply["time"] = schedule.Next
+	} else if s.payableOverLightning(login, balance, schedule) {
+		// Paid over Lightning on the next run
+		reply["eligible"] = true
+		reply["lightning"] = true
+		reply["amount"] = balance
+		reply["fee"] = int64(0)
+		reply["time"] = schedule.Next
+	} else {
+		reply["remaining"] = threshold - balance
+	}
+	return reply, nil
+}
+
+// Miner stats hide the destination, look it up only for balances the Lightning minimum covers
+func (s *ApiServer) payableOverLightning(login string, balance int64, schedule *storage.PayoutSchedule) bool {
+	if schedule.LightningMinAmount <= 0 || balance < schedule.LightningMinAmount {
+		return false
+	}
+	dest, err := s.backend.GetLightningDestination(login)
+	if err != nil {
+		Error.Printf("Failed to get Lightning destination of %v: %v", login, err)
+		return false
+	}
+	return len(dest) > 0
+}
+
 func (s *ApiServer) getStats() map[string]interface{} {
 	stats := s.stats.Load()
 	if stats != nil {
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/storage"
+)
+
+func TestNextPayoutLightning(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	backend.WritePayoutSchedule(&storage.PayoutSchedule{Next: 100, Threshold: 100000, LightningMinAmount: 1000})
+	s := NewApiServer(&ApiConfig{HashrateWindow: "10m", HashrateLargeWindow: "3h"}, "btc", backend, bitcoin.Bitcoin)
+	miner := map[string]interface{}{"balance": int64(5000)}
+
+	reply, err := s.nextPayout("x", miner)
+	if err != nil || reply["remaining"] != int64(95000) || reply["lightning"] != nil {
+		t.Errorf("Miner without a destination must wait for the threshold, got %v: %v", reply, err)
+	}
+	backend.SetLightningDestination("x", "x@ln.example.com")
+	reply, _ = s.nextPayout("x", miner)
+	if reply["lightning"] != true || reply["eligible"] != true || reply["amount"] != int64(5000) {
+		t.Errorf("Balance must be paid over Lightning, got %v", reply)
+	}
+	miner["balance"] = int64(500)
+	if reply, _ = s.nextPayout("x", miner); reply["lightning"] != nil {
+		t.Errorf("Balance below the Lightning minimum must wait, got %v", reply)
+	}
+}
@@ -0,0 +1,248 @@
+package bitcoin
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/mutalisk999/bitcoin-lib/src/base58"
+	"github.com/mutalisk999/bitcoin-lib/src/script"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const (
+	bech32Const  = uint32(1)
+	bech32mConst = uint32(0x2bc830a3)
+)
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	v := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]>>5)
+	}
+	v = append(v, 0)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]&31)
+	}
+	return v
+}
+
+// Regroup bits, e.g. from 5 bit groups to bytes
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	acc := uint32(0)
+	bits := uint(0)
+	maxv := uint32(1)<<toBits - 1
+	var ret []byte
+	for _, value := range data {
+		if uint32(value)>>fromBits != 0 {
+			return nil, errors.New("invalid data range")
+		}
+		acc = acc<<fromBits | uint32(value)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			ret = append(ret, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return ret, nil
+}
+
+// Decode a bech32 string of any length, e.g. an LNURL, into its hrp and 8 bit data
+func DecodeBech32(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case bech32 string")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndex(s, "1")
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("invalid bech32 string")
+	}
+	hrp := s[:pos]
+	var data []byte
+	for i := pos + 1; i < len(s); i++ {
+		d := strings.IndexByte(bech32Charset, s[i])
+		if d == -1 {
+			return "", nil, errors.New("invalid bech32 character")
+		}
+		data = append(data, byte(d))
+	}
+	if bech32Polymod(append(bech32HrpExpand(hrp), data...)) != bech32Const {
+		return "", nil, errors.New("invalid bech32 checksum")
+	}
+	decoded, err := convertBits(data[:len(data)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, decoded, nil
+}
+
+// Encode 8 bit data as a bech32 string of any length
+func EncodeBech32(hrp string, data []byte) (string, error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	polymod := bech32Polymod(append(append(bech32HrpExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ bech32Const
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(polymod>>uint(5*(5-i))&31))
+	}
+	var sb strings.Builder
+	sb.WriteString(hrp + "1")
+	for _, v := range values {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String(), nil
+}
+
+// Decode a BIP173/BIP350 segwit address into its output script
+func DecodeSegWitAddress(hrp string, address string) ([]byte, error) {
+	if strings.ToLower(address) != address && strings.ToUpper(address) != address {
+		return nil, errors.New("mixed case address")
+	}
+	address = strings.ToLower(address)
+	pos := strings.LastIndex(address, "1")
+	if pos < 1 || pos+7 > len(address) || len(address) > 90 || address[:pos] != hrp {
+		return nil, errors.New("invalid segwit address")
+	}
+	var data []byte
+	for i := pos + 1; i < len(address); i++ {
+		d := strings.IndexByte(bech32Charset, address[i])
+		if d == -1 {
+			return nil, errors.New("invalid segwit address character")
+		}
+		data = append(data, byte(d))
+	}
+	if len(data) < 7 {
+		return nil, errors.New("invalid segwit address")
+	}
+	version := data[0]
+	checksum := bech32Polymod(append(bech32HrpExpand(hrp), data...))
+	if (version == 0 && checksum != bech32Const) || (version != 0 && checksum != bech32mConst) {
+		return nil, errors.New("invalid segwit address checksum")
+	}
+	program, err := convertBits(data[1:len(data)-6], 5, 8, false)
+	if err != nil {
+		return nil, err
+	}
+	if version > 16 || len(program) < 2 || len(program) > 40 {
+		return nil, errors.New("invalid witness program")
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return nil, errors.New("invalid witness v0 program")
+	}
+	opVersion := byte(script.OP_0)
+	if version > 0 {
+		opVersion = byte(script.OP_1) + version - 1
+	}
+	return append([]byte{opVersion, byte(len(program))}, program...), nil
+}
+
+func cashAddrPolymod(values []byte) uint64 {
+	gen := []uint64{0x98f2bc8e61, 0x79b76d99e2, 0xf33e5fb3c4, 0xae2eabe2a8, 0x1e4f43e470}
+	c := uint64(1)
+	for _, d := range values {
+		c0 := byte(c >> 35)
+		c = (c&0x07ffffffff)<<5 ^ uint64(d)
+		for i := 0; i < 5; i++ {
+			if (c0>>uint(i))&1 == 1 {
+				c ^= gen[i]
+			}
+		}
+	}
+	return c ^ 1
+}
+
+// Decode a CashAddr address, the prefix may be omitted. Returns the type (0 p2pkh, 1 p2sh) and hash
+func DecodeCashAddress(prefix string, address string) (byte, []byte, error) {
+	if strings.ToLower(address) != address && strings.ToUpper(address) != address {
+		return 0, nil, errors.New("mixed case address")
+	}
+	address = strings.ToLower(address)
+	if pos := strings.IndexByte(address, ':'); pos != -1 {
+		if address[:pos] != prefix {
+			return 0, nil, errors.New("invalid cashaddr prefix")
+		}
+		address = address[pos+1:]
+	}
+	var data []byte
+	for i := 0; i < len(address); i++ {
+		d := strings.IndexByte(bech32Charset, address[i])
+		if d == -1 {
+			return 0, nil, errors.New("invalid cashaddr character")
+		}
+		data = append(data, byte(d))
+	}
+	if len(data) < 9 {
+		return 0, nil, errors.New("invalid cashaddr")
+	}
+	values := make([]byte, 0, len(prefix)+1+len(data))
+	for i := 0; i < len(prefix); i++ {
+		values = append(values, prefix[i]&31)
+	}
+	values = append(values, 0)
+	values = append(values, data...)
+	if cashAddrPolymod(values) != 0 {
+		return 0, nil, errors.New("invalid cashaddr checksum")
+	}
+	payload, err := convertBits(data[:len(data)-8], 5, 8, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(payload) != 21 || payload[0]&0x07 != 0 {
+		// only 160 bit hashes are used on chain
+		return 0, nil, errors.New("invalid cashaddr payload")
+	}
+	return payload[0] >> 3, payload[1:], nil
+}
+
+func decodeBase58Check(address string) ([]byte, error) {
+	addrWithCheck, err := base58.Decode(address)
+	if err != nil {
+		return nil, errors.New("invalid address")
+	}
+	if len(addrWithCheck) != 25 {
+		return nil, errors.New("invalid address")
+	}
+	check1 := utility.Sha256(utility.Sha256(addrWithCheck[0:21]))[0:4]
+	check2 := addrWithCheck[21:25]
+	if !bytes.Equal(check1, check2) {
+		return nil, errors.New("invalid address")
+	}
+	return addrWithCheck[0:21], nil
+}
+
+func p2pkhScript(hash []byte) []byte {
+	s := []byte{byte(script.OP_DUP), byte(script.OP_HASH160), byte(len(hash))}
+	s = append(s, hash...)
+	return append(s, byte(script.OP_EQUALVERIFY), byte(script.OP_CHECKSIG))
+}
+
+func p2shScript(hash []byte) []byte {
+	s := []byte{byte(script.OP_HASH160), byte(len(hash))}
+	s = append(s, hash...)
+	return append(s, byte(script.OP_EQUAL))
+}
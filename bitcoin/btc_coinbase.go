@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
-	"github.com/mutalisk999/bitcoin-lib/src/base58"
-	"github.com/mutalisk999/bitcoin-lib/src/keyid"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
 	"github.com/mutalisk999/bitcoin-lib/src/pubkey"
 	"github.com/mutalisk999/bitcoin-lib/src/script"
 	"github.com/mutalisk999/bitcoin-lib/src/serialize"
 	"github.com/mutalisk999/bitcoin-lib/src/transaction"
 	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	"github.com/mutalisk999/txid_merkle_tree"
 	"io"
+	"strings"
 	"time"
 )
 
@@ -44,87 +46,33 @@ func GetCoinBaseScriptByPubKey(pubKeyHex string) ([]byte, error) {
 }
 
 func GetCoinBaseScriptByAddress(address string) ([]byte, error) {
-	addrWithCheck, err := base58.Decode(address)
-	if err != nil {
-		return nil, errors.New("invalid address")
-	}
-	if len(addrWithCheck) != 25 {
-		return nil, errors.New("invalid address")
-	}
-	check1 := utility.Sha256(utility.Sha256(addrWithCheck[0:21]))[0:4]
-	check2 := addrWithCheck[21:25]
-	if bytes.Compare(check1, check2) != 0 {
-		return nil, errors.New("invalid address")
-	}
-
-	bytesBuf := bytes.NewBuffer([]byte{})
-	bufWriter := io.Writer(bytesBuf)
+	return Bitcoin.AddressToScript(address)
+}
 
-	if addrWithCheck[0] == byte(0) || addrWithCheck[0] == byte(111) {
-		// p2pkh
-		// mainnet: 0
-		// testnet: 111
-		err = serialize.PackByte(bufWriter, script.OP_DUP)
-		if err != nil {
-			return nil, errors.New("pack byte err")
-		}
-		err = serialize.PackByte(bufWriter, script.OP_HASH160)
-		if err != nil {
-			return nil, errors.New("pack byte err")
-		}
-		var addr keyid.KeyID
-		err = addr.SetKeyIDData(addrWithCheck[1:21])
-		if err != nil {
-			return nil, err
-		}
-		err = addr.Pack(bufWriter)
-		if err != nil {
-			return nil, errors.New("pack address err")
-		}
-		err = serialize.PackByte(bufWriter, script.OP_EQUALVERIFY)
-		if err != nil {
-			return nil, errors.New("pack byte err")
-		}
-		err = serialize.PackByte(bufWriter, script.OP_CHECKSIG)
-		if err != nil {
-			return nil, errors.New("pack byte err")
-		}
-	} else if addrWithCheck[0] == byte(5) || addrWithCheck[0] == byte(196) {
-		// p2sh
-		// mainnet: 5
-		// testnet: 196
-		err = serialize.PackByte(bufWriter, script.OP_HASH160)
-		if err != nil {
-			return nil, errors.New("pack byte err")
-		}
-		var addr keyid.KeyID
-		err = addr.SetKeyIDData(addrWithCheck[1:21])
-		if err != nil {
-			return nil, err
-		}
-		err = addr.Pack(bufWriter)
-		if err != nil {
-			return nil, errors.New("pack address err")
-		}
-		err = serialize.PackByte(bufWriter, script.OP_EQUAL)
-		if err != nil {
-			return nil, errors.New("pack byte err")
-		}
+func GetCoinBaseScript(wallet string) ([]byte, error) {
+	if len(wallet) == 66 {
+		return GetCoinBaseScriptByPubKey(wallet)
 	} else {
-		return nil, errors.New("GetCoinBaseScriptByAddress: Invalid address")
+		return GetCoinBaseScriptByAddress(wallet)
 	}
-
-	return bytesBuf.Bytes(), nil
 }
 
-func GetCoinBaseScript(wallet string) ([]byte, error) {
+func (c *CoinParams) GetCoinBaseScript(wallet string) ([]byte, error) {
 	if len(wallet) == 66 {
 		return GetCoinBaseScriptByPubKey(wallet)
 	} else {
-		return GetCoinBaseScriptByAddress(wallet)
+		return c.AddressToScript(wallet)
 	}
 }
 
+func (c *CoinParams) GetCoinBaseScriptHex(wallet string) (string, error) {
+	scriptBytes, err := c.GetCoinBaseScript(wallet)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(scriptBytes), nil
+}
+
 func GetCoinBaseScriptHex(wallet string) (string, error) {
 	scriptHex, err := GetCoinBaseScript(wallet)
 	if err != nil {
@@ -162,17 +110,46 @@ func PackString(str string) ([]byte, error) {
 }
 
 const (
-	EXTRANONCE1_SIZE    = 4
-	EXTRANONCE2_SIZE    = 4
+	EXTRANONCE1_SIZE = 4
+	EXTRANONCE2_SIZE = 4
+	// the extra nonces are announced by a single byte push in the scriptSig
+	MAX_EXTRANONCE_SIZE = 75
 	COINBASE_TX_VERSION = 2
+
+	// consensus limits of the coinbase scriptSig
+	MIN_COINBASE_SCRIPTSIG_SIZE = 2
+	MAX_COINBASE_SCRIPTSIG_SIZE = 100
+	// the extras are a single byte push too, longer lengths read as OP_PUSHDATA
+	MAX_COINBASE_EXTRAS_SIZE = 75
+
+	WITNESS_COMMITMENT_HEADER = "6a24aa21a9ed"
 )
 
+// BIP141 witness commitment script for the block transactions' wtxids, coinbase excluded.
+// The coinbase wtxid and the witness reserved value are both zero.
+func GetWitnessCommitmentHex(wtxIdsHex []string) (string, error) {
+	txIdsHex := append([]string{strings.Repeat("00", 32)}, wtxIdsHex...)
+	witnessRootHex, err := txid_merkle_tree.GetMerkleRootHexFromTxIdsWithCoinBase(txIdsHex)
+	if err != nil {
+		return "", err
+	}
+	var witnessRoot bigint.Uint256
+	err = witnessRoot.SetHex(witnessRootHex)
+	if err != nil {
+		return "", err
+	}
+	witnessReserved := make([]byte, 32)
+	commitment := utility.Sha256(utility.Sha256(append(append([]byte{}, witnessRoot.GetData()...), witnessReserved...)))
+	return WITNESS_COMMITMENT_HEADER + hex.EncodeToString(commitment), nil
+}
+
 type MasterNodeVout struct {
 	Amount     int64
 	VoutScript []byte
 }
 
 type CoinBaseTransaction struct {
+	Coin                     *CoinParams
 	BlockTime                uint32
 	BlockHeight              uint32
 	RewardValue              int64
@@ -184,6 +161,19 @@ type CoinBaseTransaction struct {
 	CoinBaseTx1              []byte
 	CoinBaseTx2              []byte
 	DefaultWitnessCommitment []byte
+	// Total size of extranonce1 and extranonce2, EXTRANONCE1_SIZE + EXTRANONCE2_SIZE if not set
+	ExtraNonceSize int
+}
+
+func (t *CoinBaseTransaction) extraNonceSize() int {
+	if t.ExtraNonceSize == 0 {
+		return EXTRANONCE1_SIZE + EXTRANONCE2_SIZE
+	}
+	return t.ExtraNonceSize
+}
+
+func (t *CoinBaseTransaction) ScriptSigSize() int {
+	return len(t.VinScript1) + t.extraNonceSize() + len(t.VinScript2)
 }
 
 func (t *CoinBaseTransaction) _generateCoinB() error {
@@ -215,8 +205,7 @@ func (t *CoinBaseTransaction) _generateCoinB() error {
 		return err
 	}
 
-	vinScriptLen := len(t.VinScript1) + EXTRANONCE1_SIZE + EXTRANONCE2_SIZE + len(t.VinScript2)
-	err = serialize.PackCompactSize(writer, uint64(vinScriptLen))
+	err = serialize.PackCompactSize(writer, uint64(t.ScriptSigSize()))
 	if err != nil {
 		return err
 	}
@@ -293,8 +282,29 @@ func (t *CoinBaseTransaction) _generateCoinB() error {
 	return nil
 }
 
-func (t *CoinBaseTransaction) Initialize(cbWallet string, bTime uint32, height uint32, value int64, flags string,
+func coinBaseScriptSig1(height uint32, flags []byte, now int64, extraNonceSize int) []byte {
+	bytes1 := PackNumber(int64(height))
+	bytes2 := flags
+	bytes3 := PackNumber(now)
+	bytes4 := []byte{byte(extraNonceSize)}
+	return append(append(append(append([]byte{}, bytes1...), bytes2...), bytes3...), bytes4...)
+}
+
+// Room left for the coinbase extras in the scriptSig, after the height, aux flags, time and extra nonces
+func MaxCoinBaseExtrasSize(height uint32, flags []byte, extraNonceSize int) int {
+	size := MAX_COINBASE_SCRIPTSIG_SIZE - len(coinBaseScriptSig1(height, flags, time.Now().Unix(), extraNonceSize)) -
+		extraNonceSize
+	// extras length prefix
+	size -= 1
+	if size > MAX_COINBASE_EXTRAS_SIZE {
+		return MAX_COINBASE_EXTRAS_SIZE
+	}
+	return size
+}
+
+func (t *CoinBaseTransaction) Initialize(coin *CoinParams, cbWallet string, bTime uint32, height uint32, value int64, flags string,
 	cbExtras string, defaultWitnessCommitment string) error {
+	t.Coin = coin
 	t.BlockTime = bTime
 	t.BlockHeight = height
 	t.RewardValue = value
@@ -305,11 +315,13 @@ func (t *CoinBaseTransaction) Initialize(cbWallet string, bTime uint32, height u
 	}
 	t.CBAuxFlag = cbFlag
 
-	bytes1 := PackNumber(int64(t.BlockHeight))
-	bytes2 := t.CBAuxFlag
-	bytes3 := PackNumber(time.Now().Unix())
-	bytes4 := []byte{EXTRANONCE1_SIZE + EXTRANONCE2_SIZE}
-	t.VinScript1 = append(append(append(append([]byte{}, bytes1...), bytes2...), bytes3...), bytes4...)
+	if t.extraNonceSize() > MAX_EXTRANONCE_SIZE {
+		return errors.New("invalid extra nonce size")
+	}
+	t.VinScript1 = coinBaseScriptSig1(t.BlockHeight, t.CBAuxFlag, time.Now().Unix(), t.extraNonceSize())
+	if len(t.CBExtras) > MAX_COINBASE_EXTRAS_SIZE {
+		return fmt.Errorf("coinbase extras of %d bytes exceed %d bytes", len(t.CBExtras), MAX_COINBASE_EXTRAS_SIZE)
+	}
 
 	script2, err := PackString(t.CBExtras)
 	if err != nil {
@@ -317,11 +329,18 @@ func (t *CoinBaseTransaction) Initialize(cbWallet string, bTime uint32, height u
 	}
 	t.VinScript2 = script2
 
-	t.VoutScript, err = GetCoinBaseScript(cbWallet)
+	if t.ScriptSigSize() > MAX_COINBASE_SCRIPTSIG_SIZE {
+		return fmt.Errorf("coinbase scriptSig size %d exceeds %d bytes", t.ScriptSigSize(), MAX_COINBASE_SCRIPTSIG_SIZE)
+	}
+
+	t.VoutScript, err = t.Coin.GetCoinBaseScript(cbWallet)
 	if err != nil {
 		return errors.New("GetCoinBaseScript cbWallet error")
 	}
 
+	if !t.Coin.SegWit {
+		defaultWitnessCommitment = ""
+	}
 	defaultWitnessCommitmentBytes, err := hex.DecodeString(defaultWitnessCommitment)
 	if err != nil {
 		return errors.New("hex decode defaultWitnessCommitment error")
@@ -338,6 +357,23 @@ func (t *CoinBaseTransaction) Initialize(cbWallet string, bTime uint32, height u
 		return errors.New("_generateCoinB error")
 	}
 
+	// pad the coinbase extras up to the coin's minimum transaction size
+	txSize := len(t.CoinBaseTx1) + t.extraNonceSize() + len(t.CoinBaseTx2)
+	if txSize < t.Coin.MinTxSize {
+		t.CBExtras = t.CBExtras + strings.Repeat(" ", t.Coin.MinTxSize-txSize)
+		if len(t.CBExtras) > MAX_COINBASE_EXTRAS_SIZE {
+			return fmt.Errorf("coinbase extras of %d bytes exceed %d bytes", len(t.CBExtras), MAX_COINBASE_EXTRAS_SIZE)
+		}
+		t.VinScript2, err = PackString(t.CBExtras)
+		if err != nil {
+			return errors.New("pack string CBExtras error")
+		}
+		err = t._generateCoinB()
+		if err != nil {
+			return errors.New("_generateCoinB error")
+		}
+	}
+
 	return nil
 }
 
@@ -352,12 +388,9 @@ func (t *CoinBaseTransaction) RecoverToRawTransaction(extraNonce1Hex string, ext
 		return transaction.Transaction{}, errors.New("decode hex extraNonce2Hex error")
 	}
 
-	if len(extraNonce1) != EXTRANONCE1_SIZE {
-		return transaction.Transaction{}, errors.New("invalid extraNonce1 length")
-	}
-
-	if len(extraNonce2) != EXTRANONCE2_SIZE {
-		return transaction.Transaction{}, errors.New("invalid extraNonce2 length")
+	// the split between extraNonce1 and extraNonce2 differs between miners and proxy clients
+	if len(extraNonce1)+len(extraNonce2) != t.extraNonceSize() {
+		return transaction.Transaction{}, errors.New("invalid extraNonce length")
 	}
 
 	bytesCoinBaseTx := append(append(append(append([]byte{}, t.CoinBaseTx1...), extraNonce1...), extraNonce2...), t.CoinBaseTx2...)
@@ -5,7 +5,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/mutalisk999/bitcoin-lib/src/transaction"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -36,7 +38,7 @@ func TestPackString(t *testing.T) {
 
 func TestInitialize(t *testing.T) {
 	var cbtx CoinBaseTransaction
-	_ = cbtx.Initialize("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "",
+	_ = cbtx.Initialize(Bitcoin, "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "",
 		"btcpool", "6a24aa21a9ed2607916dfc80dc54aefa568f2161355625d23e063e38445c6887c01cfa995b95")
 
 	extraNonce1 := []byte{0x0, 0x0, 0x0, 0x0}
@@ -66,7 +68,7 @@ func TestInitialize(t *testing.T) {
 
 func TestRecoverToRawTransaction(t *testing.T) {
 	var cbtx CoinBaseTransaction
-	_ = cbtx.Initialize("XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "",
+	_ = cbtx.Initialize(Bitcoin, "XiB2rj7PdESyaxJVsnmjhXf9D9bYJjX7ob", 1607055201, 1827, 18492529212, "",
 		"btcpool", "6a24aa21a9ed2607916dfc80dc54aefa568f2161355625d23e063e38445c6887c01cfa995b95")
 
 	extraNonce1Hex := "00000000"
@@ -87,3 +89,62 @@ func TestRecoverToRawTransaction(t *testing.T) {
 		fmt.Println("vout scriptpubkey:", trx.Vout[i].ScriptPubKey)
 	}
 }
+
+func TestGetWitnessCommitmentHex(t *testing.T) {
+	// only the coinbase: witness root is zero
+	commitmentHex, err := GetWitnessCommitmentHex([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := WITNESS_COMMITMENT_HEADER + hex.EncodeToString(utility.Sha256(utility.Sha256(make([]byte, 64))))
+	if commitmentHex != expected {
+		t.Errorf("Witness commitment must be %v vs %v", expected, commitmentHex)
+	}
+
+	commitmentHex, err = GetWitnessCommitmentHex([]string{"9fcaa86746e1ef52d3edb3c4ad8259920d509bd073605c9bf1d59983752a6b06"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commitmentHex) != 76 || commitmentHex == expected {
+		t.Errorf("Invalid witness commitment %v", commitmentHex)
+	}
+}
+
+func TestCoinBaseScriptSigLimit(t *testing.T) {
+	maxSize := MaxCoinBaseExtrasSize(1827, []byte{}, 16)
+	cbtx := CoinBaseTransaction{ExtraNonceSize: 16}
+	err := cbtx.Initialize(Bitcoin, "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu", 1607055201, 1827, 18492529212, "",
+		strings.Repeat("x", maxSize), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cbtx.ScriptSigSize() != MAX_COINBASE_SCRIPTSIG_SIZE {
+		t.Errorf("Expected a %d bytes scriptSig, got %d", MAX_COINBASE_SCRIPTSIG_SIZE, cbtx.ScriptSigSize())
+	}
+	err = cbtx.Initialize(Bitcoin, "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu", 1607055201, 1827, 18492529212, "",
+		strings.Repeat("x", maxSize+1), "")
+	if err == nil {
+		t.Error("Oversized coinbase scriptSig must be rejected")
+	}
+}
+
+func TestCoinBaseExtrasPush(t *testing.T) {
+	maxSize := MaxCoinBaseExtrasSize(1827, []byte{}, EXTRANONCE1_SIZE+EXTRANONCE2_SIZE)
+	if maxSize != MAX_COINBASE_EXTRAS_SIZE {
+		t.Fatalf("Extras must be capped at a single byte push, got %d", maxSize)
+	}
+	var cbtx CoinBaseTransaction
+	err := cbtx.Initialize(Bitcoin, "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu", 1607055201, 1827, 18492529212, "",
+		strings.Repeat("x", maxSize), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cbtx.VinScript2[0] != MAX_COINBASE_EXTRAS_SIZE {
+		t.Errorf("Extras must be a direct push, got opcode %x", cbtx.VinScript2[0])
+	}
+	err = cbtx.Initialize(Bitcoin, "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu", 1607055201, 1827, 18492529212, "",
+		strings.Repeat("x", maxSize+1), "")
+	if err == nil {
+		t.Error("Extras longer than a direct push must be rejected")
+	}
+}
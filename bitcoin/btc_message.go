@@ -0,0 +1,220 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/mutalisk999/bitcoin-lib/src/ripemd160"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+)
+
+const bip322Tag = "BIP0322-signed-message"
+
+// Message digest signed by signmessage
+func (c *CoinParams) MessageHash(message string) []byte {
+	var buf bytes.Buffer
+	serialize.PackCompactSize(&buf, uint64(len(c.MessageMagic)))
+	buf.WriteString(c.MessageMagic)
+	serialize.PackCompactSize(&buf, uint64(len(message)))
+	buf.WriteString(message)
+	return utility.Sha256(utility.Sha256(buf.Bytes()))
+}
+
+// Check that the base64 signature of the message was made with the key of the address:
+// BIP137 compact signatures for single key addresses, BIP322 simple signatures for P2WPKH
+func (c *CoinParams) VerifyMessage(address, message, signature string) error {
+	addrScript, err := c.AddressToScript(address)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return errors.New("signature is not base64")
+	}
+	if len(sig) == 65 {
+		return c.verifyCompact(addrScript, message, sig)
+	}
+	return verifyBIP322(addrScript, message, sig)
+}
+
+func (c *CoinParams) verifyCompact(addrScript []byte, message string, sig []byte) error {
+	header := sig[0]
+	if header < 27 || header > 42 {
+		return errors.New("invalid signature header")
+	}
+	rsv := append(append([]byte{}, sig[1:]...), (header-27)&3)
+	pub, err := crypto.SigToPub(c.MessageHash(message), rsv)
+	if err != nil {
+		return err
+	}
+	var keyHash []byte
+	if header < 31 {
+		keyHash = hash160(crypto.FromECDSAPub(pub))
+	} else {
+		keyHash = hash160(crypto.CompressPubkey(pub))
+	}
+	witnessScript := p2wpkhScript(keyHash)
+	var scripts [][]byte
+	switch {
+	case header < 31:
+		scripts = [][]byte{p2pkhScript(keyHash)}
+	case header < 35:
+		// Many wallets sign for SegWit addresses with the P2PKH header
+		scripts = [][]byte{p2pkhScript(keyHash), witnessScript, p2shScript(hash160(witnessScript))}
+	case header < 39:
+		scripts = [][]byte{p2shScript(hash160(witnessScript))}
+	default:
+		scripts = [][]byte{witnessScript}
+	}
+	for _, s := range scripts {
+		if bytes.Equal(s, addrScript) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match the address")
+}
+
+func verifyBIP322(addrScript []byte, message string, sig []byte) error {
+	if len(addrScript) != 22 || addrScript[0] != 0 || addrScript[1] != 20 {
+		return errors.New("BIP322 signatures are only supported for P2WPKH addresses")
+	}
+	witness, err := parseWitness(sig)
+	if err != nil {
+		return err
+	}
+	if len(witness) != 2 || len(witness[1]) != 33 || len(witness[0]) < 9 {
+		return errors.New("invalid P2WPKH witness")
+	}
+	pubKey := witness[1]
+	if !bytes.Equal(hash160(pubKey), addrScript[2:]) {
+		return errors.New("signature does not match the address")
+	}
+	derSig, hashType := witness[0][:len(witness[0])-1], witness[0][len(witness[0])-1]
+	if hashType != 1 {
+		return errors.New("BIP322 signature must be SIGHASH_ALL")
+	}
+	rs, err := parseDERSignature(derSig)
+	if err != nil {
+		return err
+	}
+	sigHash := bip322SigHash(addrScript, message, uint32(hashType))
+	if !crypto.VerifySignature(pubKey, sigHash, rs) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// BIP143 digest of the BIP322 to_sign transaction spending to_spend with a P2WPKH witness
+func bip322SigHash(addrScript []byte, message string, hashType uint32) []byte {
+	tag := sha256.Sum256([]byte(bip322Tag))
+	tagged := sha256.New()
+	tagged.Write(tag[:])
+	tagged.Write(tag[:])
+	tagged.Write([]byte(message))
+	messageHash := tagged.Sum(nil)
+
+	// to_spend: spends the null outpoint, pays the address
+	var toSpend bytes.Buffer
+	binary.Write(&toSpend, binary.LittleEndian, uint32(0))
+	toSpend.WriteByte(1)
+	toSpend.Write(make([]byte, 32))
+	binary.Write(&toSpend, binary.LittleEndian, uint32(0xffffffff))
+	toSpend.Write([]byte{34, 0, 32})
+	toSpend.Write(messageHash)
+	binary.Write(&toSpend, binary.LittleEndian, uint32(0))
+	toSpend.WriteByte(1)
+	binary.Write(&toSpend, binary.LittleEndian, uint64(0))
+	serialize.PackCompactSize(&toSpend, uint64(len(addrScript)))
+	toSpend.Write(addrScript)
+	binary.Write(&toSpend, binary.LittleEndian, uint32(0))
+	toSpendId := utility.Sha256(utility.Sha256(toSpend.Bytes()))
+
+	// to_sign: spends to_spend:0 with sequence 0, pays OP_RETURN
+	var outpoint bytes.Buffer
+	outpoint.Write(toSpendId)
+	binary.Write(&outpoint, binary.LittleEndian, uint32(0))
+	sequence := make([]byte, 4)
+	output := append(make([]byte, 8), 1, 0x6a)
+
+	var preimage bytes.Buffer
+	binary.Write(&preimage, binary.LittleEndian, uint32(0))
+	preimage.Write(utility.Sha256(utility.Sha256(outpoint.Bytes())))
+	preimage.Write(utility.Sha256(utility.Sha256(sequence)))
+	preimage.Write(outpoint.Bytes())
+	preimage.WriteByte(25)
+	preimage.Write(p2pkhScript(addrScript[2:]))
+	binary.Write(&preimage, binary.LittleEndian, uint64(0))
+	preimage.Write(sequence)
+	preimage.Write(utility.Sha256(utility.Sha256(output)))
+	binary.Write(&preimage, binary.LittleEndian, uint32(0))
+	binary.Write(&preimage, binary.LittleEndian, hashType)
+	return utility.Sha256(utility.Sha256(preimage.Bytes()))
+}
+
+func parseWitness(data []byte) ([][]byte, error) {
+	reader := bytes.NewReader(data)
+	n, err := serialize.UnPackCompactSize(reader)
+	if err != nil || n > 16 {
+		return nil, errors.New("invalid witness")
+	}
+	witness := make([][]byte, n)
+	for i := range witness {
+		size, err := serialize.UnPackCompactSize(reader)
+		if err != nil || size > uint64(reader.Len()) {
+			return nil, errors.New("invalid witness")
+		}
+		witness[i] = make([]byte, size)
+		io.ReadFull(reader, witness[i])
+	}
+	if reader.Len() != 0 {
+		return nil, errors.New("invalid witness")
+	}
+	return witness, nil
+}
+
+// Strict DER signature to 64 byte R || S
+func parseDERSignature(der []byte) ([]byte, error) {
+	invalid := errors.New("invalid DER signature")
+	if len(der) < 8 || der[0] != 0x30 || int(der[1]) != len(der)-2 {
+		return nil, invalid
+	}
+	rest := der[2:]
+	var values [][]byte
+	for i := 0; i < 2; i++ {
+		if len(rest) < 2 || rest[0] != 0x02 || int(rest[1]) > len(rest)-2 || rest[1] == 0 {
+			return nil, invalid
+		}
+		values = append(values, rest[2:2+rest[1]])
+		rest = rest[2+rest[1]:]
+	}
+	if len(rest) != 0 {
+		return nil, invalid
+	}
+	rs := make([]byte, 64)
+	for i, v := range values {
+		n := new(big.Int).SetBytes(v)
+		if n.BitLen() > 256 {
+			return nil, invalid
+		}
+		n.FillBytes(rs[i*32 : (i+1)*32])
+	}
+	return rs, nil
+}
+
+func hash160(data []byte) []byte {
+	h := ripemd160.New()
+	h.Write(utility.Sha256(data))
+	return h.Sum(nil)
+}
+
+func p2wpkhScript(hash []byte) []byte {
+	return append([]byte{0, byte(len(hash))}, hash...)
+}
@@ -0,0 +1,57 @@
+package bitcoin
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/mutalisk999/bitcoin-lib/src/keyid"
+)
+
+func TestVerifyMessageBIP322(t *testing.T) {
+	address := "bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l"
+	vectors := map[string]string{
+		"":            "AkcwRAIgM2gBAQqvZX15ZiysmKmQpDrG83avLIT492QBzLnQIxYCIBaTpOaD20qRlEylyxFSeEA2ba9YOixpX8z46TSDtS40ASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI=",
+		"Hello World": "AkcwRAIgZRfIY3p7/DoVTty6YZbWS71bc5Vct9p9Fia83eRmw2QCICK/ENGfwLtptFluMGs2KsqoNSk89pO7F29zJLUx9a/sASECx/EgAxlkQpQ9hYjgGu6EBCPMVPwVIVJqO4XCsMvViHI=",
+	}
+	for message, sig := range vectors {
+		if err := Bitcoin.VerifyMessage(address, message, sig); err != nil {
+			t.Errorf("Valid signature of %q rejected: %v", message, err)
+		}
+	}
+	if err := Bitcoin.VerifyMessage(address, "Hello World", vectors[""]); err == nil {
+		t.Error("Signature of another message must be rejected")
+	}
+}
+
+func TestVerifyMessageBIP137(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	var id keyid.KeyID
+	id.SetKeyIDData(hash160(crypto.CompressPubkey(&key.PublicKey)))
+	legacy, _ := id.ToBase58Address(0)
+	segwit, _ := id.ToBech32AddressP2WPKH("bc")
+
+	message := "btcpool settings"
+	rsv, _ := crypto.Sign(Bitcoin.MessageHash(message), key)
+	sign := func(header byte) string {
+		return base64.StdEncoding.EncodeToString(append([]byte{header + rsv[64]}, rsv[:64]...))
+	}
+	if err := Bitcoin.VerifyMessage(legacy, message, sign(31)); err != nil {
+		t.Errorf("P2PKH signature rejected: %v", err)
+	}
+	if err := Bitcoin.VerifyMessage(segwit, message, sign(39)); err != nil {
+		t.Errorf("P2WPKH signature rejected: %v", err)
+	}
+	if err := Bitcoin.VerifyMessage(segwit, message, sign(31)); err != nil {
+		t.Errorf("P2WPKH signature with P2PKH header rejected: %v", err)
+	}
+	if err := Bitcoin.VerifyMessage(legacy, message, sign(39)); err == nil {
+		t.Error("P2WPKH signature must not match a P2PKH address")
+	}
+	if err := Bitcoin.VerifyMessage(legacy, message, sign(27)); err == nil {
+		t.Error("Uncompressed key must not match a compressed key address")
+	}
+	if err := Bitcoin.VerifyMessage(legacy, "other", sign(31)); err == nil {
+		t.Error("Signature of another message must be rejected")
+	}
+}
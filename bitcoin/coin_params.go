@@ -0,0 +1,186 @@
+package bitcoin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Block header hash used for proof of work, the result is in internal byte order
+type PowHashFunc func(header []byte) ([]byte, error)
+
+func DoubleSha256PowHash(header []byte) ([]byte, error) {
+	return utility.Sha256(utility.Sha256(header)), nil
+}
+
+func ScryptPowHash(header []byte) ([]byte, error) {
+	return scrypt.Key(header, header, 1024, 1, 1, 32)
+}
+
+type CoinParams struct {
+	Name string
+	// Base58 versions, mainnet and testnet
+	PubKeyHashAddrIDs []byte
+	ScriptHashAddrIDs []byte
+	// Segwit address prefixes, mainnet and testnet
+	Bech32HRPs []string
+	// CashAddr prefixes, mainnet and testnet
+	CashAddrPrefixes []string
+	PowHash          PowHashFunc
+	// Compact form of the difficulty 1 target
+	Diff1Bits        uint32
+	SegWit           bool
+	CoinBaseMaturity int64
+	// Consensus minimum transaction size, the coinbase is padded up to it
+	MinTxSize     int
+	TemplateRules []string
+	// Prefix of messages signed with signmessage
+	MessageMagic string
+}
+
+var Bitcoin = &CoinParams{
+	Name:              "btc",
+	PubKeyHashAddrIDs: []byte{0, 111},
+	ScriptHashAddrIDs: []byte{5, 196},
+	Bech32HRPs:        []string{"bc", "tb", "bcrt"},
+	PowHash:           DoubleSha256PowHash,
+	Diff1Bits:         GENESISNBITS,
+	SegWit:            true,
+	CoinBaseMaturity:  100,
+	TemplateRules:     []string{"segwit"},
+	MessageMagic:      "Bitcoin Signed Message:\n",
+}
+
+var BitcoinCash = &CoinParams{
+	Name:              "bch",
+	PubKeyHashAddrIDs: []byte{0, 111},
+	ScriptHashAddrIDs: []byte{5, 196},
+	CashAddrPrefixes:  []string{"bitcoincash", "bchtest", "bchreg"},
+	PowHash:           DoubleSha256PowHash,
+	Diff1Bits:         GENESISNBITS,
+	SegWit:            false,
+	CoinBaseMaturity:  100,
+	MinTxSize:         100,
+	TemplateRules:     []string{},
+	MessageMagic:      "Bitcoin Signed Message:\n",
+}
+
+var Litecoin = &CoinParams{
+	Name:              "ltc",
+	PubKeyHashAddrIDs: []byte{48, 111},
+	ScriptHashAddrIDs: []byte{50, 58, 5, 196},
+	Bech32HRPs:        []string{"ltc", "tltc", "rltc"},
+	PowHash:           ScryptPowHash,
+	// scrypt stratum difficulty 1 is 65536 times easier than sha256d one
+	Diff1Bits:        0x1f00ffff,
+	SegWit:           true,
+	CoinBaseMaturity: 100,
+	TemplateRules:    []string{"mweb", "segwit"},
+	MessageMagic:     "Litecoin Signed Message:\n",
+}
+
+var coins = map[string]*CoinParams{
+	Bitcoin.Name:     Bitcoin,
+	BitcoinCash.Name: BitcoinCash,
+	Litecoin.Name:    Litecoin,
+}
+
+func GetCoinParams(name string) (*CoinParams, error) {
+	c, ok := coins[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported coin %s", name)
+	}
+	return c, nil
+}
+
+func (c *CoinParams) Diff1Target() *big.Int {
+	return NBits2Target(c.Diff1Bits)
+}
+
+// Expected hashes for a difficulty 1 share
+func (c *CoinParams) Diff1Work() (float64, error) {
+	return GetTargetWork(c.Diff1Target())
+}
+
+func (c *CoinParams) AddressToScript(address string) ([]byte, error) {
+	for _, hrp := range c.Bech32HRPs {
+		if strings.HasPrefix(strings.ToLower(address), hrp+"1") {
+			return DecodeSegWitAddress(hrp, address)
+		}
+	}
+	for _, prefix := range c.CashAddrPrefixes {
+		addrType, hash, err := DecodeCashAddress(prefix, address)
+		if err != nil {
+			continue
+		}
+		if addrType == 0 {
+			return p2pkhScript(hash), nil
+		} else if addrType == 1 {
+			return p2shScript(hash), nil
+		}
+		return nil, errors.New("invalid cashaddr type")
+	}
+
+	payload, err := decodeBase58Check(address)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range c.PubKeyHashAddrIDs {
+		if payload[0] == v {
+			return p2pkhScript(payload[1:]), nil
+		}
+	}
+	for _, v := range c.ScriptHashAddrIDs {
+		if payload[0] == v {
+			return p2shScript(payload[1:]), nil
+		}
+	}
+	return nil, fmt.Errorf("address version %d is not valid for %s", payload[0], c.Name)
+}
+
+// Serialized size of an output paying the address: value, script length and script
+func (c *CoinParams) OutputSize(address string) (int64, error) {
+	script, err := c.AddressToScript(address)
+	if err != nil {
+		return 0, err
+	}
+	return int64(8 + 1 + len(script)), nil
+}
+
+// Fee of an output paying the address at a fee rate in sat/vB
+func (c *CoinParams) OutputFee(address string, feeRate float64) (int64, error) {
+	size, err := c.OutputSize(address)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Ceil(float64(size) * feeRate)), nil
+}
+
+func (c *CoinParams) IsValidAddress(address string) bool {
+	_, err := c.AddressToScript(address)
+	return err == nil
+}
+
+// Canonical form used as login and key part: lowercase bech32 and cashaddr without prefix
+func (c *CoinParams) NormalizeAddress(address string) string {
+	lower := strings.ToLower(address)
+	for _, hrp := range c.Bech32HRPs {
+		if strings.HasPrefix(lower, hrp+"1") {
+			return lower
+		}
+	}
+	for _, prefix := range c.CashAddrPrefixes {
+		if strings.HasPrefix(lower, prefix+":") {
+			return lower[len(prefix)+1:]
+		}
+		if _, _, err := DecodeCashAddress(prefix, lower); err == nil {
+			return lower
+		}
+	}
+	return address
+}
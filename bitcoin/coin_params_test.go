@@ -0,0 +1,111 @@
+package bitcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/mutalisk999/bitcoin-lib/src/bech32"
+)
+
+func TestSegWitAddressToScript(t *testing.T) {
+	program, _ := hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+	address, err := bech32.SegWitV0Encode("bc", program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptBytes, err := Bitcoin.AddressToScript(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(scriptBytes) != "0014751e76e8199196d454941c45d1b3a323f1433bd6" {
+		t.Errorf("Invalid p2wpkh script %x", scriptBytes)
+	}
+
+	scriptBytes, err = Bitcoin.AddressToScript("bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(scriptBytes) != "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" {
+		t.Errorf("Invalid p2tr script %x", scriptBytes)
+	}
+
+	if size, _ := Bitcoin.OutputSize(address); size != 31 {
+		t.Errorf("Invalid p2wpkh output size %v", size)
+	}
+	if size, _ := Bitcoin.OutputSize("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"); size != 34 {
+		t.Errorf("Invalid p2pkh output size %v", size)
+	}
+
+	if Litecoin.IsValidAddress(address) {
+		t.Error("Bitcoin segwit address must be invalid for litecoin")
+	}
+	if BitcoinCash.IsValidAddress(address) {
+		t.Error("Segwit address must be invalid for bitcoin cash")
+	}
+}
+
+func TestCashAddressToScript(t *testing.T) {
+	expected := "76a91476a04053bda0a88bda5177b86a15c3b29f55987388ac"
+	for _, address := range []string{
+		"bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+		"qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a",
+		"1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu",
+	} {
+		scriptBytes, err := BitcoinCash.AddressToScript(address)
+		if err != nil {
+			t.Fatalf("%v: %v", address, err)
+		}
+		if hex.EncodeToString(scriptBytes) != expected {
+			t.Errorf("Invalid script for %v: %x", address, scriptBytes)
+		}
+	}
+	if BitcoinCash.IsValidAddress("bitcoincash:qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6b") {
+		t.Error("Must reject invalid checksum")
+	}
+	if BitcoinCash.NormalizeAddress("BITCOINCASH:QPM2QSZNHKS23Z7629MMS6S4CWEF74VCWVY22GDX6A") != "qpm2qsznhks23z7629mms6s4cwef74vcwvy22gdx6a" {
+		t.Error("Must normalize cashaddr")
+	}
+}
+
+func TestBase58AddressVersions(t *testing.T) {
+	if !Bitcoin.IsValidAddress("1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu") {
+		t.Error("Must accept bitcoin p2pkh address")
+	}
+	if Litecoin.IsValidAddress("1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu") {
+		t.Error("Must reject bitcoin p2pkh address for litecoin")
+	}
+	if Bitcoin.NormalizeAddress("1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu") != "1BpEi6DfDAUFd7GtittLSdBeYJvcoaVggu" {
+		t.Error("Must keep base58 address case")
+	}
+}
+
+func TestDiff1Work(t *testing.T) {
+	btcWork, _ := Bitcoin.Diff1Work()
+	ltcWork, _ := Litecoin.Diff1Work()
+	if btcWork/ltcWork < 65535 || btcWork/ltcWork > 65537 {
+		t.Errorf("Scrypt difficulty 1 must be 65536 times easier: %v vs %v", btcWork, ltcWork)
+	}
+}
+
+func TestScryptPowHash(t *testing.T) {
+	// litecoin genesis block
+	header, _ := hex.DecodeString("010000000000000000000000000000000000000000000000000000000000000000000000d9ced4ed1130f7b7faad9be25323ffafa33232a17c3edf6cfd97bee6bafbdd97b9aa8e4ef0ff0f1ecd513f7c")
+	hash, err := ScryptPowHash(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversed := make([]byte, len(hash))
+	for i := range hash {
+		reversed[i] = hash[len(hash)-1-i]
+	}
+	// the genesis block must satisfy its own nBits 0x1e0ffff0 with the scrypt hash
+	if new(big.Int).SetBytes(reversed).Cmp(NBits2Target(0x1e0ffff0)) > 0 {
+		t.Errorf("Scrypt genesis hash %x above target", reversed)
+	}
+	sha, _ := DoubleSha256PowHash(header)
+	if bytes.Equal(sha, hash) {
+		t.Error("Scrypt hash must differ from double sha256")
+	}
+}
@@ -4,11 +4,19 @@ go 1.17
 
 require (
 	github.com/ethereum/go-ethereum v1.12.1
-	github.com/garyburd/redigo v1.6.2 // indirect
 	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/mutalisk999/bitcoin-lib v0.0.0-20201203080325-81caed73682f
 	github.com/mutalisk999/txid_merkle_tree v0.0.0-20201224034958-6ecbd0cbe5ee
 	golang.org/x/crypto v0.9.0
-	gopkg.in/bsm/ratelimit.v1 v1.0.0-20160220154919-db14e161995a // indirect
 	gopkg.in/redis.v3 v3.6.4
 )
+
+require (
+	github.com/garyburd/redigo v1.6.2 // indirect
+	github.com/holiman/uint256 v1.2.3 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/term v0.8.0 // indirect
+	gopkg.in/bsm/ratelimit.v1 v1.0.0-20160220154919-db14e161995a // indirect
+)
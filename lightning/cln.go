@@ -0,0 +1,132 @@
+package lightning
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Core Lightning clnrest client
+type CLNClient struct {
+	url    string
+	rune   string
+	client *http.Client
+}
+
+type clnDecodeReply struct {
+	PaymentHash     string `json:"payment_hash"`
+	AmountMsat      int64  `json:"amount_msat"`
+	CreatedAt       int64  `json:"created_at"`
+	Expiry          int64  `json:"expiry"`
+	DescriptionHash string `json:"description_hash"`
+}
+
+type clnPayReply struct {
+	PaymentHash     string `json:"payment_hash"`
+	PaymentPreimage string `json:"payment_preimage"`
+	AmountMsat      int64  `json:"amount_msat"`
+	AmountSentMsat  int64  `json:"amount_sent_msat"`
+	Status          string `json:"status"`
+}
+
+type clnListPaysReply struct {
+	Pays []struct {
+		PaymentHash    string `json:"payment_hash"`
+		Preimage       string `json:"preimage"`
+		AmountMsat     int64  `json:"amount_msat"`
+		AmountSentMsat int64  `json:"amount_sent_msat"`
+		Status         string `json:"status"`
+	} `json:"pays"`
+}
+
+type clnError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Pay errors after which the payment surely failed: route not found, too expensive, all attempts failed
+var clnPaymentFailedCodes = map[int]bool{205: true, 206: true, 210: true}
+
+func (c *CLNClient) DecodeInvoice(invoice string) (*Invoice, error) {
+	var reply clnDecodeReply
+	err := c.do("/v1/decode", map[string]interface{}{"string": invoice}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &Invoice{
+		PaymentHash:     reply.PaymentHash,
+		AmountMsat:      reply.AmountMsat,
+		Expiry:          time.Unix(reply.CreatedAt+reply.Expiry, 0),
+		DescriptionHash: reply.DescriptionHash,
+	}, nil
+}
+
+func (c *CLNClient) PayInvoice(invoice string, amountMsat, maxFeeMsat int64) (*Payment, error) {
+	req := map[string]interface{}{"bolt11": invoice, "maxfee": maxFeeMsat}
+	if amountMsat > 0 {
+		req["amount_msat"] = amountMsat
+	}
+	var reply clnPayReply
+	err := c.do("/v1/pay", req, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status != "complete" {
+		return nil, fmt.Errorf("payment %s is %s", reply.PaymentHash, reply.Status)
+	}
+	return &Payment{
+		PaymentHash: reply.PaymentHash,
+		Preimage:    reply.PaymentPreimage,
+		FeeMsat:     reply.AmountSentMsat - reply.AmountMsat,
+	}, nil
+}
+
+func (c *CLNClient) LookupPayment(paymentHash string) (*Payment, error) {
+	var reply clnListPaysReply
+	err := c.do("/v1/listpays", map[string]interface{}{"payment_hash": paymentHash}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Pays) == 0 {
+		return nil, &PaymentError{Reason: "unknown payment"}
+	}
+	pay := reply.Pays[0]
+	switch pay.Status {
+	case "complete":
+		return &Payment{PaymentHash: pay.PaymentHash, Preimage: pay.Preimage, FeeMsat: pay.AmountSentMsat - pay.AmountMsat}, nil
+	case "failed":
+		return nil, &PaymentError{Reason: "payment failed"}
+	}
+	return nil, ErrPaymentInFlight
+}
+
+func (c *CLNClient) do(path string, body interface{}, reply interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(c.url, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Rune", c.rune)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		var e clnError
+		json.NewDecoder(resp.Body).Decode(&e)
+		if path == "/v1/pay" && clnPaymentFailedCodes[e.Code] {
+			return &PaymentError{Reason: e.Message}
+		}
+		return fmt.Errorf("cln %s: %s %v %s", path, resp.Status, e.Code, e.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
@@ -0,0 +1,69 @@
+package lightning
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCLNPayInvoice(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Rune") != "rune" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["bolt11"] == "lnbcrt1noroute" {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"code": 210, "message": "Ran out of routes"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"payment_hash": "aa", "payment_preimage": "bb", "amount_msat": 1000000, "amount_sent_msat": 1000150, "status": "complete"})
+	}))
+	defer server.Close()
+
+	node, err := NewNode(&Config{Backend: BackendCLN, Url: server.URL, Rune: "rune"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := node.PayInvoice("lnbcrt10u1ok", 0, 5000)
+	if err != nil || payment.FeeMsat != 150 || payment.Preimage != "bb" {
+		t.Errorf("Unexpected payment %+v: %v", payment, err)
+	}
+	_, err = node.PayInvoice("lnbcrt1noroute", 0, 5000)
+	if !IsPaymentFailed(err) {
+		t.Errorf("Route failure must be a failed payment, got %v", err)
+	}
+}
+
+func TestCLNLookupPayment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		pays := []interface{}{}
+		switch req["payment_hash"] {
+		case "aa":
+			pays = append(pays, map[string]interface{}{
+				"payment_hash": "aa", "preimage": "bb", "amount_msat": 1000000, "amount_sent_msat": 1000150, "status": "complete"})
+		case "bb":
+			pays = append(pays, map[string]interface{}{"payment_hash": "bb", "status": "pending"})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"pays": pays})
+	}))
+	defer server.Close()
+
+	node, _ := NewNode(&Config{Backend: BackendCLN, Url: server.URL})
+	payment, err := node.LookupPayment("aa")
+	if err != nil || payment.Preimage != "bb" || payment.FeeMsat != 150 {
+		t.Errorf("Unexpected payment %+v: %v", payment, err)
+	}
+	if _, err = node.LookupPayment("bb"); err != ErrPaymentInFlight {
+		t.Errorf("Payment must be in flight, got %v", err)
+	}
+	if _, err = node.LookupPayment("cc"); !IsPaymentFailed(err) {
+		t.Errorf("Unknown payment was never sent, got %v", err)
+	}
+}
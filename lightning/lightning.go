@@ -0,0 +1,118 @@
+package lightning
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// "lnd" or "cln"
+	Backend string `json:"backend"`
+	Url     string `json:"url"`
+	// LND admin macaroon in hex
+	Macaroon string `json:"macaroon"`
+	// CLN rune allowing decode and pay
+	Rune string `json:"rune"`
+	// Node TLS certificate, system roots if empty
+	TLSCert string `json:"tlsCert"`
+	Timeout string `json:"timeout"`
+	// Smallest balance in Satoshi paid over Lightning
+	MinAmount int64 `json:"minAmount"`
+	// Routing fee limit in parts per million of the amount, paid by the pool
+	MaxFeePPM int64 `json:"maxFeePPM"`
+	// Most Lightning payments per payout run
+	MaxPayees int `json:"maxPayees"`
+}
+
+const defaultTimeout = "10s"
+
+const (
+	BackendLND = "lnd"
+	BackendCLN = "cln"
+)
+
+type Invoice struct {
+	PaymentHash string
+	// 0 for invoices without amount
+	AmountMsat      int64
+	Expiry          time.Time
+	DescriptionHash string
+}
+
+type Payment struct {
+	PaymentHash string
+	Preimage    string
+	FeeMsat     int64
+}
+
+// Lightning node paying the invoices, implemented by the LND and CLN REST clients
+type Node interface {
+	DecodeInvoice(invoice string) (*Invoice, error)
+	// Amount only for invoices without amount. Only a *PaymentError means the payment surely failed.
+	PayInvoice(invoice string, amountMsat, maxFeeMsat int64) (*Payment, error)
+	// Settled payment, ErrPaymentInFlight while it is pending and a *PaymentError if it failed or was never sent
+	LookupPayment(paymentHash string) (*Payment, error)
+}
+
+var ErrPaymentInFlight = errors.New("payment in flight")
+
+// Payment failed for sure, no funds left the node
+type PaymentError struct {
+	Reason string
+}
+
+func (e *PaymentError) Error() string {
+	return "payment failed: " + e.Reason
+}
+
+func IsPaymentFailed(err error) bool {
+	var paymentErr *PaymentError
+	return errors.As(err, &paymentErr)
+}
+
+func NewNode(cfg *Config) (Node, error) {
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Backend {
+	case BackendLND:
+		return &LNDClient{url: cfg.Url, macaroon: cfg.Macaroon, client: client}, nil
+	case BackendCLN:
+		return &CLNClient{url: cfg.Url, rune: cfg.Rune, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown lightning backend %q", cfg.Backend)
+}
+
+// Timeout of node and LNURL requests
+func (c *Config) RequestTimeout() time.Duration {
+	if len(c.Timeout) == 0 {
+		return MustParseDuration(defaultTimeout)
+	}
+	return MustParseDuration(c.Timeout)
+}
+
+func newHTTPClient(cfg *Config) (*http.Client, error) {
+	timeout := cfg.RequestTimeout()
+	if len(cfg.TLSCert) == 0 {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	pem, err := ioutil.ReadFile(cfg.TLSCert)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("invalid lightning node TLS certificate")
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
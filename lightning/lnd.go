@@ -0,0 +1,154 @@
+package lightning
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LND REST API client
+type LNDClient struct {
+	url      string
+	macaroon string
+	client   *http.Client
+}
+
+type lndPayReq struct {
+	PaymentHash     string `json:"payment_hash"`
+	NumMsat         string `json:"num_msat"`
+	Timestamp       string `json:"timestamp"`
+	Expiry          string `json:"expiry"`
+	DescriptionHash string `json:"description_hash"`
+}
+
+type lndSendResponse struct {
+	PaymentError    string `json:"payment_error"`
+	PaymentPreimage string `json:"payment_preimage"`
+	PaymentHash     string `json:"payment_hash"`
+	PaymentRoute    struct {
+		TotalFeesMsat string `json:"total_fees_msat"`
+	} `json:"payment_route"`
+}
+
+func (c *LNDClient) DecodeInvoice(invoice string) (*Invoice, error) {
+	var reply lndPayReq
+	err := c.do("GET", "/v1/payreq/"+url.PathEscape(invoice), nil, &reply)
+	if err != nil {
+		return nil, err
+	}
+	amount, _ := strconv.ParseInt(reply.NumMsat, 10, 64)
+	created, _ := strconv.ParseInt(reply.Timestamp, 10, 64)
+	expiry, _ := strconv.ParseInt(reply.Expiry, 10, 64)
+	return &Invoice{
+		PaymentHash:     reply.PaymentHash,
+		AmountMsat:      amount,
+		Expiry:          time.Unix(created+expiry, 0),
+		DescriptionHash: reply.DescriptionHash,
+	}, nil
+}
+
+func (c *LNDClient) PayInvoice(invoice string, amountMsat, maxFeeMsat int64) (*Payment, error) {
+	req := map[string]interface{}{
+		"payment_request": invoice,
+		"fee_limit":       map[string]string{"fixed_msat": strconv.FormatInt(maxFeeMsat, 10)},
+	}
+	if amountMsat > 0 {
+		req["amt_msat"] = strconv.FormatInt(amountMsat, 10)
+	}
+	var reply lndSendResponse
+	err := c.do("POST", "/v1/channels/transactions", req, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.PaymentError) > 0 {
+		return nil, &PaymentError{Reason: reply.PaymentError}
+	}
+	fee, _ := strconv.ParseInt(reply.PaymentRoute.TotalFeesMsat, 10, 64)
+	return &Payment{
+		PaymentHash: base64ToHex(reply.PaymentHash),
+		Preimage:    base64ToHex(reply.PaymentPreimage),
+		FeeMsat:     fee,
+	}, nil
+}
+
+type lndTrackResponse struct {
+	Result struct {
+		PaymentHash     string `json:"payment_hash"`
+		PaymentPreimage string `json:"payment_preimage"`
+		Status          string `json:"status"`
+		FeeMsat         string `json:"fee_msat"`
+		FailureReason   string `json:"failure_reason"`
+	} `json:"result"`
+}
+
+// The first update of the payment stream is its current state
+func (c *LNDClient) LookupPayment(paymentHash string) (*Payment, error) {
+	hash, err := hex.DecodeString(paymentHash)
+	if err != nil {
+		return nil, err
+	}
+	var reply lndTrackResponse
+	err = c.do("GET", "/v2/router/track/"+base64.URLEncoding.EncodeToString(hash), nil, &reply)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.Result.Status {
+	case "SUCCEEDED":
+		fee, _ := strconv.ParseInt(reply.Result.FeeMsat, 10, 64)
+		return &Payment{PaymentHash: reply.Result.PaymentHash, Preimage: reply.Result.PaymentPreimage, FeeMsat: fee}, nil
+	case "FAILED":
+		return nil, &PaymentError{Reason: reply.Result.FailureReason}
+	}
+	return nil, ErrPaymentInFlight
+}
+
+func (c *LNDClient) do(method, path string, body interface{}, reply interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.url, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Grpc-Metadata-macaroon", c.macaroon)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var lndErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&lndErr)
+		// The node never sent a payment it doesn't know
+		if resp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/v2/router/track/") {
+			return &PaymentError{Reason: lndErr.Message}
+		}
+		return fmt.Errorf("lnd %s %s: %s %s", method, path, resp.Status, lndErr.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// LND REST encodes bytes fields in base64
+func base64ToHex(s string) string {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return s
+	}
+	return hex.EncodeToString(b)
+}
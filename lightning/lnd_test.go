@@ -0,0 +1,79 @@
+package lightning
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLNDPayInvoice(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Grpc-Metadata-macaroon") != "0201" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/payreq/lnbcrt10u1ok":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"payment_hash": "aa", "num_msat": "1000000", "timestamp": "1700000000", "expiry": "3600"})
+		case "/v1/channels/transactions":
+			var req map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["payment_request"] != "lnbcrt10u1ok" {
+				json.NewEncoder(w).Encode(map[string]interface{}{"payment_error": "invoice expired"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"payment_hash": "qg==", "payment_preimage": "uw==",
+				"payment_route": map[string]interface{}{"total_fees_msat": "150"}})
+		}
+	}))
+	defer server.Close()
+
+	node, err := NewNode(&Config{Backend: BackendLND, Url: server.URL, Macaroon: "0201"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoice, err := node.DecodeInvoice("lnbcrt10u1ok")
+	if err != nil || invoice.AmountMsat != 1000000 || invoice.Expiry.Unix() != 1700003600 {
+		t.Errorf("Unexpected invoice %+v: %v", invoice, err)
+	}
+	payment, err := node.PayInvoice("lnbcrt10u1ok", 0, 5000)
+	if err != nil || payment.PaymentHash != "aa" || payment.Preimage != "bb" || payment.FeeMsat != 150 {
+		t.Errorf("Unexpected payment %+v: %v", payment, err)
+	}
+	_, err = node.PayInvoice("lnbcrt10u1expired", 0, 5000)
+	if !IsPaymentFailed(err) {
+		t.Errorf("Payment error must be a failed payment, got %v", err)
+	}
+}
+
+func TestLNDLookupPayment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/router/track/qg==":
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{
+				"payment_hash": "aa", "payment_preimage": "bb", "status": "SUCCEEDED", "fee_msat": "150"}})
+		case "/v2/router/track/uw==":
+			// The stream stays open while the payment is in flight
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"payment_hash": "bb", "status": "IN_FLIGHT"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"message": "payment isn't initiated"})
+		}
+	}))
+	defer server.Close()
+
+	node, _ := NewNode(&Config{Backend: BackendLND, Url: server.URL})
+	payment, err := node.LookupPayment("aa")
+	if err != nil || payment.Preimage != "bb" || payment.FeeMsat != 150 {
+		t.Errorf("Unexpected payment %+v: %v", payment, err)
+	}
+	if _, err = node.LookupPayment("bb"); err != ErrPaymentInFlight {
+		t.Errorf("Payment must be in flight, got %v", err)
+	}
+	if _, err = node.LookupPayment("cc"); !IsPaymentFailed(err) {
+		t.Errorf("Unknown payment was never sent, got %v", err)
+	}
+}
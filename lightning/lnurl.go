@@ -0,0 +1,174 @@
+package lightning
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/PowPool/btcpool/bitcoin"
+)
+
+var addressPattern = regexp.MustCompile("^[a-z0-9._+-]+@[a-z0-9.-]+\\.[a-z]{2,}$")
+var invoicePattern = regexp.MustCompile("^ln(bc|tb|bcrt|tbs)[0-9]*[munp]?1[02-9ac-hj-np-z]+$")
+
+// LNURL-pay parameters of a reusable destination
+type PayRequest struct {
+	Callback    string `json:"callback"`
+	MinSendable int64  `json:"minSendable"`
+	MaxSendable int64  `json:"maxSendable"`
+	Metadata    string `json:"metadata"`
+	Tag         string `json:"tag"`
+}
+
+// BOLT11 invoice, paid once
+func IsInvoice(dest string) bool {
+	return invoicePattern.MatchString(strings.ToLower(dest))
+}
+
+// Check the destination a miner registers: BOLT11 invoice, LNURL-pay or Lightning address
+func ValidDestination(dest string) error {
+	if IsInvoice(dest) {
+		return nil
+	}
+	_, err := PayRequestUrl(dest)
+	return err
+}
+
+// Url of the LNURL-pay endpoint of a Lightning address or bech32 LNURL
+func PayRequestUrl(dest string) (string, error) {
+	dest = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(dest), "lightning:"))
+	if addressPattern.MatchString(dest) {
+		at := strings.LastIndex(dest, "@")
+		return "https://" + dest[at+1:] + "/.well-known/lnurlp/" + dest[:at], nil
+	}
+	hrp, data, err := bitcoin.DecodeBech32(dest)
+	if err != nil || hrp != "lnurl" {
+		return "", errors.New("destination is neither a Lightning address nor an LNURL")
+	}
+	u, err := url.Parse(string(data))
+	if err != nil {
+		return "", err
+	}
+	// Onion services are http
+	if u.Scheme != "https" && !(u.Scheme == "http" && strings.HasSuffix(u.Hostname(), ".onion")) {
+		return "", errors.New("LNURL must be https")
+	}
+	return u.String(), nil
+}
+
+func FetchPayRequest(client *http.Client, dest string) (*PayRequest, error) {
+	payUrl, err := PayRequestUrl(dest)
+	if err != nil {
+		return nil, err
+	}
+	var reply struct {
+		PayRequest
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	err = getJSON(client, payUrl, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Status == "ERROR" {
+		return nil, errors.New("LNURL error: " + reply.Reason)
+	}
+	if reply.Tag != "payRequest" || len(reply.Callback) == 0 {
+		return nil, errors.New("not an LNURL-pay endpoint")
+	}
+	return &reply.PayRequest, nil
+}
+
+// Amount the endpoint accepts, at most the balance, 0 if it takes no less than the balance
+func (r *PayRequest) Sendable(balanceMsat int64) int64 {
+	amount := balanceMsat
+	if amount > r.MaxSendable {
+		amount = r.MaxSendable
+	}
+	if amount < r.MinSendable {
+		return 0
+	}
+	return amount
+}
+
+// Description hash the invoices of this endpoint commit to
+func (r *PayRequest) MetadataHash() string {
+	hash := sha256.Sum256([]byte(r.Metadata))
+	return hex.EncodeToString(hash[:])
+}
+
+func (r *PayRequest) FetchInvoice(client *http.Client, amountMsat int64) (string, error) {
+	u, err := url.Parse(r.Callback)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("amount", strconv.FormatInt(amountMsat, 10))
+	u.RawQuery = q.Encode()
+
+	var reply struct {
+		Pr     string `json:"pr"`
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	err = getJSON(client, u.String(), &reply)
+	if err != nil {
+		return "", err
+	}
+	if reply.Status == "ERROR" {
+		return "", errors.New("LNURL error: " + reply.Reason)
+	}
+	if !IsInvoice(reply.Pr) {
+		return "", errors.New("LNURL returned no invoice")
+	}
+	return reply.Pr, nil
+}
+
+// Client for LNURL and Lightning address lookups. Their hosts are chosen by miners, so only public
+// addresses are dialed, also after redirects, keeping the pool's own network out of reach
+func NewLNURLClient(cfg *Config) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.RequestTimeout(), Control: dialPublic}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: cfg.RequestTimeout(), Transport: transport}
+}
+
+func dialPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("LNURL host %s is not a public address", host)
+	}
+	return nil
+}
+
+// Neither loopback, private, link-local, multicast nor unspecified
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+func getJSON(client *http.Client, u string, reply interface{}) error {
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
@@ -0,0 +1,91 @@
+package lightning
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/PowPool/btcpool/bitcoin"
+)
+
+func TestPayRequestUrl(t *testing.T) {
+	u, err := PayRequestUrl("Satoshi@Example.com")
+	if err != nil || u != "https://example.com/.well-known/lnurlp/satoshi" {
+		t.Errorf("Unexpected Lightning address url %v: %v", u, err)
+	}
+	lnurl, _ := bitcoin.EncodeBech32("lnurl", []byte("https://service.com/api?q=3fc3645b439ce8e7"))
+	u, err = PayRequestUrl(lnurl)
+	if err != nil || u != "https://service.com/api?q=3fc3645b439ce8e7" {
+		t.Errorf("Unexpected LNURL url %v: %v", u, err)
+	}
+	lnurl, _ = bitcoin.EncodeBech32("lnurl", []byte("http://service.com/api"))
+	if _, err = PayRequestUrl(lnurl); err == nil {
+		t.Error("LNURL over http must be rejected")
+	}
+	if err = ValidDestination("bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"); err == nil {
+		t.Error("Bitcoin address must not be a Lightning destination")
+	}
+	if !IsInvoice("lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypq") {
+		t.Error("BOLT11 invoice not recognized")
+	}
+}
+
+func TestFetchInvoice(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lnurlp":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"tag": "payRequest", "callback": server.URL + "/callback?id=1",
+				"minSendable": 1000, "maxSendable": 5000000, "metadata": `[["text/plain","pool"]]`})
+		case "/callback":
+			if r.URL.Query().Get("amount") != "2000000" || r.URL.Query().Get("id") != "1" {
+				json.NewEncoder(w).Encode(map[string]interface{}{"status": "ERROR", "reason": "bad amount"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"pr": "lnbcrt20u1pvjluez", "routes": []string{}})
+		}
+	}))
+	defer server.Close()
+
+	lnurl, _ := bitcoin.EncodeBech32("lnurl", []byte(server.URL+"/lnurlp"))
+	payReq, err := FetchPayRequest(server.Client(), lnurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount := payReq.Sendable(9000000); amount != 5000000 {
+		t.Errorf("Unexpected sendable amount %v", amount)
+	}
+	if amount := payReq.Sendable(500); amount != 0 {
+		t.Errorf("Amount below minSendable must not be sendable, got %v", amount)
+	}
+	pr, err := payReq.FetchInvoice(server.Client(), 2000000)
+	if err != nil || pr != "lnbcrt20u1pvjluez" {
+		t.Errorf("Unexpected invoice %v: %v", pr, err)
+	}
+	if _, err = payReq.FetchInvoice(server.Client(), 3000000); err == nil {
+		t.Error("LNURL error must be returned")
+	}
+}
+
+func TestLNURLClientPublicHosts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"tag": "payRequest", "callback": "https://service.com/cb"})
+	}))
+	defer server.Close()
+
+	lnurl, _ := bitcoin.EncodeBech32("lnurl", []byte(server.URL+"/lnurlp"))
+	if _, err := FetchPayRequest(NewLNURLClient(&Config{}), lnurl); err == nil {
+		t.Error("LNURL on a loopback address must not be fetched")
+	}
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "192.168.1.124", "169.254.169.254", "::1", "fe80::1", "fd00::1", "0.0.0.0"} {
+		if isPublicIP(net.ParseIP(ip)) {
+			t.Errorf("%s must not be public", ip)
+		}
+	}
+	if !isPublicIP(net.ParseIP("1.1.1.1")) || !isPublicIP(net.ParseIP("2606:4700::1111")) {
+		t.Error("Public addresses must be dialed")
+	}
+}
@@ -0,0 +1,116 @@
+package lightning
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/PowPool/btcpool/bitcoin"
+)
+
+// In-process node for tests, pays the invoices it issued
+type MockNode struct {
+	sync.Mutex
+	invoices  map[string]*Invoice
+	preimages map[string]string
+	Paid      []*Payment
+	inFlight  map[string]*Payment
+	// Returned by the next payment
+	Fail error
+	// The next payment is sent but stays in flight, its call times out
+	Timeout bool
+	FeeMsat int64
+}
+
+func NewMockNode() *MockNode {
+	return &MockNode{invoices: make(map[string]*Invoice), preimages: make(map[string]string), inFlight: make(map[string]*Payment)}
+}
+
+// Issue an invoice, 0 for an invoice without amount
+func (m *MockNode) AddInvoice(amountMsat int64, descriptionHash string) string {
+	m.Lock()
+	defer m.Unlock()
+
+	preimage := make([]byte, 32)
+	rand.Read(preimage)
+	hash := sha256.Sum256(preimage)
+	paymentHash := hex.EncodeToString(hash[:])
+
+	// Not a real BOLT11 invoice, only the format matters to the pool
+	invoice, _ := bitcoin.EncodeBech32("lnbcrt", hash[:])
+	m.invoices[invoice] = &Invoice{
+		PaymentHash:     paymentHash,
+		AmountMsat:      amountMsat,
+		Expiry:          time.Now().Add(time.Hour),
+		DescriptionHash: descriptionHash,
+	}
+	m.preimages[paymentHash] = hex.EncodeToString(preimage)
+	return invoice
+}
+
+func (m *MockNode) DecodeInvoice(invoice string) (*Invoice, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	v, ok := m.invoices[invoice]
+	if !ok {
+		return nil, errors.New("invalid invoice")
+	}
+	return v, nil
+}
+
+func (m *MockNode) PayInvoice(invoice string, amountMsat, maxFeeMsat int64) (*Payment, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.Fail != nil {
+		err := m.Fail
+		m.Fail = nil
+		return nil, err
+	}
+	v, ok := m.invoices[invoice]
+	if !ok {
+		return nil, &PaymentError{Reason: "invalid invoice"}
+	}
+	if m.FeeMsat > maxFeeMsat {
+		return nil, &PaymentError{Reason: "route too expensive"}
+	}
+	payment := &Payment{PaymentHash: v.PaymentHash, Preimage: m.preimages[v.PaymentHash], FeeMsat: m.FeeMsat}
+	delete(m.invoices, invoice)
+	if m.Timeout {
+		m.Timeout = false
+		m.inFlight[payment.PaymentHash] = payment
+		return nil, errors.New("request timed out")
+	}
+	m.Paid = append(m.Paid, payment)
+	return payment, nil
+}
+
+// Settle a payment in flight
+func (m *MockNode) Settle(paymentHash string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if payment, ok := m.inFlight[paymentHash]; ok {
+		delete(m.inFlight, paymentHash)
+		m.Paid = append(m.Paid, payment)
+	}
+}
+
+func (m *MockNode) LookupPayment(paymentHash string) (*Payment, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.inFlight[paymentHash]; ok {
+		return nil, ErrPaymentInFlight
+	}
+	for _, payment := range m.Paid {
+		if payment.PaymentHash == paymentHash {
+			return payment, nil
+		}
+	}
+	return nil, &PaymentError{Reason: "unknown payment"}
+}
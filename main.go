@@ -17,10 +17,13 @@ import (
 	//"github.com/yvasiyarov/gorelic"
 
 	"github.com/PowPool/btcpool/api"
+	"github.com/PowPool/btcpool/bitcoin"
 	"github.com/PowPool/btcpool/payouts"
 	"github.com/PowPool/btcpool/proxy"
 	"github.com/PowPool/btcpool/storage"
 	. "github.com/PowPool/btcpool/util"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -32,27 +35,73 @@ var (
 )
 
 var cfg proxy.Config
+var pools []*proxy.Config
 var backend *storage.RedisClient
+var sqlDB *storage.SQLDB
 
-func startProxy() {
-	s := proxy.NewProxy(&cfg, backend)
+// Unlocker command to run instead of the pool, see payouts.RunCommand
+var unlockerCommand, unlockerPool, unlockerRound string
+
+func mustGetCoinParams(pool *proxy.Config) *bitcoin.CoinParams {
+	coin, err := bitcoin.GetCoinParams(pool.Coin)
+	if err != nil {
+		Error.Fatalf("Pool %s: %v", pool.PoolName, err)
+	}
+	return coin
+}
+
+// Backend of a pool, blocks, balances and payments go to SQL if it is enabled
+func poolBackend(pool *proxy.Config) storage.Backend {
+	rounds := backend.WithPrefix(pool.Prefix)
+	if sqlDB == nil {
+		return rounds
+	}
+	b, err := storage.NewSQLBackend(sqlDB, pool.Prefix, rounds)
+	if err != nil {
+		Error.Fatalf("Pool %s: SQL backend: %v", pool.PoolName, err)
+	}
+	return b
+}
+
+func startProxy(pool *proxy.Config) {
+	s := proxy.NewProxy(pool, poolBackend(pool))
 	s.Start()
 }
 
 func startApi() {
-	s := api.NewApiServer(&cfg.Api, backend)
-	s.Start()
+	var servers []*api.ApiServer
+	for _, pool := range pools {
+		s := api.NewApiServer(&cfg.Api, pool.PoolName, poolBackend(pool), mustGetCoinParams(pool))
+		servers = append(servers, s)
+	}
+	api.StartPools(&cfg.Api, servers)
 }
 
-func startBlockUnlocker() {
-	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
+func startBlockUnlocker(pool *proxy.Config) {
+	pool.BlockUnlocker.CoinBaseAddress = pool.UpstreamCoinBase
+	u := payouts.NewBlockUnlocker(&pool.BlockUnlocker, poolBackend(pool), mustGetCoinParams(pool))
 	u.Start()
 }
 
-//func startPayoutsProcessor() {
-//	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-//	u.Start()
-//}
+func runUnlockerCommand() {
+	for _, pool := range pools {
+		if (len(unlockerPool) == 0 && pool.BlockUnlocker.Enabled) || pool.PoolName == unlockerPool {
+			pool.BlockUnlocker.CoinBaseAddress = pool.UpstreamCoinBase
+			u := payouts.NewBlockUnlocker(&pool.BlockUnlocker, poolBackend(pool), mustGetCoinParams(pool))
+			err := u.RunCommand(os.Stdout, unlockerCommand, unlockerRound)
+			if err != nil {
+				Error.Fatalf("Pool %s: unlocker %s failed: %v", pool.PoolName, unlockerCommand, err)
+			}
+			os.Exit(0)
+		}
+	}
+	Error.Fatalf("No pool %q with block unlocker", unlockerPool)
+}
+
+func startPayoutsProcessor(pool *proxy.Config) {
+	u := payouts.NewPayoutsProcessor(&pool.Payouts, poolBackend(pool), mustGetCoinParams(pool))
+	u.Start()
+}
 
 // this function is for performance profile
 //func startNewrelic() {
@@ -67,8 +116,8 @@ func startBlockUnlocker() {
 
 func readConfig(cfg *proxy.Config) {
 	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+	if flag.NArg() > 0 {
+		configFileName = flag.Arg(0)
 	}
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
@@ -112,16 +161,34 @@ func decryptPoolConfigure(cfg *proxy.Config, passBytes []byte) error {
 	}
 	cfg.UpstreamCoinBase = string(b)
 	// check address
-	if !IsValidBTCAddress(cfg.UpstreamCoinBase) {
-		return errors.New("decryptPoolConfigure: IsValidBTCAddress")
+	coin, err := bitcoin.GetCoinParams(cfg.Coin)
+	if err != nil {
+		return err
+	}
+	if !coin.IsValidAddress(cfg.UpstreamCoinBase) {
+		return errors.New("decryptPoolConfigure: IsValidAddress")
 	}
+	return nil
+}
 
-	b, err = Ae64Decode(cfg.Redis.PasswordEncrypted, passBytes)
+func decryptRedisConfigure(cfg *proxy.Config, passBytes []byte) error {
+	b, err := Ae64Decode(cfg.Redis.PasswordEncrypted, passBytes)
 	if err != nil {
 		return err
 	}
 	cfg.Redis.Password = string(b)
+	return nil
+}
 
+func decryptSQLConfigure(cfg *proxy.Config, passBytes []byte) error {
+	if !cfg.SQL.Enabled || len(cfg.SQL.DSNEncrypted) == 0 {
+		return nil
+	}
+	b, err := Ae64Decode(cfg.SQL.DSNEncrypted, passBytes)
+	if err != nil {
+		return err
+	}
+	cfg.SQL.DSN = string(b)
 	return nil
 }
 
@@ -162,6 +229,9 @@ func initPeerName(cfg *proxy.Config) error {
 func OptionParse() {
 	var showVer bool
 	flag.BoolVar(&showVer, "v", false, "show build version")
+	flag.StringVar(&unlockerCommand, "unlocker", "", "run an unlocker command and exit: dry-run, resume, orphan, recredit or recompute")
+	flag.StringVar(&unlockerPool, "pool", "", "pool of the unlocker command, the first pool with an unlocker by default")
+	flag.StringVar(&unlockerRound, "round", "", "round of the unlocker command as height:hash")
 
 	flag.Parse()
 
@@ -193,6 +263,8 @@ func main() {
 	}
 	Info.Println("Init Peer Name as:", cfg.Name)
 
+	InitAlert(&cfg.Alert)
+
 	if cfg.Threads > 0 {
 		runtime.GOMAXPROCS(cfg.Threads)
 		Info.Printf("Running with %v threads", cfg.Threads)
@@ -205,18 +277,41 @@ func main() {
 		Error.Fatal("Read Security Password error: ", err.Error())
 	}
 
-	err = decryptPoolConfigure(&cfg, secPassBytes)
+	err = decryptRedisConfigure(&cfg, secPassBytes)
 	if err != nil {
-		Error.Fatal("Decrypt Pool Configure error: ", err.Error())
+		Error.Fatal("Decrypt Redis Configure error: ", err.Error())
+	}
+	err = decryptSQLConfigure(&cfg, secPassBytes)
+	if err != nil {
+		Error.Fatal("Decrypt SQL Configure error: ", err.Error())
+	}
+
+	pools, err = cfg.PoolConfigs()
+	if err != nil {
+		Error.Fatal("Pool Configure error: ", err.Error())
+	}
+	for _, pool := range pools {
+		err = decryptPoolConfigure(pool, secPassBytes)
+		if err != nil {
+			Error.Fatalf("Decrypt Pool %s Configure error: %v", pool.PoolName, err)
+		}
+		Info.Printf("Hosting pool %s, coin %s, redis prefix %s", pool.PoolName, pool.Coin, pool.Prefix)
 	}
 
-	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	backend = storage.NewRedisClient(&cfg.Redis, "")
 	pong, err := backend.Check()
 	if err != nil {
 		Error.Printf("Can't establish connection to backend: %v", err)
 	} else {
 		Error.Printf("Backend check reply: %v", pong)
 	}
+	if cfg.SQL.Enabled {
+		sqlDB, err = storage.OpenSQL(&cfg.SQL)
+		if err != nil {
+			Error.Fatal("Can't open SQL database: ", err.Error())
+		}
+		Info.Printf("Blocks, balances and payments are kept in %s", cfg.SQL.Driver)
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -224,18 +319,37 @@ func main() {
 		}
 	}()
 
-	if cfg.Proxy.Enabled {
-		go startProxy()
+	if len(unlockerCommand) > 0 {
+		runUnlockerCommand()
+	}
+
+	for _, pool := range pools {
+		if pool.Proxy.Enabled || pool.BlockUnlocker.Enabled || pool.Payouts.Enabled {
+			// Balances of a pool that ran without ledger open it
+			err = poolBackend(pool).OpenLedger()
+			if err != nil {
+				Error.Printf("Pool %s: failed to open ledger: %v", pool.PoolName, err)
+			}
+			n, err := poolBackend(pool).MigrateBlocks()
+			if err != nil {
+				Error.Printf("Pool %s: failed to migrate blocks: %v", pool.PoolName, err)
+			} else if n > 0 {
+				Info.Printf("Pool %s: migrated %v blocks to version %v records", pool.PoolName, n, storage.BlockRecordVersion)
+			}
+		}
+		if pool.Proxy.Enabled {
+			go startProxy(pool)
+		}
+		if pool.BlockUnlocker.Enabled {
+			go startBlockUnlocker(pool)
+		}
+		if pool.Payouts.Enabled {
+			go startPayoutsProcessor(pool)
+		}
 	}
 	if cfg.Api.Enabled {
 		go startApi()
 	}
-	if cfg.BlockUnlocker.Enabled {
-		go startBlockUnlocker()
-	}
-	//if cfg.Payouts.Enabled {
-	//	go startPayoutsProcessor()
-	//}
 	quit := make(chan bool)
 	<-quit
 }
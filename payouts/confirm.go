@@ -0,0 +1,272 @@
+package payouts
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+const defaultConfirmations = 6
+const defaultTrackInterval = "5m"
+const defaultStuckAfter = "3h"
+
+// One P2WPKH input and output spending the change of a stuck payout
+const cpfpChildSize = 110
+
+func (p *PayoutsProcessor) confirmations() int64 {
+	if p.config.Confirmations > 0 {
+		return p.config.Confirmations
+	}
+	return defaultConfirmations
+}
+
+func (p *PayoutsProcessor) trackInterval() time.Duration {
+	if len(p.config.TrackInterval) > 0 {
+		return MustParseDuration(p.config.TrackInterval)
+	}
+	return MustParseDuration(defaultTrackInterval)
+}
+
+func (p *PayoutsProcessor) stuckAfter() time.Duration {
+	if len(p.config.StuckAfter) > 0 {
+		return MustParseDuration(p.config.StuckAfter)
+	}
+	return MustParseDuration(defaultStuckAfter)
+}
+
+func (p *PayoutsProcessor) trackPayments() {
+	if p.halt {
+		Info.Println("Payments suspended due to last critical error:", p.lastFail)
+		return
+	}
+	txs, err := p.backend.GetUnconfirmedPayments()
+	if err != nil {
+		Error.Println("Error while retrieving unconfirmed payouts from backend:", err)
+		return
+	}
+	for _, ptx := range txs {
+		err = p.trackPayment(ptx)
+		if err != nil {
+			Error.Printf("Failed to track payout tx %s: %v", ptx.TxId, err)
+		}
+		if p.halt {
+			return
+		}
+	}
+}
+
+func (p *PayoutsProcessor) trackPayment(ptx *storage.PaymentTx) error {
+	wtx, err := p.rpc.GetWalletTransaction(ptx.TxId)
+	if err != nil {
+		return err
+	}
+	if wtx == nil {
+		return errors.New("tx is unknown to the wallet")
+	}
+
+	switch {
+	case len(wtx.ReplacedBy) > 0:
+		// Bumped outside of the pool
+		replacement, err := p.backend.ReplacePaymentTx(ptx, wtx.ReplacedBy)
+		if err != nil {
+			return err
+		}
+		Info.Printf("Payout tx %s was replaced by %s", ptx.TxId, replacement.TxId)
+	case wtx.Confirmations >= p.confirmations():
+		fee, err := p.payoutFee(ptx, wtx)
+		if err != nil {
+			return err
+		}
+		// Written once per tx, a retry after a failed update doesn't record it again
+		err = p.backend.WriteNetworkFee(ptx.TxId, "payout tx fee", fee)
+		if err != nil {
+			return err
+		}
+		ptx.Status = storage.PaymentConfirmed
+		ptx.Confirmations = wtx.Confirmations
+		err = p.backend.UpdatePaymentTx(ptx)
+		if err != nil {
+			return err
+		}
+		Info.Printf("Payout tx %s to %v payees confirmed", ptx.TxId, len(ptx.Payments))
+	case wtx.Confirmations > 0:
+		if ptx.Confirmations != wtx.Confirmations {
+			ptx.Confirmations = wtx.Confirmations
+			return p.backend.UpdatePaymentTx(ptx)
+		}
+	case wtx.Confirmations < 0:
+		// Inputs spent by a tx the pool didn't make, payments are logged but never happened
+		ptx.Status = storage.PaymentConflicted
+		ptx.Confirmations = wtx.Confirmations
+		err = p.backend.UpdatePaymentTx(ptx)
+		if err != nil {
+			return err
+		}
+		err = fmt.Errorf("payout tx %s conflicts with %s", ptx.TxId, strings.Join(wtx.WalletConflicts, ", "))
+		Error.Printf("%v. Payments of it need manual resolution, see docs/PAYOUTS.md", err)
+		p.halt = true
+		p.lastFail = err
+	default:
+		return p.checkMempool(ptx, wtx)
+	}
+	return nil
+}
+
+// Fee the pool paid for a confirmed payout tx and the CPFP children confirmed with it. Fees charged to the payees
+// by outputFee or subtractFee are left out, their outputs fall short of their payments by them
+func (p *PayoutsProcessor) payoutFee(ptx *storage.PaymentTx, wtx *rpc.WalletTxReply) (int64, error) {
+	fee := -BTCToSatoshi(wtx.Fee)
+	for _, txId := range ptx.Children {
+		child, err := p.rpc.GetWalletTransaction(txId)
+		if err != nil {
+			return 0, err
+		}
+		if child != nil && child.Confirmations > 0 {
+			fee -= BTCToSatoshi(child.Fee)
+		}
+	}
+	sent := make(map[string]int64)
+	for _, v := range wtx.Details {
+		if v.Category == "send" {
+			sent[v.Address] -= BTCToSatoshi(v.Amount)
+		}
+	}
+	for login, amount := range ptx.Payments {
+		if output, ok := sent[login]; ok && output < amount {
+			fee -= amount - output
+		}
+	}
+	return fee, nil
+}
+
+// Rebroadcast evicted payout txs and bump the fee of stuck ones
+func (p *PayoutsProcessor) checkMempool(ptx *storage.PaymentTx, wtx *rpc.WalletTxReply) error {
+	entry, err := p.rpc.GetMempoolEntry(ptx.TxId)
+	if err != nil && strings.Contains(err.Error(), "not in mempool") {
+		Info.Printf("Payout tx %s is gone from mempool, broadcasting it again", ptx.TxId)
+		_, err = p.rpc.SendRawTransaction(wtx.Hex)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	since := ptx.Sent
+	if ptx.Bumped > since {
+		since = ptx.Bumped
+	}
+	stuck := time.Since(time.Unix(since, 0))
+	if stuck < p.stuckAfter() || len(p.config.BumpFee) == 0 {
+		return nil
+	}
+	if p.config.Mode == PayoutModePSBT {
+		// Keys are offline, nothing to sign a bump with
+		Error.Printf("Payout tx %s is unconfirmed for %v, bump its fee with the offline signer", ptx.TxId, stuck)
+		ptx.Bumped = MakeTimestamp() / 1000
+		return p.backend.UpdatePaymentTx(ptx)
+	}
+
+	feeRate, err := p.bumpFeeRate()
+	if err != nil {
+		return err
+	}
+	if p.config.BumpFee == BumpFeeRBF {
+		reply, err := p.rpc.BumpFee(ptx.TxId, feeRate)
+		if err != nil {
+			return err
+		}
+		_, err = p.backend.ReplacePaymentTx(ptx, reply.TxId)
+		if err != nil {
+			Error.Printf("Failed to replace payout tx %s by %s in backend: %v", ptx.TxId, reply.TxId, err)
+			p.halt = true
+			p.lastFail = err
+			return err
+		}
+		Info.Printf("Payout tx %s unconfirmed for %v replaced by %s, fee %v -> %v",
+			ptx.TxId, stuck, reply.TxId, reply.OrigFee, reply.Fee)
+		return nil
+	}
+
+	child, err := p.bumpChild(ptx, entry, feeRate)
+	if err != nil {
+		return err
+	}
+	ptx.Children = append(ptx.Children, child)
+	ptx.Bumped = MakeTimestamp() / 1000
+	Info.Printf("Payout tx %s unconfirmed for %v, child %s pays for it", ptx.TxId, stuck, child)
+	return p.backend.UpdatePaymentTx(ptx)
+}
+
+// Current estimate capped by the payout fee ceiling
+func (p *PayoutsProcessor) bumpFeeRate() (float64, error) {
+	feeRate, err := p.rpc.EstimateSmartFee(p.feeTarget())
+	if err != nil {
+		return 0, err
+	}
+	if p.config.MaxFeeRate > 0 && feeRate > p.config.MaxFeeRate {
+		feeRate = p.config.MaxFeeRate
+	}
+	return feeRate, nil
+}
+
+// Spend the change of the payout tx so that both together pay the fee rate. A later bump spends the output of
+// the last child instead, the new child pays for the whole package
+func (p *PayoutsProcessor) bumpChild(ptx *storage.PaymentTx, entry *rpc.MempoolEntry, feeRate float64) (string, error) {
+	parent, vsize, paid := ptx.TxId, entry.VSize, entry.Fees.Base
+	if len(ptx.Children) > 0 {
+		last := ptx.Children[len(ptx.Children)-1]
+		childEntry, err := p.rpc.GetMempoolEntry(last)
+		if err == nil {
+			parent, vsize, paid = last, childEntry.AncestorSize, childEntry.Fees.Ancestor
+		} else if !strings.Contains(err.Error(), "not in mempool") {
+			return "", err
+		}
+	}
+
+	unspent, err := p.rpc.ListUnspent(0, 0)
+	if err != nil {
+		return "", err
+	}
+	var change *rpc.UnspentReply
+	for _, v := range unspent {
+		if v.TxId == parent {
+			change = v
+			break
+		}
+	}
+	if change == nil {
+		return "", errors.New("no unspent change output to pay for the tx")
+	}
+
+	fee := int64(math.Ceil(feeRate*float64(vsize+cpfpChildSize))) - BTCToSatoshi(paid)
+	if fee <= 0 {
+		return "", fmt.Errorf("tx already pays %v sat/vB", feeRate)
+	}
+	amount := BTCToSatoshi(change.Amount) - fee
+	if amount < dustLimit {
+		return "", fmt.Errorf("change of %v Satoshi can't pay %v Satoshi fee", BTCToSatoshi(change.Amount), fee)
+	}
+
+	address, err := p.rpc.GetRawChangeAddress()
+	if err != nil {
+		return "", err
+	}
+	raw, err := p.rpc.CreateRawTransaction([]rpc.Outpoint{{TxId: change.TxId, Vout: change.Vout}}, map[string]int64{address: amount})
+	if err != nil {
+		return "", err
+	}
+	signed, err := p.rpc.SignRawTransactionWithWallet(raw)
+	if err != nil {
+		return "", err
+	}
+	if !signed.Complete {
+		return "", errors.New("wallet could not sign the child tx")
+	}
+	return p.rpc.SendRawTransaction(signed.Hex)
+}
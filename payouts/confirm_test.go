@@ -0,0 +1,137 @@
+package payouts
+
+import (
+	"testing"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+)
+
+func TestBumpFeeRate(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"estimatesmartfee": map[string]interface{}{"feerate": 0.0008, "blocks": 6}}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	if feeRate, err := p.bumpFeeRate(); err != nil || feeRate != 80 {
+		t.Errorf("Unexpected fee rate %v: %v", feeRate, err)
+	}
+	p.config.MaxFeeRate = 50
+	if feeRate, _ := p.bumpFeeRate(); feeRate != 50 {
+		t.Errorf("Fee rate must be capped by the ceiling, got %v", feeRate)
+	}
+}
+
+func TestBumpChild(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{
+		"listunspent": []interface{}{
+			map[string]interface{}{"txid": "aa", "vout": 0, "amount": 0.1},
+			map[string]interface{}{"txid": testBatchTxId, "vout": 2, "amount": 0.001},
+		},
+		"getrawchangeaddress":          "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq",
+		"createrawtransaction":         "0200",
+		"signrawtransactionwithwallet": map[string]interface{}{"hex": "0201", "complete": true},
+		"sendrawtransaction":           "bb",
+	}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{BumpFee: BumpFeeCPFP}, server.URL)
+	ptx := &storage.PaymentTx{TxId: testBatchTxId}
+	entry := &rpc.MempoolEntry{VSize: 290, Fees: rpc.MempoolEntryFees{Base: 0.00000400}}
+	child, err := p.bumpChild(ptx, entry, 10)
+	if err != nil || child != "bb" {
+		t.Fatalf("Unexpected child %v: %v", child, err)
+	}
+	params := calls["createrawtransaction"]
+	if params[0].([]interface{})[0].(map[string]interface{})["vout"] != float64(2) {
+		t.Errorf("Child must spend the change, got %v", params[0])
+	}
+	// 10 sat/vB for 400 vB minus 400 Satoshi paid by the parent
+	if params[1].(map[string]interface{})["bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"] != "0.00096400" {
+		t.Errorf("Unexpected child output %v", params[1])
+	}
+	if calls["sendrawtransaction"][0] != "0201" {
+		t.Errorf("Must broadcast the signed child, got %v", calls["sendrawtransaction"])
+	}
+
+	if _, err = p.bumpChild(ptx, entry, 1); err == nil {
+		t.Error("Must not bump a tx already paying the fee rate")
+	}
+	results["listunspent"] = []interface{}{}
+	if _, err = p.bumpChild(ptx, entry, 10); err == nil {
+		t.Error("Must require a change output")
+	}
+
+	// The first child spent the change, the next one spends the child
+	ptx.Children = []string{"bb"}
+	results["getmempoolentry"] = map[string]interface{}{"vsize": 110, "ancestorsize": 400, "fees": map[string]interface{}{"base": 0.00000400, "ancestor": 0.00000800}}
+	results["listunspent"] = []interface{}{map[string]interface{}{"txid": "bb", "vout": 0, "amount": 0.000964}}
+	results["sendrawtransaction"] = "cc"
+	if child, err = p.bumpChild(ptx, entry, 20); err != nil || child != "cc" {
+		t.Fatalf("Unexpected child %v: %v", child, err)
+	}
+	params = calls["createrawtransaction"]
+	if params[0].([]interface{})[0].(map[string]interface{})["txid"] != "bb" {
+		t.Errorf("Child must spend the last child, got %v", params[0])
+	}
+	// 20 sat/vB for 510 vB minus 800 Satoshi paid by parent and child
+	if params[1].(map[string]interface{})["bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"] != "0.00087000" {
+		t.Errorf("Unexpected child output %v", params[1])
+	}
+}
+
+func TestTrackPaymentFee(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{
+		"gettransaction": map[string]interface{}{
+			"txid": "aa", "confirmations": 6, "fee": -0.00000500,
+			"details": []interface{}{
+				map[string]interface{}{"address": "a", "category": "send", "amount": -0.00004800, "vout": 0},
+				map[string]interface{}{"address": "b", "category": "send", "amount": -0.00003000, "vout": 1},
+			},
+		},
+	}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{OutputFee: true}, server.URL)
+	p.backend = storage.NewMemoryBackend()
+	p.backend.WritePayments("aa", map[string]int64{"a": 5000, "b": 3000})
+	txs, _ := p.backend.GetUnconfirmedPayments()
+	if len(txs) != 1 {
+		t.Fatalf("Unexpected unconfirmed payouts %v", txs)
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.trackPayment(txs[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 500 Satoshi tx fee less 200 Satoshi withheld from the output of a
+	balances, _ := p.backend.LedgerBalances()
+	if balances[storage.AccountNetworkFees] != 300 || balances[storage.AccountPoolFee] != -300 {
+		t.Errorf("Unexpected fee balances %v", balances)
+	}
+	if txs, _ = p.backend.GetUnconfirmedPayments(); len(txs) != 0 {
+		t.Errorf("Payout must be confirmed, got %v", txs)
+	}
+}
+
+func TestPayoutFeeChildren(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{
+		"gettransaction": map[string]interface{}{"txid": "bb", "confirmations": 1, "fee": -0.00000600},
+	}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	ptx := &storage.PaymentTx{TxId: "aa", Payments: map[string]int64{"a": 5000}, Children: []string{"bb", "cc"}}
+	wtx := &rpc.WalletTxReply{TxId: "aa", Confirmations: 1, Fee: -0.00000500}
+	// 500 Satoshi of the payout and 600 Satoshi of each child
+	if fee, err := p.payoutFee(ptx, wtx); err != nil || fee != 1700 {
+		t.Errorf("Unexpected payout fee %v: %v", fee, err)
+	}
+}
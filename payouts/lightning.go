@@ -0,0 +1,253 @@
+package payouts
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/PowPool/btcpool/lightning"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+const defaultLightningMinAmount = 1000
+const defaultLightningMaxPayees = 50
+const defaultLightningMaxFeePPM = 5000
+
+// Invoice of a Lightning payout ready to be paid
+type lightningInvoice struct {
+	invoice     string
+	paymentHash string
+	// Amount of the payout in Satoshi
+	amount int64
+	// Passed to the node only for invoices without amount
+	amountMsat int64
+	// Single use destination, removed once paid
+	clear bool
+}
+
+func (p *PayoutsProcessor) lightningMinAmount() int64 {
+	if p.config.Lightning.MinAmount > 0 {
+		return p.config.Lightning.MinAmount
+	}
+	return defaultLightningMinAmount
+}
+
+func (p *PayoutsProcessor) lightningMaxPayees() int {
+	if p.config.Lightning.MaxPayees > 0 {
+		return p.config.Lightning.MaxPayees
+	}
+	return defaultLightningMaxPayees
+}
+
+func (p *PayoutsProcessor) lightningMaxFee(amount int64) int64 {
+	ppm := p.config.Lightning.MaxFeePPM
+	if ppm <= 0 {
+		ppm = defaultLightningMaxFeePPM
+	}
+	return amount * 1000 * ppm / 1000000
+}
+
+// Pay balances below the on-chain threshold to miners with a Lightning destination
+func (p *PayoutsProcessor) processLightning() {
+	if p.lightning == nil || p.halt {
+		return
+	}
+	balances, thresholds, err := p.collectBalances()
+	if err != nil {
+		Error.Println("Error while retrieving Lightning payees from backend:", err)
+		return
+	}
+	var logins []string
+	for login := range balances {
+		logins = append(logins, login)
+	}
+	dests, err := p.backend.GetLightningDestinations(logins)
+	if err != nil {
+		Error.Println("Error while retrieving Lightning destinations from backend:", err)
+		return
+	}
+	payees := selectLightningPayees(balances, thresholds, dests, p.lightningMinAmount(), p.lightningMaxPayees())
+
+	for _, v := range payees {
+		if !p.payLightning(v, dests[v.login]) {
+			return
+		}
+	}
+}
+
+// Balances between the Lightning minimum and the on-chain threshold, largest first
+func selectLightningPayees(balances, thresholds map[string]int64, dests map[string]string, min int64, max int) []payee {
+	var payees []payee
+	for login, amount := range balances {
+		if len(dests[login]) > 0 && amount >= min && amount < thresholds[login] {
+			payees = append(payees, payee{login: login, amount: amount})
+		}
+	}
+	sort.Slice(payees, func(i, j int) bool {
+		if payees[i].amount != payees[j].amount {
+			return payees[i].amount > payees[j].amount
+		}
+		return payees[i].login < payees[j].login
+	})
+	if len(payees) > max {
+		payees = payees[:max]
+	}
+	return payees
+}
+
+// Pay one miner, false if payouts must stop
+func (p *PayoutsProcessor) payLightning(v payee, dest string) bool {
+	inv, err := p.lightningInvoice(v.login, v.amount, dest)
+	if err != nil {
+		Error.Printf("Unable to pay %v over Lightning: %v", v.login, err)
+		return true
+	}
+	if inv == nil {
+		return true
+	}
+
+	err = p.backend.LockPayouts(v.login, inv.amount)
+	if err != nil {
+		Error.Printf("Failed to lock Lightning payment of %v Satoshi to %v: %v", inv.amount, v.login, err)
+		p.halt = true
+		p.lastFail = err
+		return false
+	}
+	err = p.backend.UpdateBalance(v.login, inv.amount)
+	if err != nil {
+		Error.Printf("Failed to update balance for %s, %v Satoshi: %v", v.login, inv.amount, err)
+		p.halt = true
+		p.lastFail = err
+		return false
+	}
+
+	// Recorded before paying, a payment with unknown outcome is looked up on the node instead of credited back
+	inFlight := &storage.InFlightPayment{Login: v.login, PaymentHash: inv.paymentHash, Amount: inv.amount, Clear: inv.clear,
+		Sent: MakeTimestamp() / 1000}
+	err = p.backend.WriteInFlightPayment(inFlight)
+	if err != nil {
+		Error.Printf("Failed to record Lightning payment of %v Satoshi to %v: %v", inv.amount, v.login, err)
+		p.halt = true
+		p.lastFail = err
+		return false
+	}
+
+	payment, err := p.lightning.PayInvoice(inv.invoice, inv.amountMsat, p.lightningMaxFee(inv.amount))
+	if lightning.IsPaymentFailed(err) {
+		Error.Printf("Lightning payment of %v Satoshi to %v failed: %v", inv.amount, v.login, err)
+		return p.rollbackLightning(inFlight)
+	} else if err != nil {
+		// A timeout doesn't stop the payment, it is looked up by its hash on the next run
+		Error.Printf("Lightning payment of %v Satoshi to %v may be in flight, payment hash %s: %v",
+			inv.amount, v.login, inv.paymentHash, err)
+		return false
+	}
+	return p.recordLightning(inFlight, payment)
+}
+
+// Settle the Lightning payment left in flight by an earlier run, false while its outcome is unknown
+func (p *PayoutsProcessor) resolveLightning() bool {
+	inFlight, err := p.backend.GetInFlightPayment()
+	if err != nil {
+		Error.Println("Error while retrieving Lightning payment in flight from backend:", err)
+		return false
+	}
+	if inFlight == nil {
+		return true
+	}
+	if p.lightning == nil {
+		Error.Printf("Lightning payment %s to %v is in flight, enable Lightning to resolve it", inFlight.PaymentHash, inFlight.Login)
+		return false
+	}
+	payment, err := p.lightning.LookupPayment(inFlight.PaymentHash)
+	if lightning.IsPaymentFailed(err) {
+		Error.Printf("Lightning payment %s of %v Satoshi to %v failed: %v", inFlight.PaymentHash, inFlight.Amount, inFlight.Login, err)
+		return p.rollbackLightning(inFlight)
+	} else if err != nil {
+		Info.Printf("Lightning payment %s of %v Satoshi to %v is not settled yet: %v", inFlight.PaymentHash, inFlight.Amount,
+			inFlight.Login, err)
+		return false
+	}
+	return p.recordLightning(inFlight, payment)
+}
+
+func (p *PayoutsProcessor) rollbackLightning(inFlight *storage.InFlightPayment) bool {
+	err := p.backend.RollbackBalance(inFlight.Login, inFlight.Amount)
+	if err == nil {
+		err = p.backend.UnlockPayouts()
+	}
+	if err != nil {
+		Error.Printf("Failed to credit %v Satoshi back to %v: %v", inFlight.Amount, inFlight.Login, err)
+		p.halt = true
+		p.lastFail = err
+		return false
+	}
+	return true
+}
+
+func (p *PayoutsProcessor) recordLightning(inFlight *storage.InFlightPayment, payment *lightning.Payment) bool {
+	fee := (payment.FeeMsat + 999) / 1000
+	err := p.backend.WriteLightningPayment(inFlight.Login, inFlight.PaymentHash, inFlight.Amount, fee, inFlight.Clear)
+	if err != nil {
+		Error.Printf("Failed to log Lightning payment of %v Satoshi to %v, payment hash: %s: %v",
+			inFlight.Amount, inFlight.Login, inFlight.PaymentHash, err)
+		p.halt = true
+		p.lastFail = err
+		return false
+	}
+	Info.Printf("Paid %v Satoshi to %v over Lightning, fee %v Satoshi, payment hash: %v", inFlight.Amount, inFlight.Login,
+		fee, inFlight.PaymentHash)
+	return true
+}
+
+// Invoice paying at most the balance to the destination, nil if the payout has to wait
+func (p *PayoutsProcessor) lightningInvoice(login string, balance int64, dest string) (*lightningInvoice, error) {
+	if lightning.IsInvoice(dest) {
+		invoice, err := p.lightning.DecodeInvoice(dest)
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().After(invoice.Expiry) {
+			Info.Printf("Removing expired Lightning invoice of %v", login)
+			return nil, p.backend.SetLightningDestination(login, "")
+		}
+		if invoice.AmountMsat == 0 {
+			return &lightningInvoice{invoice: dest, paymentHash: invoice.PaymentHash, amount: balance, amountMsat: balance * 1000,
+				clear: true}, nil
+		}
+		if invoice.AmountMsat%1000 != 0 {
+			return nil, fmt.Errorf("invoice amount of %v msat is not whole Satoshi", invoice.AmountMsat)
+		}
+		// Wait until the balance covers the invoice
+		if invoice.AmountMsat > balance*1000 {
+			return nil, nil
+		}
+		return &lightningInvoice{invoice: dest, paymentHash: invoice.PaymentHash, amount: invoice.AmountMsat / 1000, clear: true}, nil
+	}
+
+	payReq, err := lightning.FetchPayRequest(p.lnurlClient, dest)
+	if err != nil {
+		return nil, err
+	}
+	amountMsat := payReq.Sendable(balance*1000) / 1000 * 1000
+	if amountMsat < payReq.MinSendable || amountMsat == 0 {
+		return nil, nil
+	}
+	pr, err := payReq.FetchInvoice(p.lnurlClient, amountMsat)
+	if err != nil {
+		return nil, err
+	}
+	invoice, err := p.lightning.DecodeInvoice(pr)
+	if err != nil {
+		return nil, err
+	}
+	// The service must not change the amount nor the payee description
+	if invoice.AmountMsat != amountMsat {
+		return nil, fmt.Errorf("LNURL invoice is for %v msat instead of %v msat", invoice.AmountMsat, amountMsat)
+	}
+	if invoice.DescriptionHash != payReq.MetadataHash() {
+		return nil, fmt.Errorf("LNURL invoice description hash %v does not match metadata", invoice.DescriptionHash)
+	}
+	return &lightningInvoice{invoice: pr, paymentHash: invoice.PaymentHash, amount: amountMsat / 1000}, nil
+}
@@ -0,0 +1,186 @@
+package payouts
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/lightning"
+	"github.com/PowPool/btcpool/storage"
+)
+
+func TestSelectLightningPayees(t *testing.T) {
+	balances := map[string]int64{"a": 500, "b": 5000, "c": 3000, "d": 4000, "e": 2000}
+	thresholds := map[string]int64{"a": 10000, "b": 4500, "c": 10000, "d": 10000, "e": 10000}
+	dests := map[string]string{"a": "a@pool.com", "b": "b@pool.com", "c": "c@pool.com", "d": "d@pool.com"}
+	payees := selectLightningPayees(balances, thresholds, dests, 1000, 2)
+	expected := []payee{{login: "d", amount: 4000}, {login: "c", amount: 3000}}
+	if !reflect.DeepEqual(payees, expected) {
+		t.Errorf("Unexpected payees %v", payees)
+	}
+}
+
+func TestLightningInvoice(t *testing.T) {
+	node := lightning.NewMockNode()
+	p := newTestPayouts(&PayoutsConfig{}, "")
+	p.lightning = node
+
+	invoice := node.AddInvoice(3000000, "")
+	if inv, err := p.lightningInvoice("a", 2000, invoice); inv != nil || err != nil {
+		t.Errorf("Invoice above the balance must wait, got %v: %v", inv, err)
+	}
+	inv, err := p.lightningInvoice("a", 4000, invoice)
+	if err != nil || inv.amount != 3000 || inv.amountMsat != 0 || !inv.clear {
+		t.Errorf("Unexpected invoice payout %+v: %v", inv, err)
+	}
+	invoice = node.AddInvoice(0, "")
+	inv, err = p.lightningInvoice("a", 4000, invoice)
+	if err != nil || inv.amount != 4000 || inv.amountMsat != 4000000 {
+		t.Errorf("Unexpected invoice payout %+v: %v", inv, err)
+	}
+
+	metadata := `[["text/plain","pool"]]`
+	descriptionHash := (&lightning.PayRequest{Metadata: metadata}).MetadataHash()
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/lnurlp" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"tag": "payRequest", "callback": server.URL + "/callback",
+				"minSendable": 1000, "maxSendable": 2500000, "metadata": metadata})
+			return
+		}
+		amount, _ := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+		hash := descriptionHash
+		if amount == 1000000 {
+			hash = ""
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"pr": node.AddInvoice(amount, hash)})
+	}))
+	defer server.Close()
+	p.lnurlClient = server.Client()
+
+	lnurl, _ := bitcoin.EncodeBech32("lnurl", []byte(server.URL+"/lnurlp"))
+	inv, err = p.lightningInvoice("a", 4000, lnurl)
+	if err != nil || inv.amount != 2500 || inv.amountMsat != 0 || inv.clear {
+		t.Errorf("Unexpected LNURL payout %+v: %v", inv, err)
+	}
+	payment, err := node.PayInvoice(inv.invoice, inv.amountMsat, p.lightningMaxFee(inv.amount))
+	if err != nil || len(node.Paid) != 1 || payment.PaymentHash != node.Paid[0].PaymentHash {
+		t.Errorf("Unexpected payment %+v: %v", payment, err)
+	}
+	if _, err = p.lightningInvoice("a", 1000, lnurl); err == nil {
+		t.Error("Invoice not committing to the metadata must be rejected")
+	}
+}
+
+func newLightningTestPayouts(login string, balance int64) (*PayoutsProcessor, *lightning.MockNode, storage.Backend) {
+	node := lightning.NewMockNode()
+	backend := storage.NewMemoryBackend()
+	backend.AdjustBalance(login, balance, "test")
+	p := newTestPayouts(&PayoutsConfig{}, "")
+	p.lightning = node
+	p.backend = backend
+	return p, node, backend
+}
+
+func TestPayLightning(t *testing.T) {
+	p, node, backend := newLightningTestPayouts("a", 5000)
+	node.FeeMsat = 1500
+	invoice := node.AddInvoice(0, "")
+	backend.SetLightningDestination("a", invoice)
+
+	if !p.payLightning(payee{login: "a", amount: 5000}, invoice) {
+		t.Fatal("Payouts must go on after a payment")
+	}
+	if balance, _ := backend.GetBalance("a"); balance != 0 || len(node.Paid) != 1 {
+		t.Errorf("Unexpected balance %v after %v payments", balance, len(node.Paid))
+	}
+	hash := node.Paid[0].PaymentHash
+	if txs, _ := backend.GetPaymentTxs([]string{hash}); txs[hash] == nil || txs[hash].Fee != 2 || !txs[hash].Lightning {
+		t.Errorf("Unexpected Lightning payment %+v", txs[hash])
+	}
+	if dest, _ := backend.GetLightningDestination("a"); dest != "" {
+		t.Errorf("Paid invoice must be cleared, got %q", dest)
+	}
+	if locked, _ := backend.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked")
+	}
+}
+
+func TestPayLightningFailed(t *testing.T) {
+	p, node, backend := newLightningTestPayouts("a", 5000)
+	node.Fail = &lightning.PaymentError{Reason: "no route"}
+	invoice := node.AddInvoice(0, "")
+
+	if !p.payLightning(payee{login: "a", amount: 5000}, invoice) || p.halt {
+		t.Fatal("Failed payment must not stop payouts")
+	}
+	if balance, _ := backend.GetBalance("a"); balance != 5000 {
+		t.Errorf("Failed payment must be credited back, balance %v", balance)
+	}
+	if locked, _ := backend.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked")
+	}
+}
+
+func TestPayLightningTimeout(t *testing.T) {
+	p, node, backend := newLightningTestPayouts("a", 5000)
+	node.Timeout = true
+	invoice := node.AddInvoice(0, "")
+	decoded, _ := node.DecodeInvoice(invoice)
+
+	if p.payLightning(payee{login: "a", amount: 5000}, invoice) {
+		t.Fatal("Payouts must stop while a payment is in flight")
+	}
+	if p.halt {
+		t.Error("Payment in flight must not halt payouts")
+	}
+	if inFlight, _ := backend.GetInFlightPayment(); inFlight == nil || inFlight.PaymentHash != decoded.PaymentHash {
+		t.Fatalf("Unexpected payment in flight %+v", inFlight)
+	}
+	if p.resolveLightning() {
+		t.Error("Payment must stay in flight until settled")
+	}
+	if balance, _ := backend.GetBalance("a"); balance != 0 {
+		t.Errorf("Payment in flight must not be credited back, balance %v", balance)
+	}
+
+	node.Settle(decoded.PaymentHash)
+	if !p.resolveLightning() {
+		t.Fatal("Settled payment must be resolved")
+	}
+	if txs, _ := backend.GetPaymentTxs([]string{decoded.PaymentHash}); txs[decoded.PaymentHash] == nil {
+		t.Error("Settled payment must be recorded")
+	}
+	if locked, _ := backend.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked")
+	}
+	if balance, _ := backend.GetBalance("a"); balance != 0 {
+		t.Errorf("Settled payment must not be credited back, balance %v", balance)
+	}
+}
+
+func TestPayLightningNeverSent(t *testing.T) {
+	p, node, backend := newLightningTestPayouts("a", 5000)
+	node.Fail = errors.New("connection refused")
+	invoice := node.AddInvoice(0, "")
+
+	if p.payLightning(payee{login: "a", amount: 5000}, invoice) {
+		t.Fatal("Payouts must stop while the payment is unknown")
+	}
+	// The node doesn't know the payment, it never left
+	if !p.resolveLightning() {
+		t.Fatal("Unknown payment must be resolved")
+	}
+	if balance, _ := backend.GetBalance("a"); balance != 5000 {
+		t.Errorf("Unsent payment must be credited back, balance %v", balance)
+	}
+	if inFlight, _ := backend.GetInFlightPayment(); inFlight != nil {
+		t.Errorf("Unexpected payment in flight %+v", inFlight)
+	}
+}
@@ -1,296 +1,749 @@
 package payouts
 
 import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/lightning"
 	"github.com/PowPool/btcpool/rpc"
 	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
 )
 
-const txCheckInterval = 5 * time.Second
-
 type PayoutsConfig struct {
 	Enabled      bool   `json:"enabled"`
 	RequirePeers int64  `json:"requirePeers"`
 	Interval     string `json:"interval"`
 	Daemon       string `json:"daemon"`
 	Timeout      string `json:"timeout"`
-	Address      string `json:"address"`
-	Gas          string `json:"gas"`
-	GasPrice     string `json:"gasPrice"`
-	AutoGas      bool   `json:"autoGas"`
-	// In Shannon
+	// Wallet of the node to pay from, the default wallet if empty
+	Wallet string `json:"wallet"`
+	// In Satoshi, default for miners without their own threshold
 	Threshold int64 `json:"threshold"`
-	BgSave    bool  `json:"bgsave"`
+	// Lowest threshold a miner may choose, defaults to threshold
+	MinThreshold int64 `json:"minThreshold"`
+	// Confirmation target in blocks for the fee estimate
+	FeeTarget int `json:"feeTarget"`
+	// Defer payouts while the estimated fee rate in sat/vB is higher, 0 disables the ceiling
+	MaxFeeRate float64 `json:"maxFeeRate"`
+	// Deduct the fee of every output from its payee
+	OutputFee bool `json:"outputFee"`
+	// Most payees batched in one transaction
+	MaxPayees int `json:"maxPayees"`
+	// Split the transaction fee between the payees instead of paying it from the pool
+	SubtractFee bool `json:"subtractFee"`
+	BgSave      bool `json:"bgsave"`
+	// "sendmany" (default) pays from a hot wallet, "psbt" waits for an offline signature
+	Mode string `json:"mode"`
+	// Directory unsigned batches are exported to and signed ones picked up from
+	PSBTDir string `json:"psbtDir"`
+	// How often a pending batch is checked for a signature
+	PSBTPollInterval string `json:"psbtPollInterval"`
+	// Payout txs are watched until this deep
+	Confirmations int64  `json:"confirmations"`
+	TrackInterval string `json:"trackInterval"`
+	// Raise the fee of payout txs unconfirmed for longer than stuckAfter, "rbf" or "cpfp", empty disables
+	BumpFee    string `json:"bumpFee"`
+	StuckAfter string `json:"stuckAfter"`
+	// Spend tracked UTXOs oldest first instead of leaving coin selection to the wallet
+	CoinSelection bool   `json:"coinSelection"`
+	UTXOInterval  string `json:"utxoInterval"`
+	// Consolidate UTXOs while the fee rate in sat/vB is at most this, 0 disables
+	ConsolidateFeeRate float64 `json:"consolidateFeeRate"`
+	// Consolidate once the wallet holds this many UTXOs, at most consolidateMax in one tx
+	ConsolidateMin int `json:"consolidateMin"`
+	ConsolidateMax int `json:"consolidateMax"`
+	// Compare the wallet with owed balances this often
+	SolvencyInterval string `json:"solvencyInterval"`
+	// Alert when the wallet is short by more Satoshi
+	MaxDeficit int64 `json:"maxDeficit"`
+	// Pay balances below the threshold over Lightning
+	Lightning lightning.Config `json:"lightning"`
 }
 
-//func (c PayoutsConfig) GasHex() string {
-//	x := String2Big(c.Gas)
-//	return hexutil.EncodeBig(x)
-//}
-//
-//func (c PayoutsConfig) GasPriceHex() string {
-//	x := String2Big(c.GasPrice)
-//	return hexutil.EncodeBig(x)
-//}
+const (
+	PayoutModeSendMany = "sendmany"
+	PayoutModePSBT     = "psbt"
+)
+
+const (
+	BumpFeeRBF  = "rbf"
+	BumpFeeCPFP = "cpfp"
+)
+
+const defaultMaxPayees = 500
+const defaultFeeTarget = 6
+
+// Outputs below are not relayed
+const dustLimit = 546
+const defaultPSBTPollInterval = "1m"
+
+// Latest wallet tx entries searched for a payout that failed, and how far the node clock may lag in seconds
+const payoutTxSearch = 1000
+const payoutTxClockSkew = 3600
+
+// Wallet endpoint of the node RPC
+func (c *PayoutsConfig) WalletUrl() string {
+	if len(c.Wallet) == 0 {
+		return c.Daemon
+	}
+	return strings.TrimRight(c.Daemon, "/") + "/wallet/" + c.Wallet
+}
 
 type PayoutsProcessor struct {
 	config   *PayoutsConfig
-	backend  *storage.RedisClient
+	backend  storage.Backend
 	rpc      *rpc.RPCClient
+	coin     *bitcoin.CoinParams
 	halt     bool
 	lastFail error
+	// Fee estimate of the last run in sat/vB, 0 leaves fees to the wallet
+	feeRate  float64
+	deferred bool
+	// Nil unless Lightning payouts are enabled
+	lightning   lightning.Node
+	lnurlClient *http.Client
+	// Wallet short by more than maxDeficit at the last check
+	insolvent bool
+}
+
+type payee struct {
+	login  string
+	amount int64
+	// Share of the tx fee deducted from the output
+	fee int64
+}
+
+func NewPayoutsProcessor(cfg *PayoutsConfig, backend storage.Backend, coin *bitcoin.CoinParams) *PayoutsProcessor {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = PayoutModeSendMany
+	case PayoutModeSendMany, PayoutModePSBT:
+	default:
+		Error.Fatalln("Unknown payout mode", cfg.Mode)
+	}
+	if cfg.SubtractFee && cfg.OutputFee {
+		Error.Fatalln("Payouts subtractFee and outputFee are exclusive")
+	}
+	switch cfg.BumpFee {
+	case "", BumpFeeRBF, BumpFeeCPFP:
+	default:
+		Error.Fatalln("Unknown payout fee bumping", cfg.BumpFee)
+	}
+	u := &PayoutsProcessor{config: cfg, backend: backend, coin: coin}
+	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.WalletUrl(), cfg.Timeout)
+	if cfg.Lightning.Enabled {
+		node, err := lightning.NewNode(&cfg.Lightning)
+		if err != nil {
+			Error.Fatalln("Unable to set up Lightning payouts:", err)
+		}
+		u.lightning = node
+		u.lnurlClient = lightning.NewLNURLClient(&cfg.Lightning)
+	}
+	return u
+}
+
+func (p *PayoutsProcessor) Start() {
+	Info.Println("Starting payouts")
+
+	if p.mustResolvePayout() {
+		Info.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
+		p.resolvePayouts()
+		Info.Println("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
+		return
+	}
+	if p.mustReconcileLedger() {
+		Info.Println("Running with env RECONCILE_LEDGER=1, now comparing the ledger with balances")
+		p.reconcileLedger()
+		return
+	}
+
+	intv := MustParseDuration(p.config.Interval)
+	timer := time.NewTimer(intv)
+	Info.Printf("Set payouts interval to %v", intv)
+
+	batch, err := p.backend.GetPayoutBatch()
+	if err != nil {
+		Error.Println("Unable to start payouts:", err)
+		return
+	}
+	inFlight, err := p.backend.GetInFlightPayment()
+	if err != nil {
+		Error.Println("Unable to start payouts:", err)
+		return
+	}
+	// Balances of a batch waiting for its signature or a Lightning payment in flight stay pending and locked
+	if batch == nil && inFlight == nil {
+		payments := p.backend.GetPendingPayments()
+		if len(payments) > 0 {
+			Error.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v", formatPendingPayments(payments))
+			return
+		}
+
+		locked, err := p.backend.IsPayoutsLocked()
+		if err != nil {
+			Error.Println("Unable to start payouts:", err)
+			return
+		}
+		if locked {
+			Error.Println("Unable to start payouts because they are locked")
+			return
+		}
+	} else if batch != nil && p.config.Mode != PayoutModePSBT {
+		Error.Printf("Unable to start payouts, payout batch %v is pending, run in psbt mode to complete it", batch.Id)
+		return
+	}
+
+	// Batches waiting for a signature are checked more often than payouts run
+	var pollTimer *time.Timer
+	var poll <-chan time.Time
+	pollIntv := p.psbtPollInterval()
+	if p.config.Mode == PayoutModePSBT {
+		pollTimer = time.NewTimer(pollIntv)
+		poll = pollTimer.C
+		Info.Printf("Check pending payout batch every %v", pollIntv)
+	}
+
+	// Payout txs are watched until confirmed
+	trackIntv := p.trackInterval()
+	trackTimer := time.NewTimer(trackIntv)
+	Info.Printf("Track payout txs every %v until %v confirmations", trackIntv, p.confirmations())
+
+	// Coinbase and change outputs are reconciled with the wallet
+	utxoIntv := p.utxoInterval()
+	utxoTimer := time.NewTimer(utxoIntv)
+	Info.Printf("Reconcile UTXOs every %v", utxoIntv)
+
+	// The wallet must cover what miners are owed
+	solvencyIntv := p.solvencyInterval()
+	solvencyTimer := time.NewTimer(solvencyIntv)
+	Info.Printf("Check pool solvency every %v", solvencyIntv)
+
+	// Immediately process payouts after start
+	p.process()
+	timer.Reset(intv)
+	p.publishSchedule(time.Now().Add(intv))
+	p.checkSolvency()
+
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				p.process()
+				timer.Reset(intv)
+				p.publishSchedule(time.Now().Add(intv))
+			case <-poll:
+				p.processBatch()
+				pollTimer.Reset(pollIntv)
+			case <-trackTimer.C:
+				p.trackPayments()
+				trackTimer.Reset(trackIntv)
+			case <-utxoTimer.C:
+				p.manageUTXOs()
+				utxoTimer.Reset(utxoIntv)
+			case <-solvencyTimer.C:
+				p.checkSolvency()
+				solvencyTimer.Reset(solvencyIntv)
+			}
+		}
+	}()
+}
+
+func (p *PayoutsProcessor) process() {
+	if p.halt {
+		Info.Println("Payments suspended due to last critical error:", p.lastFail)
+		return
+	}
+	if !p.resolveLightning() {
+		return
+	}
+	if p.config.Mode == PayoutModePSBT {
+		batch, err := p.backend.GetPayoutBatch()
+		if err != nil {
+			Error.Println("Error while retrieving payout batch from backend:", err)
+			return
+		}
+		if batch != nil {
+			p.processBatch()
+			return
+		}
+	}
+
+	// Small balances do not wait for the on-chain threshold nor fees
+	p.processLightning()
+	if p.halt {
+		return
+	}
+
+	// Check fees before touching balances
+	err := p.estimateFeeRate()
+	if err != nil {
+		Error.Println("Unable to process payouts:", err)
+		return
+	}
+	if p.deferred {
+		Info.Printf("Payouts deferred, fee rate %.2f sat/vB is above %.2f sat/vB", p.feeRate, p.config.MaxFeeRate)
+		return
+	}
+
+	payees, err := p.collectPayees()
+	if err != nil {
+		Error.Println("Error while retrieving payees from backend:", err)
+		return
+	}
+	if len(payees) == 0 {
+		Error.Println("No payees that have reached payout threshold")
+		return
+	}
+	totalAmount := int64(0)
+	for _, v := range payees {
+		totalAmount += v.amount
+	}
+
+	// Require active peers and enough funds before processing
+	err = p.checkWallet(totalAmount)
+	if err != nil {
+		Error.Println("Unable to process payouts:", err)
+		return
+	}
+
+	var conflicts []string
+	var inputs []rpc.Outpoint
+	if p.config.Mode == PayoutModePSBT {
+		conflicts, inputs, err = p.conflictInputs()
+		if err != nil {
+			Error.Println("Unable to process payouts:", err)
+			p.halt = true
+			p.lastFail = err
+			return
+		}
+	}
+	inputs = appendInputs(inputs, p.payoutInputs(totalAmount, len(payees)))
+
+	// Lock payments for current payout
+	err = p.backend.LockPayouts("batch", totalAmount)
+	if err != nil {
+		Error.Printf("Failed to lock payments of %v Satoshi: %v", totalAmount, err)
+		p.halt = true
+		p.lastFail = err
+		return
+	}
+	Info.Printf("Locked payments of %v Satoshi to %v payees", totalAmount, len(payees))
+
+	// Debit miners' balances and update stats
+	for _, v := range payees {
+		err = p.backend.UpdateBalance(v.login, v.amount)
+		if err != nil {
+			Error.Printf("Failed to update balance for %s, %v Satoshi: %v", v.login, v.amount, err)
+			p.halt = true
+			p.lastFail = err
+			return
+		}
+	}
+
+	if p.config.Mode == PayoutModePSBT {
+		p.createBatch(payees, inputs, conflicts)
+		return
+	}
+
+	txHash, err := p.sendBatch(payees, inputs)
+	if err != nil {
+		Error.Printf("Failed to send payments of %v Satoshi: %v. Check outgoing tx of the pool wallet and docs/PAYOUTS.md",
+			totalAmount, err)
+		p.halt = true
+		p.lastFail = err
+		return
+	}
+
+	// Log transaction hash
+	payments := make(map[string]int64, len(payees))
+	for _, v := range payees {
+		payments[v.login] = v.amount
+	}
+	err = p.backend.WritePayments(txHash, payments)
+	if err != nil {
+		Error.Printf("Failed to log payments of %v Satoshi, tx: %s: %v", totalAmount, txHash, err)
+		p.halt = true
+		p.lastFail = err
+		return
+	}
+	for _, v := range payees {
+		Info.Printf("Paid %v Satoshi to %v, TxHash: %v", v.amount, v.login, txHash)
+	}
+	Info.Printf("Paid total %v Satoshi to %v payees, TxHash: %v", totalAmount, len(payees), txHash)
+
+	// Save redis state to disk
+	if p.config.BgSave {
+		p.bgSave()
+	}
+}
+
+// Payees above the threshold, largest balances first
+func (p *PayoutsProcessor) collectPayees() ([]payee, error) {
+	balances, thresholds, err := p.collectBalances()
+	if err != nil {
+		return nil, err
+	}
+	payees := selectPayees(balances, thresholds, p.maxPayees())
+	if p.config.OutputFee {
+		payees = p.deductOutputFees(payees)
+	}
+	return payees, nil
+}
+
+// Balances and effective thresholds of miners with a valid address
+func (p *PayoutsProcessor) collectBalances() (map[string]int64, map[string]int64, error) {
+	logins, err := p.backend.GetPayees()
+	if err != nil {
+		return nil, nil, err
+	}
+	schedule := p.schedule(time.Time{})
+	balances := make(map[string]int64)
+	thresholds := make(map[string]int64)
+	for _, login := range logins {
+		amount, err := p.backend.GetBalance(login)
+		if err != nil {
+			return nil, nil, err
+		}
+		threshold, err := p.backend.GetPayoutThreshold(login)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !p.coin.IsValidAddress(login) {
+			if amount > 0 {
+				Error.Printf("Unable to pay %v Satoshi to invalid address %v", amount, login)
+			}
+			continue
+		}
+		balances[login] = amount
+		thresholds[login] = schedule.PayeeThreshold(threshold)
+	}
+	return balances, thresholds, nil
+}
+
+func (p *PayoutsProcessor) maxPayees() int {
+	if p.config.MaxPayees > 0 {
+		return p.config.MaxPayees
+	}
+	return defaultMaxPayees
 }
 
-//func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-//	u := &PayoutsProcessor{config: cfg, backend: backend}
-//	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
-//	return u
-//}
-
-//func (p *PayoutsProcessor) Start() {
-//	Info.Println("Starting payouts")
-//
-//	if p.mustResolvePayout() {
-//		Info.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
-//		p.resolvePayouts()
-//		Info.Println("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
-//		return
-//	}
-//
-//	intv := MustParseDuration(p.config.Interval)
-//	timer := time.NewTimer(intv)
-//	Info.Printf("Set payouts interval to %v", intv)
-//
-//	payments := p.backend.GetPendingPayments()
-//	if len(payments) > 0 {
-//		Error.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v", formatPendingPayments(payments))
-//		return
-//	}
-//
-//	locked, err := p.backend.IsPayoutsLocked()
-//	if err != nil {
-//		Error.Println("Unable to start payouts:", err)
-//		return
-//	}
-//	if locked {
-//		Error.Println("Unable to start payouts because they are locked")
-//		return
-//	}
-//
-//	// Immediately process payouts after start
-//	p.process()
-//	timer.Reset(intv)
-//
-//	go func() {
-//		for {
-//			select {
-//			case <-timer.C:
-//				p.process()
-//				timer.Reset(intv)
-//			}
-//		}
-//	}()
-//}
-
-//func (p *PayoutsProcessor) process() {
-//	if p.halt {
-//		Info.Println("Payments suspended due to last critical error:", p.lastFail)
-//		return
-//	}
-//	mustPay := 0
-//	minersPaid := 0
-//	totalAmount := big.NewInt(0)
-//	payees, err := p.backend.GetPayees()
-//	if err != nil {
-//		Error.Println("Error while retrieving payees from backend:", err)
-//		return
-//	}
-//
-//	for _, login := range payees {
-//		amount, _ := p.backend.GetBalance(login)
-//		amountInShannon := big.NewInt(amount)
-//
-//		// Shannon^2 = Wei
-//		amountInWei := new(big.Int).Mul(amountInShannon, Shannon)
-//
-//		if !p.reachedThreshold(amountInShannon) {
-//			continue
-//		}
-//		mustPay++
-//
-//		// Require active peers before processing
-//		if !p.checkPeers() {
-//			break
-//		}
-//		// Require unlocked account
-//		if !p.isUnlockedAccount() {
-//			break
-//		}
-//
-//		// Check if we have enough funds
-//		poolBalance, err := p.rpc.GetBalance(p.config.Address)
-//		if err != nil {
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//		if poolBalance.Cmp(amountInWei) < 0 {
-//			err := fmt.Errorf("Not enough balance for payment, need %s Wei, pool has %s Wei",
-//				amountInWei.String(), poolBalance.String())
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//
-//		// Lock payments for current payout
-//		err = p.backend.LockPayouts(login, amount)
-//		if err != nil {
-//			Error.Printf("Failed to lock payment for %s: %v", login, err)
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//		Info.Printf("Locked payment for %s, %v Shannon", login, amount)
-//
-//		// Debit miner's balance and update stats
-//		err = p.backend.UpdateBalance(login, amount)
-//		if err != nil {
-//			Error.Printf("Failed to update balance for %s, %v Shannon: %v", login, amount, err)
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//
-//		value := hexutil.EncodeBig(amountInWei)
-//		txHash, err := p.rpc.SendTransaction(p.config.Address, login, p.config.GasHex(), p.config.GasPriceHex(), value, p.config.AutoGas)
-//		if err != nil {
-//			Error.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
-//				login, amount, err, login)
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//
-//		// Log transaction hash
-//		err = p.backend.WritePayment(login, txHash, amount)
-//		if err != nil {
-//			Error.Printf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", login, amount, txHash, err)
-//			p.halt = true
-//			p.lastFail = err
-//			break
-//		}
-//
-//		minersPaid++
-//		totalAmount.Add(totalAmount, big.NewInt(amount))
-//		Info.Printf("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
-//
-//		// Wait for TX confirmation before further payouts
-//		for {
-//			Info.Printf("Waiting for tx confirmation: %v", txHash)
-//			time.Sleep(txCheckInterval)
-//			receipt, err := p.rpc.GetTxReceipt(txHash)
-//			if err != nil {
-//				Error.Printf("Failed to get tx receipt for %v: %v", txHash, err)
-//				continue
-//			}
-//			// Tx has been mined
-//			if receipt != nil && receipt.Confirmed() {
-//				if receipt.Successful() {
-//					Info.Printf("Payout tx successful for %s: %s", login, txHash)
-//				} else {
-//					Error.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx.", login, txHash)
-//				}
-//				break
-//			}
-//		}
-//	}
-//
-//	if mustPay > 0 {
-//		Info.Printf("Paid total %v Shannon to %v of %v payees", totalAmount, minersPaid, mustPay)
-//	} else {
-//		Error.Println("No payees that have reached payout threshold")
-//	}
-//
-//	// Save redis state to disk
-//	if minersPaid > 0 && p.config.BgSave {
-//		p.bgSave()
-//	}
-//}
-
-//func (p PayoutsProcessor) isUnlockedAccount() bool {
-//	_, err := p.rpc.Sign(p.config.Address, "0x0")
-//	if err != nil {
-//		Error.Println("Unable to process payouts:", err)
-//		return false
-//	}
-//	return true
-//}
-
-//func (p PayoutsProcessor) checkPeers() bool {
-//	n, err := p.rpc.GetPeerCount()
-//	if err != nil {
-//		Error.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
-//		return false
-//	}
-//	if n < p.config.RequirePeers {
-//		Error.Println("Unable to start payouts, number of peers on a node is less than required", p.config.RequirePeers)
-//		return false
-//	}
-//	return true
-//}
-
-//func (p PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
-//	return big.NewInt(p.config.Threshold).Cmp(amount) < 0
-//}
-//
-//func formatPendingPayments(list []*storage.PendingPayment) string {
-//	var s string
-//	for _, v := range list {
-//		s += fmt.Sprintf("\tAddress: %s, Amount: %v Shannon, %v\n", v.Address, v.Amount, time.Unix(v.Timestamp, 0))
-//	}
-//	return s
-//}
-//
-//func (p PayoutsProcessor) bgSave() {
-//	result, err := p.backend.BgSave()
-//	if err != nil {
-//		Error.Println("Failed to perform BGSAVE on backend:", err)
-//		return
-//	}
-//	Info.Println("Saving backend state to disk:", result)
-//}
-//
-//func (p PayoutsProcessor) resolvePayouts() {
-//	payments := p.backend.GetPendingPayments()
-//
-//	if len(payments) > 0 {
-//		Info.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
-//
-//		for _, v := range payments {
-//			err := p.backend.RollbackBalance(v.Address, v.Amount)
-//			if err != nil {
-//				Error.Printf("Failed to credit %v Shannon back to %s, error is: %v", v.Amount, v.Address, err)
-//				return
-//			}
-//			Info.Printf("Credited %v Shannon back to %s", v.Amount, v.Address)
-//		}
-//		err := p.backend.UnlockPayouts()
-//		if err != nil {
-//			Error.Println("Failed to unlock payouts:", err)
-//			return
-//		}
-//	} else {
-//		Error.Println("No pending payments to resolve")
-//	}
-//
-//	if p.config.BgSave {
-//		p.bgSave()
-//	}
-//	Info.Println("Payouts unlocked")
-//}
-//
-//func (p PayoutsProcessor) mustResolvePayout() bool {
-//	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
-//	return v
-//}
+func selectPayees(balances, thresholds map[string]int64, max int) []payee {
+	var payees []payee
+	for login, amount := range balances {
+		if amount > 0 && amount >= thresholds[login] {
+			payees = append(payees, payee{login: login, amount: amount})
+		}
+	}
+	sort.Slice(payees, func(i, j int) bool {
+		if payees[i].amount != payees[j].amount {
+			return payees[i].amount > payees[j].amount
+		}
+		return payees[i].login < payees[j].login
+	})
+	if len(payees) > max {
+		payees = payees[:max]
+	}
+	return payees
+}
+
+func (p *PayoutsProcessor) checkWallet(amount int64) error {
+	n, err := p.rpc.GetConnectionCount()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve number of peers from node: %v", err)
+	}
+	if n < p.config.RequirePeers {
+		return fmt.Errorf("number of peers on a node is less than required %v", p.config.RequirePeers)
+	}
+	balance, err := p.rpc.GetWalletBalance()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve wallet balance: %v", err)
+	}
+	if balance < amount {
+		return fmt.Errorf("not enough balance for payment, need %v Satoshi, pool has %v Satoshi", amount, balance)
+	}
+	return nil
+}
+
+// Send one transaction paying all the payees, spending at least the inputs if there are any
+func (p *PayoutsProcessor) sendBatch(payees []payee, inputs []rpc.Outpoint) (string, error) {
+	replaceable := p.config.BumpFee == BumpFeeRBF
+	if len(inputs) > 0 {
+		outputs := make([]map[string]int64, len(payees))
+		var subtractFeeFrom []int
+		for i, v := range payees {
+			outputs[i] = map[string]int64{v.login: v.amount - v.fee}
+			if p.config.SubtractFee {
+				subtractFeeFrom = append(subtractFeeFrom, i)
+			}
+		}
+		return p.rpc.Send(outputs, inputs, true, subtractFeeFrom, p.feeRate, replaceable)
+	}
+
+	amounts := make(map[string]int64, len(payees))
+	var subtractFeeFrom []string
+	for _, v := range payees {
+		amounts[v.login] = v.amount - v.fee
+		if p.config.SubtractFee {
+			subtractFeeFrom = append(subtractFeeFrom, v.login)
+		}
+	}
+	return p.rpc.SendMany(amounts, subtractFeeFrom, p.feeRate, replaceable)
+}
+
+// Inputs without duplicates
+func appendInputs(inputs []rpc.Outpoint, more []rpc.Outpoint) []rpc.Outpoint {
+	for _, v := range more {
+		found := false
+		for _, input := range inputs {
+			if input == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			inputs = append(inputs, v)
+		}
+	}
+	return inputs
+}
+
+func (p *PayoutsProcessor) feeTarget() int {
+	if p.config.FeeTarget > 0 {
+		return p.config.FeeTarget
+	}
+	return defaultFeeTarget
+}
+
+func (p *PayoutsProcessor) minThreshold() int64 {
+	if p.config.MinThreshold > 0 {
+		return p.config.MinThreshold
+	}
+	return p.config.Threshold
+}
+
+// Fee rate the batch is sent with, payouts are deferred above the ceiling
+func (p *PayoutsProcessor) estimateFeeRate() error {
+	p.deferred = false
+	feeRate, err := p.rpc.EstimateSmartFee(p.feeTarget())
+	if err != nil {
+		p.feeRate = 0
+		// Both need a fee rate, otherwise the wallet estimates it itself
+		if p.config.MaxFeeRate > 0 || p.config.OutputFee {
+			return fmt.Errorf("failed to estimate fee rate: %v", err)
+		}
+		Error.Println("Failed to estimate fee rate, leaving fees to the wallet:", err)
+		return nil
+	}
+	p.feeRate = feeRate
+	p.deferred = p.config.MaxFeeRate > 0 && feeRate > p.config.MaxFeeRate
+	return nil
+}
+
+// Charge every payee the fee of their own output, payees left with dust wait for a later batch
+func (p *PayoutsProcessor) deductOutputFees(payees []payee) []payee {
+	var result []payee
+	for _, v := range payees {
+		fee, err := p.coin.OutputFee(v.login, p.feeRate)
+		if err != nil {
+			Error.Printf("Unable to pay %v Satoshi to invalid address %v", v.amount, v.login)
+			continue
+		}
+		v.fee = fee
+		if v.amount-v.fee < dustLimit {
+			Info.Printf("Skipping payout of %v Satoshi to %v, output fee is %v Satoshi", v.amount, v.login, v.fee)
+			continue
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+func (p *PayoutsProcessor) schedule(next time.Time) *storage.PayoutSchedule {
+	schedule := &storage.PayoutSchedule{
+		FeeRate:      p.feeRate,
+		MaxFeeRate:   p.config.MaxFeeRate,
+		Deferred:     p.deferred,
+		Threshold:    p.config.Threshold,
+		MinThreshold: p.minThreshold(),
+		OutputFee:    p.config.OutputFee,
+		Updated:      MakeTimestamp() / 1000,
+	}
+	if p.lightning != nil {
+		schedule.LightningMinAmount = p.lightningMinAmount()
+	}
+	if !next.IsZero() {
+		schedule.Next = next.Unix()
+	}
+	return schedule
+}
+
+// Let the API show miners when they are paid next
+func (p *PayoutsProcessor) publishSchedule(next time.Time) {
+	err := p.backend.WritePayoutSchedule(p.schedule(next))
+	if err != nil {
+		Error.Println("Failed to publish payout schedule:", err)
+	}
+}
+
+func formatPendingPayments(list []*storage.PendingPayment) string {
+	var s string
+	for _, v := range list {
+		s += fmt.Sprintf("\tAddress: %s, Amount: %v Satoshi, %v\n", v.Address, v.Amount, time.Unix(v.Timestamp, 0))
+	}
+	return s
+}
+
+func (p *PayoutsProcessor) bgSave() {
+	result, err := p.backend.BgSave()
+	if err != nil {
+		Error.Println("Failed to perform BGSAVE on backend:", err)
+		return
+	}
+	Info.Println("Saving backend state to disk:", result)
+}
+
+func (p *PayoutsProcessor) resolvePayouts() {
+	batch, err := p.backend.GetPayoutBatch()
+	if err != nil {
+		Error.Println("Failed to get payout batch from backend:", err)
+		return
+	}
+	if batch != nil {
+		p.abandonBatch(batch)
+		return
+	}
+	// The node knows whether a Lightning payment went through
+	if !p.resolveLightning() {
+		Error.Println("Unable to resolve the Lightning payment in flight, try again later")
+		return
+	}
+
+	payments := p.backend.GetPendingPayments()
+
+	if len(payments) > 0 {
+		// sendmany may have broadcast the payout although it returned an error
+		txHash, err := p.findPayoutTx(payments)
+		if err != nil {
+			Error.Printf("Unable to tell whether pending payments were sent, resolve them manually: %v", err)
+			return
+		}
+		if len(txHash) > 0 {
+			Info.Printf("Pending payments were sent in tx %s, recording them:\n%s", txHash, formatPendingPayments(payments))
+			amounts := make(map[string]int64, len(payments))
+			for _, v := range payments {
+				amounts[v.Address] += v.Amount
+			}
+			err = p.backend.WritePayments(txHash, amounts)
+			if err != nil {
+				Error.Printf("Failed to log payments of tx %s: %v", txHash, err)
+				return
+			}
+		} else {
+			Info.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
+
+			for _, v := range payments {
+				err := p.backend.RollbackBalance(v.Address, v.Amount)
+				if err != nil {
+					Error.Printf("Failed to credit %v Satoshi back to %s, error is: %v", v.Amount, v.Address, err)
+					return
+				}
+				Info.Printf("Credited %v Satoshi back to %s", v.Amount, v.Address)
+			}
+			err = p.backend.UnlockPayouts()
+			if err != nil {
+				Error.Println("Failed to unlock payouts:", err)
+				return
+			}
+		}
+	} else {
+		Error.Println("No pending payments to resolve")
+	}
+
+	if p.config.BgSave {
+		p.bgSave()
+	}
+	Info.Println("Payouts unlocked")
+}
+
+// Wallet tx paying all the pending payments, empty if the wallet sent none of them. Sends since
+// shortly before the payments were debited count unless their tx is already recorded.
+func (p *PayoutsProcessor) findPayoutTx(payments []*storage.PendingPayment) (string, error) {
+	since := payments[0].Timestamp
+	pending := make(map[string]bool, len(payments))
+	for _, v := range payments {
+		pending[v.Address] = true
+		if v.Timestamp < since {
+			since = v.Timestamp
+		}
+	}
+	entries, err := p.rpc.ListTransactions(payoutTxSearch)
+	if err != nil {
+		return "", fmt.Errorf("failed to list wallet txs: %v", err)
+	}
+	sent := make(map[string]map[string]bool)
+	for _, v := range entries {
+		if v.Category != "send" || v.Abandoned || v.Confirmations < 0 || v.Time < since-payoutTxClockSkew || !pending[v.Address] {
+			continue
+		}
+		if sent[v.TxId] == nil {
+			sent[v.TxId] = make(map[string]bool)
+		}
+		sent[v.TxId][v.Address] = true
+	}
+	var txIds []string
+	for txId := range sent {
+		txIds = append(txIds, txId)
+	}
+	known, err := p.backend.GetPaymentTxs(txIds)
+	if err != nil {
+		return "", err
+	}
+	var partial []string
+	for _, txId := range txIds {
+		if known[txId] != nil {
+			continue
+		}
+		if len(sent[txId]) == len(pending) {
+			return txId, nil
+		}
+		partial = append(partial, txId)
+	}
+	if len(partial) > 0 {
+		return "", fmt.Errorf("wallet txs %v pay only some of the pending payments", partial)
+	}
+	return "", nil
+}
+
+func (p *PayoutsProcessor) reconcileLedger() {
+	drifts, err := p.backend.ReconcileLedger()
+	if err != nil {
+		Error.Println("Failed to reconcile ledger:", err)
+		return
+	}
+	for _, v := range drifts {
+		Error.Printf("Ledger drift of %s: ledger %v Satoshi, balance key %v Satoshi, difference %v Satoshi",
+			v.Account, v.Ledger, v.Actual, v.Actual-v.Ledger)
+	}
+	if len(drifts) == 0 {
+		Info.Println("Ledger matches all balances")
+	} else {
+		Error.Printf("Ledger drifts from %v balances, see docs/PAYOUTS.md", len(drifts))
+	}
+}
+
+func (p *PayoutsProcessor) mustReconcileLedger() bool {
+	v, _ := strconv.ParseBool(os.Getenv("RECONCILE_LEDGER"))
+	return v
+}
+
+func (p *PayoutsProcessor) mustResolvePayout() bool {
+	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
+	return v
+}
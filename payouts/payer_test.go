@@ -0,0 +1,244 @@
+package payouts
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+)
+
+// Stand-in for the wallet RPC of a local bitcoind
+func newWalletStub(t *testing.T, results map[string]interface{}, calls map[string][]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		calls[req.Method] = req.Params
+		result, ok := results[req.Method]
+		if !ok {
+			result = errors.New("Method not found")
+		}
+		if err, ok := result.(error); ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id": 0, "result": nil, "error": map[string]interface{}{"code": -1, "message": err.Error()}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": result, "error": nil})
+	}))
+}
+
+func newTestPayouts(cfg *PayoutsConfig, url string) *PayoutsProcessor {
+	return &PayoutsProcessor{config: cfg, coin: bitcoin.Bitcoin, rpc: rpc.NewRPCClient("PayoutsProcessor", url, "5s")}
+}
+
+func TestSelectPayees(t *testing.T) {
+	balances := map[string]int64{"a": 100, "b": 5000, "c": 3000, "d": 4000, "e": 0}
+	thresholds := map[string]int64{"a": 1000, "b": 1000, "c": 1000, "d": 4500, "e": 1000}
+	payees := selectPayees(balances, thresholds, 2)
+	expected := []payee{{login: "b", amount: 5000}, {login: "c", amount: 3000}}
+	if !reflect.DeepEqual(payees, expected) {
+		t.Errorf("Unexpected payees %v", payees)
+	}
+}
+
+func TestEstimateFeeRate(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"estimatesmartfee": map[string]interface{}{"feerate": 0.0002, "blocks": 6}}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{MaxFeeRate: 25}, server.URL)
+	if err := p.estimateFeeRate(); err != nil || p.feeRate != 20 || p.deferred {
+		t.Fatalf("Unexpected fee rate %v, deferred %v: %v", p.feeRate, p.deferred, err)
+	}
+	if calls["estimatesmartfee"][0] != float64(defaultFeeTarget) {
+		t.Errorf("Unexpected fee target %v", calls["estimatesmartfee"])
+	}
+	p.config.MaxFeeRate = 10
+	if p.estimateFeeRate(); !p.deferred {
+		t.Error("Payouts must be deferred above the fee ceiling")
+	}
+
+	results["estimatesmartfee"] = map[string]interface{}{"errors": []string{"Insufficient data or no feerate found"}, "blocks": 0}
+	if err := p.estimateFeeRate(); err == nil {
+		t.Error("Fee ceiling must require an estimate")
+	}
+	p.config.MaxFeeRate = 0
+	if err := p.estimateFeeRate(); err != nil || p.feeRate != 0 {
+		t.Errorf("Fees must be left to the wallet without estimate, got %v: %v", p.feeRate, err)
+	}
+}
+
+func TestDeductOutputFees(t *testing.T) {
+	p := newTestPayouts(&PayoutsConfig{OutputFee: true}, "")
+	p.feeRate = 10.5
+	payees := []payee{
+		{login: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", amount: 25000000},
+		{login: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", amount: 800},
+	}
+	payees = p.deductOutputFees(payees)
+	// 31 vB p2wpkh output, the p2pkh payee would be left with dust
+	if len(payees) != 1 || payees[0].fee != 326 {
+		t.Errorf("Unexpected payees %v", payees)
+	}
+}
+
+func TestCheckWallet(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"getconnectioncount": 8, "getbalance": 0.5}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{RequirePeers: 5}, server.URL)
+	if err := p.checkWallet(50000000); err != nil {
+		t.Errorf("Wallet must cover the payout: %v", err)
+	}
+	if err := p.checkWallet(50000001); err == nil {
+		t.Error("Payout above the wallet balance must be refused")
+	}
+	p.config.RequirePeers = 10
+	if err := p.checkWallet(1); err == nil {
+		t.Error("Payout must require peers")
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"sendmany": "e670ec64341771606e55d6b4ca35a1a6b75ee3d5145a99d05921026d1527331"}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{SubtractFee: true}, server.URL)
+	payees := []payee{{login: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", amount: 25000000}, {login: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", amount: 1000}}
+	txHash, err := p.sendBatch(payees, nil)
+	if err != nil || txHash != results["sendmany"] {
+		t.Fatalf("Unexpected sendmany result %v: %v", txHash, err)
+	}
+	params := calls["sendmany"]
+	outputs := params[1].(map[string]interface{})
+	if outputs["bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"] != "0.25000000" || outputs["1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"] != "0.00001000" {
+		t.Errorf("Unexpected sendmany outputs %v", outputs)
+	}
+	if len(params[4].([]interface{})) != 2 {
+		t.Errorf("Fee must be subtracted from every payee, got %v", params[4])
+	}
+}
+
+func TestSendBatchInputs(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"send": map[string]interface{}{"txid": "aa", "complete": true}}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{BumpFee: BumpFeeRBF}, server.URL)
+	p.feeRate = 12
+	payees := []payee{{login: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", amount: 25000000}}
+	txHash, err := p.sendBatch(payees, []rpc.Outpoint{{TxId: "bb", Vout: 1}})
+	if err != nil || txHash != "aa" {
+		t.Fatalf("Unexpected send result %v: %v", txHash, err)
+	}
+	options := calls["send"][4].(map[string]interface{})
+	if len(options["inputs"].([]interface{})) != 1 || options["fee_rate"] != float64(12) || options["replaceable"] != true {
+		t.Errorf("Unexpected send options %v", options)
+	}
+}
+
+func TestWalletUrl(t *testing.T) {
+	cfg := &PayoutsConfig{Daemon: "http://a:b@127.0.0.1:8332/"}
+	if cfg.WalletUrl() != "http://a:b@127.0.0.1:8332/" {
+		t.Error("Default wallet must use the node url")
+	}
+	cfg.Wallet = "pool"
+	if cfg.WalletUrl() != "http://a:b@127.0.0.1:8332/wallet/pool" {
+		t.Errorf("Unexpected wallet url %v", cfg.WalletUrl())
+	}
+}
+
+func lockTestPayout(t *testing.T, backend storage.Backend, login string, amount int64) {
+	backend.AdjustBalance(login, amount, "test")
+	if err := backend.LockPayouts("batch", amount); err != nil {
+		t.Fatal(err)
+	}
+	backend.UpdateBalance(login, amount)
+}
+
+func TestResolveBroadcastPayout(t *testing.T) {
+	login := "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+	calls := make(map[string][]interface{})
+	// sendmany timed out after the wallet broadcast the payout
+	results := map[string]interface{}{"listtransactions": []interface{}{
+		map[string]interface{}{"txid": "aa", "address": login, "category": "send", "amount": -0.0005,
+			"confirmations": 0, "time": time.Now().Unix()},
+	}}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	backend := storage.NewMemoryBackend()
+	lockTestPayout(t, backend, login, 50000)
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	p.backend = backend
+	p.resolvePayouts()
+
+	if balance, _ := backend.GetBalance(login); balance != 0 {
+		t.Errorf("Broadcast payout must not be credited back, balance %v", balance)
+	}
+	if txs, _ := backend.GetPaymentTxs([]string{"aa"}); txs["aa"] == nil || txs["aa"].Payments[login] != 50000 {
+		t.Errorf("Broadcast payout must be recorded, got %v", txs)
+	}
+	if locked, _ := backend.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked")
+	}
+}
+
+func TestResolveUnsentPayout(t *testing.T) {
+	login := "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+	calls := make(map[string][]interface{})
+	// An earlier payout to the same miner is already recorded
+	results := map[string]interface{}{"listtransactions": []interface{}{
+		map[string]interface{}{"txid": "bb", "address": login, "category": "send", "amount": -0.0005,
+			"confirmations": 3, "time": time.Now().Unix()},
+	}}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	backend := storage.NewMemoryBackend()
+	backend.WritePayments("bb", map[string]int64{login: 0})
+	lockTestPayout(t, backend, login, 50000)
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	p.backend = backend
+	p.resolvePayouts()
+
+	if balance, _ := backend.GetBalance(login); balance != 50000 {
+		t.Errorf("Unsent payout must be credited back, balance %v", balance)
+	}
+	if locked, _ := backend.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked")
+	}
+}
+
+func TestResolvePayoutWalletError(t *testing.T) {
+	login := "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+	server := newWalletStub(t, map[string]interface{}{}, make(map[string][]interface{}))
+	defer server.Close()
+
+	backend := storage.NewMemoryBackend()
+	lockTestPayout(t, backend, login, 50000)
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	p.backend = backend
+	p.resolvePayouts()
+
+	if balance, _ := backend.GetBalance(login); balance != 0 {
+		t.Errorf("Payout must stay pending while the wallet can't be checked, balance %v", balance)
+	}
+}
@@ -0,0 +1,376 @@
+package payouts
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+func (p *PayoutsProcessor) psbtPollInterval() time.Duration {
+	if len(p.config.PSBTPollInterval) > 0 {
+		return MustParseDuration(p.config.PSBTPollInterval)
+	}
+	return MustParseDuration(defaultPSBTPollInterval)
+}
+
+// One unspent input of every abandoned batch, spending it makes the abandoned batch invalid
+func (p *PayoutsProcessor) conflictInputs() ([]string, []rpc.Outpoint, error) {
+	abandoned, err := p.backend.GetAbandonedBatches()
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids []string
+	var inputs []rpc.Outpoint
+	for id, outpoints := range abandoned {
+		found := false
+		for _, v := range outpoints {
+			outpoint, err := parseOutpoint(v)
+			if err != nil {
+				return nil, nil, err
+			}
+			unspent, err := p.rpc.IsUnspent(outpoint.TxId, outpoint.Vout)
+			if err != nil {
+				return nil, nil, err
+			}
+			if unspent {
+				ids = append(ids, id)
+				inputs = append(inputs, outpoint)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("inputs of abandoned payout batch %s are spent, check whether it was broadcast", id)
+		}
+	}
+	return ids, inputs, nil
+}
+
+// Fund an unsigned PSBT for the locked and debited payees and export it for signing
+func (p *PayoutsProcessor) createBatch(payees []payee, inputs []rpc.Outpoint, conflicts []string) {
+	batch, err := p.fundBatch(payees, inputs)
+	if err == nil {
+		batch.Conflicts = conflicts
+		err = p.backend.WritePayoutBatch(batch)
+		if err != nil {
+			p.unlockInputs(batch)
+		}
+	}
+	if err != nil {
+		// Nothing left the wallet, credit the balances back
+		Error.Printf("Failed to create payout batch: %v", err)
+		for _, v := range payees {
+			err := p.backend.RollbackBalance(v.login, v.amount)
+			if err != nil {
+				Error.Printf("Failed to credit %v Satoshi back to %s: %v", v.amount, v.login, err)
+				p.halt = true
+				p.lastFail = err
+				return
+			}
+		}
+		err = p.backend.UnlockPayouts()
+		if err != nil {
+			Error.Println("Failed to unlock payouts:", err)
+			p.halt = true
+			p.lastFail = err
+		}
+		return
+	}
+
+	err = p.exportBatch(batch)
+	if err != nil {
+		Error.Printf("Failed to export payout batch %s: %v", batch.Id, err)
+	}
+	Info.Printf("Payout batch %s of %v payees waits for signature, tx %s, fee %v Satoshi",
+		batch.Id, len(batch.Payments), batch.TxId, batch.Fee)
+}
+
+func (p *PayoutsProcessor) fundBatch(payees []payee, inputs []rpc.Outpoint) (*storage.PayoutBatch, error) {
+	outputs := make([]map[string]int64, len(payees))
+	payments := make(map[string]int64, len(payees))
+	var subtractFeeFrom []int
+	for i, v := range payees {
+		outputs[i] = map[string]int64{v.login: v.amount - v.fee}
+		payments[v.login] = v.amount
+		if p.config.SubtractFee {
+			subtractFeeFrom = append(subtractFeeFrom, i)
+		}
+	}
+	funded, err := p.rpc.WalletCreateFundedPsbt(inputs, outputs, subtractFeeFrom, p.feeRate, p.config.BumpFee == BumpFeeRBF)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := p.rpc.DecodePsbt(funded.Psbt)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := MakeTimestamp() / 1000
+	batch := &storage.PayoutBatch{
+		Id:       strconv.FormatInt(ts, 10) + "-" + decoded.Tx.TxId[:8],
+		Psbt:     funded.Psbt,
+		TxId:     decoded.Tx.TxId,
+		Payments: payments,
+		Fee:      BTCToSatoshi(funded.Fee),
+		Created:  ts,
+	}
+	for _, vin := range decoded.Tx.Vin {
+		batch.Inputs = append(batch.Inputs, formatOutpoint(vin.PrevOutHash, vin.PrevOutN))
+	}
+	return batch, nil
+}
+
+// Broadcast the pending batch once its signed PSBT was submitted through the API or the export directory
+func (p *PayoutsProcessor) processBatch() {
+	if p.halt {
+		Info.Println("Payments suspended due to last critical error:", p.lastFail)
+		return
+	}
+	batch, err := p.backend.GetPayoutBatch()
+	if err != nil {
+		Error.Println("Error while retrieving payout batch from backend:", err)
+		return
+	}
+	if batch == nil {
+		return
+	}
+
+	signed := batch.SignedPsbt
+	if len(signed) == 0 {
+		signed, err = p.importBatch(batch)
+		if err != nil {
+			Error.Printf("Failed to import signed payout batch %s: %v", batch.Id, err)
+		}
+	}
+	txHash := ""
+	if len(signed) > 0 {
+		txHash, err = p.broadcastBatch(batch, signed)
+		if invalid, ok := err.(*invalidPsbtError); ok {
+			p.failBatch(batch, invalid)
+			return
+		} else if err != nil {
+			Error.Printf("Failed to broadcast payout batch %s: %v", batch.Id, err)
+			return
+		}
+	} else {
+		// The signer may have broadcast it
+		wtx, err := p.rpc.GetWalletTransaction(batch.TxId)
+		if err != nil {
+			Error.Printf("Failed to look up tx %s of payout batch %s: %v", batch.TxId, batch.Id, err)
+			return
+		}
+		if wtx == nil {
+			Info.Printf("Payout batch %s waits for signature", batch.Id)
+			return
+		}
+		txHash = wtx.TxId
+	}
+
+	err = p.backend.CompletePayoutBatch(txHash, batch)
+	if err != nil {
+		Error.Printf("Failed to log payments of batch %s, tx: %s: %v", batch.Id, txHash, err)
+		p.halt = true
+		p.lastFail = err
+		return
+	}
+	p.removeBatchFiles(batch)
+	for login, amount := range batch.Payments {
+		Info.Printf("Paid %v Satoshi to %v, TxHash: %v", amount, login, txHash)
+	}
+	Info.Printf("Paid payout batch %s to %v payees, TxHash: %v", batch.Id, len(batch.Payments), txHash)
+
+	if p.config.BgSave {
+		p.bgSave()
+	}
+}
+
+// Signed PSBT the node refused, submitting it again can't succeed
+type invalidPsbtError struct {
+	err error
+}
+
+func (e *invalidPsbtError) Error() string {
+	return e.err.Error()
+}
+
+// Errors the node answered with are about the PSBT, others are retried
+func rejectedPsbt(err error) error {
+	if _, ok := err.(*rpc.RPCError); ok {
+		return &invalidPsbtError{err}
+	}
+	return err
+}
+
+// Finalize and broadcast a signed PSBT of the batch, broadcasting it again is harmless
+func (p *PayoutsProcessor) broadcastBatch(batch *storage.PayoutBatch, signed string) (string, error) {
+	decoded, err := p.rpc.DecodePsbt(signed)
+	if err != nil {
+		return "", rejectedPsbt(err)
+	}
+	if decoded.Tx.TxId != batch.TxId {
+		return "", &invalidPsbtError{fmt.Errorf("signed PSBT is for tx %s, not %s", decoded.Tx.TxId, batch.TxId)}
+	}
+	finalized, err := p.rpc.FinalizePsbt(signed)
+	if err != nil {
+		return "", rejectedPsbt(err)
+	}
+	if !finalized.Complete {
+		return "", &invalidPsbtError{errors.New("signed PSBT is incomplete")}
+	}
+	tx, err := p.rpc.DecodeRawTransaction(finalized.Hex)
+	if err != nil {
+		return "", rejectedPsbt(err)
+	}
+	wtx, err := p.rpc.GetWalletTransaction(tx.TxId)
+	if err != nil {
+		return "", err
+	}
+	if wtx != nil {
+		return wtx.TxId, nil
+	}
+	txHash, err := p.rpc.SendRawTransaction(finalized.Hex)
+	if err != nil {
+		return "", rejectedPsbt(err)
+	}
+	return txHash, nil
+}
+
+// Drop a signed PSBT that can't be broadcast, the batch waits for a new signature or to be abandoned
+func (p *PayoutsProcessor) failBatch(batch *storage.PayoutBatch, invalid *invalidPsbtError) {
+	RaiseAlert("payout batch", "Signed PSBT of payout batch %s failed: %v. Sign it again or abandon the batch",
+		batch.Id, invalid)
+	if len(p.config.PSBTDir) > 0 {
+		err := os.Rename(p.batchFile(batch, true), filepath.Join(p.config.PSBTDir, batch.Id+".failed.psbt"))
+		if err != nil && !os.IsNotExist(err) {
+			Error.Printf("Failed to move signed PSBT of payout batch %s aside: %v", batch.Id, err)
+		}
+	}
+	err := p.backend.FailSignedPsbt(batch.Id, invalid.Error())
+	if err != nil {
+		Error.Printf("Failed to mark signed PSBT of payout batch %s failed: %v", batch.Id, err)
+	}
+}
+
+// Give up a batch that was never broadcast, only possible while none of its inputs is spent
+func (p *PayoutsProcessor) abandonBatch(batch *storage.PayoutBatch) {
+	wtx, err := p.rpc.GetWalletTransaction(batch.TxId)
+	if err != nil {
+		Error.Printf("Failed to look up tx %s of payout batch %s: %v", batch.TxId, batch.Id, err)
+		return
+	}
+	if wtx != nil {
+		Info.Printf("Payout batch %s was broadcast in tx %s, recording its payments", batch.Id, wtx.TxId)
+		err = p.backend.CompletePayoutBatch(wtx.TxId, batch)
+		if err != nil {
+			Error.Printf("Failed to log payments of batch %s: %v", batch.Id, err)
+		}
+		return
+	}
+	for _, v := range batch.Inputs {
+		outpoint, err := parseOutpoint(v)
+		if err != nil {
+			Error.Printf("Invalid input %s of payout batch %s", v, batch.Id)
+			return
+		}
+		unspent, err := p.rpc.IsUnspent(outpoint.TxId, outpoint.Vout)
+		if err != nil {
+			Error.Printf("Failed to check input %s of payout batch %s: %v", v, batch.Id, err)
+			return
+		}
+		if !unspent {
+			Error.Printf("Unable to abandon payout batch %s, its input %s is spent. Find the spending tx and resolve it manually", batch.Id, v)
+			return
+		}
+	}
+
+	Info.Printf("Will abandon payout batch %s and credit back following balances:", batch.Id)
+	for login, amount := range batch.Payments {
+		Info.Printf("\tAddress: %s, Amount: %v Satoshi", login, amount)
+	}
+	p.unlockInputs(batch)
+	err = p.backend.AbandonPayoutBatch(batch)
+	if err != nil {
+		Error.Printf("Failed to abandon payout batch %s: %v", batch.Id, err)
+		return
+	}
+	p.removeBatchFiles(batch)
+	if p.config.BgSave {
+		p.bgSave()
+	}
+	Info.Printf("Payout batch %s abandoned, the next batch will conflict with it", batch.Id)
+}
+
+func (p *PayoutsProcessor) unlockInputs(batch *storage.PayoutBatch) {
+	var outpoints []rpc.Outpoint
+	for _, v := range batch.Inputs {
+		outpoint, err := parseOutpoint(v)
+		if err == nil {
+			outpoints = append(outpoints, outpoint)
+		}
+	}
+	err := p.rpc.LockUnspent(true, outpoints)
+	if err != nil {
+		Error.Printf("Failed to unlock inputs of payout batch %s: %v", batch.Id, err)
+	}
+}
+
+func (p *PayoutsProcessor) batchFile(batch *storage.PayoutBatch, signed bool) string {
+	name := batch.Id + ".psbt"
+	if signed {
+		name = batch.Id + ".signed.psbt"
+	}
+	return filepath.Join(p.config.PSBTDir, name)
+}
+
+func (p *PayoutsProcessor) exportBatch(batch *storage.PayoutBatch) error {
+	if len(p.config.PSBTDir) == 0 {
+		return nil
+	}
+	return ioutil.WriteFile(p.batchFile(batch, false), []byte(batch.Psbt+"\n"), 0600)
+}
+
+// Signed PSBT dropped next to the exported one, empty if there is none yet
+func (p *PayoutsProcessor) importBatch(batch *storage.PayoutBatch) (string, error) {
+	if len(p.config.PSBTDir) == 0 {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(p.batchFile(batch, true))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+func (p *PayoutsProcessor) removeBatchFiles(batch *storage.PayoutBatch) {
+	if len(p.config.PSBTDir) == 0 {
+		return
+	}
+	os.Remove(p.batchFile(batch, false))
+	os.Remove(p.batchFile(batch, true))
+	os.Remove(filepath.Join(p.config.PSBTDir, batch.Id+".failed.psbt"))
+}
+
+func formatOutpoint(txId string, vout uint32) string {
+	return txId + ":" + strconv.FormatUint(uint64(vout), 10)
+}
+
+func parseOutpoint(s string) (rpc.Outpoint, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return rpc.Outpoint{}, errors.New("invalid outpoint " + s)
+	}
+	vout, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil {
+		return rpc.Outpoint{}, err
+	}
+	return rpc.Outpoint{TxId: s[:i], Vout: uint32(vout)}, nil
+}
@@ -0,0 +1,168 @@
+package payouts
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+)
+
+const testBatchTxId = "e670ec64341771606e55d6b4ca35a1a6b75ee3d5145a99d05921026d1527331f"
+
+func TestFundBatch(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{
+		"walletcreatefundedpsbt": map[string]interface{}{"psbt": "cHNidP8B", "fee": 0.00012345, "changepos": 2},
+		"decodepsbt": map[string]interface{}{"tx": map[string]interface{}{
+			"txid": testBatchTxId,
+			"vin":  []interface{}{map[string]interface{}{"txid": "aa", "vout": 1}, map[string]interface{}{"txid": "bb", "vout": 0}},
+		}},
+	}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{SubtractFee: true}, server.URL)
+	payees := []payee{{login: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", amount: 25000000}, {login: "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", amount: 1000}}
+	batch, err := p.fundBatch(payees, []rpc.Outpoint{{TxId: "bb", Vout: 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.TxId != testBatchTxId || batch.Fee != 12345 || len(batch.Payments) != 2 {
+		t.Errorf("Unexpected batch %+v", batch)
+	}
+	if len(batch.Inputs) != 2 || batch.Inputs[0] != "aa:1" || batch.Inputs[1] != "bb:0" {
+		t.Errorf("Unexpected batch inputs %v", batch.Inputs)
+	}
+
+	params := calls["walletcreatefundedpsbt"]
+	if len(params[0].([]interface{})) != 1 {
+		t.Errorf("Must spend the conflicting input, got %v", params[0])
+	}
+	outputs := params[1].([]interface{})
+	if outputs[0].(map[string]interface{})["bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"] != "0.25000000" {
+		t.Errorf("Outputs must keep payee order, got %v", outputs)
+	}
+	options := params[3].(map[string]interface{})
+	if len(options["subtractFeeFromOutputs"].([]interface{})) != 2 || options["lockUnspents"] != true {
+		t.Errorf("Unexpected funding options %v", options)
+	}
+}
+
+func TestBroadcastBatch(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{
+		"decodepsbt":           map[string]interface{}{"tx": map[string]interface{}{"txid": testBatchTxId}},
+		"finalizepsbt":         map[string]interface{}{"hex": "0200", "complete": true},
+		"decoderawtransaction": map[string]interface{}{"txid": testBatchTxId},
+		"gettransaction":       errors.New("Invalid or non-wallet transaction id"),
+		"sendrawtransaction":   testBatchTxId,
+	}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	batch := &storage.PayoutBatch{Id: "1-e670ec64", TxId: testBatchTxId}
+	txHash, err := p.broadcastBatch(batch, "signed")
+	if err != nil || txHash != testBatchTxId {
+		t.Fatalf("Unexpected broadcast result %v: %v", txHash, err)
+	}
+	if calls["sendrawtransaction"][0] != "0200" {
+		t.Errorf("Must broadcast the finalized tx, got %v", calls["sendrawtransaction"])
+	}
+
+	// Already broadcast by the signer
+	delete(calls, "sendrawtransaction")
+	results["gettransaction"] = map[string]interface{}{"txid": testBatchTxId, "confirmations": 0}
+	txHash, err = p.broadcastBatch(batch, "signed")
+	if err != nil || txHash != testBatchTxId {
+		t.Fatalf("Unexpected broadcast result %v: %v", txHash, err)
+	}
+	if _, ok := calls["sendrawtransaction"]; ok {
+		t.Error("Must not broadcast a known tx again")
+	}
+
+	results["finalizepsbt"] = map[string]interface{}{"psbt": "cHNidP8B", "complete": false}
+	if _, err = p.broadcastBatch(batch, "signed"); !isInvalidPsbt(err) {
+		t.Errorf("Must reject an incomplete signature, got %v", err)
+	}
+	results["finalizepsbt"] = errors.New("TX decode failed")
+	if _, err = p.broadcastBatch(batch, "signed"); !isInvalidPsbt(err) {
+		t.Errorf("Must reject a PSBT the node can't finalize, got %v", err)
+	}
+	batch.TxId = "00"
+	if _, err = p.broadcastBatch(batch, "signed"); !isInvalidPsbt(err) {
+		t.Errorf("Must reject a PSBT of another tx, got %v", err)
+	}
+	server.Close()
+	if _, err = p.broadcastBatch(batch, "signed"); err == nil || isInvalidPsbt(err) {
+		t.Errorf("Unreachable node must be retried, got %v", err)
+	}
+}
+
+func isInvalidPsbt(err error) bool {
+	_, ok := err.(*invalidPsbtError)
+	return ok
+}
+
+func TestProcessBatchInvalid(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{
+		"decodepsbt":   map[string]interface{}{"tx": map[string]interface{}{"txid": testBatchTxId}},
+		"finalizepsbt": map[string]interface{}{"psbt": "cHNidP8B", "complete": false},
+	}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	p.backend = storage.NewMemoryBackend()
+	p.backend.WritePayoutBatch(&storage.PayoutBatch{Id: "1-e670ec64", TxId: testBatchTxId, Payments: map[string]int64{"a": 1000}})
+	p.backend.SubmitSignedPsbt("1-e670ec64", "signed")
+
+	p.processBatch()
+	batch, _ := p.backend.GetPayoutBatch()
+	if batch == nil || batch.SignedPsbt != "" || batch.Failed != "signed PSBT is incomplete" {
+		t.Fatalf("Batch must wait for a new signature, got %+v", batch)
+	}
+	if p.halt {
+		t.Error("Invalid PSBT must not halt payouts")
+	}
+}
+
+func TestImportBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "psbt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestPayouts(&PayoutsConfig{PSBTDir: dir}, "")
+	batch := &storage.PayoutBatch{Id: "1-e670ec64", Psbt: "cHNidP8B"}
+	if err := p.exportBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if signed, err := p.importBatch(batch); err != nil || signed != "" {
+		t.Errorf("Unsigned batch must not be imported, got %v: %v", signed, err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "1-e670ec64.signed.psbt"), []byte("cHNidP8Bsigned\n"), 0600)
+	if signed, _ := p.importBatch(batch); signed != "cHNidP8Bsigned" {
+		t.Errorf("Unexpected signed PSBT %v", signed)
+	}
+	p.removeBatchFiles(batch)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Must remove batch files, got %v", len(files))
+	}
+}
+
+func TestParseOutpoint(t *testing.T) {
+	outpoint, err := parseOutpoint(formatOutpoint(testBatchTxId, 7))
+	if err != nil || outpoint.TxId != testBatchTxId || outpoint.Vout != 7 {
+		t.Errorf("Unexpected outpoint %v: %v", outpoint, err)
+	}
+	if _, err = parseOutpoint("aa"); err == nil {
+		t.Error("Must reject outpoint without vout")
+	}
+}
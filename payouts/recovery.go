@@ -0,0 +1,252 @@
+package payouts
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Commands of the unlocker CLI, rounds are given as height:hash the way the unlocker logs them
+const (
+	UnlockerDryRun    = "dry-run"
+	UnlockerResume    = "resume"
+	UnlockerOrphan    = "orphan"
+	UnlockerRecredit  = "recredit"
+	UnlockerRecompute = "recompute"
+)
+
+func (u *BlockUnlocker) RunCommand(w io.Writer, command, round string) error {
+	switch command {
+	case UnlockerDryRun:
+		return u.DryRun(w)
+	case UnlockerResume:
+		return u.Resume(w)
+	case UnlockerOrphan, UnlockerRecredit, UnlockerRecompute:
+		if len(round) == 0 {
+			return fmt.Errorf("%s needs a round", command)
+		}
+		block, err := u.findRound(round)
+		if err != nil {
+			return err
+		}
+		switch command {
+		case UnlockerOrphan:
+			return u.ForceOrphan(w, block)
+		case UnlockerRecredit:
+			return u.Recredit(w, block)
+		default:
+			return u.Recompute(w, block)
+		}
+	}
+	return fmt.Errorf("unknown unlocker command %q", command)
+}
+
+// Both unlocker passes as they would run now, nothing is written
+func (u *BlockUnlocker) DryRun(w io.Writer) error {
+	u.dryRun = true
+	defer func() { u.dryRun = false }()
+
+	current, err := u.rpc.GetPendingBlockWithRules(u.coin.TemplateRules)
+	if err != nil {
+		return err
+	}
+	currentHeight := int64(current.Height - 1)
+	fmt.Fprintf(w, "Current height %v, scheme %s, pool fee %v%%\n", currentHeight, u.config.Scheme, u.config.PoolFee)
+	if reason, err := u.backend.GetUnlockerHalt(); err == nil && len(reason) > 0 {
+		fmt.Fprintf(w, "Unlocker halted: %s\n", reason)
+	}
+
+	candidates, err := u.backend.GetCandidates(currentHeight - u.config.ImmatureDepth)
+	if err != nil {
+		return err
+	}
+	err = u.dryRunPass(w, "IMMATURE", candidates, false)
+	if err != nil {
+		return err
+	}
+	immature, err := u.backend.GetImmatureBlocks(currentHeight - u.config.Depth)
+	if err != nil {
+		return err
+	}
+	return u.dryRunPass(w, "MATURED", immature, true)
+}
+
+func (u *BlockUnlocker) dryRunPass(w io.Writer, label string, blocks []*storage.BlockData, coinBaseMaturity bool) error {
+	if len(blocks) == 0 {
+		fmt.Fprintf(w, "%s: no blocks\n", label)
+		return nil
+	}
+	result, err := u.unlockCandidates(blocks, coinBaseMaturity)
+	if err != nil {
+		return err
+	}
+	for _, block := range result.orphanedBlocks {
+		fmt.Fprintf(w, "ORPHAN %v: not on the main chain\n", block.RoundKey())
+	}
+	if result.immature > 0 {
+		fmt.Fprintf(w, "%s: %v blocks with coinbase not spendable yet\n", label, result.immature)
+	}
+	if result.unknown > 0 {
+		fmt.Fprintf(w, "%s: %v blocks unknown to the node\n", label, result.unknown)
+	}
+	for _, block := range result.maturedBlocks {
+		revenue, minersProfit, poolProfit, rewards, err := u.calculateRewards(block)
+		if err != nil {
+			return fmt.Errorf("round %v: %v", block.RoundKey(), err)
+		}
+		fmt.Fprintf(w, "%s %v: revenue %v, miners profit %v, pool profit: %v\n", label, block.RoundKey(),
+			FormatRatReward(revenue), FormatRatReward(minersProfit), FormatRatReward(poolProfit))
+		writeRewards(w, rewards, nil)
+	}
+	return nil
+}
+
+// Clear the halt, a running unlocker resumes on its next run
+func (u *BlockUnlocker) Resume(w io.Writer) error {
+	reason, err := u.backend.GetUnlockerHalt()
+	if err != nil {
+		return err
+	}
+	if len(reason) == 0 {
+		fmt.Fprintln(w, "Unlocker is not halted")
+		return nil
+	}
+	if _, err = u.backend.ClearUnlockerHalt(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Cleared unlocker halt: %s\n", reason)
+	return nil
+}
+
+// Orphan a block whatever the node says, credits of matured blocks are taken back
+func (u *BlockUnlocker) ForceOrphan(w io.Writer, block *storage.BlockData) error {
+	switch {
+	case block.State == storage.BlockOrphaned && !block.Pending():
+		return fmt.Errorf("block %v is orphaned already", block.RoundKey())
+	case block.State == storage.BlockCandidate:
+		err := u.backend.WritePendingOrphans([]*storage.BlockData{block})
+		if err != nil {
+			return err
+		}
+	case block.Pending():
+		err := u.backend.WriteOrphan(block)
+		if err != nil {
+			return err
+		}
+	default:
+		total, err := u.backend.WriteReorg(block)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Took back %v Satoshi from miner balances\n", total)
+	}
+	Info.Printf("Block %v orphaned by command", block.RoundKey())
+	fmt.Fprintf(w, "Orphaned block %v\n", block.RoundKey())
+	return nil
+}
+
+// Move a candidate or immature block back to the candidates, the unlocker checks and credits it on its next run
+func (u *BlockUnlocker) Recredit(w io.Writer, block *storage.BlockData) error {
+	if !block.Pending() {
+		return fmt.Errorf("block %v is %s, its round shares are gone", block.RoundKey(), block.State)
+	}
+	err := u.backend.RequeueBlock(block)
+	if err != nil {
+		return err
+	}
+	Info.Printf("Block %v requeued by command", block.RoundKey())
+	fmt.Fprintf(w, "Block %v is a candidate again, immature credits were taken back\n", block.RoundKey())
+	return nil
+}
+
+// Calculate the rewards of a round again and compare them with its immature credits, nothing is written
+func (u *BlockUnlocker) Recompute(w io.Writer, block *storage.BlockData) error {
+	if !block.Pending() {
+		return fmt.Errorf("block %v is %s, its round shares are gone", block.RoundKey(), block.State)
+	}
+	chainBlock, err := u.mainChainBlock(block)
+	if err != nil {
+		return err
+	}
+	if chainBlock == nil {
+		return fmt.Errorf("block %v is not on the main chain", block.RoundKey())
+	}
+	if err = u.handleBlock(chainBlock, block); err != nil {
+		return err
+	}
+	revenue, minersProfit, poolProfit, rewards, err := u.calculateRewards(block)
+	if err != nil {
+		return err
+	}
+	credits, err := u.backend.GetImmatureCredits(block)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "ROUND %v (%s): revenue %v, miners profit %v, pool profit: %v\n", block.RoundKey(), block.State,
+		FormatRatReward(revenue), FormatRatReward(minersProfit), FormatRatReward(poolProfit))
+	writeRewards(w, rewards, credits)
+	return nil
+}
+
+func (u *BlockUnlocker) findRound(round string) (*storage.BlockData, error) {
+	i := strings.Index(round, ":")
+	if i < 0 {
+		return nil, errors.New("round must be height:hash")
+	}
+	height, err := strconv.ParseInt(round[:i], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid round height: %v", err)
+	}
+	hash := round[i+1:]
+	blocks, err := u.backend.GetBlocksAt(height)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		// Legacy blocks without hash are named by their nonce
+		if strings.EqualFold(block.Hash, hash) || (len(block.Hash) == 0 && strings.EqualFold(block.Nonce, hash)) {
+			return block, nil
+		}
+	}
+	return nil, fmt.Errorf("no block %v", round)
+}
+
+// Rewards by login, with the credits of the round next to them if there are any
+func writeRewards(w io.Writer, rewards map[string]int64, credits map[string]int64) {
+	logins := make([]string, 0, len(rewards))
+	for login := range rewards {
+		logins = append(logins, login)
+	}
+	for login := range credits {
+		if _, ok := rewards[login]; !ok {
+			logins = append(logins, login)
+		}
+	}
+	sort.Strings(logins)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	if credits == nil {
+		fmt.Fprintln(tw, "\tLOGIN\tREWARD\t")
+		for _, login := range logins {
+			fmt.Fprintf(tw, "\t%s\t%v\t\n", login, rewards[login])
+		}
+	} else {
+		fmt.Fprintln(tw, "\tLOGIN\tREWARD\tCREDITED\tDIFF\t")
+		for _, login := range logins {
+			fmt.Fprintf(tw, "\t%s\t%v\t%v\t%v\t\n", login, rewards[login], credits[login], rewards[login]-credits[login])
+		}
+	}
+	total := int64(0)
+	for _, v := range rewards {
+		total += v
+	}
+	fmt.Fprintf(tw, "\tTOTAL\t%v\t\n", total)
+	tw.Flush()
+}
@@ -0,0 +1,69 @@
+package payouts
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/PowPool/btcpool/storage"
+)
+
+func TestWriteRewards(t *testing.T) {
+	var buf bytes.Buffer
+	writeRewards(&buf, map[string]int64{"b": 300, "a": 1200}, map[string]int64{"a": 1000, "c": 50})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := [][]string{
+		{"LOGIN", "REWARD", "CREDITED", "DIFF"},
+		{"a", "1200", "1000", "200"},
+		{"b", "300", "0", "300"},
+		{"c", "0", "50", "-50"},
+		{"TOTAL", "1500"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Unexpected rewards table:\n%s", buf.String())
+	}
+	for i, fields := range expected {
+		if strings.Join(strings.Fields(lines[i]), " ") != strings.Join(fields, " ") {
+			t.Errorf("Line %v is %q, expected %v", i, lines[i], fields)
+		}
+	}
+}
+
+func TestFindRoundInvalid(t *testing.T) {
+	u := &BlockUnlocker{}
+	for _, round := range []string{"", "100", "abc:00ff"} {
+		if _, err := u.findRound(round); err == nil {
+			t.Errorf("Round %q must be rejected", round)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	u := &BlockUnlocker{backend: backend}
+	backend.SetUnlockerHalt("reward mismatch")
+
+	var buf bytes.Buffer
+	if err := u.Resume(&buf); err != nil || !strings.Contains(buf.String(), "reward mismatch") {
+		t.Fatalf("Unexpected resume %q: %v", buf.String(), err)
+	}
+	if reason, _ := backend.GetUnlockerHalt(); reason != "" {
+		t.Errorf("Halt must be cleared, got %q", reason)
+	}
+	buf.Reset()
+	u.Resume(&buf)
+	if !strings.Contains(buf.String(), "not halted") {
+		t.Errorf("Unexpected resume %q", buf.String())
+	}
+}
+
+func TestDryRunSuspend(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	u := &BlockUnlocker{backend: backend, dryRun: true}
+	u.suspend(errors.New("reward mismatch"))
+	if reason, _ := backend.GetUnlockerHalt(); u.halt || reason != "" {
+		t.Errorf("Dry run must not halt the unlocker, got %q", reason)
+	}
+}
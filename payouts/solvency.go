@@ -0,0 +1,73 @@
+package payouts
+
+import (
+	"time"
+
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+const defaultSolvencyInterval = "10m"
+
+func (p *PayoutsProcessor) solvencyInterval() time.Duration {
+	if len(p.config.SolvencyInterval) > 0 {
+		return MustParseDuration(p.config.SolvencyInterval)
+	}
+	return MustParseDuration(defaultSolvencyInterval)
+}
+
+// Compare the pool wallet with what the pool owes and publish the result for the API
+func (p *PayoutsProcessor) checkSolvency() {
+	solvency, err := p.solvency()
+	if err != nil {
+		Error.Println("Failed to check pool solvency:", err)
+		return
+	}
+	err = p.backend.WriteSolvency(solvency)
+	if err != nil {
+		Error.Println("Failed to publish pool solvency:", err)
+	}
+	p.reportSolvency(solvency)
+}
+
+func (p *PayoutsProcessor) solvency() (*storage.Solvency, error) {
+	trusted, pending, immature, err := p.rpc.GetBalances()
+	if err != nil {
+		return nil, err
+	}
+	balance, immatureOwed, pendingOwed, err := p.backend.GetOwedBalances()
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := p.backend.LedgerBalances()
+	if err != nil {
+		return nil, err
+	}
+	solvency := &storage.Solvency{
+		Wallet:   trusted + pending + immature,
+		Balance:  balance,
+		Immature: immatureOwed,
+		Pending:  pendingOwed,
+		PoolFee:  ledger[storage.AccountPoolFee],
+		Updated:  MakeTimestamp() / 1000,
+	}
+	solvency.Surplus = solvency.Wallet - solvency.Balance - solvency.Immature - solvency.Pending - solvency.PoolFee
+	return solvency, nil
+}
+
+// Alert once when the deficit grows above the limit and once it is covered again
+func (p *PayoutsProcessor) reportSolvency(solvency *storage.Solvency) {
+	deficit := -solvency.Surplus
+	if deficit > p.config.MaxDeficit {
+		if !p.insolvent {
+			RaiseAlert("pool deficit", "Pool wallet holds %v Satoshi, %v Satoshi less than owed balances and pool fee",
+				solvency.Wallet, deficit)
+		}
+		p.insolvent = true
+		return
+	}
+	if p.insolvent {
+		Info.Printf("Pool wallet covers owed balances again, surplus %v Satoshi", solvency.Surplus)
+	}
+	p.insolvent = false
+}
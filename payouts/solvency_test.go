@@ -0,0 +1,63 @@
+package payouts
+
+import (
+	"testing"
+
+	"github.com/PowPool/btcpool/storage"
+)
+
+func TestWalletBalances(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"getbalances": map[string]interface{}{
+		"mine":      map[string]interface{}{"trusted": 1.5, "untrusted_pending": 0.25, "immature": 6.25},
+		"watchonly": map[string]interface{}{"trusted": 0.001, "untrusted_pending": 0, "immature": 0},
+	}}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	trusted, pending, immature, err := p.rpc.GetBalances()
+	if err != nil || trusted != 150100000 || pending != 25000000 || immature != 625000000 {
+		t.Errorf("Unexpected balances %v, %v, %v: %v", trusted, pending, immature, err)
+	}
+}
+
+func TestReportSolvency(t *testing.T) {
+	p := newTestPayouts(&PayoutsConfig{MaxDeficit: 1000}, "")
+	p.reportSolvency(&storage.Solvency{Surplus: -500})
+	if p.insolvent {
+		t.Error("Deficit below the limit must not alert")
+	}
+	p.reportSolvency(&storage.Solvency{Surplus: -1500})
+	if !p.insolvent {
+		t.Error("Deficit above the limit must alert")
+	}
+	p.reportSolvency(&storage.Solvency{Surplus: 0})
+	if p.insolvent {
+		t.Error("Covered balances must clear the alert")
+	}
+}
+
+func TestSolvencyNetworkFees(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"getbalances": map[string]interface{}{
+		"mine": map[string]interface{}{"trusted": 0.000047, "untrusted_pending": 0, "immature": 0},
+	}}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	p.backend = storage.NewMemoryBackend()
+	p.backend.AdjustBalance("a", 5000, "test")
+	p.backend.UpdateBalance("a", 2000)
+	// Wallet paid 300 Satoshi fee out of the pool fee
+	p.backend.WriteNetworkFee("tx1", "payout tx fee", 300)
+
+	solvency, err := p.solvency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if solvency.Balance != 3000 || solvency.Pending != 2000 || solvency.PoolFee != -300 || solvency.Surplus != 0 {
+		t.Errorf("Unexpected solvency %+v", solvency)
+	}
+}
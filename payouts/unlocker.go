@@ -1,12 +1,15 @@
 package payouts
 
 import (
+	"encoding/hex"
 	"fmt"
+	"math"
 	"math/big"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/PowPool/btcpool/bitcoin"
 	"github.com/PowPool/btcpool/rpc"
 	"github.com/PowPool/btcpool/storage"
 	. "github.com/PowPool/btcpool/util"
@@ -17,15 +20,104 @@ type UnlockerConfig struct {
 	PoolFee        float64 `json:"poolFee"`
 	PoolFeeAddress string  `json:"poolFeeAddress"`
 	Donate         bool    `json:"donate"`
-	Depth          int64   `json:"depth"`
-	ImmatureDepth  int64   `json:"immatureDepth"`
-	KeepTxFees     bool    `json:"keepTxFees"`
-	Interval       string  `json:"interval"`
-	Daemon         string  `json:"daemon"`
-	Timeout        string  `json:"timeout"`
+	// Blocks deeper than depth are credited to balances once their coinbase is spendable, at least the coin maturity
+	Depth int64 `json:"depth"`
+	// Blocks deeper than immatureDepth are credited as immature
+	ImmatureDepth int64  `json:"immatureDepth"`
+	KeepTxFees    bool   `json:"keepTxFees"`
+	Interval      string `json:"interval"`
+	Daemon        string `json:"daemon"`
+	Timeout       string `json:"timeout"`
+	// Reward scheme, "prop" (default), "pplns", "score", "pps" or "fpps"
+	Scheme string `json:"scheme"`
+	// PPLNS window as a multiple of the network difficulty
+	PPLNSWindow float64 `json:"pplnsWindow"`
+	// Most shares kept in the PPLNS window whatever their difficulty
+	PPLNSMaxShares int64 `json:"pplnsMaxShares"`
+	// Recent blocks averaged for the FPPS fee component
+	FPPSFeeBlocks int `json:"fppsFeeBlocks"`
+	// Score scheme decay constant, a share's weight drops by e every scoreDecay
+	ScoreDecay string `json:"scoreDecay"`
+	// Matured blocks are checked for reorgs until they are this many blocks deeper than depth
+	ReorgDepth int64 `json:"reorgDepth"`
+	// Pool address the coinbase pays, set from the pool config
+	CoinBaseAddress string `json:"-"`
+}
+
+const (
+	SchemeProp  = "prop"
+	SchemePPLNS = "pplns"
+	SchemeScore = "score"
+	SchemePPS   = "pps"
+	SchemeFPPS  = "fpps"
+)
+
+const defaultPPLNSWindow = 2.0
+const defaultPPLNSMaxShares = 200000
+const defaultFPPSFeeBlocks = 144
+const defaultScoreDecay = "15m"
+const defaultReorgDepth = 100
+
+// Cap of the share window the proxy keeps, 0 if the scheme needs none
+func (c *UnlockerConfig) PPLNSShares() int64 {
+	if c.Scheme != SchemePPLNS {
+		return 0
+	}
+	if c.PPLNSMaxShares > 0 {
+		return c.PPLNSMaxShares
+	}
+	return defaultPPLNSMaxShares
+}
+
+// Decay constant of share scores, 0 unless the score scheme is used
+func (c *UnlockerConfig) ScoreDecayDuration() time.Duration {
+	if c.Scheme != SchemeScore {
+		return 0
+	}
+	if len(c.ScoreDecay) > 0 {
+		return MustParseDuration(c.ScoreDecay)
+	}
+	return MustParseDuration(defaultScoreDecay)
+}
+
+// Miners are credited for every share, found blocks belong to the pool
+func (c *UnlockerConfig) PaysPerShare() bool {
+	return c.Scheme == SchemePPS || c.Scheme == SchemeFPPS
+}
+
+func (c *UnlockerConfig) FeeBlocks() int {
+	if c.FPPSFeeBlocks > 0 {
+		return c.FPPSFeeBlocks
+	}
+	return defaultFPPSFeeBlocks
+}
+
+// Millisatoshis a share of shareDiff earns at netDiff, after the pool fee
+func (c *UnlockerConfig) ShareCredit(shareDiff, netDiff, subsidy, avgFee int64) int64 {
+	if !c.PaysPerShare() || netDiff <= 0 {
+		return 0
+	}
+	reward := subsidy
+	if c.Scheme == SchemeFPPS {
+		reward += avgFee
+	}
+	return int64(math.Round(float64(shareDiff) / float64(netDiff) * float64(reward) * 1000 * (1 - c.PoolFee/100)))
+}
+
+func (c *UnlockerConfig) reorgDepth() int64 {
+	if c.ReorgDepth > 0 {
+		return c.ReorgDepth
+	}
+	return defaultReorgDepth
+}
+
+func (c *UnlockerConfig) pplnsWindow() float64 {
+	if c.PPLNSWindow > 0 {
+		return c.PPLNSWindow
+	}
+	return defaultPPLNSWindow
 }
 
-//const minDepth = 16
 //const byzantiumHardForkHeight = 4370000
 //const istanbulHardForkHeight = 7080000
 
@@ -38,24 +130,40 @@ const donationFee = 0.0
 const donationAccount = ""
 
 type BlockUnlocker struct {
-	config   *UnlockerConfig
-	backend  *storage.RedisClient
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config  *UnlockerConfig
+	backend storage.Backend
+	rpc     *rpc.RPCClient
+	coin    *bitcoin.CoinParams
+	// Decay constant of the score scheme
+	scoreDecay time.Duration
+	halt       bool
+	lastFail   error
+	// Set by DryRun, a failure is reported instead of halting the unlocker
+	dryRun bool
 }
 
-func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
-	if len(cfg.PoolFeeAddress) != 0 && !IsValidBTCAddress(cfg.PoolFeeAddress) {
+func NewBlockUnlocker(cfg *UnlockerConfig, backend storage.Backend, coin *bitcoin.CoinParams) *BlockUnlocker {
+	if len(cfg.PoolFeeAddress) != 0 && !coin.IsValidAddress(cfg.PoolFeeAddress) {
 		Error.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
 	}
-	//if cfg.Depth < minDepth*2 {
-	//	Error.Fatalf("Block maturity depth can't be < %v, your depth is %v", minDepth*2, cfg.Depth)
-	//}
-	//if cfg.ImmatureDepth < minDepth {
-	//	Error.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
-	//}
-	u := &BlockUnlocker{config: cfg, backend: backend}
+	switch cfg.Scheme {
+	case "":
+		cfg.Scheme = SchemeProp
+	case SchemeProp, SchemePPLNS, SchemeScore, SchemePPS, SchemeFPPS:
+	default:
+		Error.Fatalln("Unknown reward scheme", cfg.Scheme)
+	}
+	// Blocks are credited to balances at depth + 1 confirmations, the wallet spends coinbase outputs from maturity + 1 on
+	if cfg.Depth == 0 {
+		cfg.Depth = coin.CoinBaseMaturity
+	}
+	if cfg.Depth < coin.CoinBaseMaturity {
+		Error.Fatalf("Block maturity depth can't be < %v for %s, your depth is %v", coin.CoinBaseMaturity, coin.Name, cfg.Depth)
+	}
+	if cfg.ImmatureDepth < 0 || cfg.ImmatureDepth > cfg.Depth {
+		Error.Fatalf("Immature depth must be between 0 and depth %v, your immature depth is %v", cfg.Depth, cfg.ImmatureDepth)
+	}
+	u := &BlockUnlocker{config: cfg, backend: backend, coin: coin, scoreDecay: cfg.ScoreDecayDuration()}
 	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
 	return u
 }
@@ -66,74 +174,192 @@ func (u *BlockUnlocker) Start() {
 	timer := time.NewTimer(intv)
 	Info.Printf("Set block unlock interval to %v", intv)
 
+	// A restart clears the halt of the last run
+	_, err := u.backend.ClearUnlockerHalt()
+	if err != nil {
+		Error.Printf("Failed to clear unlocker halt: %v", err)
+	}
+
 	// Immediately unlock after start
 	u.unlockPendingBlocks()
 	u.unlockAndCreditMiners()
+	u.checkMainChain()
 	timer.Reset(intv)
 
 	go func() {
 		for {
 			select {
 			case <-timer.C:
+				u.resumeIfCleared()
 				u.unlockPendingBlocks()
 				u.unlockAndCreditMiners()
+				u.checkMainChain()
 				timer.Reset(intv)
 			}
 		}
 	}()
 }
 
+// Halt unlocking until restart or until the halt is cleared with the resume command
+func (u *BlockUnlocker) suspend(err error) {
+	if u.dryRun {
+		Error.Printf("Unlocker would halt: %v", err)
+		return
+	}
+	u.halt = true
+	u.lastFail = err
+	if err := u.backend.SetUnlockerHalt(err.Error()); err != nil {
+		Error.Printf("Failed to store unlocker halt: %v", err)
+	}
+}
+
+func (u *BlockUnlocker) resumeIfCleared() {
+	if !u.halt {
+		return
+	}
+	reason, err := u.backend.GetUnlockerHalt()
+	if err != nil || len(reason) > 0 {
+		return
+	}
+	Info.Println("Unlocker halt cleared, resuming after:", u.lastFail)
+	u.halt = false
+	u.lastFail = nil
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
 	orphans        int
-	uncles         int
 	blocks         int
+	// Blocks left for a later run because their coinbase isn't spendable yet
+	immature int
+	// Blocks left for a later run because the node doesn't know them
+	unknown int
 }
 
-func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*UnlockResult, error) {
+// With coinBaseMaturity blocks on the main chain are only unlocked once their coinbase can be spent
+func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData, coinBaseMaturity bool) (*UnlockResult, error) {
 	result := &UnlockResult{}
 
-	// Data row is: "nonce:enonce1:enonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee"
 	for _, candidate := range candidates {
-		blockHash, err := u.rpc.GetBlockHashByHeight(candidate.Height)
-		if err != nil {
+		block, err := u.mainChainBlock(candidate)
+		if err == rpc.ErrBlockNotFound {
+			result.unknown++
+			Error.Printf("Node doesn't know block %v, is it still syncing?", candidate.RoundKey())
+			continue
+		} else if err != nil {
 			Error.Printf("Error while retrieving block %v from node: %v", candidate.Height, err)
 			return nil, err
 		}
 
-		block, err := u.rpc.GetBlockByHash(blockHash)
-		if err != nil {
-			Error.Printf("Error while retrieving block %v from node: %v", blockHash, err)
-			return nil, err
-		}
-
-		blockNonceHex := fmt.Sprintf("%08x", block.Nonce)
-		if len(candidate.Nonce) > 0 && strings.EqualFold(candidate.Nonce, blockNonceHex) {
+		if block != nil && u.paysPool(block) {
+			if coinBaseMaturity {
+				matured, err := u.coinBaseMatured(block)
+				if err != nil {
+					Error.Printf("Error while retrieving coinbase of block %v from node: %v", candidate.Height, err)
+					return nil, err
+				}
+				if !matured {
+					result.immature++
+					Info.Printf("Coinbase of block %v isn't spendable yet, %v confirmations", candidate.Height, block.Confirmations)
+					continue
+				}
+			}
 			result.blocks++
 
 			err = u.handleBlock(block, candidate)
 			if err != nil {
-				u.halt = true
-				u.lastFail = err
+				u.suspend(err)
 				return nil, err
 			}
 			result.maturedBlocks = append(result.maturedBlocks, candidate)
 			Info.Printf("Mature block %v with %v tx, hash: %v", candidate.Height, len(block.Transactions), candidate.Hash[0:10])
 		} else {
 			result.orphans++
-			candidate.Orphan = true
 			result.orphanedBlocks = append(result.orphanedBlocks, candidate)
-			Info.Printf("Orphaned block %v:%v", candidate.RoundHeight, candidate.Nonce)
+			Info.Printf("Orphaned block %v:%v, hash: %v", candidate.RoundHeight, candidate.Nonce, candidate.Hash)
 		}
 	}
 	return result, nil
 }
 
+// Block of the candidate if it is on the main chain, nil if it was orphaned.
+// Like onMainChain, rpc.ErrBlockNotFound is returned for a block the node doesn't know
+func (u *BlockUnlocker) mainChainBlock(candidate *storage.BlockData) (*rpc.GetBlockReply, error) {
+	if len(candidate.Hash) == 0 {
+		// Candidates recorded without hash are matched by the nonce of the block at their height
+		blockHash, err := u.rpc.GetBlockHashByHeight(candidate.Height)
+		if err != nil {
+			return nil, err
+		}
+		block, err := u.rpc.GetBlockByHash(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		if len(candidate.Nonce) > 0 && strings.EqualFold(candidate.Nonce, fmt.Sprintf("%08x", block.Nonce)) {
+			return block, nil
+		}
+		return nil, nil
+	}
+	block, err := u.rpc.GetBlockByHash(candidate.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if block.Confirmations < 0 || int64(block.Height) != candidate.Height {
+		return nil, nil
+	}
+	return block, nil
+}
+
+// Whether the wallet can spend the coinbase of the block, decided by the confirmations of its outputs
+func (u *BlockUnlocker) coinBaseMatured(block *rpc.GetBlockReply) (bool, error) {
+	if len(block.Transactions) == 0 {
+		return false, fmt.Errorf("block %v without transactions", block.Hash)
+	}
+	required := u.coin.CoinBaseMaturity + 1
+	coinBase := block.Transactions[0]
+	for _, v := range coinBase.Vout {
+		if BTCToSatoshi(v.Value) == 0 {
+			continue
+		}
+		out, err := u.rpc.GetTxOut(coinBase.TxId, v.N)
+		if err != nil {
+			return false, err
+		}
+		if out != nil {
+			return out.Coinbase && out.Confirmations >= required, nil
+		}
+	}
+	// Outputs already spent matured, the block confirmations decide
+	return block.Confirmations >= required, nil
+}
+
+// Whether the coinbase of the block pays the pool address
+func (u *BlockUnlocker) paysPool(block *rpc.GetBlockReply) bool {
+	if len(u.config.CoinBaseAddress) == 0 {
+		return true
+	}
+	if len(block.Transactions) == 0 {
+		return false
+	}
+	script, err := u.coin.AddressToScript(u.config.CoinBaseAddress)
+	if err != nil {
+		return false
+	}
+	scriptHex := hex.EncodeToString(script)
+	for _, v := range block.Transactions[0].Vout {
+		if strings.EqualFold(v.ScriptPubKey.Hex, scriptHex) {
+			return true
+		}
+	}
+	Error.Printf("Coinbase of block %v doesn't pay the pool address %v", block.Hash, u.config.CoinBaseAddress)
+	return false
+}
+
 func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage.BlockData) error {
-	reward := new(big.Int).Set(candidate.CoinBaseValue)
-	// Add TX fees
-	extraTxReward := new(big.Int).Set(candidate.BlkTotalFee)
+	reward := big.NewInt(candidate.Subsidy)
+	// TX fees are shared with the miners unless the pool keeps them
+	extraTxReward := big.NewInt(candidate.Fees)
 
 	if u.config.KeepTxFees {
 		candidate.ExtraReward = new(big.Int).Set(extraTxReward)
@@ -141,22 +367,49 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 		reward.Add(reward, extraTxReward)
 	}
 
-	candidate.Orphan = false
 	candidate.Hash = block.Hash
+	candidate.Confirmations = block.Confirmations
+	if len(block.Transactions) > 0 {
+		candidate.CoinBaseTxId = block.Transactions[0].TxId
+	}
 	candidate.Reward = new(big.Int).Set(reward)
+	candidate.CoinBaseOutputs = coinBaseOutputs(block, candidate.Height)
 	return nil
 }
 
+// Spendable coinbase outputs, the witness commitment and other zero value outputs are left out
+func coinBaseOutputs(block *rpc.GetBlockReply, height int64) []*storage.UTXO {
+	if len(block.Transactions) == 0 {
+		return nil
+	}
+	coinBase := block.Transactions[0]
+	var result []*storage.UTXO
+	for _, v := range coinBase.Vout {
+		value := BTCToSatoshi(v.Value)
+		if value == 0 || v.ScriptPubKey.Type == "nulldata" {
+			continue
+		}
+		result = append(result, &storage.UTXO{
+			TxId:     coinBase.TxId,
+			Vout:     v.N,
+			Value:    value,
+			Address:  v.ScriptPubKey.Address,
+			Height:   height,
+			Coinbase: true,
+		})
+	}
+	return result
+}
+
 func (u *BlockUnlocker) unlockPendingBlocks() {
 	if u.halt {
 		Info.Println("Unlocking suspended due to last critical error:", u.lastFail)
 		return
 	}
 
-	current, err := u.rpc.GetPendingBlock()
+	current, err := u.rpc.GetPendingBlockWithRules(u.coin.TemplateRules)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.suspend(err)
 		Error.Printf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
@@ -164,8 +417,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 
 	candidates, err := u.backend.GetCandidates(currentHeight - u.config.ImmatureDepth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.suspend(err)
 		Error.Printf("Failed to get block candidates from backend: %v", err)
 		return
 	}
@@ -175,19 +427,17 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 		return
 	}
 
-	result, err := u.unlockCandidates(candidates)
+	result, err := u.unlockCandidates(candidates, false)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.suspend(err)
 		Error.Printf("Failed to unlock blocks: %v", err)
 		return
 	}
-	Info.Printf("Immature %v blocks, %v uncles, %v orphans", result.blocks, result.uncles, result.orphans)
+	Info.Printf("Immature %v blocks, %v orphans", result.blocks, result.orphans)
 
 	err = u.backend.WritePendingOrphans(result.orphanedBlocks)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.suspend(err)
 		Error.Printf("Failed to insert orphaned blocks into backend: %v", err)
 		return
 	} else {
@@ -201,15 +451,13 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 	for _, block := range result.maturedBlocks {
 		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.suspend(err)
 			Error.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
 		err = u.backend.WriteImmatureBlock(block, roundRewards)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.suspend(err)
 			Error.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
@@ -245,10 +493,9 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		return
 	}
 
-	current, err := u.rpc.GetPendingBlock()
+	current, err := u.rpc.GetPendingBlockWithRules(u.coin.TemplateRules)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.suspend(err)
 		Error.Printf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
@@ -256,8 +503,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 	immature, err := u.backend.GetImmatureBlocks(currentHeight - u.config.Depth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.suspend(err)
 		Error.Printf("Failed to get block candidates from backend: %v", err)
 		return
 	}
@@ -267,20 +513,18 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		return
 	}
 
-	result, err := u.unlockCandidates(immature)
+	result, err := u.unlockCandidates(immature, true)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.suspend(err)
 		Error.Printf("Failed to unlock blocks: %v", err)
 		return
 	}
-	Info.Printf("Unlocked %v blocks, %v uncles, %v orphans", result.blocks, result.uncles, result.orphans)
+	Info.Printf("Unlocked %v blocks, %v orphans, %v not spendable yet", result.blocks, result.orphans, result.immature)
 
 	for _, block := range result.orphanedBlocks {
 		err = u.backend.WriteOrphan(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.suspend(err)
 			Error.Printf("Failed to insert orphaned block into backend: %v", err)
 			return
 		}
@@ -294,15 +538,17 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	for _, block := range result.maturedBlocks {
 		revenue, minersProfit, poolProfit, roundRewards, err := u.calculateRewards(block)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.suspend(err)
 			Error.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
-		err = u.backend.WriteMaturedBlock(block, roundRewards)
+		reserve := int64(0)
+		if u.config.PaysPerShare() {
+			reserve, _ = strconv.ParseInt(poolProfit.FloatString(0), 10, 64)
+		}
+		err = u.backend.WriteMaturedBlock(block, roundRewards, reserve)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.suspend(err)
 			Error.Printf("Failed to credit rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
@@ -332,17 +578,117 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 	)
 }
 
+// Orphan immature blocks and roll back recently matured ones that left the main chain
+func (u *BlockUnlocker) checkMainChain() {
+	if u.halt {
+		return
+	}
+
+	current, err := u.rpc.GetPendingBlockWithRules(u.coin.TemplateRules)
+	if err != nil {
+		u.suspend(err)
+		Error.Printf("Unable to get current blockchain height from node: %v", err)
+		return
+	}
+	currentHeight := int64(current.Height - 1)
+
+	immature, err := u.backend.GetImmatureBlocks(currentHeight)
+	if err != nil {
+		u.suspend(err)
+		Error.Printf("Failed to get immature blocks from backend: %v", err)
+		return
+	}
+	for _, block := range immature {
+		// Deep enough blocks are checked when they mature
+		if block.Orphan || len(block.Hash) == 0 || block.Height <= currentHeight-u.config.Depth {
+			continue
+		}
+		onChain, err := u.onMainChain(block)
+		if err != nil {
+			return
+		}
+		if onChain {
+			continue
+		}
+		err = u.backend.WriteOrphan(block)
+		if err != nil {
+			u.suspend(err)
+			Error.Printf("Failed to orphan immature block %v: %v", block.RoundKey(), err)
+			return
+		}
+		Info.Printf("Immature block %v left the main chain, immature credits removed", block.RoundKey())
+	}
+
+	matured, err := u.backend.GetMaturedBlocks(currentHeight - u.config.Depth - u.config.reorgDepth())
+	if err != nil {
+		u.suspend(err)
+		Error.Printf("Failed to get matured blocks from backend: %v", err)
+		return
+	}
+	for _, block := range matured {
+		if block.Orphan || len(block.Hash) == 0 {
+			continue
+		}
+		onChain, err := u.onMainChain(block)
+		if err != nil {
+			return
+		}
+		if onChain {
+			continue
+		}
+		total, err := u.backend.WriteReorg(block)
+		if err != nil {
+			u.suspend(err)
+			Error.Printf("Failed to roll back credits of block %v: %v", block.RoundKey(), err)
+			return
+		}
+		RaiseAlert("block reorg", "Matured block %v left the main chain, %v Satoshi taken back from miner balances",
+			block.RoundKey(), total)
+	}
+}
+
+// Whether the node has the block on its main chain. Blocks the node doesn't know are kept
+func (u *BlockUnlocker) onMainChain(block *storage.BlockData) (bool, error) {
+	header, err := u.rpc.GetBlockHeader(block.Hash)
+	if err == rpc.ErrBlockNotFound {
+		Error.Printf("Node doesn't know block %v, is it still syncing?", block.RoundKey())
+		return false, err
+	} else if err != nil {
+		Error.Printf("Error while retrieving block %v from node: %v", block.RoundKey(), err)
+		return false, err
+	}
+	return header.Confirmations >= 0, nil
+}
+
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
 	revenue := new(big.Rat).SetInt(block.Reward)
+	if u.config.PaysPerShare() {
+		// Miners got paid for their shares, the block goes to the pool reserve
+		poolProfit := new(big.Rat).Set(revenue)
+		if block.ExtraReward != nil {
+			extraReward := new(big.Rat).SetInt(block.ExtraReward)
+			poolProfit.Add(poolProfit, extraReward)
+			revenue.Add(revenue, extraReward)
+		}
+		return revenue, new(big.Rat), poolProfit, make(map[string]int64), nil
+	}
 	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
 
-	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
-	if err != nil {
-		return nil, nil, nil, nil, err
+	var rewards map[string]int64
+	if u.config.Scheme == SchemeScore {
+		scores, err := u.roundScores(block)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		rewards = calculateRewardsForScores(scores, minersProfit)
+	} else {
+		shares, totalShares, err := u.roundShares(block)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		rewards = calculateRewardsForShares(shares, totalShares, minersProfit)
 	}
 
-	rewards := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
-
 	if block.ExtraReward != nil {
 		extraReward := new(big.Rat).SetInt(block.ExtraReward)
 		poolProfit.Add(poolProfit, extraReward)
@@ -357,7 +703,7 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
 	}
 
 	if len(u.config.PoolFeeAddress) != 0 {
-		address := strings.ToLower(u.config.PoolFeeAddress)
+		address := u.coin.NormalizeAddress(u.config.PoolFeeAddress)
 		value, _ := strconv.ParseInt(poolProfit.FloatString(0), 10, 64)
 		rewards[address] += value
 	}
@@ -365,6 +711,73 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
 	return revenue, minersProfit, poolProfit, rewards, nil
 }
 
+// Shares a block is rewarded for and their total under the configured scheme
+func (u *BlockUnlocker) roundShares(block *storage.BlockData) (map[string]int64, int64, error) {
+	if u.config.Scheme == SchemePPLNS {
+		window, err := u.backend.GetPPLNSShares(block.RoundHeight, block.Nonce)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(window) > 0 {
+			size := int64(u.config.pplnsWindow() * float64(block.Difficulty))
+			shares, total := calculatePPLNSShares(window, size)
+			if total < size && int64(len(window)) >= u.config.PPLNSShares() {
+				Error.Printf("PPLNS window of round %v cut short by pplnsMaxShares %v: %v of %v difficulty, raise pplnsMaxShares",
+					block.RoundKey(), u.config.PPLNSShares(), total, size)
+			}
+			return shares, total, nil
+		}
+		Error.Printf("No PPLNS window for round %v, falling back to round shares", block.RoundKey())
+	}
+	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := block.TotalShares
+	if total == 0 {
+		// Candidate whose total wasn't written after its round was closed
+		for _, n := range shares {
+			total += n
+		}
+	}
+	return shares, total, nil
+}
+
+// Per login scores of a round, rebuilt from the share log if they are missing
+func (u *BlockUnlocker) roundScores(block *storage.BlockData) (map[string]float64, error) {
+	scores, err := u.backend.GetRoundScores(block.RoundHeight, block.Nonce, u.scoreDecay)
+	if err != nil {
+		return nil, err
+	}
+	if len(scores) > 0 {
+		return scores, nil
+	}
+	Error.Printf("No scores for round %v, rebuilding them from the share log", block.RoundKey())
+	log, err := u.backend.GetRoundShareLog(block.RoundHeight, block.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return storage.ScoresFromShareLog(log, u.scoreDecay), nil
+}
+
+// Sum the last shares of the window up to size difficulty, the oldest one counts partially
+func calculatePPLNSShares(window []storage.PPLNSShare, size int64) (map[string]int64, int64) {
+	shares := make(map[string]int64)
+	total := int64(0)
+	for _, share := range window {
+		if size > 0 && total >= size {
+			break
+		}
+		diff := share.Diff
+		if size > 0 && total+diff > size {
+			diff = size - total
+		}
+		shares[share.Login] += diff
+		total += diff
+	}
+	return shares, total
+}
+
 func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
 	rewards := make(map[string]int64)
 
@@ -383,3 +796,22 @@ func chargeFee(value *big.Rat, fee float64) (*big.Rat, *big.Rat) {
 	feeValue := new(big.Rat).Mul(value, feePercent)
 	return new(big.Rat).Sub(value, feeValue), feeValue
 }
+
+func calculateRewardsForScores(scores map[string]float64, reward *big.Rat) map[string]int64 {
+	rewards := make(map[string]int64)
+
+	total := 0.0
+	for _, score := range scores {
+		total += score
+	}
+	if total <= 0 {
+		return rewards
+	}
+	for login, score := range scores {
+		percent := new(big.Rat).SetFloat64(score / total)
+		workerReward := new(big.Rat).Mul(reward, percent)
+		value, _ := strconv.ParseInt(workerReward.FloatString(0), 10, 64)
+		rewards[login] += value
+	}
+	return rewards
+}
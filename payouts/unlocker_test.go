@@ -1,13 +1,31 @@
 package payouts
 
 import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
 )
 
 func TestMain(m *testing.M) {
-	os.Exit(m.Run())
+	dir, err := ioutil.TempDir("", "payouts")
+	if err != nil {
+		panic(err)
+	}
+	InitLog(filepath.Join(dir, "info.log"), filepath.Join(dir, "error.log"),
+		filepath.Join(dir, "share.log"), filepath.Join(dir, "block.log"), ERROR)
+	c := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(c)
 }
 
 func TestCalculateRewards(t *testing.T) {
@@ -49,3 +67,149 @@ func TestChargeFee(t *testing.T) {
 		t.Error("Must charge fee")
 	}
 }
+
+func TestHandleBlockFees(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		u := &BlockUnlocker{config: &UnlockerConfig{KeepTxFees: keep}}
+		candidate := &storage.BlockData{Height: 100, Subsidy: 5000, Fees: 100}
+		if err := u.handleBlock(&rpc.GetBlockReply{Hash: "aa", Confirmations: 1}, candidate); err != nil {
+			t.Fatal(err)
+		}
+		revenue := candidate.Reward.Int64()
+		if candidate.ExtraReward != nil {
+			revenue += candidate.ExtraReward.Int64()
+		}
+		if revenue != 5100 {
+			t.Errorf("Fees must be counted once with keepTxFees %v, revenue %v", keep, revenue)
+		}
+		if keep && candidate.Reward.Int64() != 5000 {
+			t.Errorf("Kept fees must not be shared, reward %v", candidate.Reward)
+		}
+	}
+}
+
+func TestCalculatePPLNSShares(t *testing.T) {
+	window := []storage.PPLNSShare{
+		{Login: "a", Diff: 100}, {Login: "b", Diff: 300}, {Login: "a", Diff: 200}, {Login: "c", Diff: 500},
+	}
+	shares, total := calculatePPLNSShares(window, 500)
+	if total != 500 {
+		t.Errorf("Window total must be 500, got %v", total)
+	}
+	if shares["a"] != 200 || shares["b"] != 300 || shares["c"] != 0 {
+		t.Errorf("Unexpected window shares %v", shares)
+	}
+
+	shares, total = calculatePPLNSShares(window, 10000)
+	if total != 1100 || shares["a"] != 300 || shares["c"] != 500 {
+		t.Errorf("Short window must count every share, got %v/%v", shares, total)
+	}
+}
+
+func TestShareCredit(t *testing.T) {
+	cfg := &UnlockerConfig{Scheme: SchemePPS, PoolFee: 2.0}
+	if credit := cfg.ShareCredit(1000, 100000, 625000000, 50000000); credit != 6125000000 {
+		t.Errorf("Unexpected PPS credit %v", credit)
+	}
+	cfg.Scheme = SchemeFPPS
+	if credit := cfg.ShareCredit(1000, 100000, 625000000, 50000000); credit != 6615000000 {
+		t.Errorf("Unexpected FPPS credit %v", credit)
+	}
+	cfg.Scheme = SchemePPLNS
+	if credit := cfg.ShareCredit(1000, 100000, 625000000, 50000000); credit != 0 {
+		t.Error("Only pay per share schemes credit shares")
+	}
+}
+
+func TestCalculateRewardsForScores(t *testing.T) {
+	log := []storage.ShareLogEntry{
+		{Timestamp: 0, Diff: 1000, Login: "a"},
+		{Timestamp: 60000, Diff: 1000, Login: "b"},
+	}
+	scores := storage.ScoresFromShareLog(log, time.Minute)
+	rewards := calculateRewardsForScores(scores, big.NewRat(1000000, 1))
+	// a's share is one decay constant older than b's
+	if rewards["a"] != 268941 || rewards["b"] != 731059 {
+		t.Errorf("Unexpected score rewards %v", rewards)
+	}
+}
+
+func TestMainChainBlock(t *testing.T) {
+	address := "bc1q9vza2e8x573nczrlzms0wvx3gsqjx7vavgkx0l"
+	script, _ := bitcoin.Bitcoin.AddressToScript(address)
+	coinBase := map[string]interface{}{"txid": "cc", "vout": []interface{}{
+		map[string]interface{}{"value": 3.125, "n": 0, "scriptPubKey": map[string]interface{}{"hex": hex.EncodeToString(script)}},
+	}}
+	block := map[string]interface{}{"height": 100, "hash": "aa", "confirmations": 2, "tx": []interface{}{coinBase}}
+
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"getblock": block}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+	u := &BlockUnlocker{config: &UnlockerConfig{CoinBaseAddress: address}, coin: bitcoin.Bitcoin,
+		rpc: rpc.NewRPCClient("BlockUnlocker", server.URL, "5s")}
+
+	candidate := &storage.BlockData{Height: 100, Hash: "aa"}
+	found, err := u.mainChainBlock(candidate)
+	if err != nil || found == nil || !u.paysPool(found) {
+		t.Fatalf("Block on the main chain must be found: %v", err)
+	}
+	if calls["getblock"][0] != "aa" {
+		t.Errorf("Block must be looked up by hash, got %v", calls["getblock"])
+	}
+	u.config.CoinBaseAddress = "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2"
+	if u.paysPool(found) {
+		t.Error("Coinbase paying another address must not be ours")
+	}
+
+	block["confirmations"] = -1
+	if found, err = u.mainChainBlock(candidate); err != nil || found != nil {
+		t.Errorf("Stale block must be orphaned: %v", err)
+	}
+	results["getblock"] = errors.New("Block not found")
+	if _, err = u.mainChainBlock(candidate); err != rpc.ErrBlockNotFound {
+		t.Errorf("Unknown block must not be orphaned, got %v", err)
+	}
+
+	results["getblockheader"] = map[string]interface{}{"height": 100, "hash": "aa", "confirmations": -1}
+	if onChain, err := u.onMainChain(candidate); err != nil || onChain {
+		t.Errorf("Stale block must be off the main chain: %v", err)
+	}
+	results["getblockheader"] = errors.New("Block not found")
+	if _, err := u.onMainChain(candidate); err != rpc.ErrBlockNotFound {
+		t.Errorf("Unknown block must not be rolled back, got %v", err)
+	}
+}
+
+func TestCoinBaseMatured(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{"gettxout": map[string]interface{}{"confirmations": 100, "coinbase": true}}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+	u := &BlockUnlocker{config: &UnlockerConfig{}, coin: bitcoin.Bitcoin, rpc: rpc.NewRPCClient("BlockUnlocker", server.URL, "5s")}
+
+	coinBase := rpc.Tx{TxId: "cc", Vout: []rpc.Vout{
+		{Value: 0, N: 0, ScriptPubKey: rpc.ScriptPubKey{Type: "nulldata"}},
+		{Value: 3.125, N: 1},
+	}}
+	block := &rpc.GetBlockReply{Hash: "aa", Confirmations: 101, Transactions: []rpc.Tx{coinBase}}
+	if matured, err := u.coinBaseMatured(block); err != nil || matured {
+		t.Errorf("Coinbase with 100 confirmations must not be spendable: %v", err)
+	}
+	if calls["gettxout"][0] != "cc" || calls["gettxout"][1] != 1.0 {
+		t.Errorf("Unexpected gettxout call %v", calls["gettxout"])
+	}
+	results["gettxout"] = map[string]interface{}{"confirmations": 101, "coinbase": true}
+	if matured, err := u.coinBaseMatured(block); err != nil || !matured {
+		t.Errorf("Coinbase with 101 confirmations must be spendable: %v", err)
+	}
+	results["gettxout"] = nil
+	block.Confirmations = 50
+	if matured, err := u.coinBaseMatured(block); err != nil || matured {
+		t.Errorf("Unknown coinbase output of a young block must not be spendable: %v", err)
+	}
+	block.Confirmations = 120
+	if matured, err := u.coinBaseMatured(block); err != nil || !matured {
+		t.Errorf("Spent coinbase output must be matured: %v", err)
+	}
+}
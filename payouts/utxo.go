@@ -0,0 +1,238 @@
+package payouts
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+const defaultUTXOInterval = "30m"
+const defaultConsolidateMin = 50
+const defaultConsolidateMax = 200
+
+// Rough vsize of a transaction without inputs and outputs and of spending one P2WPKH input
+const txOverheadSize = 11
+const inputSize = 68
+
+func (p *PayoutsProcessor) utxoInterval() time.Duration {
+	if len(p.config.UTXOInterval) > 0 {
+		return MustParseDuration(p.config.UTXOInterval)
+	}
+	return MustParseDuration(defaultUTXOInterval)
+}
+
+func (p *PayoutsProcessor) consolidateMin() int {
+	if p.config.ConsolidateMin > 0 {
+		return p.config.ConsolidateMin
+	}
+	return defaultConsolidateMin
+}
+
+func (p *PayoutsProcessor) consolidateMax() int {
+	if p.config.ConsolidateMax > 0 {
+		return p.config.ConsolidateMax
+	}
+	return defaultConsolidateMax
+}
+
+func (p *PayoutsProcessor) manageUTXOs() {
+	if p.halt {
+		Info.Println("Payments suspended due to last critical error:", p.lastFail)
+		return
+	}
+	utxos, err := p.reconcileUTXOs()
+	if err != nil {
+		Error.Println("Failed to reconcile UTXOs with the wallet:", err)
+		return
+	}
+	if p.config.ConsolidateFeeRate <= 0 || len(utxos) < p.consolidateMin() {
+		return
+	}
+	if p.config.Mode == PayoutModePSBT {
+		Info.Printf("Wallet holds %v UTXOs, consolidate them with the offline signer", len(utxos))
+		return
+	}
+	feeRate, err := p.rpc.EstimateSmartFee(p.feeTarget())
+	if err != nil {
+		Error.Println("Unable to consolidate UTXOs:", err)
+		return
+	}
+	if feeRate > p.config.ConsolidateFeeRate {
+		Info.Printf("Consolidation of %v UTXOs deferred, fee rate %.2f sat/vB is above %.2f sat/vB",
+			len(utxos), feeRate, p.config.ConsolidateFeeRate)
+		return
+	}
+	err = p.consolidateUTXOs(utxos, feeRate)
+	if err != nil {
+		Error.Println("Failed to consolidate UTXOs:", err)
+	}
+}
+
+// Sync tracked UTXOs with the wallet: spent outputs are dropped, change and other new wallet outputs added
+func (p *PayoutsProcessor) reconcileUTXOs() ([]*storage.UTXO, error) {
+	tracked, err := p.backend.GetUTXOs()
+	if err != nil {
+		return nil, err
+	}
+	unspent, err := p.rpc.ListUnspent(1, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	// Inputs of a batch waiting for a signature are locked and not listed
+	locked, err := p.rpc.ListLockUnspent()
+	if err != nil {
+		return nil, err
+	}
+	// Outputs other than coinbase are dated by their confirmations
+	tip, err := p.rpc.GetBlockCount()
+	if err != nil {
+		return nil, err
+	}
+
+	wallet := make(map[string]*rpc.UnspentReply, len(unspent))
+	for _, v := range unspent {
+		if v.Spendable {
+			wallet[formatOutpoint(v.TxId, v.Vout)] = v
+		}
+	}
+	lockedSet := make(map[string]bool, len(locked))
+	for _, v := range locked {
+		lockedSet[formatOutpoint(v.TxId, v.Vout)] = true
+	}
+
+	var result []*storage.UTXO
+	var remove []string
+	known := make(map[string]bool, len(tracked))
+	for _, utxo := range tracked {
+		outpoint := utxo.Outpoint()
+		known[outpoint] = true
+		if v, ok := wallet[outpoint]; ok {
+			if utxo.Height == 0 {
+				utxo.Height = tip - v.Confirmations + 1
+			}
+			result = append(result, utxo)
+			continue
+		}
+		if lockedSet[outpoint] {
+			continue
+		}
+		if utxo.Coinbase {
+			unspent, err := p.rpc.IsUnspent(utxo.TxId, utxo.Vout)
+			if err == nil && unspent {
+				Error.Printf("Coinbase output %s of block %v is not in the wallet, check the pool address", outpoint, utxo.Height)
+			}
+		}
+		remove = append(remove, outpoint)
+	}
+	var add []*storage.UTXO
+	for outpoint, v := range wallet {
+		if known[outpoint] {
+			continue
+		}
+		utxo := &storage.UTXO{TxId: v.TxId, Vout: v.Vout, Value: BTCToSatoshi(v.Amount), Address: v.Address,
+			Height: tip - v.Confirmations + 1}
+		add = append(add, utxo)
+		result = append(result, utxo)
+	}
+
+	err = p.backend.ReconcileUTXOs(add, remove)
+	if err != nil {
+		return nil, err
+	}
+	if len(add) > 0 || len(remove) > 0 {
+		Info.Printf("Reconciled UTXOs with the wallet, %v added, %v spent", len(add), len(remove))
+	}
+	sortUTXOs(result)
+	return result, nil
+}
+
+// Oldest first, so coinbase outputs are spent in the order they matured
+func sortUTXOs(utxos []*storage.UTXO) {
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].Height != utxos[j].Height {
+			return utxos[i].Height < utxos[j].Height
+		}
+		if utxos[i].TxId != utxos[j].TxId {
+			return utxos[i].TxId < utxos[j].TxId
+		}
+		return utxos[i].Vout < utxos[j].Vout
+	})
+}
+
+// Oldest UTXOs covering the amount and the fee of spending them, always the same for the same set
+func selectCoins(utxos []*storage.UTXO, amount int64, outputs int, feeRate float64) ([]*storage.UTXO, error) {
+	var selected []*storage.UTXO
+	total := int64(0)
+	for _, utxo := range utxos {
+		selected = append(selected, utxo)
+		total += utxo.Value
+		// Payees and change
+		size := txOverheadSize + len(selected)*inputSize + (outputs+1)*31
+		if total >= amount+int64(math.Ceil(float64(size)*feeRate)) {
+			return selected, nil
+		}
+	}
+	return nil, fmt.Errorf("tracked UTXOs of %v Satoshi don't cover %v Satoshi", total, amount)
+}
+
+// Inputs for a payout of the amount, nil leaves coin selection to the wallet
+func (p *PayoutsProcessor) payoutInputs(amount int64, outputs int) []rpc.Outpoint {
+	if !p.config.CoinSelection {
+		return nil
+	}
+	utxos, err := p.reconcileUTXOs()
+	if err != nil {
+		Error.Println("Failed to reconcile UTXOs, leaving coin selection to the wallet:", err)
+		return nil
+	}
+	selected, err := selectCoins(utxos, amount, outputs, p.feeRate)
+	if err != nil {
+		Error.Println("Leaving coin selection to the wallet:", err)
+		return nil
+	}
+	inputs := make([]rpc.Outpoint, len(selected))
+	for i, utxo := range selected {
+		inputs[i] = rpc.Outpoint{TxId: utxo.TxId, Vout: utxo.Vout}
+	}
+	return inputs
+}
+
+// Merge the smallest UTXOs into one wallet output while fees are low
+func (p *PayoutsProcessor) consolidateUTXOs(utxos []*storage.UTXO, feeRate float64) error {
+	candidates := append([]*storage.UTXO{}, utxos...)
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Value < candidates[j].Value })
+	if len(candidates) > p.consolidateMax() {
+		candidates = candidates[:p.consolidateMax()]
+	}
+
+	inputs := make([]rpc.Outpoint, len(candidates))
+	total := int64(0)
+	for i, utxo := range candidates {
+		inputs[i] = rpc.Outpoint{TxId: utxo.TxId, Vout: utxo.Vout}
+		total += utxo.Value
+	}
+	address, err := p.rpc.GetNewAddress()
+	if err != nil {
+		return err
+	}
+	outputs := []map[string]int64{{address: total}}
+	txHash, err := p.rpc.Send(outputs, inputs, false, []int{0}, feeRate, true)
+	if err != nil {
+		return err
+	}
+	Info.Printf("Consolidated %v UTXOs of %v Satoshi at %.2f sat/vB, TxHash: %v", len(inputs), total, feeRate, txHash)
+	wtx, err := p.rpc.GetWalletTransaction(txHash)
+	if err == nil && wtx != nil {
+		err = p.backend.WriteNetworkFee(txHash, "consolidation tx fee", -BTCToSatoshi(wtx.Fee))
+	}
+	if err != nil {
+		Error.Printf("Failed to record the fee of consolidation tx %v in the ledger: %v", txHash, err)
+	}
+	_, err = p.reconcileUTXOs()
+	return err
+}
@@ -0,0 +1,75 @@
+package payouts
+
+import (
+	"testing"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+)
+
+func TestSelectCoins(t *testing.T) {
+	utxos := []*storage.UTXO{
+		{TxId: "cc", Vout: 0, Value: 5000, Height: 200, Coinbase: true},
+		{TxId: "aa", Vout: 1, Value: 3000, Height: 100, Coinbase: true},
+		{TxId: "aa", Vout: 0, Value: 4000, Height: 100, Coinbase: true},
+		{TxId: "bb", Vout: 0, Value: 1000, Height: 0},
+	}
+	sortUTXOs(utxos)
+	if utxos[0].TxId != "bb" || utxos[1].Vout != 0 || utxos[3].TxId != "cc" {
+		t.Fatalf("UTXOs must be ordered by height and outpoint")
+	}
+
+	selected, err := selectCoins(utxos, 4900, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1000 + 4000 cover the amount but not the fee of 2 inputs
+	if len(selected) != 3 || selected[2].Outpoint() != "aa:1" {
+		t.Errorf("Unexpected selection %v", selected)
+	}
+	if _, err = selectCoins(utxos, 13000, 1, 1); err == nil {
+		t.Error("Selection must fail without enough funds")
+	}
+}
+
+func TestCoinBaseOutputs(t *testing.T) {
+	block := &rpc.GetBlockReply{Transactions: []rpc.Tx{{
+		TxId: "aa",
+		Vout: []rpc.Vout{
+			{Value: 3.125, N: 0, ScriptPubKey: rpc.ScriptPubKey{Type: "witness_v0_keyhash", Address: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"}},
+			{Value: 0, N: 1, ScriptPubKey: rpc.ScriptPubKey{Type: "nulldata"}},
+		},
+	}}}
+	outputs := coinBaseOutputs(block, 800000)
+	if len(outputs) != 1 || outputs[0].Value != 312500000 || outputs[0].Height != 800000 || !outputs[0].Coinbase {
+		t.Errorf("Unexpected coinbase outputs %v", outputs)
+	}
+}
+
+func TestReconcileUTXOsOrder(t *testing.T) {
+	calls := make(map[string][]interface{})
+	results := map[string]interface{}{
+		"getblockcount": 1000,
+		"listunspent": []interface{}{
+			map[string]interface{}{"txid": "aa", "vout": 0, "amount": 3.125, "confirmations": 101, "spendable": true},
+			map[string]interface{}{"txid": "bb", "vout": 1, "amount": 0.1, "confirmations": 50, "spendable": true},
+			map[string]interface{}{"txid": "cc", "vout": 1, "amount": 0.2, "confirmations": 200, "spendable": true},
+		},
+		"listlockunspent": []interface{}{},
+	}
+	server := newWalletStub(t, results, calls)
+	defer server.Close()
+
+	p := newTestPayouts(&PayoutsConfig{}, server.URL)
+	p.backend = storage.NewMemoryBackend()
+	p.backend.ReconcileUTXOs([]*storage.UTXO{{TxId: "aa", Vout: 0, Value: 312500000, Height: 900, Coinbase: true}}, nil)
+
+	utxos, err := p.reconcileUTXOs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Change of block 801, coinbase of block 900, change of block 951
+	if len(utxos) != 3 || utxos[0].TxId != "cc" || utxos[1].TxId != "aa" || utxos[2].TxId != "bb" || utxos[2].Height != 951 {
+		t.Errorf("UTXOs must be ordered oldest first, got %+v %+v %+v", utxos[0], utxos[1], utxos[2])
+	}
+}
@@ -3,6 +3,8 @@ package proxy
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/PowPool/btcpool/bitcoin"
 	"github.com/PowPool/btcpool/rpc"
 	. "github.com/PowPool/btcpool/util"
@@ -13,6 +15,7 @@ import (
 	"io"
 	"math/big"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -26,6 +29,11 @@ type BlockTemplateJob struct {
 	CoinBaseValue            int64
 	JobTxsFeeTotal           int64
 	DefaultWitnessCommitment string
+	// Serialized litecoin MWEB block, appended after the transactions
+	MWeb        string
+	CoinBaseTag string
+	// Total size of the extra nonces in the coinbase
+	ExtraNonceSize int
 }
 
 type BlockTemplate struct {
@@ -78,6 +86,14 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		return
 	}
 
+	if s.config.Proxy.TxPolicy.Enabled {
+		err = s.applyTxPolicy(rpcClient, blkTplReply)
+		if err != nil {
+			Error.Printf("Error while applying transaction policy on %s: %s", rpcClient.Name, err)
+			return
+		}
+	}
+
 	var newTpl BlockTemplate
 	if t == nil || t.PrevHash != blkTplReply.PreviousBlockHash {
 		nBits, err := strconv.ParseInt(blkTplReply.Bits, 16, 32)
@@ -108,7 +124,49 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		newTpl.newBlkTpl = false
 	}
 
+	newTplJob, ok := s.newTemplateJob(rpcClient, &newTpl, blkTplReply)
+	if !ok {
+		return
+	}
+	if s.config.Proxy.BlockProposal {
+		reason := s.proposeBlockTemplate(rpcClient, newTplJob, &newTpl)
+		s.reportProposal(rpcClient.Name, newTpl.Height, reason)
+		if len(reason) > 0 {
+			// the node would reject it again on every refresh, mine an empty block rather than the previous one
+			blkTplReply, err = coinBaseOnlyTemplate(blkTplReply)
+			if err != nil {
+				Error.Printf("Error while building coinbase only template on %s: %s", rpcClient.Name, err)
+				return
+			}
+			newTplJob, ok = s.newTemplateJob(rpcClient, &newTpl, blkTplReply)
+			if !ok || len(s.proposeBlockTemplate(rpcClient, newTplJob, &newTpl)) > 0 {
+				return
+			}
+			Info.Printf("Mining coinbase only block at height %d on %s", newTpl.Height, rpcClient.Name)
+		}
+	}
+	s.fees.observe(newTpl.Height, newTplJob.JobTxsFeeTotal)
+
+	for _, tx := range blkTplReply.Transactions {
+		newTpl.TxDetailMap[tx.TxId] = tx.Data
+	}
+
+	newTpl.lastBlkTplId = newTplJob.BlkTplJobId
+	newTpl.BlockTplJobMap[newTplJob.BlkTplJobId] = *newTplJob
+
+	s.blockTemplate.Store(&newTpl)
+	Info.Printf("NEW pending block on %s at height %d / %s", rpcClient.Name, newTpl.Height, newTplJob.BlkTplJobId)
+
+	// Stratum
+	if s.config.Proxy.Stratum.Enabled {
+		go s.broadcastNewJobs()
+	}
+}
+
+// Build the coinbase and merkle branch of a job for the template transactions
+func (s *ProxyServer) newTemplateJob(rpcClient *rpc.RPCClient, newTpl *BlockTemplate, blkTplReply *rpc.GetBlockTemplateReplyPart) (*BlockTemplateJob, bool) {
 	var newTplJob BlockTemplateJob
+	var err error
 	newTplJob.BlkTplJobTime = blkTplReply.CurTime
 	for _, tx := range blkTplReply.Transactions {
 		newTplJob.TxIdList = append(newTplJob.TxIdList, tx.TxId)
@@ -116,22 +174,25 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	newTplJob.MerkleBranch, err = txid_merkle_tree.GetMerkleBranchHexFromTxIdsWithoutCoinBase(newTplJob.TxIdList)
 	if err != nil {
 		Error.Printf("Error while get merkle branch on %s: %s", rpcClient.Name, err)
-		return
+		return nil, false
 	}
 
 	coinBaseReward := blkTplReply.CoinBaseValue
 
 	if coinBaseReward <= 0 {
 		Error.Printf("Invalid block template, coinBaseReward <= 0")
-		return
+		return nil, false
 	}
 
-	var coinBaseTx bitcoin.CoinBaseTransaction
-	err = coinBaseTx.Initialize(s.config.UpstreamCoinBase, newTplJob.BlkTplJobTime, newTpl.Height, coinBaseReward,
-		blkTplReply.CoinBaseAux.Flags, s.config.CoinBaseExtraData, blkTplReply.DefaultWitnessCommitment)
+	cbFlags, _ := hex.DecodeString(blkTplReply.CoinBaseAux.Flags)
+	newTplJob.CoinBaseTag = s.coinBaseTag(newTpl.Height, cbFlags)
+
+	coinBaseTx := bitcoin.CoinBaseTransaction{ExtraNonceSize: s.extraNonce.size()}
+	err = coinBaseTx.Initialize(s.coin, s.config.UpstreamCoinBase, newTplJob.BlkTplJobTime, newTpl.Height, coinBaseReward,
+		blkTplReply.CoinBaseAux.Flags, newTplJob.CoinBaseTag, blkTplReply.DefaultWitnessCommitment)
 	if err != nil {
 		Error.Printf("Error while initialize coinbase transaction on %s: %s", rpcClient.Name, err)
-		return
+		return nil, false
 	}
 	newTplJob.CoinBase1 = hex.EncodeToString(coinBaseTx.CoinBaseTx1)
 	newTplJob.CoinBase2 = hex.EncodeToString(coinBaseTx.CoinBaseTx2)
@@ -143,25 +204,71 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	newTplJob.BlkTplJobId = hex.EncodeToString(utility.Sha256(coinBaseTx.CoinBaseTx1))[0:16]
 
 	newTplJob.DefaultWitnessCommitment = blkTplReply.DefaultWitnessCommitment
+	newTplJob.MWeb = blkTplReply.MWeb
+	newTplJob.ExtraNonceSize = s.extraNonce.size()
+	return &newTplJob, true
+}
 
-	newTpl.lastBlkTplId = newTplJob.BlkTplJobId
-	newTpl.BlockTplJobMap[newTplJob.BlkTplJobId] = newTplJob
-	for _, tx := range blkTplReply.Transactions {
-		newTpl.TxDetailMap[tx.TxId] = tx.Data
+// Ask the node to validate the job template (BIP23), returns the reason the node rejects it for.
+// A proposal that can't be made keeps miners on the new template rather than a stale job
+func (s *ProxyServer) proposeBlockTemplate(rpcClient *rpc.RPCClient, tplJob *BlockTemplateJob, tpl *BlockTemplate) string {
+	proposalHex, err := ConstructProposalBlockHex(tplJob, tpl)
+	if err != nil {
+		Error.Printf("Error while constructing block proposal on %s, using the template unchecked: %s", rpcClient.Name, err)
+		return ""
+	}
+	reason, err := rpcClient.ProposeBlock(proposalHex, s.coin.TemplateRules)
+	if err != nil {
+		Error.Printf("Error while proposing block template on %s, using the template unchecked: %s", rpcClient.Name, err)
+		return ""
+	}
+	if len(reason) > 0 {
+		BlockLog.Printf("Block template at height %d / %s rejected by %s: %s", tpl.Height, tplJob.BlkTplJobId, rpcClient.Name, reason)
 	}
+	return reason
+}
 
-	s.blockTemplate.Store(&newTpl)
-	Info.Printf("NEW pending block on %s at height %d / %s", rpcClient.Name, newTpl.Height, newTplJob.BlkTplJobId)
+// Alert once per rejection reason, templates are refreshed every few seconds
+func (s *ProxyServer) reportProposal(node string, height uint32, reason string) {
+	s.proposalMu.Lock()
+	defer s.proposalMu.Unlock()
 
-	// Stratum
-	if s.config.Proxy.Stratum.Enabled {
-		go s.broadcastNewJobs()
+	if len(reason) == 0 {
+		if len(s.proposalRejected) > 0 {
+			Info.Printf("Block template at height %d accepted by %s again", height, node)
+		}
+		s.proposalRejected = ""
+		return
+	}
+	if reason != s.proposalRejected {
+		RaiseAlert("block proposal", "Block template at height %d rejected by %s: %s", height, node, reason)
+	}
+	s.proposalRejected = reason
+}
+
+// Template without its transactions. MWEB blocks can't drop them, the HogEx tx is mandatory
+func coinBaseOnlyTemplate(blkTplReply *rpc.GetBlockTemplateReplyPart) (*rpc.GetBlockTemplateReplyPart, error) {
+	if len(blkTplReply.MWeb) > 0 {
+		return nil, errors.New("MWEB template can't drop transactions")
+	}
+	empty := *blkTplReply
+	empty.Transactions = nil
+	for _, tx := range blkTplReply.Transactions {
+		empty.CoinBaseValue -= tx.Fee
 	}
+	if len(empty.DefaultWitnessCommitment) != 0 {
+		commitment, err := bitcoin.GetWitnessCommitmentHex(nil)
+		if err != nil {
+			return nil, err
+		}
+		empty.DefaultWitnessCommitment = commitment
+	}
+	return &empty, nil
 }
 
 func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockTemplateReplyPart, error) {
 	rpcClient := s.rpc()
-	reply, err := rpcClient.GetPendingBlock()
+	reply, err := rpcClient.GetPendingBlockWithRules(s.coin.TemplateRules)
 	if err != nil {
 		Error.Printf("Error while refreshing pending block on %s: %s", rpcClient.Name, err)
 		return nil, err
@@ -170,26 +277,86 @@ func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockTemplateReplyPart, error
 }
 
 func ConstructRawBlockHex(oBlock *Block, tplJob *BlockTemplateJob, tpl *BlockTemplate) (string, error) {
-	bytes1, err := hex.DecodeString(oBlock.coinBase1)
+	rawBlock, err := constructRawBlock(oBlock, tplJob, tpl)
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: hex decode coinBase1 error")
 		return "", err
 	}
-	bytes2, err := hex.DecodeString(oBlock.extraNonce1)
+
+	rawBlockHex, err := rawBlock.PackToHex()
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: hex decode extraNonce1 error")
+		Error.Println("ConstructRawBlockHex: rawBlock PackToHex error")
 		return "", err
 	}
-	bytes3, err := hex.DecodeString(oBlock.extraNonce2)
+
+	return appendMWebHex(rawBlockHex, tplJob), nil
+}
+
+// Build a block for the job with zero extra nonces and nonce, good enough for BIP23 proposal
+// since the node skips the PoW check in proposal mode
+func ConstructProposalBlockHex(tplJob *BlockTemplateJob, tpl *BlockTemplate) (string, error) {
+	oBlock := Block{
+		difficulty:   tpl.Difficulty,
+		coinBase1:    tplJob.CoinBase1,
+		coinBase2:    tplJob.CoinBase2,
+		extraNonce1:  "",
+		extraNonce2:  strings.Repeat("00", tplJob.ExtraNonceSize),
+		merkleBranch: tplJob.MerkleBranch,
+		nVersion:     tpl.Version,
+		prevHash:     tpl.PrevHash,
+		sTime:        fmt.Sprintf("%08x", tplJob.BlkTplJobTime),
+		nBits:        tpl.NBits,
+		sNonce:       "00000000",
+	}
+	rawBlock, err := constructRawBlock(&oBlock, tplJob, tpl)
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: hex decode extraNonce2 error")
 		return "", err
 	}
-	bytes4, err := hex.DecodeString(oBlock.coinBase2)
+
+	// the witness commitment requires the coinbase to carry the 32 bytes witness reserved value
+	if len(tplJob.DefaultWitnessCommitment) != 0 {
+		err = rawBlock.Vtx[0].Vin[0].ScriptWitness.UnPackFromHex("0120" + strings.Repeat("00", 32))
+		if err != nil {
+			Error.Println("ConstructProposalBlockHex: coinbase ScriptWitness UnPackFromHex error")
+			return "", err
+		}
+	}
+
+	rawBlockHex, err := rawBlock.PackToHex()
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: hex decode coinBase2 error")
+		Error.Println("ConstructProposalBlockHex: rawBlock PackToHex error")
 		return "", err
 	}
+	return appendMWebHex(rawBlockHex, tplJob), nil
+}
+
+func appendMWebHex(rawBlockHex string, tplJob *BlockTemplateJob) string {
+	if len(tplJob.MWeb) == 0 {
+		return rawBlockHex
+	}
+	return rawBlockHex + "01" + tplJob.MWeb
+}
+
+func constructRawBlock(oBlock *Block, tplJob *BlockTemplateJob, tpl *BlockTemplate) (*block.Block, error) {
+	bytes1, err := hex.DecodeString(oBlock.coinBase1)
+	if err != nil {
+		Error.Println("constructRawBlock: hex decode coinBase1 error")
+		return nil, err
+	}
+	bytes2, err := hex.DecodeString(oBlock.extraNonce1)
+	if err != nil {
+		Error.Println("constructRawBlock: hex decode extraNonce1 error")
+		return nil, err
+	}
+	bytes3, err := hex.DecodeString(oBlock.extraNonce2)
+	if err != nil {
+		Error.Println("constructRawBlock: hex decode extraNonce2 error")
+		return nil, err
+	}
+	bytes4, err := hex.DecodeString(oBlock.coinBase2)
+	if err != nil {
+		Error.Println("constructRawBlock: hex decode coinBase2 error")
+		return nil, err
+	}
 
 	// construct coin base transaction
 	bytesCoinBaseTx := append(append(append(append([]byte{}, bytes1...), bytes2...), bytes3...), bytes4...)
@@ -198,22 +365,22 @@ func ConstructRawBlockHex(oBlock *Block, tplJob *BlockTemplateJob, tpl *BlockTem
 	var cbTrx transaction.Transaction
 	err = cbTrx.UnPack(bufReader)
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: unpack coinBase transaction error")
-		return "", err
+		Error.Println("constructRawBlock: unpack coinBase transaction error")
+		return nil, err
 	}
 
 	// get coin base transaction id
 	cbTrxId, err := cbTrx.CalcTrxId()
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: CalcTrxId error")
-		return "", err
+		Error.Println("constructRawBlock: CalcTrxId error")
+		return nil, err
 	}
 
 	// get merkle root hash
 	merkleRootHex, err := txid_merkle_tree.GetMerkleRootHexFromCoinBaseAndMerkleBranch(cbTrxId.GetHex(), oBlock.merkleBranch)
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
-		return "", err
+		Error.Println("constructRawBlock: GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
+		return nil, err
 	}
 
 	// construct block header
@@ -221,25 +388,25 @@ func ConstructRawBlockHex(oBlock *Block, tplJob *BlockTemplateJob, tpl *BlockTem
 	rawBlock.Header.Version = int32(oBlock.nVersion)
 	err = rawBlock.Header.HashPrevBlock.SetHex(oBlock.prevHash)
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: HashPrevBlock SetHex error")
-		return "", err
+		Error.Println("constructRawBlock: HashPrevBlock SetHex error")
+		return nil, err
 	}
 	err = rawBlock.Header.HashMerkleRoot.SetHex(merkleRootHex)
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: HashMerkleRoot SetHex error")
-		return "", err
+		Error.Println("constructRawBlock: HashMerkleRoot SetHex error")
+		return nil, err
 	}
 	nTime, err := strconv.ParseUint(oBlock.sTime, 16, 32)
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: ParseUint sTime error")
-		return "", err
+		Error.Println("constructRawBlock: ParseUint sTime error")
+		return nil, err
 	}
 	rawBlock.Header.Time = uint32(nTime)
 	rawBlock.Header.Bits = oBlock.nBits
 	nNonce, err := strconv.ParseUint(oBlock.sNonce, 16, 32)
 	if err != nil {
-		Error.Println("ConstructRawBlockHex: ParseUint sNonce error")
-		return "", err
+		Error.Println("constructRawBlock: ParseUint sNonce error")
+		return nil, err
 	}
 	rawBlock.Header.Nonce = uint32(nNonce)
 
@@ -251,23 +418,17 @@ func ConstructRawBlockHex(oBlock *Block, tplJob *BlockTemplateJob, tpl *BlockTem
 	for _, trxId := range tplJob.TxIdList {
 		rawTrxHex, ok := tpl.TxDetailMap[trxId]
 		if !ok {
-			Error.Printf("ConstructRawBlockHex: get TxDetailMap key [%s] error", trxId)
-			return "", err
+			Error.Printf("constructRawBlock: get TxDetailMap key [%s] error", trxId)
+			return nil, fmt.Errorf("missing transaction %s", trxId)
 		}
 		var trx transaction.Transaction
 		err = trx.UnPackFromHex(rawTrxHex)
 		if err != nil {
-			Error.Println("ConstructRawBlockHex: trx UnPackFromHex error")
-			return "", err
+			Error.Println("constructRawBlock: trx UnPackFromHex error")
+			return nil, err
 		}
 		rawBlock.Vtx = append(rawBlock.Vtx, trx)
 	}
 
-	rawBlockHex, err := rawBlock.PackToHex()
-	if err != nil {
-		Error.Println("ConstructRawBlockHex: rawBlock PackToHex error")
-		return "", err
-	}
-
-	return rawBlockHex, nil
+	return &rawBlock, nil
 }
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/rpc"
+)
+
+// Genesis block coinbase and template, the proposal is the genesis block with a zero nonce
+func genesisTemplate() (*BlockTemplateJob, *BlockTemplate) {
+	tplJob := &BlockTemplateJob{
+		BlkTplJobId:   "genesis",
+		BlkTplJobTime: 0x495fab29,
+		CoinBase1:     "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000",
+	}
+	tpl := &BlockTemplate{
+		Version:  1,
+		PrevHash: "0000000000000000000000000000000000000000000000000000000000000000",
+		NBits:    0x1d00ffff,
+	}
+	return tplJob, tpl
+}
+
+func TestConstructProposalBlockHex(t *testing.T) {
+	tplJob, tpl := genesisTemplate()
+	proposal, err := ConstructProposalBlockHex(tplJob, tpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "01000000" + strings.Repeat("00", 32) +
+		"3ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a" + "29ab5f49" + "ffff001d" + "00000000"
+	if proposal != header+"01"+tplJob.CoinBase1 {
+		t.Errorf("Unexpected proposal %s", proposal)
+	}
+
+	tplJob.DefaultWitnessCommitment = "6a24aa21a9ed" + strings.Repeat("00", 32)
+	proposal, err = ConstructProposalBlockHex(tplJob, tpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(proposal, "0120"+strings.Repeat("00", 32)+"00000000") {
+		t.Errorf("Coinbase must carry the witness reserved value, got %s", proposal)
+	}
+}
+
+func TestProposeBlockTemplate(t *testing.T) {
+	var reply map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(reply)
+	}))
+	defer server.Close()
+
+	s := &ProxyServer{coin: bitcoin.Bitcoin}
+	rpcClient := rpc.NewRPCClient("node", server.URL, "5s")
+	tplJob, tpl := genesisTemplate()
+
+	reply = map[string]interface{}{"id": 0, "result": nil}
+	if reason := s.proposeBlockTemplate(rpcClient, tplJob, tpl); reason != "" {
+		t.Errorf("Accepted template must be used, got %v", reason)
+	}
+	reply = map[string]interface{}{"id": 0, "result": "bad-txnmrklroot"}
+	if reason := s.proposeBlockTemplate(rpcClient, tplJob, tpl); reason != "bad-txnmrklroot" {
+		t.Errorf("Rejected template must not be used, got %v", reason)
+	}
+	reply = map[string]interface{}{"id": 0, "error": map[string]interface{}{"code": -32601, "message": "Method not found"}}
+	if reason := s.proposeBlockTemplate(rpcClient, tplJob, tpl); reason != "" {
+		t.Errorf("Template must be used when the node can't check it, got %v", reason)
+	}
+}
+
+func TestReportProposal(t *testing.T) {
+	s := &ProxyServer{}
+	s.reportProposal("node", 100, "bad-cb-amount")
+	s.reportProposal("node", 101, "bad-cb-amount")
+	if s.proposalRejected != "bad-cb-amount" {
+		t.Errorf("Must remember the rejection, got %v", s.proposalRejected)
+	}
+	s.reportProposal("node", 101, "")
+	if s.proposalRejected != "" {
+		t.Error("Accepted template must clear the rejection")
+	}
+}
+
+func TestCoinBaseOnlyTemplate(t *testing.T) {
+	reply := &rpc.GetBlockTemplateReplyPart{
+		CoinBaseValue:            5000001000,
+		Transactions:             []rpc.BlockTplTransaction{{TxId: "aa", Fee: 400}, {TxId: "bb", Fee: 600}},
+		DefaultWitnessCommitment: "6a24aa21a9edff",
+	}
+	empty, err := coinBaseOnlyTemplate(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty.Transactions) != 0 || empty.CoinBaseValue != 5000000000 {
+		t.Errorf("Unexpected coinbase only template %v", empty)
+	}
+	commitment, _ := bitcoin.GetWitnessCommitmentHex(nil)
+	if empty.DefaultWitnessCommitment != commitment {
+		t.Errorf("Unexpected witness commitment %v", empty.DefaultWitnessCommitment)
+	}
+	if len(reply.Transactions) != 2 {
+		t.Error("Must not modify the template")
+	}
+	reply.MWeb = "01"
+	if _, err = coinBaseOnlyTemplate(reply); err == nil {
+		t.Error("MWEB template must keep its transactions")
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Placeholders of the coinbase tag template, e.g. "/{pool}/{node}-{nodeId}/{counter}/"
+const (
+	cbTagPool    = "{pool}"
+	cbTagNode    = "{node}"
+	cbTagNodeId  = "{nodeId}"
+	cbTagHeight  = "{height}"
+	cbTagCounter = "{counter}"
+)
+
+func renderCoinBaseTag(tpl string, cfg *Config, height uint32, counter int64) string {
+	r := strings.NewReplacer(
+		cbTagPool, cfg.PoolName,
+		cbTagNode, cfg.Name,
+		cbTagNodeId, strconv.FormatUint(uint64(cfg.Id), 10),
+		cbTagHeight, strconv.FormatUint(uint64(height), 10),
+		cbTagCounter, strconv.FormatInt(counter, 10),
+	)
+	return r.Replace(tpl)
+}
+
+// Make sure the tag fits in the coinbase scriptSig at any height, aux flags aside
+func validateCoinBaseTag(cfg *Config, extraNonceSize int) error {
+	tag := renderCoinBaseTag(cfg.CoinBaseExtraData, cfg, ^uint32(0)>>1, 1<<32)
+	maxSize := bitcoin.MaxCoinBaseExtrasSize(^uint32(0)>>1, []byte{}, extraNonceSize)
+	if len(tag) > maxSize {
+		return fmt.Errorf("coinbase tag %q is %d bytes, at most %d bytes fit in the coinbase scriptSig",
+			tag, len(tag), maxSize)
+	}
+	return nil
+}
+
+// Coinbase tag of a new job, cut down if the node's aux flags leave no room for it
+func (s *ProxyServer) coinBaseTag(height uint32, flags []byte) string {
+	tag := renderCoinBaseTag(s.config.CoinBaseExtraData, s.config, height, atomic.LoadInt64(&s.blocksFound))
+	maxSize := bitcoin.MaxCoinBaseExtrasSize(height, flags, s.extraNonce.size())
+	if len(tag) > maxSize {
+		Error.Printf("Coinbase tag %q truncated to %d bytes at height %d", tag, maxSize, height)
+		tag = truncateTag(tag, maxSize)
+	}
+	return tag
+}
+
+// Cut the tag to at most maxSize bytes without splitting a UTF-8 character
+func truncateTag(tag string, maxSize int) string {
+	if maxSize <= 0 {
+		return ""
+	}
+	if len(tag) <= maxSize {
+		return tag
+	}
+	n := maxSize
+	for n > 0 && !utf8.RuneStart(tag[n]) {
+		n--
+	}
+	return tag[:n]
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderCoinBaseTag(t *testing.T) {
+	cfg := &Config{Name: "pool1", Id: 3, PoolName: "btc"}
+	tag := renderCoinBaseTag("/{pool}/{node}-{nodeId}/{height}/{counter}/", cfg, 1827, 12)
+	if tag != "/btc/pool1-3/1827/12/" {
+		t.Errorf("Unexpected coinbase tag %s", tag)
+	}
+}
+
+func TestValidateCoinBaseTag(t *testing.T) {
+	cfg := &Config{Name: "pool1", Id: 3, PoolName: "btc", CoinBaseExtraData: "/btcpool/{node}/{counter}/"}
+	if err := validateCoinBaseTag(cfg, 8); err != nil {
+		t.Error(err)
+	}
+	cfg.CoinBaseExtraData = strings.Repeat("x", 100)
+	if err := validateCoinBaseTag(cfg, 8); err == nil {
+		t.Error("Oversized coinbase tag must be rejected")
+	}
+}
+
+func TestTruncateTag(t *testing.T) {
+	if tag := truncateTag("/pool/", 4); tag != "/poo" {
+		t.Errorf("Unexpected tag %q", tag)
+	}
+	// "é" takes 2 bytes, the cut would fall inside it
+	if tag := truncateTag("/poolé/", 6); tag != "/pool" {
+		t.Errorf("Tag must not split a character, got %q", tag)
+	}
+	if tag := truncateTag("/pool/", 0); tag != "" {
+		t.Errorf("Unexpected tag %q", tag)
+	}
+}
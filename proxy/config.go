@@ -1,10 +1,15 @@
 package proxy
 
 import (
+	"fmt"
+	"net"
+	"regexp"
+
 	"github.com/PowPool/btcpool/api"
 	"github.com/PowPool/btcpool/payouts"
 	"github.com/PowPool/btcpool/policy"
 	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
 )
 
 type Config struct {
@@ -21,8 +26,18 @@ type Config struct {
 
 	Threads int `json:"threads"`
 
-	Coin  string         `json:"coin"`
-	Redis storage.Config `json:"redis"`
+	Coin string `json:"coin"`
+	// Redis key prefix, defaults to the coin
+	Prefix string         `json:"prefix"`
+	Redis  storage.Config `json:"redis"`
+	// Blocks, balances and payments, shares and stats stay in Redis
+	SQL storage.SQLConfig `json:"sql"`
+
+	// Several coin pools hosted by one process, the top level pool settings are ignored if set
+	Pools    []Pool `json:"pools"`
+	PoolName string `json:"-"`
+
+	Alert AlertConfig `json:"alert"`
 
 	BlockUnlocker payouts.UnlockerConfig `json:"unlocker"`
 	Payouts       payouts.PayoutsConfig  `json:"payouts"`
@@ -35,6 +50,109 @@ type Config struct {
 	NewrelicEnabled bool   `json:"newrelicEnabled"`
 }
 
+type Pool struct {
+	Name                      string                 `json:"name"`
+	Coin                      string                 `json:"coin"`
+	Prefix                    string                 `json:"prefix"`
+	Proxy                     Proxy                  `json:"proxy"`
+	Upstream                  []Upstream             `json:"upstream"`
+	UpstreamCheckInterval     string                 `json:"upstreamCheckInterval"`
+	UpstreamCoinBaseEncrypted string                 `json:"upstreamCoinBaseEncrypted"`
+	BlockUnlocker             payouts.UnlockerConfig `json:"unlocker"`
+	Payouts                   payouts.PayoutsConfig  `json:"payouts"`
+	CoinBaseExtraData         string                 `json:"coinbaseExtraData"`
+}
+
+var poolNamePattern = regexp.MustCompile("^[a-z0-9_-]+$")
+
+// Expand the configuration into one config per hosted pool, each with its own Redis prefix
+func (c *Config) PoolConfigs() ([]*Config, error) {
+	if len(c.Pools) == 0 {
+		pool := *c
+		if len(pool.Prefix) == 0 {
+			pool.Prefix = pool.Coin
+		}
+		pool.PoolName = pool.Coin
+		if err := pool.Proxy.Stratum.SessionResume.check(); err != nil {
+			return nil, err
+		}
+		return []*Config{&pool}, nil
+	}
+
+	names := make(map[string]struct{})
+	prefixes := make(map[string]struct{})
+	ports := make(map[string]string)
+	if c.Api.Enabled {
+		if err := claimPort(ports, c.Api.Listen, "api"); err != nil {
+			return nil, err
+		}
+	}
+	var pools []*Config
+	for _, p := range c.Pools {
+		pool := *c
+		pool.Pools = nil
+		pool.PoolName = p.Name
+		pool.Coin = p.Coin
+		pool.Prefix = p.Prefix
+		pool.Proxy = p.Proxy
+		pool.Upstream = p.Upstream
+		pool.UpstreamCheckInterval = p.UpstreamCheckInterval
+		pool.UpstreamCoinBaseEncrypted = p.UpstreamCoinBaseEncrypted
+		pool.BlockUnlocker = p.BlockUnlocker
+		pool.Payouts = p.Payouts
+		pool.CoinBaseExtraData = p.CoinBaseExtraData
+		if len(pool.PoolName) == 0 {
+			pool.PoolName = pool.Coin
+		}
+		if len(pool.Prefix) == 0 {
+			pool.Prefix = pool.PoolName
+		}
+		// names are api paths and prefixes Redis key spaces, a ':' would nest one pool in another
+		if !poolNamePattern.MatchString(pool.PoolName) {
+			return nil, fmt.Errorf("invalid pool name %q, use lowercase letters, digits, '_' and '-'", pool.PoolName)
+		}
+		if !poolNamePattern.MatchString(pool.Prefix) {
+			return nil, fmt.Errorf("invalid redis prefix %q of pool %s, use lowercase letters, digits, '_' and '-'", pool.Prefix, pool.PoolName)
+		}
+		if _, ok := names[pool.PoolName]; ok {
+			return nil, fmt.Errorf("duplicate pool name %s", pool.PoolName)
+		}
+		if _, ok := prefixes[pool.Prefix]; ok {
+			return nil, fmt.Errorf("duplicate redis prefix %s of pool %s", pool.Prefix, pool.PoolName)
+		}
+		if pool.Proxy.Enabled {
+			if err := claimPort(ports, pool.Proxy.Listen, "proxy of pool "+pool.PoolName); err != nil {
+				return nil, err
+			}
+		}
+		if err := pool.Proxy.Stratum.SessionResume.check(); err != nil {
+			return nil, fmt.Errorf("%v of pool %s", err, pool.PoolName)
+		}
+		if pool.Proxy.Stratum.Enabled {
+			if err := claimPort(ports, pool.Proxy.Stratum.Listen, "stratum of pool "+pool.PoolName); err != nil {
+				return nil, err
+			}
+		}
+		names[pool.PoolName] = struct{}{}
+		prefixes[pool.Prefix] = struct{}{}
+		pools = append(pools, &pool)
+	}
+	return pools, nil
+}
+
+// Pools listen in one process, whatever their hosts two of them can't share a port
+func claimPort(ports map[string]string, listen, owner string) error {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q of %s: %v", listen, owner, err)
+	}
+	if other, ok := ports[port]; ok {
+		return fmt.Errorf("port %s of %s is taken by %s", port, owner, other)
+	}
+	ports[port] = owner
+	return nil
+}
+
 type Proxy struct {
 	Enabled               bool   `json:"enabled"`
 	Listen                string `json:"listen"`
@@ -43,12 +161,14 @@ type Proxy struct {
 	BehindReverseProxy    bool   `json:"behindReverseProxy"`
 	BlockRefreshInterval  string `json:"blockRefreshInterval"`
 	BlockTemplateInterval string `json:"blockTemplateInterval"`
+	BlockProposal         bool   `json:"blockProposal"`
 
 	Difficulty          int64  `json:"difficulty"`
 	StateUpdateInterval string `json:"stateUpdateInterval"`
 	HashrateExpiration  string `json:"hashrateExpiration"`
 
-	Policy policy.Config `json:"policy"`
+	Policy   policy.Config `json:"policy"`
+	TxPolicy TxPolicy      `json:"txPolicy"`
 
 	MaxFails    int64 `json:"maxFails"`
 	HealthCheck bool  `json:"healthCheck"`
@@ -62,6 +182,9 @@ type Stratum struct {
 	Listen  string `json:"listen"`
 	Timeout string `json:"timeout"`
 	MaxConn int    `json:"maxConn"`
+
+	ExtraNonce    ExtraNonce    `json:"extraNonce"`
+	SessionResume SessionResume `json:"sessionResume"`
 }
 
 type DiffAdjust struct {
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/PowPool/btcpool/api"
+)
+
+func TestPoolConfigsSinglePool(t *testing.T) {
+	cfg := Config{Coin: "btc", Name: "pool1"}
+	pools, err := cfg.PoolConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 1 || pools[0].Prefix != "btc" || pools[0].PoolName != "btc" || pools[0].Name != "pool1" {
+		t.Errorf("Unexpected single pool config: %+v", pools)
+	}
+
+	cfg.Proxy.Stratum.SessionResume = SessionResume{Enabled: true, Expire: "0s"}
+	if _, err = cfg.PoolConfigs(); err == nil {
+		t.Error("Zero session resume expire must be rejected")
+	}
+	cfg.Proxy.Stratum.SessionResume.Expire = "3m"
+	if _, err = cfg.PoolConfigs(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPoolConfigsMultiPool(t *testing.T) {
+	cfg := Config{Coin: "btc", Name: "pool1", Id: 7}
+	cfg.Pools = []Pool{
+		{Name: "btc", Coin: "btc", Proxy: Proxy{Stratum: Stratum{Listen: "0.0.0.0:3333"}}},
+		{Name: "ltc", Coin: "ltc", Prefix: "litecoin", Proxy: Proxy{Stratum: Stratum{Listen: "0.0.0.0:3334"}}},
+	}
+	pools, err := cfg.PoolConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 {
+		t.Fatalf("Expected 2 pools, got %v", len(pools))
+	}
+	if pools[0].Prefix != "btc" || pools[1].Prefix != "litecoin" || pools[1].Coin != "ltc" {
+		t.Error("Wrong pool prefixes")
+	}
+	if pools[1].Proxy.Stratum.Listen != "0.0.0.0:3334" || pools[1].Id != 7 || len(pools[1].Pools) != 0 {
+		t.Error("Pool config must override pool settings and keep node settings")
+	}
+
+	cfg.Pools[1].Prefix = "btc"
+	_, err = cfg.PoolConfigs()
+	if err == nil {
+		t.Error("Duplicate redis prefix must be rejected")
+	}
+	cfg.Pools[1].Prefix = "btc:test"
+	if _, err = cfg.PoolConfigs(); err == nil {
+		t.Error("Redis prefix nested in another must be rejected")
+	}
+	cfg.Pools[1].Prefix = "litecoin"
+	cfg.Pools[1].Name = "ltc main"
+	if _, err = cfg.PoolConfigs(); err == nil {
+		t.Error("Pool name unfit for an api path must be rejected")
+	}
+}
+
+func TestPoolConfigsDuplicatePorts(t *testing.T) {
+	cfg := Config{Coin: "btc", Name: "pool1"}
+	cfg.Api = api.ApiConfig{Enabled: true, Listen: "0.0.0.0:8080"}
+	cfg.Pools = []Pool{
+		{Name: "btc", Coin: "btc", Proxy: Proxy{Enabled: true, Listen: "0.0.0.0:8888",
+			Stratum: Stratum{Enabled: true, Listen: "0.0.0.0:3333"}}},
+		{Name: "ltc", Coin: "ltc", Proxy: Proxy{Stratum: Stratum{Enabled: true, Listen: "127.0.0.1:3334"}}},
+	}
+	if _, err := cfg.PoolConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Pools[1].Proxy.Stratum.Listen = "127.0.0.1:3333"
+	if _, err := cfg.PoolConfigs(); err == nil {
+		t.Error("Stratum port of another pool must be rejected")
+	}
+	cfg.Pools[1].Proxy.Stratum.Listen = ":8080"
+	if _, err := cfg.PoolConfigs(); err == nil {
+		t.Error("Stratum port of the api must be rejected")
+	}
+	cfg.Pools[1].Proxy.Stratum.Enabled = false
+	if _, err := cfg.PoolConfigs(); err != nil {
+		t.Errorf("Disabled stratum must not take a port: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PowPool/btcpool/bitcoin"
+)
+
+type ExtraNonce struct {
+	// Bytes of the extranonce1 holding node id and session tag
+	ExtraNonce1Size int `json:"extraNonce1Size"`
+	ExtraNonce2Size int `json:"extraNonce2Size"`
+	// Bits of the extranonce1 used for the node id, the rest is the session tag
+	NodeBits int `json:"nodeBits"`
+	// Bytes of extranonce2 left to proxy clients to split between their own miners,
+	// regular miners get them as zeros appended to their extranonce1
+	ProxyPrefixSize int `json:"proxyPrefixSize"`
+	// mining.subscribe user agent prefixes of proxy clients
+	ProxyAgents []string `json:"proxyAgents"`
+	// Minimum time before a session tag is handed out again
+	TagReuseDelay string `json:"tagReuseDelay"`
+}
+
+type extraNonceLayout struct {
+	nodeId          uint64
+	size1           int
+	size2           int
+	sessionBits     uint
+	proxyPrefixSize int
+	proxyAgents     []string
+}
+
+func newExtraNonceLayout(cfg *ExtraNonce, nodeId uint16, maxConn int) (*extraNonceLayout, error) {
+	l := &extraNonceLayout{
+		nodeId:          uint64(nodeId),
+		size1:           cfg.ExtraNonce1Size,
+		size2:           cfg.ExtraNonce2Size,
+		proxyPrefixSize: cfg.ProxyPrefixSize,
+	}
+	if l.size1 == 0 {
+		l.size1 = bitcoin.EXTRANONCE1_SIZE
+	}
+	if l.size2 == 0 {
+		l.size2 = bitcoin.EXTRANONCE2_SIZE
+	}
+	nodeBits := cfg.NodeBits
+	if nodeBits == 0 {
+		nodeBits = 16
+	}
+	for _, agent := range cfg.ProxyAgents {
+		l.proxyAgents = append(l.proxyAgents, strings.ToLower(agent))
+	}
+
+	if l.size1 < 1 || l.size1 > 8 {
+		return nil, errors.New("extraNonce1Size must be 1 to 8 bytes")
+	}
+	if nodeBits < 0 || nodeBits >= l.size1*8 {
+		return nil, errors.New("nodeBits leaves no room for session tags")
+	}
+	if l.nodeId >= 1<<uint(nodeBits) {
+		return nil, fmt.Errorf("node id %d does not fit in %d bits", nodeId, nodeBits)
+	}
+	l.sessionBits = uint(l.size1*8 - nodeBits)
+	if l.sessionBits > 32 {
+		return nil, errors.New("session tags are limited to 32 bits")
+	}
+	if maxConn > 1<<l.sessionBits {
+		return nil, fmt.Errorf("maxConn %d exceeds the %d session tags", maxConn, 1<<l.sessionBits)
+	}
+	if l.proxyPrefixSize < 0 || l.size2-l.proxyPrefixSize < 2 {
+		return nil, errors.New("extraNonce2Size must keep at least 2 bytes to miners")
+	}
+	if l.size1+l.size2 > bitcoin.MAX_EXTRANONCE_SIZE {
+		return nil, errors.New("extra nonces too large")
+	}
+	return l, nil
+}
+
+// Total extra nonce bytes in the coinbase
+func (l *extraNonceLayout) size() int {
+	return l.size1 + l.size2
+}
+
+func (l *extraNonceLayout) isProxyAgent(agent string) bool {
+	agent = strings.ToLower(agent)
+	for _, prefix := range l.proxyAgents {
+		if strings.HasPrefix(agent, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Node id and session tag part of an extranonce1
+func (l *extraNonceLayout) prefix(tag uint32) string {
+	return fmt.Sprintf("%0*x", l.size1*2, l.nodeId<<l.sessionBits|uint64(tag))
+}
+
+// Node id and session tag of an extranonce1 handed out by any node of the cluster
+func (l *extraNonceLayout) parse(extraNonce1 string) (uint64, uint32, error) {
+	if len(extraNonce1) < l.size1*2 {
+		return 0, 0, errors.New("extranonce1 too short")
+	}
+	v, err := strconv.ParseUint(extraNonce1[:l.size1*2], 16, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return v >> l.sessionBits, uint32(v & (1<<l.sessionBits - 1)), nil
+}
+
+// Extranonce1 hex and extranonce2 size of a session
+func (l *extraNonceLayout) assign(tag uint32, proxyClient bool) (string, int) {
+	extraNonce1 := l.prefix(tag)
+	if proxyClient {
+		return extraNonce1, l.size2
+	}
+	return extraNonce1 + strings.Repeat("00", l.proxyPrefixSize), l.size2 - l.proxyPrefixSize
+}
+
+type releasedTag struct {
+	tag        uint32
+	releasedAt time.Time
+}
+
+// Session tags are handed out fresh first, then oldest released first, and never
+// again before the reuse delay so shares of a gone session can't collide with a new one
+type tagPool struct {
+	sync.Mutex
+	capacity   uint64
+	next       uint64
+	released   *list.List
+	reuseDelay time.Duration
+	// fresh tags taken by resumed sessions
+	claimed map[uint32]struct{}
+}
+
+func newTagPool(sessionBits uint, reuseDelay time.Duration) *tagPool {
+	return &tagPool{capacity: 1 << sessionBits, released: list.New(), reuseDelay: reuseDelay,
+		claimed: make(map[uint32]struct{})}
+}
+
+func (p *tagPool) acquire() (uint32, bool) {
+	p.Lock()
+	defer p.Unlock()
+	for p.next < p.capacity {
+		tag := uint32(p.next)
+		p.next++
+		if _, ok := p.claimed[tag]; ok {
+			delete(p.claimed, tag)
+			continue
+		}
+		return tag, true
+	}
+	front := p.released.Front()
+	if front == nil {
+		return 0, false
+	}
+	r := front.Value.(releasedTag)
+	if time.Since(r.releasedAt) < p.reuseDelay {
+		return 0, false
+	}
+	p.released.Remove(front)
+	return r.tag, true
+}
+
+// Take a specific tag back for a resumed session, fails if it is in use
+func (p *tagPool) claim(tag uint32) bool {
+	p.Lock()
+	defer p.Unlock()
+	if uint64(tag) >= p.capacity {
+		return false
+	}
+	if uint64(tag) >= p.next {
+		if _, ok := p.claimed[tag]; ok {
+			return false
+		}
+		p.claimed[tag] = struct{}{}
+		return true
+	}
+	for e := p.released.Front(); e != nil; e = e.Next() {
+		if e.Value.(releasedTag).tag == tag {
+			p.released.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *tagPool) release(tag uint32) {
+	p.Lock()
+	defer p.Unlock()
+	p.released.PushBack(releasedTag{tag: tag, releasedAt: time.Now()})
+}
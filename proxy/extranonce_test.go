@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExtraNonceDefaultLayout(t *testing.T) {
+	l, err := newExtraNonceLayout(&ExtraNonce{}, 2, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extraNonce1, extraNonce2Size := l.assign(5, false)
+	if extraNonce1 != "00020005" || extraNonce2Size != 4 {
+		t.Errorf("Unexpected default extranonce %v/%v", extraNonce1, extraNonce2Size)
+	}
+}
+
+func TestExtraNonceProxyPrefix(t *testing.T) {
+	cfg := &ExtraNonce{ExtraNonce1Size: 4, ExtraNonce2Size: 8, NodeBits: 8, ProxyPrefixSize: 4, ProxyAgents: []string{"NiceHash"}}
+	l, err := newExtraNonceLayout(cfg, 3, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.size() != 12 {
+		t.Errorf("Expected 12 bytes of extra nonces, got %v", l.size())
+	}
+	extraNonce1, extraNonce2Size := l.assign(0x10203, false)
+	if extraNonce1 != "0301020300000000" || extraNonce2Size != 4 {
+		t.Errorf("Unexpected miner extranonce %v/%v", extraNonce1, extraNonce2Size)
+	}
+	if !l.isProxyAgent("nicehash/1.0") || l.isProxyAgent("cgminer/4.10") {
+		t.Error("Wrong proxy agent matching")
+	}
+	extraNonce1, extraNonce2Size = l.assign(0x10203, true)
+	if extraNonce1 != "03010203" || extraNonce2Size != 8 {
+		t.Errorf("Unexpected proxy extranonce %v/%v", extraNonce1, extraNonce2Size)
+	}
+}
+
+func TestExtraNonceLayoutValidation(t *testing.T) {
+	if _, err := newExtraNonceLayout(&ExtraNonce{NodeBits: 8}, 256, 10); err == nil {
+		t.Error("Node id above node bits must be rejected")
+	}
+	if _, err := newExtraNonceLayout(&ExtraNonce{}, 1, 70000); err == nil {
+		t.Error("maxConn above session tags must be rejected")
+	}
+	if _, err := newExtraNonceLayout(&ExtraNonce{ProxyPrefixSize: 3}, 1, 10); err == nil {
+		t.Error("Proxy prefix must leave extranonce2 to miners")
+	}
+}
+
+func TestTagPoolReuseDelay(t *testing.T) {
+	p := newTagPool(1, time.Hour)
+	tag1, _ := p.acquire()
+	tag2, _ := p.acquire()
+	if tag1 == tag2 {
+		t.Error("Fresh tags must differ")
+	}
+	if _, ok := p.acquire(); ok {
+		t.Error("Pool must be exhausted")
+	}
+	p.release(tag1)
+	if _, ok := p.acquire(); ok {
+		t.Error("Released tag must not be reused before the delay")
+	}
+
+	p = newTagPool(1, 0)
+	tag1, _ = p.acquire()
+	tag2, _ = p.acquire()
+	p.release(tag2)
+	p.release(tag1)
+	if tag, ok := p.acquire(); !ok || tag != tag2 {
+		t.Error("Oldest released tag must be reused first")
+	}
+}
+
+func TestExtraNonceParse(t *testing.T) {
+	l, err := newExtraNonceLayout(&ExtraNonce{ProxyPrefixSize: 2}, 3, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extraNonce1, _ := l.assign(0x1a, false)
+	nodeId, tag, err := l.parse(extraNonce1)
+	if err != nil || nodeId != 3 || tag != 0x1a {
+		t.Errorf("Unexpected parse of %v: %v/%v/%v", extraNonce1, nodeId, tag, err)
+	}
+	if _, _, err = l.parse("0003"); err == nil {
+		t.Error("Short extranonce1 must be rejected")
+	}
+}
+
+func TestTagPoolClaim(t *testing.T) {
+	p := newTagPool(2, time.Hour)
+	if !p.claim(2) || p.claim(2) {
+		t.Error("Fresh tag must be claimed once")
+	}
+	for i := 0; i < 3; i++ {
+		if tag, ok := p.acquire(); !ok || tag == 2 {
+			t.Errorf("Claimed tag must be skipped, got %v/%v", tag, ok)
+		}
+	}
+	if _, ok := p.acquire(); ok {
+		t.Error("Pool must be exhausted")
+	}
+	if p.claim(1) {
+		t.Error("Tag in use must not be claimed")
+	}
+	p.release(1)
+	if !p.claim(1) {
+		t.Error("Released tag must be claimed regardless of the reuse delay")
+	}
+}
@@ -2,12 +2,11 @@ package proxy
 
 import (
 	"encoding/hex"
-	"fmt"
-	"github.com/PowPool/btcpool/bitcoin"
 	"github.com/mutalisk999/bitcoin-lib/src/utility"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	//"github.com/PowPool/btcpool/rpc"
 	. "github.com/PowPool/btcpool/util"
@@ -15,24 +14,47 @@ import (
 
 var noncePattern = regexp.MustCompile("^[0-9a-f]{8}$")
 var hashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+var sidPattern = regexp.MustCompile("^[0-9a-f]{32}$")
 var workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_\x2e]{1,64}$")
 
+func isHexOfSize(s string, size int) bool {
+	if len(s) != size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
 // Stratum
-func (s *ProxyServer) handleSubscribeRPC(cs *Session) (interface{}, *ErrorReply) {
-	cs.target = s.target
-	// at first time, target is the same with targetNextJob
-	cs.targetNextJob = s.target
-	s.registerSession(cs)
+func (s *ProxyServer) handleSubscribeRPC(cs *Session, agent, sessionId string) (interface{}, *ErrorReply) {
+	// the broadcast and the lease renewal read the session, keep it out of them while it is set up
+	s.removeSession(cs)
 	Info.Printf("Stratum miner connected from %v", cs.ip)
 
-	cs.sid = hex.EncodeToString(utility.Sha256(
-		[]byte(strings.Join([]string{cs.ip, strconv.Itoa(int(s.config.Id)), strconv.Itoa(int(cs.tag))}, ","))))[0:32]
-	cs.extraNonce1 = fmt.Sprintf("%08x", uint32(s.config.Id)<<16|uint32(cs.tag))
+	resumed := false
+	if s.config.Proxy.Stratum.SessionResume.Enabled && sidPattern.MatchString(sessionId) {
+		resumed = s.resumeSession(cs, sessionId)
+	}
+	if !resumed {
+		cs.target = s.target
+		// at first time, target is the same with targetNextJob
+		cs.targetNextJob = s.target
+
+		cs.sid = hex.EncodeToString(utility.Sha256(
+			[]byte(strings.Join([]string{cs.ip, strconv.Itoa(int(s.config.Id)), strconv.Itoa(int(cs.tag)),
+				strconv.FormatInt(time.Now().UnixNano(), 10)}, ","))))[0:32]
+		proxyClient := s.extraNonce.isProxyAgent(agent)
+		cs.extraNonce1, cs.extraNonce2Size = s.extraNonce.assign(cs.tag, proxyClient)
+		if proxyClient {
+			Info.Printf("Stratum proxy client %v from %v gets extranonce prefix %v", agent, cs.ip, cs.extraNonce1)
+		}
+	}
+	s.registerSession(cs)
 
 	setDiff := []string{"mining.set_difficulty", cs.sid}
 	notify := []string{"mining.notify", cs.sid}
 	l := []interface{}{setDiff, notify}
-	reply := []interface{}{l, cs.extraNonce1, bitcoin.EXTRANONCE2_SIZE}
+	reply := []interface{}{l, cs.extraNonce1, cs.extraNonce2Size}
 
 	return reply, nil
 }
@@ -43,7 +65,8 @@ func (s *ProxyServer) handleAuthorizeRPC(cs *Session, params []string) (bool, *E
 	}
 
 	l := strings.Split(strings.Trim(params[0], " \t\r\n"), ".")
-	if !IsValidBTCAddress(l[0]) {
+	l[0] = s.coin.NormalizeAddress(l[0])
+	if !s.coin.IsValidAddress(l[0]) {
 		return false, &ErrorReply{Code: -1, Message: "Invalid authorize"}
 	}
 	if !s.policy.ApplyLoginPolicy(l[0], cs.ip) {
@@ -54,6 +77,9 @@ func (s *ProxyServer) handleAuthorizeRPC(cs *Session, params []string) (bool, *E
 	if len(l) > 1 && workerPattern.MatchString(l[1]) {
 		id = l[1]
 	}
+	if len(cs.resumedLogin) > 0 && (cs.resumedLogin != l[0] || cs.resumedId != id) {
+		return false, &ErrorReply{Code: -1, Message: "Session belongs to another worker"}
+	}
 
 	cs.login = l[0]
 	cs.id = id
@@ -82,7 +108,7 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, params []string) (bool, *Erro
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
-	if !noncePattern.MatchString(params[2]) || !noncePattern.MatchString(params[3]) || !noncePattern.MatchString(params[4]) {
+	if !isHexOfSize(params[2], cs.extraNonce2Size) || !noncePattern.MatchString(params[3]) || !noncePattern.MatchString(params[4]) {
 		s.policy.ApplyMalformedPolicy(cs.ip)
 		Error.Printf("Malformed PoW result from %s@%s %v", cs.login, cs.ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/policy"
+)
+
+func TestAuthorizeResumedSession(t *testing.T) {
+	s := &ProxyServer{coin: bitcoin.Bitcoin, policy: &policy.PolicyServer{}}
+	cs := &Session{resumedLogin: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq", resumedId: "rig"}
+
+	if ok, _ := s.handleAuthorizeRPC(cs, []string{"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa.rig"}); ok || cs.isAuth {
+		t.Error("Must not resume the session of another login")
+	}
+	if ok, _ := s.handleAuthorizeRPC(cs, []string{"bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq.other"}); ok || cs.isAuth {
+		t.Error("Must not resume the session of another worker")
+	}
+	if ok, _ := s.handleAuthorizeRPC(cs, []string{"bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq.rig"}); !ok || !cs.isAuth {
+		t.Error("Must resume the session of the same worker")
+	}
+}
@@ -3,6 +3,8 @@ package proxy
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"github.com/PowPool/btcpool/bitcoin"
 	. "github.com/PowPool/btcpool/util"
 	"github.com/mutalisk999/bitcoin-lib/src/blob"
 	"github.com/mutalisk999/bitcoin-lib/src/block"
@@ -12,6 +14,7 @@ import (
 	"io"
 	"math/big"
 	"strconv"
+	"sync/atomic"
 )
 
 func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int64, t *BlockTemplate, params []string) (bool, bool) {
@@ -63,7 +66,7 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 		sNonce:       nonceHex,
 	}
 
-	if !DoubleSha256HashVerify(&share) {
+	if !PowHashVerify(&share, s.coin) {
 		ms := MakeTimestamp()
 		ts := ms / 1000
 
@@ -75,20 +78,26 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 	}
 
 	paramIn := []string{nonceHex, eNonce1, eNonce2Hex}
-	if DoubleSha256HashVerify(&block) {
+	if PowHashVerify(&block, s.coin) {
 		// construct new block
 		rawBlockHex, err := ConstructRawBlockHex(&block, &h, t)
 		if err != nil {
 			return false, false
 		}
+		blockHash, err := BlockHash(&block)
+		if err != nil {
+			Error.Printf("Failed to hash block at height %v: %v", t.Height, err)
+			return false, false
+		}
 		err = s.rpc().SubmitBlock([]interface{}{rawBlockHex})
 		if err != nil {
 			Error.Printf("Block submission failure at height %v for %v: %v", t.Height, t.PrevHash, err)
 			BlockLog.Printf("Block submission failure at height %v for %v: %v", t.Height, t.PrevHash, err)
 		} else {
+			atomic.AddInt64(&s.blocksFound, 1)
 			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, paramIn, shareDiff, t.Difficulty.Int64(), uint64(t.Height),
-				h.CoinBaseValue, h.JobTxsFeeTotal, s.hashrateExpiration)
+			exist, err := s.backend.WriteBlock(login, id, paramIn, blockHash, shareDiff, t.Difficulty.Int64(), uint64(t.Height),
+				h.CoinBaseValue, h.JobTxsFeeTotal, s.config.Name, h.CoinBaseTag, s.hashrateExpiration, s.shareAccounting(shareDiff, t, &h))
 			if exist {
 				ms := MakeTimestamp()
 				ts := ms / 1000
@@ -106,11 +115,12 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 				Info.Printf("Inserted block %v to backend", t.Height)
 				BlockLog.Printf("Inserted block %v to backend", t.Height)
 			}
-			Info.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
-			BlockLog.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
+			Info.Printf("Block %v found by miner %v@%v at height %d on node %s with tag %q", blockHash, login, ip, t.Height, s.config.Name, h.CoinBaseTag)
+			BlockLog.Printf("Block %v found by miner %v@%v at height %d on node %s with tag %q", blockHash, login, ip, t.Height, s.config.Name, h.CoinBaseTag)
 		}
 	} else {
-		exist, err := s.backend.WriteShare(login, id, paramIn, shareDiff, uint64(t.Height), s.hashrateExpiration)
+		exist, err := s.backend.WriteShare(login, id, paramIn, shareDiff, uint64(t.Height), s.hashrateExpiration,
+			s.shareAccounting(shareDiff, t, &h))
 		if exist {
 			ms := MakeTimestamp()
 			ts := ms / 1000
@@ -128,26 +138,23 @@ func (s *ProxyServer) processShare(login, id, eNonce1, ip string, shareDiff int6
 	return false, true
 }
 
-func DoubleSha256HashVerify(oBlock *Block) bool {
+// Serialized 80 byte header of the block
+func packBlockHeader(oBlock *Block) ([]byte, error) {
 	bytes1, err := hex.DecodeString(oBlock.coinBase1)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: hex decode coinBase1 error")
-		return false
+		return nil, errors.New("hex decode coinBase1 error")
 	}
 	bytes2, err := hex.DecodeString(oBlock.extraNonce1)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: hex decode extraNonce1 error")
-		return false
+		return nil, errors.New("hex decode extraNonce1 error")
 	}
 	bytes3, err := hex.DecodeString(oBlock.extraNonce2)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: hex decode extraNonce2 error")
-		return false
+		return nil, errors.New("hex decode extraNonce2 error")
 	}
 	bytes4, err := hex.DecodeString(oBlock.coinBase2)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: hex decode coinBase2 error")
-		return false
+		return nil, errors.New("hex decode coinBase2 error")
 	}
 
 	Debug.Printf("block.coinBase1: %s", oBlock.coinBase1)
@@ -162,15 +169,13 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	var cbTrx transaction.Transaction
 	err = cbTrx.UnPack(bufReader)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: unpack coinBase transaction error")
-		return false
+		return nil, errors.New("unpack coinBase transaction error")
 	}
 
 	// get coin base transaction id
 	cbTrxId, err := cbTrx.CalcTrxId()
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: CalcTrxId error")
-		return false
+		return nil, errors.New("CalcTrxId error")
 	}
 
 	Debug.Printf("coinBase trx id: %s", cbTrxId.GetHex())
@@ -179,8 +184,7 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	// get merkle root hash
 	merkleRootHex, err := txid_merkle_tree.GetMerkleRootHexFromCoinBaseAndMerkleBranch(cbTrxId.GetHex(), oBlock.merkleBranch)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
-		return false
+		return nil, errors.New("GetMerkleRootHexFromCoinBaseAndMerkleBranch error")
 	}
 
 	Debug.Printf("merkleRootHex: %s", merkleRootHex)
@@ -190,25 +194,21 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	blockHeader.Version = int32(oBlock.nVersion)
 	err = blockHeader.HashPrevBlock.SetHex(oBlock.prevHash)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: HashPrevBlock SetHex error")
-		return false
+		return nil, errors.New("HashPrevBlock SetHex error")
 	}
 	err = blockHeader.HashMerkleRoot.SetHex(merkleRootHex)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: HashMerkleRoot SetHex error")
-		return false
+		return nil, errors.New("HashMerkleRoot SetHex error")
 	}
 	nTime, err := strconv.ParseUint(oBlock.sTime, 16, 32)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: ParseUint sTime error")
-		return false
+		return nil, errors.New("ParseUint sTime error")
 	}
 	blockHeader.Time = uint32(nTime)
 	blockHeader.Bits = oBlock.nBits
 	nNonce, err := strconv.ParseUint(oBlock.sNonce, 16, 32)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: ParseUint sNonce error")
-		return false
+		return nil, errors.New("ParseUint sNonce error")
 	}
 	blockHeader.Nonce = uint32(nNonce)
 
@@ -216,8 +216,7 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	bufWriter := io.Writer(bytesBuf)
 	err = blockHeader.Pack(bufWriter)
 	if err != nil {
-		Error.Println("DoubleSha256HashVerify: blockHeader Pack error")
-		return false
+		return nil, errors.New("blockHeader Pack error")
 	}
 
 	Debug.Printf("blockHeader.Version: %d", blockHeader.Version)
@@ -228,9 +227,22 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 	Debug.Printf("blockHeader.Nonce: %d", blockHeader.Nonce)
 
 	Debug.Printf("blockHeader Hex: %s", hex.EncodeToString(bytesBuf.Bytes()))
+	return bytesBuf.Bytes(), nil
+}
 
-	// calc block header hash (double sha256)
-	bytesRes := utility.Sha256(utility.Sha256(bytesBuf.Bytes()))
+func PowHashVerify(oBlock *Block, coin *bitcoin.CoinParams) bool {
+	header, err := packBlockHeader(oBlock)
+	if err != nil {
+		Error.Println("PowHashVerify:", err)
+		return false
+	}
+
+	// calc block header hash with the coin's pow function
+	bytesRes, err := coin.PowHash(header)
+	if err != nil {
+		Error.Println("PowHashVerify: PowHash error")
+		return false
+	}
 	var res blob.Baseblob
 	res.SetData(bytesRes)
 	resHex := res.GetHex()
@@ -245,3 +257,14 @@ func DoubleSha256HashVerify(oBlock *Block) bool {
 		return false
 	}
 }
+
+// Block hash as shown by the node, double SHA256 of the header whatever the PoW function
+func BlockHash(oBlock *Block) (string, error) {
+	header, err := packBlockHeader(oBlock)
+	if err != nil {
+		return "", err
+	}
+	var hash blob.Baseblob
+	hash.SetData(utility.Sha256(utility.Sha256(header)))
+	return hash.GetHex(), nil
+}
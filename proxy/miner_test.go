@@ -3,10 +3,27 @@ package proxy
 import (
 	"encoding/hex"
 	"fmt"
-	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	. "github.com/PowPool/btcpool/util"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
 )
 
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		panic(err)
+	}
+	InitLog(filepath.Join(dir, "info.log"), filepath.Join(dir, "error.log"),
+		filepath.Join(dir, "share.log"), filepath.Join(dir, "block.log"), ERROR)
+	c := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(c)
+}
+
 func TestDoubleSha256Hash(t *testing.T) {
 	//"adf6e2e56df692822f5e064a8b6404a05d67cccd64bc90f57f65b46805e9a54b"
 	b1, _ := hex.DecodeString("01000000f615f7ce3b4fc6b8f61e8f89aedb1d0852507650533a9e3b10b9bbcc30639f279fcaa86746e1ef52d3edb3c4ad8259920d509bd073605c9bf1d59983752a6b06b817bb4ea78e011d012d59d4")
@@ -17,3 +34,22 @@ func TestDoubleSha256Hash(t *testing.T) {
 	}
 	fmt.Println("b1r: ", hex.EncodeToString(b1r))
 }
+
+func TestBlockHash(t *testing.T) {
+	// Genesis block, the coinbase split around empty extra nonces
+	genesis := Block{
+		coinBase1: "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000",
+		nVersion:  1,
+		prevHash:  "0000000000000000000000000000000000000000000000000000000000000000",
+		sTime:     "495fab29",
+		nBits:     0x1d00ffff,
+		sNonce:    "7c2bac1d",
+	}
+	hash, err := BlockHash(&genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f" {
+		t.Errorf("Unexpected block hash %v", hash)
+	}
+}
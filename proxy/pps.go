@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/PowPool/btcpool/storage"
+)
+
+// Fees of the latest template at each recent height, averaged for the FPPS fee component
+type feeSampler struct {
+	sync.Mutex
+	size    int
+	heights []uint32
+	fees    []int64
+}
+
+func newFeeSampler(size int) *feeSampler {
+	return &feeSampler{size: size}
+}
+
+func (f *feeSampler) observe(height uint32, fees int64) {
+	f.Lock()
+	defer f.Unlock()
+	if n := len(f.heights); n > 0 && f.heights[n-1] == height {
+		f.fees[n-1] = fees
+		return
+	}
+	f.heights = append(f.heights, height)
+	f.fees = append(f.fees, fees)
+	if len(f.heights) > f.size {
+		f.heights = f.heights[1:]
+		f.fees = f.fees[1:]
+	}
+}
+
+func (f *feeSampler) average() int64 {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.fees) == 0 {
+		return 0
+	}
+	total := int64(0)
+	for _, fee := range f.fees {
+		total += fee
+	}
+	return total / int64(len(f.fees))
+}
+
+// Reward accounting of an accepted share under the pool's reward scheme
+func (s *ProxyServer) shareAccounting(shareDiff int64, t *BlockTemplate, h *BlockTemplateJob) storage.ShareAccounting {
+	cfg := &s.config.BlockUnlocker
+	acc := storage.ShareAccounting{PPLNSShares: cfg.PPLNSShares(), ScoreDecay: s.scoreDecay}
+	if cfg.PaysPerShare() {
+		subsidy := h.CoinBaseValue - h.JobTxsFeeTotal
+		acc.Credit = cfg.ShareCredit(shareDiff, t.Difficulty.Int64(), subsidy, s.fees.average())
+	}
+	return acc
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestFeeSampler(t *testing.T) {
+	f := newFeeSampler(2)
+	if f.average() != 0 {
+		t.Error("Empty sampler must average to 0")
+	}
+	f.observe(100, 1000)
+	f.observe(100, 3000)
+	f.observe(101, 5000)
+	if avg := f.average(); avg != 4000 {
+		t.Errorf("Latest template of each height must be sampled, got %v", avg)
+	}
+	f.observe(102, 1000)
+	if avg := f.average(); avg != 3000 {
+		t.Errorf("Oldest height must be dropped, got %v", avg)
+	}
+}
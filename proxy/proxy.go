@@ -6,13 +6,13 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/PowPool/btcpool/bitcoin"
 	"github.com/PowPool/btcpool/policy"
 	"github.com/PowPool/btcpool/rpc"
 	"github.com/PowPool/btcpool/storage"
@@ -24,11 +24,27 @@ type ProxyServer struct {
 	blockTemplate      atomic.Value
 	upstream           int32
 	upstreams          []*rpc.RPCClient
-	backend            *storage.RedisClient
+	backend            storage.Backend
 	target             string
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
-	failsCount         int64
+	// Recent template fees for FPPS
+	fees *feeSampler
+	// Share score decay constant of the score scheme
+	scoreDecay time.Duration
+	failsCount int64
+	coin       *bitcoin.CoinParams
+	// Expected hashes for a stratum difficulty 1 share
+	diff1Work float64
+	// Blocks found by this node, the coinbase tag counter
+	blocksFound int64
+	extraNonce  *extraNonceLayout
+	tags        *tagPool
+	// How long a disconnected stratum session can be resumed
+	resumeExpire time.Duration
+	// Reason the node rejected the last proposed template for
+	proposalMu       sync.Mutex
+	proposalRejected string
 
 	// Stratum
 	sessionsMu sync.RWMutex
@@ -53,22 +69,50 @@ type Session struct {
 	shareCountInv int64
 
 	// Session tag
-	tag uint16
+	tag uint32
+	// false if the extranonce1 was resumed from another node
+	ownsTag bool
 	// Session id
 	sid string
 	// Session extra nonce1
-	extraNonce1 string
+	extraNonce1     string
+	extraNonce2Size int
 	// authorized
 	isAuth bool
+	// Worker a resumed session belongs to
+	resumedLogin string
+	resumedId    string
 }
 
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, backend storage.Backend) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		Error.Fatal("You must set instance name")
 	}
+	coin, err := bitcoin.GetCoinParams(cfg.Coin)
+	if err != nil {
+		Error.Fatal(err)
+	}
+	diff1Work, err := coin.Diff1Work()
+	if err != nil {
+		Error.Fatal(err)
+	}
+	extraNonce, err := newExtraNonceLayout(&cfg.Proxy.Stratum.ExtraNonce, cfg.Id, cfg.Proxy.Stratum.MaxConn)
+	if err != nil {
+		Error.Fatal("Invalid extranonce configuration: ", err)
+	}
+	err = validateCoinBaseTag(cfg, extraNonce.size())
+	if err != nil {
+		Error.Fatal(err)
+	}
+	blocksFound, err := backend.GetNodeBlocksFound(cfg.Name)
+	if err != nil {
+		Error.Printf("Failed to get blocks found by node %s from backend: %v", cfg.Name, err)
+	}
 	policyServer := policy.Start(&cfg.Proxy.Policy, backend)
 
-	proxy := &ProxyServer{config: cfg, backend: backend, policy: policyServer}
+	proxy := &ProxyServer{config: cfg, backend: backend, policy: policyServer, coin: coin, diff1Work: diff1Work,
+		blocksFound: blocksFound, extraNonce: extraNonce, fees: newFeeSampler(cfg.BlockUnlocker.FeeBlocks()),
+		scoreDecay: cfg.BlockUnlocker.ScoreDecayDuration()}
 	proxy.target = GetTargetHex(cfg.Proxy.Difficulty)
 
 	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
@@ -79,6 +123,15 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	Info.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
 	if cfg.Proxy.Stratum.Enabled {
+		reuseDelay := time.Duration(0)
+		if len(cfg.Proxy.Stratum.ExtraNonce.TagReuseDelay) > 0 {
+			reuseDelay = MustParseDuration(cfg.Proxy.Stratum.ExtraNonce.TagReuseDelay)
+		}
+		proxy.tags = newTagPool(extraNonce.sessionBits, reuseDelay)
+		if cfg.Proxy.Stratum.SessionResume.Enabled {
+			proxy.resumeExpire = MustParseDuration(cfg.Proxy.Stratum.SessionResume.Expire)
+			proxy.startLeaseRenewal()
+		}
 		proxy.sessions = make(map[*Session]struct{})
 		go proxy.ListenTCP()
 	}
@@ -131,6 +184,9 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 						proxy.markOk()
 					}
 				}
+				if err := backend.FlushCredits(); err != nil {
+					Error.Printf("Failed to settle PPS credits: %v", err)
+				}
 				stateUpdateTimer.Reset(stateUpdateIntv)
 			}
 		}
@@ -156,10 +212,10 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 }
 
 func (s *ProxyServer) Start() {
-	Info.Printf("Starting proxy on %v", s.config.Proxy.Listen)
+	Info.Printf("Starting proxy of pool %s on %v", s.config.PoolName, s.config.Proxy.Listen)
 	r := mux.NewRouter()
-	r.Handle("/{login:0x[0-9a-fA-F]{40}}/{id:[0-9a-zA-Z-_]{1,64}}", s)
-	r.Handle("/{login:0x[0-9a-fA-F]{40}}", s)
+	r.Handle("/{login:[0-9a-zA-Z:]{25,100}}/{id:[0-9a-zA-Z-_]{1,64}}", s)
+	r.Handle("/{login:[0-9a-zA-Z:]{25,100}}", s)
 	srv := &http.Server{
 		Addr:           s.config.Proxy.Listen,
 		Handler:        r,
@@ -280,9 +336,9 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 	}
 
 	vars := mux.Vars(r)
-	login := strings.ToLower(vars["login"])
+	login := s.coin.NormalizeAddress(vars["login"])
 
-	if !IsValidBTCAddress(login) {
+	if !s.coin.IsValidAddress(login) {
 		errReply := &ErrorReply{Code: -1, Message: "Invalid login"}
 		_ = cs.sendError(req.Id, errReply)
 		return
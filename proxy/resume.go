@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/PowPool/btcpool/storage"
+	. "github.com/PowPool/btcpool/util"
+)
+
+type SessionResume struct {
+	Enabled bool `json:"enabled"`
+	// How long a disconnected session can be resumed
+	Expire string `json:"expire"`
+}
+
+// Leases are renewed every expire/2, a non-positive expire would renew them in a busy loop
+func (r *SessionResume) check() error {
+	if !r.Enabled {
+		return nil
+	}
+	expire, err := time.ParseDuration(r.Expire)
+	if err != nil || expire <= 0 {
+		return fmt.Errorf("invalid session resume expire %q", r.Expire)
+	}
+	return nil
+}
+
+// Tries to find a session tag that no suspended or resumed session holds
+const maxTagAttempts = 16
+
+func (s *ProxyServer) acquireTag() (uint32, bool) {
+	for i := 0; i < maxTagAttempts; i++ {
+		tag, ok := s.tags.acquire()
+		if !ok {
+			return 0, false
+		}
+		if !s.config.Proxy.Stratum.SessionResume.Enabled {
+			return tag, true
+		}
+		leased, err := s.backend.IsExtraNonceLeased(s.extraNonce.prefix(tag))
+		if err != nil {
+			Error.Printf("Failed to check extranonce lease in backend: %v", err)
+		}
+		if !leased {
+			return tag, true
+		}
+		s.tags.release(tag)
+	}
+	return 0, false
+}
+
+// Keep the state of a disconnected session for a while so the miner can resume it
+func (s *ProxyServer) suspendSession(cs *Session) {
+	if len(cs.sid) == 0 {
+		return
+	}
+	ss := &storage.StratumSession{
+		ExtraNonce1:     cs.extraNonce1,
+		ExtraNonce2Size: cs.extraNonce2Size,
+		Target:          cs.targetNextJob,
+		Login:           cs.login,
+		Id:              cs.id,
+		Authorized:      cs.isAuth,
+		Node:            s.config.Name,
+	}
+	err := s.backend.WriteStratumSession(cs.sid, ss, s.resumeExpire)
+	if err != nil {
+		Error.Printf("Failed to write stratum session of %v@%v to backend: %v", cs.login, cs.ip, err)
+		return
+	}
+	err = s.backend.LeaseExtraNonce(cs.extraNonce1[:s.extraNonce.size1*2], s.config.Name, s.resumeExpire)
+	if err != nil {
+		Error.Printf("Failed to lease extranonce of %v@%v in backend: %v", cs.login, cs.ip, err)
+	}
+}
+
+// Restore a session suspended on this node or any other node of the cluster.
+// Shares of jobs from another node are stale, the extranonce1 still saves the miner's work split.
+func (s *ProxyServer) resumeSession(cs *Session, sid string) bool {
+	ss, err := s.backend.TakeStratumSession(sid)
+	if err != nil {
+		Error.Printf("Failed to get stratum session from backend: %v", err)
+		return false
+	}
+	if ss == nil {
+		return false
+	}
+	nodeId, tag, err := s.extraNonce.parse(ss.ExtraNonce1)
+	if err != nil || len(ss.ExtraNonce1) != s.extraNonce.size()*2-ss.ExtraNonce2Size*2 {
+		Error.Printf("Invalid stratum session %v from %v: %v", sid, ss.Node, ss.ExtraNonce1)
+		return false
+	}
+	if nodeId == s.extraNonce.nodeId {
+		if !s.tags.claim(tag) {
+			Info.Printf("Stratum session %v can't be resumed, tag %v is in use", sid, tag)
+			return false
+		}
+		s.tags.release(cs.tag)
+		cs.tag = tag
+	} else {
+		// the lease keeps the other node from handing the extranonce1 out
+		s.tags.release(cs.tag)
+		cs.ownsTag = false
+		err = s.backend.LeaseExtraNonce(ss.ExtraNonce1[:s.extraNonce.size1*2], s.config.Name, s.resumeExpire)
+		if err != nil {
+			Error.Printf("Failed to lease extranonce in backend: %v", err)
+		}
+	}
+
+	cs.sid = sid
+	cs.extraNonce1 = ss.ExtraNonce1
+	cs.extraNonce2Size = ss.ExtraNonce2Size
+	cs.target = ss.Target
+	cs.targetNextJob = ss.Target
+	// the miner must authorize again, as the same worker, before its shares count
+	cs.resumedLogin = ss.Login
+	cs.resumedId = ss.Id
+	Info.Printf("Stratum session %v of %v.%v@%v resumed from node %v", sid, ss.Login, ss.Id, cs.ip, ss.Node)
+	return true
+}
+
+// Renew the leases of sessions resumed from other nodes while they are connected
+func (s *ProxyServer) renewExtraNonceLeases() {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+
+	for cs := range s.sessions {
+		if cs.ownsTag || len(cs.extraNonce1) == 0 {
+			continue
+		}
+		err := s.backend.LeaseExtraNonce(cs.extraNonce1[:s.extraNonce.size1*2], s.config.Name, s.resumeExpire)
+		if err != nil {
+			Error.Printf("Failed to renew extranonce lease of %v@%v: %v", cs.login, cs.ip, err)
+		}
+	}
+}
+
+func (s *ProxyServer) startLeaseRenewal() {
+	intv := s.resumeExpire / 2
+	timer := time.NewTimer(intv)
+	go func() {
+		for {
+			select {
+			case <-timer.C:
+				s.renewExtraNonceLeases()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
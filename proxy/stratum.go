@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/PowPool/btcpool/bitcoin"
 	"github.com/mutalisk999/bitcoin-lib/src/bigint"
 	"io"
 	"net"
@@ -33,12 +32,7 @@ func (s *ProxyServer) ListenTCP() {
 	defer server.Close()
 
 	Info.Printf("Stratum listening on %s", s.config.Proxy.Stratum.Listen)
-	var accept = make(chan int, s.config.Proxy.Stratum.MaxConn)
-
-	tag := 0
-	for i := 0; i < s.config.Proxy.Stratum.MaxConn; i++ {
-		accept <- i
-	}
+	var accept = make(chan struct{}, s.config.Proxy.Stratum.MaxConn)
 
 	for {
 		conn, err := server.AcceptTCP()
@@ -56,17 +50,30 @@ func (s *ProxyServer) ListenTCP() {
 			continue
 		}
 
-		tag = <-accept
-		cs := &Session{conn: conn, ip: ip, shareCountInv: 0, tag: uint16(tag), isAuth: false}
+		accept <- struct{}{}
+		tag, ok := s.acquireTag()
+		if !ok {
+			Error.Printf("No session tag available for %s, all tags are in use or released recently", ip)
+			_ = conn.Close()
+			<-accept
+			continue
+		}
+		cs := &Session{conn: conn, ip: ip, shareCountInv: 0, tag: tag, ownsTag: true, isAuth: false}
 
-		go func(cs *Session, tag int) {
-			err = s.handleTCPClient(cs)
+		go func(cs *Session) {
+			err := s.handleTCPClient(cs)
 			if err != nil {
 				s.removeSession(cs)
-				_ = conn.Close()
+				_ = cs.conn.Close()
+			}
+			if s.config.Proxy.Stratum.SessionResume.Enabled {
+				s.suspendSession(cs)
 			}
-			accept <- tag
-		}(cs, tag)
+			if cs.ownsTag {
+				s.tags.release(cs.tag)
+			}
+			<-accept
+		}(cs)
 	}
 }
 
@@ -123,10 +130,15 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 			Error.Println("Malformed stratum request (mining.subscribe) params from", cs.ip)
 			return err
 		}
+		agent, sessionId := "", ""
 		if len(params) > 0 {
 			Info.Println("mining.subscribe:", params[0])
+			agent = params[0]
+		}
+		if len(params) > 1 {
+			sessionId = params[1]
 		}
-		reply, errReply := s.handleSubscribeRPC(cs)
+		reply, errReply := s.handleSubscribeRPC(cs, agent, sessionId)
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
@@ -146,7 +158,7 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 
 		//set difficulty
 		go func(s *ProxyServer, cs *Session) {
-			err := cs.setDifficulty()
+			err := cs.setDifficulty(s.diff1Work)
 			if err != nil {
 				Error.Printf("set difficulty error to %v@%v: %v", cs.login, cs.ip, err)
 				s.removeSession(cs)
@@ -188,16 +200,12 @@ func (cs *Session) sendTCPResult(id json.RawMessage, result interface{}) error {
 	return cs.enc.Encode(&message)
 }
 
-func (cs *Session) setDifficulty() error {
+func (cs *Session) setDifficulty(diff1Work float64) error {
 	cs.Lock()
 	defer cs.Unlock()
-	genesisWork, err := bitcoin.GetGenesisTargetWork()
-	if err != nil {
-		return err
-	}
 
 	diff := TargetHexToDiff(cs.targetNextJob).Int64()
-	setDiff := float64(diff) / genesisWork
+	setDiff := float64(diff) / diff1Work
 
 	message := JSONPushMessage{Id: nil, Method: "mining.set_difficulty", Params: []interface{}{setDiff}}
 	return cs.enc.Encode(&message)
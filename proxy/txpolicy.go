@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/PowPool/btcpool/bitcoin"
+	"github.com/PowPool/btcpool/rpc"
+	. "github.com/PowPool/btcpool/util"
+	"github.com/mutalisk999/bitcoin-lib/src/transaction"
+)
+
+const (
+	maxBlockWeight = 4000000
+	// Weight bitcoind keeps free for the coinbase transaction
+	coinBaseReservedWeight = 4000
+	maxBlockSigOpsCost     = 80000
+	// Sigops cost bitcoind keeps free for the coinbase transaction
+	coinBaseReservedSigOps = 400
+	// Mempool vsize counts every sigop as this many weight units when they outweigh the transaction
+	weightPerSigOp = 20
+)
+
+type TxPolicy struct {
+	Enabled          bool     `json:"enabled"`
+	ExcludeTxIds     []string `json:"excludeTxIds"`
+	ExcludeScripts   []string `json:"excludeScripts"`
+	ExcludeAddresses []string `json:"excludeAddresses"`
+	// Satoshi per virtual byte
+	MinFeeRate     float64 `json:"minFeeRate"`
+	PriorityWeight int64   `json:"priorityWeight"`
+}
+
+type TxSelection struct {
+	Transactions []rpc.BlockTplTransaction
+	FeesTotal    int64
+	// Fees of the template transactions left out, to be deducted from the coinbase value
+	FeesDropped int64
+	// Fees of the priority transactions pulled from the mempool
+	FeesAdded int64
+	Weight    int64
+	SigOps    int64
+	Modified  bool
+}
+
+type txFilter struct {
+	excludedTxIds   map[string]struct{}
+	excludedScripts map[string]struct{}
+	priorityTxIds   map[string]struct{}
+	minFeeRate      float64
+	// Weight available to non priority transactions
+	weightBudget int64
+}
+
+func txWeight(tx *rpc.BlockTplTransaction) int64 {
+	if tx.Weight > 0 {
+		return tx.Weight
+	}
+	// pre-segwit nodes don't report weight, assume no witness data
+	return int64(len(tx.Data)/2) * 4
+}
+
+func txFeeRate(fee, weight int64) float64 {
+	if weight <= 0 {
+		return 0
+	}
+	return float64(fee) * 4 / float64(weight)
+}
+
+func (f *txFilter) paysToExcludedScript(tx *rpc.BlockTplTransaction) bool {
+	if len(f.excludedScripts) == 0 {
+		return false
+	}
+	var trx transaction.Transaction
+	err := trx.UnPackFromHex(tx.Data)
+	if err != nil {
+		Error.Printf("Unable to decode template transaction %s: %v", tx.TxId, err)
+		return false
+	}
+	for _, vout := range trx.Vout {
+		scriptHex := hex.EncodeToString(vout.ScriptPubKey.GetScriptBytes())
+		if _, ok := f.excludedScripts[scriptHex]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter template transactions keeping getblocktemplate order, so every kept
+// transaction still comes after all of its in-template parents. Depends of the kept
+// transactions are renumbered to their positions in the selection
+func (f *txFilter) selectTransactions(txs []rpc.BlockTplTransaction) *TxSelection {
+	n := len(txs)
+	drop := make([]bool, n)
+	for i := range txs {
+		if _, ok := f.excludedTxIds[txs[i].TxId]; ok {
+			drop[i] = true
+		} else if f.paysToExcludedScript(&txs[i]) {
+			drop[i] = true
+		}
+		// children of excluded transactions are invalid without them
+		for _, d := range txs[i].Depends {
+			if d >= 1 && d <= i && drop[d-1] {
+				drop[i] = true
+			}
+		}
+	}
+
+	// priority transactions pull their ancestors along
+	priority := make([]bool, n)
+	for i := n - 1; i >= 0; i-- {
+		if drop[i] {
+			continue
+		}
+		if _, ok := f.priorityTxIds[txs[i].TxId]; ok {
+			priority[i] = true
+		}
+		if priority[i] {
+			for _, d := range txs[i].Depends {
+				if d >= 1 && d <= i {
+					priority[d-1] = true
+				}
+			}
+		}
+	}
+
+	selection := &TxSelection{}
+	keep := make([]bool, n)
+	// 1-based position of every kept transaction in the selection
+	position := make([]int, n)
+	budget := int64(0)
+	for i := range txs {
+		tx := &txs[i]
+		if drop[i] {
+			selection.FeesDropped += tx.Fee
+			continue
+		}
+		parentsKept := true
+		for _, d := range tx.Depends {
+			if d < 1 || d > i || !keep[d-1] {
+				parentsKept = false
+				break
+			}
+		}
+		weight := txWeight(tx)
+		if parentsKept && !priority[i] {
+			if txFeeRate(tx.Fee, weight) < f.minFeeRate || budget+weight > f.weightBudget {
+				parentsKept = false
+			} else {
+				budget += weight
+			}
+		}
+		if !parentsKept {
+			selection.FeesDropped += tx.Fee
+			continue
+		}
+		keep[i] = true
+		kept := *tx
+		kept.Depends = make([]int, len(tx.Depends))
+		for j, d := range tx.Depends {
+			kept.Depends[j] = position[d-1]
+		}
+		selection.Transactions = append(selection.Transactions, kept)
+		position[i] = len(selection.Transactions)
+		selection.FeesTotal += tx.Fee
+		selection.Weight += weight
+		selection.SigOps += tx.SigOps
+	}
+	selection.Modified = len(selection.Transactions) != n
+	return selection
+}
+
+func (s *ProxyServer) newTxFilter(weightLimit int64) *txFilter {
+	cfg := &s.config.Proxy.TxPolicy
+	f := &txFilter{
+		excludedTxIds:   make(map[string]struct{}),
+		excludedScripts: make(map[string]struct{}),
+		priorityTxIds:   make(map[string]struct{}),
+		minFeeRate:      cfg.MinFeeRate,
+	}
+	for _, txId := range cfg.ExcludeTxIds {
+		f.excludedTxIds[strings.ToLower(txId)] = struct{}{}
+	}
+	for _, scriptHex := range cfg.ExcludeScripts {
+		f.excludedScripts[strings.ToLower(scriptHex)] = struct{}{}
+	}
+	for _, address := range cfg.ExcludeAddresses {
+		scriptHex, err := s.coin.GetCoinBaseScriptHex(address)
+		if err != nil {
+			Error.Printf("Invalid excluded address %s: %v", address, err)
+			continue
+		}
+		f.excludedScripts[scriptHex] = struct{}{}
+	}
+
+	excluded, err := s.backend.GetExcludedTxs()
+	if err != nil {
+		Error.Printf("Failed to get excluded transactions from backend: %v", err)
+	}
+	for _, txId := range excluded {
+		f.excludedTxIds[strings.ToLower(txId)] = struct{}{}
+	}
+	priority, err := s.backend.GetPriorityTxs()
+	if err != nil {
+		Error.Printf("Failed to get priority transactions from backend: %v", err)
+	}
+	for _, txId := range priority {
+		f.priorityTxIds[strings.ToLower(txId)] = struct{}{}
+	}
+
+	if weightLimit <= 0 {
+		weightLimit = maxBlockWeight
+	}
+	f.weightBudget = weightLimit - coinBaseReservedWeight - cfg.PriorityWeight
+	return f
+}
+
+// Apply the transaction policy to a fresh template, the template's coinbase value
+// and witness commitment are updated to match the selected transactions
+func (s *ProxyServer) applyTxPolicy(rpcClient *rpc.RPCClient, blkTplReply *rpc.GetBlockTemplateReplyPart) error {
+	f := s.newTxFilter(blkTplReply.WeightLimit)
+	selection := f.selectTransactions(blkTplReply.Transactions)
+	s.addPriorityTxs(rpcClient, f, selection, blkTplReply.WeightLimit, blkTplReply.SigOpLimit)
+
+	if !selection.Modified {
+		return nil
+	}
+
+	if len(blkTplReply.DefaultWitnessCommitment) != 0 {
+		var wtxIds []string
+		for _, tx := range selection.Transactions {
+			if len(tx.Hash) > 0 {
+				wtxIds = append(wtxIds, tx.Hash)
+			} else {
+				wtxIds = append(wtxIds, tx.TxId)
+			}
+		}
+		commitment, err := bitcoin.GetWitnessCommitmentHex(wtxIds)
+		if err != nil {
+			return err
+		}
+		blkTplReply.DefaultWitnessCommitment = commitment
+	}
+
+	Info.Printf("Transaction policy kept %d of %d template transactions, dropped %d Satoshi fees, added %d Satoshi fees",
+		len(selection.Transactions), len(blkTplReply.Transactions), selection.FeesDropped, selection.FeesAdded)
+	blkTplReply.CoinBaseValue = blkTplReply.CoinBaseValue - selection.FeesDropped + selection.FeesAdded
+	blkTplReply.Transactions = selection.Transactions
+	return nil
+}
+
+// Pull priority transactions the node left out of its template from the mempool
+func (s *ProxyServer) addPriorityTxs(rpcClient *rpc.RPCClient, f *txFilter, selection *TxSelection, weightLimit, sigOpLimit int64) {
+	if len(f.priorityTxIds) == 0 {
+		return
+	}
+	if weightLimit <= 0 {
+		weightLimit = maxBlockWeight
+	}
+	if sigOpLimit <= 0 {
+		sigOpLimit = maxBlockSigOpsCost
+	}
+	// 1-based position of every transaction in the selection
+	included := make(map[string]int)
+	for i, tx := range selection.Transactions {
+		included[tx.TxId] = i + 1
+	}
+
+	// a priority child may be visited before its priority parent, retry until nothing changes
+	for added := true; added; {
+		added = false
+		for txId := range f.priorityTxIds {
+			if _, ok := included[txId]; ok {
+				continue
+			}
+			if _, ok := f.excludedTxIds[txId]; ok {
+				continue
+			}
+			entry, err := rpcClient.GetMempoolEntry(txId)
+			if err != nil && strings.Contains(err.Error(), "not in mempool") {
+				// mined or evicted, nothing left to prioritize
+				Info.Printf("Priority transaction %s is gone from mempool of %s", txId, rpcClient.Name)
+				_ = s.backend.RemovePriorityTx(txId)
+				continue
+			}
+			if err != nil || entry == nil {
+				Error.Printf("Failed to get mempool entry of priority transaction %s from %s: %v", txId, rpcClient.Name, err)
+				continue
+			}
+			parentsIncluded := true
+			var depends []int
+			for _, parent := range entry.Depends {
+				position, ok := included[parent]
+				if !ok {
+					parentsIncluded = false
+					break
+				}
+				depends = append(depends, position)
+			}
+			if !parentsIncluded {
+				Debug.Printf("Priority transaction %s skipped, unconfirmed parents are not in the template", txId)
+				continue
+			}
+			if selection.Weight+entry.Weight > weightLimit-coinBaseReservedWeight {
+				Info.Printf("Priority transaction %s skipped, no weight left in the template", txId)
+				continue
+			}
+			// The mempool doesn't report sigops, the sigop adjusted vsize bounds them
+			sigOps := entry.VSize * 4 / weightPerSigOp
+			if selection.SigOps+sigOps > sigOpLimit-coinBaseReservedSigOps {
+				Info.Printf("Priority transaction %s skipped, no sigops left in the template", txId)
+				continue
+			}
+			data, err := rpcClient.GetRawTransaction(txId)
+			if err != nil {
+				Error.Printf("Failed to get priority transaction %s from %s: %v", txId, rpcClient.Name, err)
+				continue
+			}
+			tx := rpc.BlockTplTransaction{
+				Data:    data,
+				TxId:    txId,
+				Hash:    entry.WTxId,
+				Depends: depends,
+				Fee:     BTCToSatoshi(entry.Fees.Base),
+				SigOps:  sigOps,
+				Weight:  entry.Weight,
+			}
+			selection.Transactions = append(selection.Transactions, tx)
+			selection.FeesTotal += tx.Fee
+			selection.FeesAdded += tx.Fee
+			selection.Weight += tx.Weight
+			selection.SigOps += tx.SigOps
+			selection.Modified = true
+			included[txId] = len(selection.Transactions)
+			added = true
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/PowPool/btcpool/rpc"
+	"github.com/PowPool/btcpool/storage"
+)
+
+func testTemplateTxs() []rpc.BlockTplTransaction {
+	return []rpc.BlockTplTransaction{
+		{TxId: "a", Fee: 1000, Weight: 400},
+		{TxId: "b", Fee: 100, Weight: 400, Depends: []int{1}},
+		{TxId: "c", Fee: 50, Weight: 400},
+		{TxId: "d", Fee: 2000, Weight: 400, Depends: []int{3}},
+		{TxId: "e", Fee: 4000, Weight: 800},
+	}
+}
+
+func newTestTxFilter() *txFilter {
+	return &txFilter{
+		excludedTxIds:   make(map[string]struct{}),
+		excludedScripts: make(map[string]struct{}),
+		priorityTxIds:   make(map[string]struct{}),
+		weightBudget:    maxBlockWeight,
+	}
+}
+
+func selectedTxIds(selection *TxSelection) []string {
+	var ids []string
+	for _, tx := range selection.Transactions {
+		ids = append(ids, tx.TxId)
+	}
+	return ids
+}
+
+func assertTxIds(t *testing.T, selection *TxSelection, expected ...string) {
+	ids := selectedTxIds(selection)
+	if len(ids) != len(expected) {
+		t.Fatalf("Must select %v vs %v", expected, ids)
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Fatalf("Must select %v vs %v", expected, ids)
+		}
+	}
+}
+
+func TestSelectTransactionsUnchanged(t *testing.T) {
+	f := newTestTxFilter()
+	selection := f.selectTransactions(testTemplateTxs())
+	assertTxIds(t, selection, "a", "b", "c", "d", "e")
+	if selection.Modified || selection.FeesDropped != 0 || selection.FeesTotal != 7150 {
+		t.Errorf("Must keep template as is: %+v", selection)
+	}
+}
+
+func TestSelectTransactionsExcludeWithChildren(t *testing.T) {
+	f := newTestTxFilter()
+	f.excludedTxIds["a"] = struct{}{}
+	selection := f.selectTransactions(testTemplateTxs())
+	assertTxIds(t, selection, "c", "d", "e")
+	if !selection.Modified || selection.FeesDropped != 1100 || selection.FeesTotal != 6050 {
+		t.Errorf("Must drop excluded transaction and its children: %+v", selection)
+	}
+	if depends := selection.Transactions[1].Depends; len(depends) != 1 || depends[0] != 1 {
+		t.Errorf("Depends must point at the parent's new position, got %v", depends)
+	}
+}
+
+func TestSelectTransactionsMinFeeRate(t *testing.T) {
+	f := newTestTxFilter()
+	// b pays 1 sat/vB, c pays 0.5 sat/vB
+	f.minFeeRate = 2
+	selection := f.selectTransactions(testTemplateTxs())
+	// d depends on c and goes with it
+	assertTxIds(t, selection, "a", "e")
+	if selection.FeesDropped != 2150 {
+		t.Errorf("Must drop low fee rate transactions: %+v", selection)
+	}
+}
+
+func TestSelectTransactionsPriority(t *testing.T) {
+	f := newTestTxFilter()
+	f.minFeeRate = 2
+	f.priorityTxIds["d"] = struct{}{}
+	selection := f.selectTransactions(testTemplateTxs())
+	// priority d pulls its low fee parent c
+	assertTxIds(t, selection, "a", "c", "d", "e")
+}
+
+func TestSelectTransactionsWeightBudget(t *testing.T) {
+	f := newTestTxFilter()
+	f.weightBudget = 1200
+	f.priorityTxIds["e"] = struct{}{}
+	selection := f.selectTransactions(testTemplateTxs())
+	// priority weight does not count against the budget
+	assertTxIds(t, selection, "a", "b", "c", "e")
+	if selection.Weight != 2000 {
+		t.Errorf("Must account weight of selected transactions: %v", selection.Weight)
+	}
+}
+
+func TestAddPriorityTxs(t *testing.T) {
+	entries := map[string]interface{}{
+		"p": map[string]interface{}{"wtxid": "p", "vsize": 100, "weight": 400, "fees": map[string]interface{}{"base": 0.00001}, "depends": []string{"c"}},
+		// 2000 vB for its sigops, up to 400 sigops cost
+		"q": map[string]interface{}{"wtxid": "q", "vsize": 2000, "weight": 400, "fees": map[string]interface{}{"base": 0.00001}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		result := interface{}("00")
+		if req.Method == "getmempoolentry" {
+			result = entries[req.Params[0].(string)]
+			if result == nil {
+				json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "error": map[string]interface{}{"code": -5, "message": "Transaction not in mempool"}})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 0, "result": result})
+	}))
+	defer server.Close()
+
+	s := &ProxyServer{backend: storage.NewMemoryBackend()}
+	f := newTestTxFilter()
+	f.priorityTxIds["p"] = struct{}{}
+	f.priorityTxIds["q"] = struct{}{}
+	// mined already
+	for _, txId := range []string{"r", "s", "t", "u", "v"} {
+		f.priorityTxIds[txId] = struct{}{}
+	}
+	f.excludedTxIds["a"] = struct{}{}
+	selection := f.selectTransactions(testTemplateTxs())
+	selection.SigOps = 79300
+	rpcClient := rpc.NewRPCClient("node", server.URL, "5s")
+	s.addPriorityTxs(rpcClient, f, selection, 0, 0)
+	if rpcClient.Sick() {
+		t.Error("Node answering errors must not be marked sick")
+	}
+	if txIds, _ := s.backend.GetPriorityTxs(); len(txIds) != 0 {
+		t.Errorf("Mined priority transactions must be removed, got %v", txIds)
+	}
+
+	// q would exceed the sigops limit
+	assertTxIds(t, selection, "c", "d", "e", "p")
+	if depends := selection.Transactions[3].Depends; len(depends) != 1 || depends[0] != 1 {
+		t.Errorf("Depends must point at the parent in the selection, got %v", depends)
+	}
+	if selection.SigOps != 79320 || selection.FeesAdded != 1000 {
+		t.Errorf("Must count sigops and fees of added transactions: %+v", selection)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 
 	. "github.com/PowPool/btcpool/util"
@@ -21,21 +23,51 @@ type RPCClient struct {
 }
 
 type GetBlockReply struct {
-	Height       uint32  `json:"height"`
-	Hash         string  `json:"hash"`
-	Nonce        uint32  `json:"nonce"`
-	Difficulty   float64 `json:"difficulty"`
-	Transactions []Tx    `json:"tx"`
+	Height     uint32  `json:"height"`
+	Hash       string  `json:"hash"`
+	Nonce      uint32  `json:"nonce"`
+	Difficulty float64 `json:"difficulty"`
+	// -1 if the block is not on the main chain
+	Confirmations int64 `json:"confirmations"`
+	Transactions  []Tx  `json:"tx"`
 }
 
+type BlockHeaderReply struct {
+	Height        int64  `json:"height"`
+	Hash          string `json:"hash"`
+	Confirmations int64  `json:"confirmations"`
+}
+
+// Returned for blocks the node doesn't know
+var ErrBlockNotFound = errors.New("block not found")
+
 type CoinBaseAux struct {
 	Flags string `json:"flags"`
 }
 
 type BlockTplTransaction struct {
-	Data string `json:"data"`
-	TxId string `json:"txid"`
-	Fee  int64  `json:"fee"`
+	Data    string `json:"data"`
+	TxId    string `json:"txid"`
+	Hash    string `json:"hash"`
+	Depends []int  `json:"depends"`
+	Fee     int64  `json:"fee"`
+	SigOps  int64  `json:"sigops"`
+	Weight  int64  `json:"weight"`
+}
+
+type MempoolEntryFees struct {
+	Base     float64 `json:"base"`
+	Ancestor float64 `json:"ancestor"`
+}
+
+type MempoolEntry struct {
+	WTxId        string           `json:"wtxid"`
+	VSize        int64            `json:"vsize"`
+	Weight       int64            `json:"weight"`
+	Time         int64            `json:"time"`
+	AncestorSize int64            `json:"ancestorsize"`
+	Fees         MempoolEntryFees `json:"fees"`
+	Depends      []string         `json:"depends"`
 }
 
 type MasterNode struct {
@@ -54,28 +86,10 @@ type GetBlockTemplateReplyPart struct {
 	Bits                     string                `json:"bits"`
 	Target                   string                `json:"target"`
 	Height                   uint32                `json:"height"`
+	WeightLimit              int64                 `json:"weightlimit"`
+	SigOpLimit               int64                 `json:"sigoplimit"`
 	DefaultWitnessCommitment string                `json:"default_witness_commitment"`
-}
-
-const receiptStatusSuccessful = "0x1"
-
-type TxReceipt struct {
-	TxHash    string `json:"transactionHash"`
-	GasUsed   string `json:"gasUsed"`
-	BlockHash string `json:"blockHash"`
-	Status    string `json:"status"`
-}
-
-func (r *TxReceipt) Confirmed() bool {
-	return len(r.BlockHash) > 0
-}
-
-// Use with previous method
-func (r *TxReceipt) Successful() bool {
-	if len(r.Status) > 0 {
-		return r.Status == receiptStatusSuccessful
-	}
-	return true
+	MWeb                     string                `json:"mweb"`
 }
 
 type Tx struct {
@@ -90,9 +104,129 @@ type Vin struct {
 }
 
 type Vout struct {
-	Value    float64 `json:"value"`
-	ValueSat int64   `json:"valueSat"`
-	N        uint32  `json:"n"`
+	Value        float64      `json:"value"`
+	ValueSat     int64        `json:"valueSat"`
+	N            uint32       `json:"n"`
+	ScriptPubKey ScriptPubKey `json:"scriptPubKey"`
+}
+
+type ScriptPubKey struct {
+	Hex     string `json:"hex"`
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+type TxOutReply struct {
+	BestBlock     string       `json:"bestblock"`
+	Confirmations int64        `json:"confirmations"`
+	Value         float64      `json:"value"`
+	ScriptPubKey  ScriptPubKey `json:"scriptPubKey"`
+	Coinbase      bool         `json:"coinbase"`
+}
+
+type Outpoint struct {
+	TxId string `json:"txid"`
+	Vout uint32 `json:"vout"`
+}
+
+type FundedPsbtReply struct {
+	Psbt      string  `json:"psbt"`
+	Fee       float64 `json:"fee"`
+	ChangePos int     `json:"changepos"`
+}
+
+type DecodedPsbtReply struct {
+	Tx Tx `json:"tx"`
+}
+
+type FinalizedPsbtReply struct {
+	Hex      string `json:"hex"`
+	Complete bool   `json:"complete"`
+}
+
+type WalletTxReply struct {
+	TxId string `json:"txid"`
+	// Negative if conflicted
+	Confirmations   int64    `json:"confirmations"`
+	ReplacedBy      string   `json:"replaced_by_txid"`
+	WalletConflicts []string `json:"walletconflicts"`
+	Hex             string   `json:"hex"`
+	// Negative fee of a tx the wallet sent
+	Fee     float64          `json:"fee"`
+	Details []WalletTxDetail `json:"details"`
+}
+
+// Output of a wallet tx, sent amounts are negative
+type WalletTxDetail struct {
+	Address  string  `json:"address"`
+	Category string  `json:"category"`
+	Amount   float64 `json:"amount"`
+	Vout     uint32  `json:"vout"`
+}
+
+// Entry of listtransactions, one per output a wallet tx sends or receives
+type WalletTxEntry struct {
+	TxId     string  `json:"txid"`
+	Address  string  `json:"address"`
+	Category string  `json:"category"`
+	Amount   float64 `json:"amount"`
+	// Negative if conflicted
+	Confirmations int64 `json:"confirmations"`
+	Time          int64 `json:"time"`
+	Abandoned     bool  `json:"abandoned"`
+}
+
+type BumpFeeReply struct {
+	TxId    string   `json:"txid"`
+	OrigFee float64  `json:"origfee"`
+	Fee     float64  `json:"fee"`
+	Errors  []string `json:"errors"`
+}
+
+type UnspentReply struct {
+	TxId          string  `json:"txid"`
+	Vout          uint32  `json:"vout"`
+	Address       string  `json:"address"`
+	Amount        float64 `json:"amount"`
+	Confirmations int64   `json:"confirmations"`
+	Spendable     bool    `json:"spendable"`
+}
+
+type BalancesReply struct {
+	Mine      WalletBalances  `json:"mine"`
+	WatchOnly *WalletBalances `json:"watchonly"`
+}
+
+type WalletBalances struct {
+	Trusted          json.Number `json:"trusted"`
+	UntrustedPending json.Number `json:"untrusted_pending"`
+	Immature         json.Number `json:"immature"`
+}
+
+type SendReply struct {
+	TxId     string `json:"txid"`
+	Complete bool   `json:"complete"`
+}
+
+type SignedTxReply struct {
+	Hex      string `json:"hex"`
+	Complete bool   `json:"complete"`
+}
+
+type FeeEstimateReply struct {
+	FeeRate *float64 `json:"feerate"`
+	Errors  []string `json:"errors"`
+	Blocks  int64    `json:"blocks"`
+}
+
+// Error the node answered a call with
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
 }
 
 type JSONRpcResp struct {
@@ -121,8 +255,12 @@ func (r *RPCClient) GetPrevBlockHash() (string, error) {
 }
 
 func (r *RPCClient) GetPendingBlock() (*GetBlockTemplateReplyPart, error) {
+	return r.GetPendingBlockWithRules([]string{"segwit"})
+}
+
+func (r *RPCClient) GetPendingBlockWithRules(rules []string) (*GetBlockTemplateReplyPart, error) {
 	param := make(map[string][]string)
-	param["rules"] = []string{"segwit"}
+	param["rules"] = rules
 	rpcResp, err := r.doPost(r.Url, "getblocktemplate", []interface{}{param})
 	if err != nil {
 		return nil, err
@@ -135,6 +273,31 @@ func (r *RPCClient) GetPendingBlock() (*GetBlockTemplateReplyPart, error) {
 	return nil, nil
 }
 
+// BIP23 block proposal, returns empty reason if the node would accept the block
+func (r *RPCClient) ProposeBlock(blockHex string, rules []string) (string, error) {
+	param := map[string]interface{}{"mode": "proposal", "data": blockHex, "rules": rules}
+	rpcResp, err := r.doPost(r.Url, "getblocktemplate", []interface{}{param})
+	if err != nil {
+		return "", err
+	}
+	if rpcResp.Result != nil {
+		var reply string
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+		return reply, err
+	}
+	return "", nil
+}
+
+func (r *RPCClient) GetBlockCount() (int64, error) {
+	rpcResp, err := r.doPost(r.Url, "getblockcount", []string{})
+	if err != nil {
+		return 0, err
+	}
+	var reply int64
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
 func (r *RPCClient) GetBlockHashByHeight(height int64) (string, error) {
 	rpcResp, err := r.doPost(r.Url, "getblockhash", []int64{height})
 	if err != nil {
@@ -153,7 +316,7 @@ func (r *RPCClient) GetBlockByHash(hash string) (*GetBlockReply, error) {
 func (r *RPCClient) getBlockBy(method string, params []interface{}) (*GetBlockReply, error) {
 	rpcResp, err := r.doPost(r.Url, method, params)
 	if err != nil {
-		return nil, err
+		return nil, blockError(err)
 	}
 	if rpcResp.Result != nil {
 		var reply *GetBlockReply
@@ -163,6 +326,46 @@ func (r *RPCClient) getBlockBy(method string, params []interface{}) (*GetBlockRe
 	return nil, nil
 }
 
+func (r *RPCClient) GetBlockHeader(hash string) (*BlockHeaderReply, error) {
+	rpcResp, err := r.doPost(r.Url, "getblockheader", []interface{}{hash, true})
+	if err != nil {
+		return nil, blockError(err)
+	}
+	var reply *BlockHeaderReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func blockError(err error) error {
+	if strings.Contains(err.Error(), "Block not found") {
+		return ErrBlockNotFound
+	}
+	return err
+}
+
+func (r *RPCClient) GetRawTransaction(txId string) (string, error) {
+	rpcResp, err := r.doPost(r.Url, "getrawtransaction", []interface{}{txId, false})
+	if err != nil {
+		return "", err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) GetMempoolEntry(txId string) (*MempoolEntry, error) {
+	rpcResp, err := r.doPost(r.Url, "getmempoolentry", []string{txId})
+	if err != nil {
+		return nil, err
+	}
+	if rpcResp.Result != nil {
+		var reply *MempoolEntry
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+		return reply, err
+	}
+	return nil, nil
+}
+
 func (r *RPCClient) SubmitBlock(params []interface{}) error {
 	rpcResp, err := r.doPost(r.Url, "submitblock", params)
 	if err != nil {
@@ -176,6 +379,348 @@ func (r *RPCClient) SubmitBlock(params []interface{}) error {
 	return nil
 }
 
+func (r *RPCClient) GetConnectionCount() (int64, error) {
+	rpcResp, err := r.doPost(r.Url, "getconnectioncount", []string{})
+	if err != nil {
+		return 0, err
+	}
+	var reply int64
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Spendable wallet balance in satoshi
+func (r *RPCClient) GetWalletBalance() (int64, error) {
+	rpcResp, err := r.doPost(r.Url, "getbalance", []string{})
+	if err != nil {
+		return 0, err
+	}
+	var reply json.Number
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	return AmountToSatoshi(reply.String())
+}
+
+// Confirmed, unconfirmed and immature wallet balance in satoshi, watch-only outputs included
+func (r *RPCClient) GetBalances() (int64, int64, int64, error) {
+	rpcResp, err := r.doPost(r.Url, "getbalances", []string{})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var reply *BalancesReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	balances := []WalletBalances{reply.Mine}
+	if reply.WatchOnly != nil {
+		balances = append(balances, *reply.WatchOnly)
+	}
+	var trusted, pending, immature int64
+	for _, v := range balances {
+		for total, amount := range map[*int64]json.Number{&trusted: v.Trusted, &pending: v.UntrustedPending, &immature: v.Immature} {
+			if len(amount) == 0 {
+				continue
+			}
+			value, err := AmountToSatoshi(amount.String())
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			*total += value
+		}
+	}
+	return trusted, pending, immature, nil
+}
+
+// Pay several addresses in one transaction, amounts in satoshi. The fee is split between
+// the subtractFeeFrom addresses or paid by the wallet if there are none. A positive fee rate
+// in sat/vB overrides the wallet fee estimation.
+func (r *RPCClient) SendMany(amounts map[string]int64, subtractFeeFrom []string, feeRate float64, replaceable bool) (string, error) {
+	outputs := make(map[string]string, len(amounts))
+	for address, amount := range amounts {
+		outputs[address] = SatoshiToAmount(amount)
+	}
+	if subtractFeeFrom == nil {
+		subtractFeeFrom = []string{}
+	}
+	// conf_target and estimate_mode keep wallet defaults
+	params := []interface{}{"", outputs, 1, "", subtractFeeFrom, replaceable, nil, "unset"}
+	if feeRate > 0 {
+		params = append(params, feeRate)
+	}
+	rpcResp, err := r.doPost(r.Url, "sendmany", params)
+	if err != nil {
+		return "", err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Fee rate in sat/vB expected to confirm within target blocks
+func (r *RPCClient) EstimateSmartFee(target int) (float64, error) {
+	rpcResp, err := r.doPost(r.Url, "estimatesmartfee", []interface{}{target})
+	if err != nil {
+		return 0, err
+	}
+	var reply *FeeEstimateReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	if reply.FeeRate == nil {
+		return 0, fmt.Errorf("no fee estimate for %d blocks: %v", target, reply.Errors)
+	}
+	// BTC/kvB
+	return *reply.FeeRate * 1e5, nil
+}
+
+// Unsigned PSBT paying the amounts in satoshi in output order, funded from the wallet and spending
+// at least the given inputs. The wallet locks the selected coins until the PSBT is broadcast.
+func (r *RPCClient) WalletCreateFundedPsbt(inputs []Outpoint, outputs []map[string]int64, subtractFeeFrom []int, feeRate float64, replaceable bool) (*FundedPsbtReply, error) {
+	amounts := make([]map[string]string, len(outputs))
+	for i, output := range outputs {
+		amounts[i] = make(map[string]string)
+		for address, amount := range output {
+			amounts[i][address] = SatoshiToAmount(amount)
+		}
+	}
+	if inputs == nil {
+		inputs = []Outpoint{}
+	}
+	if subtractFeeFrom == nil {
+		subtractFeeFrom = []int{}
+	}
+	options := map[string]interface{}{"subtractFeeFromOutputs": subtractFeeFrom, "lockUnspents": true, "replaceable": replaceable}
+	if len(inputs) > 0 {
+		options["add_inputs"] = true
+	}
+	if feeRate > 0 {
+		options["fee_rate"] = feeRate
+	}
+	rpcResp, err := r.doPost(r.Url, "walletcreatefundedpsbt", []interface{}{inputs, amounts, 0, options})
+	if err != nil {
+		return nil, err
+	}
+	var reply *FundedPsbtReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) DecodePsbt(psbt string) (*DecodedPsbtReply, error) {
+	rpcResp, err := r.doPost(r.Url, "decodepsbt", []string{psbt})
+	if err != nil {
+		return nil, err
+	}
+	var reply *DecodedPsbtReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) FinalizePsbt(psbt string) (*FinalizedPsbtReply, error) {
+	rpcResp, err := r.doPost(r.Url, "finalizepsbt", []string{psbt})
+	if err != nil {
+		return nil, err
+	}
+	var reply *FinalizedPsbtReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) DecodeRawTransaction(txHex string) (*Tx, error) {
+	rpcResp, err := r.doPost(r.Url, "decoderawtransaction", []string{txHex})
+	if err != nil {
+		return nil, err
+	}
+	var reply *Tx
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) SendRawTransaction(txHex string) (string, error) {
+	rpcResp, err := r.doPost(r.Url, "sendrawtransaction", []string{txHex})
+	if err != nil {
+		return "", err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Replace an unconfirmed wallet transaction paying a fee rate in sat/vB, 0 lets the wallet pick it
+func (r *RPCClient) BumpFee(txId string, feeRate float64) (*BumpFeeReply, error) {
+	options := map[string]interface{}{}
+	if feeRate > 0 {
+		options["fee_rate"] = feeRate
+	}
+	rpcResp, err := r.doPost(r.Url, "bumpfee", []interface{}{txId, options})
+	if err != nil {
+		return nil, err
+	}
+	var reply *BumpFeeReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Wallet outputs with confirmations in range, unconfirmed and unsafe included
+func (r *RPCClient) ListUnspent(minConf, maxConf int64) ([]*UnspentReply, error) {
+	rpcResp, err := r.doPost(r.Url, "listunspent", []interface{}{minConf, maxConf, []string{}, true})
+	if err != nil {
+		return nil, err
+	}
+	var reply []*UnspentReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Outputs locked by the wallet, e.g. inputs of a payout batch waiting for a signature
+func (r *RPCClient) ListLockUnspent() ([]Outpoint, error) {
+	rpcResp, err := r.doPost(r.Url, "listlockunspent", []interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	var reply []Outpoint
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Pay the amounts in satoshi in output order spending at least the given inputs, the wallet adds
+// more only if allowed. A positive fee rate in sat/vB overrides the wallet fee estimation.
+func (r *RPCClient) Send(outputs []map[string]int64, inputs []Outpoint, addInputs bool, subtractFeeFrom []int, feeRate float64, replaceable bool) (string, error) {
+	amounts := make([]map[string]string, len(outputs))
+	for i, output := range outputs {
+		amounts[i] = make(map[string]string)
+		for address, amount := range output {
+			amounts[i][address] = SatoshiToAmount(amount)
+		}
+	}
+	if subtractFeeFrom == nil {
+		subtractFeeFrom = []int{}
+	}
+	options := map[string]interface{}{
+		"inputs":                    inputs,
+		"add_inputs":                addInputs,
+		"subtract_fee_from_outputs": subtractFeeFrom,
+		"replaceable":               replaceable,
+	}
+	if feeRate > 0 {
+		options["fee_rate"] = feeRate
+	}
+	rpcResp, err := r.doPost(r.Url, "send", []interface{}{amounts, nil, "unset", nil, options})
+	if err != nil {
+		return "", err
+	}
+	var reply *SendReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return "", err
+	}
+	if !reply.Complete {
+		return "", errors.New("wallet could not sign the tx")
+	}
+	return reply.TxId, nil
+}
+
+func (r *RPCClient) GetNewAddress() (string, error) {
+	rpcResp, err := r.doPost(r.Url, "getnewaddress", []interface{}{})
+	if err != nil {
+		return "", err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) GetRawChangeAddress() (string, error) {
+	rpcResp, err := r.doPost(r.Url, "getrawchangeaddress", []interface{}{})
+	if err != nil {
+		return "", err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Unsigned transaction spending the inputs to the amounts in satoshi
+func (r *RPCClient) CreateRawTransaction(inputs []Outpoint, outputs map[string]int64) (string, error) {
+	amounts := make(map[string]string, len(outputs))
+	for address, amount := range outputs {
+		amounts[address] = SatoshiToAmount(amount)
+	}
+	rpcResp, err := r.doPost(r.Url, "createrawtransaction", []interface{}{inputs, amounts, 0, true})
+	if err != nil {
+		return "", err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) SignRawTransactionWithWallet(txHex string) (*SignedTxReply, error) {
+	rpcResp, err := r.doPost(r.Url, "signrawtransactionwithwallet", []string{txHex})
+	if err != nil {
+		return nil, err
+	}
+	var reply *SignedTxReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// False if the output is spent, mempool included
+func (r *RPCClient) IsUnspent(txId string, vout uint32) (bool, error) {
+	rpcResp, err := r.doPost(r.Url, "gettxout", []interface{}{txId, vout, true})
+	if err != nil {
+		return false, err
+	}
+	return rpcResp.Result != nil, nil
+}
+
+// Unspent output with its confirmations, nil if it is spent or unknown
+func (r *RPCClient) GetTxOut(txId string, vout uint32) (*TxOutReply, error) {
+	rpcResp, err := r.doPost(r.Url, "gettxout", []interface{}{txId, vout, false})
+	if err != nil {
+		return nil, err
+	}
+	if rpcResp.Result == nil {
+		return nil, nil
+	}
+	var reply *TxOutReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Wallet transaction, watch-only included, nil if the wallet doesn't know it
+func (r *RPCClient) GetWalletTransaction(txId string) (*WalletTxReply, error) {
+	rpcResp, err := r.doPost(r.Url, "gettransaction", []interface{}{txId, true})
+	if err != nil {
+		if strings.Contains(err.Error(), "Invalid or non-wallet transaction id") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var reply *WalletTxReply
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+// Latest wallet tx entries, oldest first
+func (r *RPCClient) ListTransactions(count int) ([]*WalletTxEntry, error) {
+	rpcResp, err := r.doPost(r.Url, "listtransactions", []interface{}{"*", count, 0, true})
+	if err != nil {
+		return nil, err
+	}
+	var reply []*WalletTxEntry
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
+func (r *RPCClient) LockUnspent(unlock bool, outpoints []Outpoint) error {
+	_, err := r.doPost(r.Url, "lockunspent", []interface{}{unlock, outpoints})
+	return err
+}
+
 func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
 	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
 	data, err := json.Marshal(jsonReq)
@@ -205,8 +750,10 @@ func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSON
 		return nil, err
 	}
 	if rpcResp.Error != nil {
-		r.markSick()
-		return nil, errors.New(rpcResp.Error["message"].(string))
+		// the node is alive, it only refused the request
+		code, _ := rpcResp.Error["code"].(float64)
+		message, _ := rpcResp.Error["message"].(string)
+		return nil, &RPCError{Code: int(code), Message: message}
 	}
 	return rpcResp, err
 }
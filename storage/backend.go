@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"math/big"
+	"time"
+)
+
+// Storage of one pool. RedisClient is the production backend, MemoryBackend keeps everything in process
+// and SQLBackend keeps the money in a SQL database
+type Backend interface {
+	NodesBackend
+	SharesBackend
+	BlocksBackend
+	BalancesBackend
+	PaymentsBackend
+	StatsBackend
+}
+
+// Node state, stratum sessions and the pool wide lists
+type NodesBackend interface {
+	Check() (string, error)
+	BgSave() (string, error)
+	GetBlacklist() ([]string, error)
+	GetWhitelist() ([]string, error)
+	WriteNodeState(id string, height uint32, diff *big.Int) error
+	GetNodeStates() ([]map[string]interface{}, error)
+	GetNodeBlocksFound(id string) (int64, error)
+	WriteStratumSession(sid string, ss *StratumSession, expire time.Duration) error
+	TakeStratumSession(sid string) (*StratumSession, error)
+	LeaseExtraNonce(extraNonce1, node string, expire time.Duration) error
+	IsExtraNonceLeased(extraNonce1 string) (bool, error)
+	GetPriorityTxs() ([]string, error)
+	AddPriorityTx(txId string) error
+	RemovePriorityTx(txId string) error
+	GetExcludedTxs() ([]string, error)
+	AddExcludedTx(txId string) error
+	RemoveExcludedTx(txId string) error
+	SetUnlockerHalt(reason string) error
+	GetUnlockerHalt() (string, error)
+	ClearUnlockerHalt() (bool, error)
+}
+
+// Shares of the current round and of the rounds of found blocks
+type SharesBackend interface {
+	WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration,
+		acc ShareAccounting) (bool, error)
+	WriteInvalidShare(ms, ts int64, login, id string, diff int64) error
+	WriteRejectShare(ms, ts int64, login, id string, diff int64) error
+	WriteBlock(login, id string, params []string, hash string, diff, roundDiff int64, height uint64,
+		coinBaseValue int64, blkTotalFee int64, node, coinBaseTag string, window time.Duration, acc ShareAccounting) (bool, error)
+	GetRoundShares(height int64, nonce string) (map[string]int64, error)
+	GetPPLNSShares(height int64, nonce string) ([]PPLNSShare, error)
+	GetRoundScores(height int64, nonce string, decay time.Duration) (map[string]float64, error)
+	GetRoundShareLog(height int64, nonce string) ([]ShareLogEntry, error)
+	// Settle the PPS credits of shares kept pending, the proxies call it periodically
+	FlushCredits() error
+}
+
+// Found blocks through their states and the credits of their rounds
+type BlocksBackend interface {
+	GetCandidates(maxHeight int64) ([]*BlockData, error)
+	GetImmatureBlocks(maxHeight int64) ([]*BlockData, error)
+	GetMaturedBlocks(minHeight int64) ([]*BlockData, error)
+	GetBlocksAt(height int64) ([]*BlockData, error)
+	GetImmatureCredits(block *BlockData) (map[string]int64, error)
+	WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error
+	WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, reserve int64) error
+	WriteOrphan(block *BlockData) error
+	WritePendingOrphans(blocks []*BlockData) error
+	WriteReorg(block *BlockData) (int64, error)
+	RequeueBlock(block *BlockData) error
+	MigrateBlocks() (int, error)
+}
+
+// Miner accounts, their settings and the ledger
+type BalancesBackend interface {
+	IsMinerExists(login string) (bool, error)
+	GetPayees() ([]string, error)
+	GetBalance(login string) (int64, error)
+	GetOwedBalances() (int64, int64, int64, error)
+	UpdateBalance(login string, amount int64) error
+	RollbackBalance(login string, amount int64) error
+	AdjustBalance(login string, amount int64, note string) error
+	GetPayoutThreshold(login string) (int64, error)
+	SetPayoutThreshold(login string, threshold int64) error
+	GetLightningDestination(login string) (string, error)
+	SetLightningDestination(login, dest string) error
+	GetLightningDestinations(logins []string) (map[string]string, error)
+	IssueChallenge(login string, expire time.Duration) (string, int64, error)
+	GetChallenge(login string) (string, error)
+	TakeChallenge(login, challenge string) (bool, error)
+	UpdateMinerSettings(login string, settings *MinerSettings) error
+	GetLedger(start, limit int64) ([]*LedgerEntry, error)
+	LedgerBalances() (map[string]int64, error)
+	OpenLedger() error
+	ReconcileLedger() ([]LedgerDrift, error)
+}
+
+// Payouts, their transactions and the pool wallet
+type PaymentsBackend interface {
+	LockPayouts(login string, amount int64) error
+	UnlockPayouts() error
+	IsPayoutsLocked() (bool, error)
+	GetPendingPayments() []*PendingPayment
+	WritePayment(login, txHash string, amount int64) error
+	WritePayments(txHash string, payments map[string]int64) error
+	WriteLightningPayment(login, paymentHash string, amount, fee int64, clearDestination bool) error
+	WriteNetworkFee(txId, note string, fee int64) error
+	WriteInFlightPayment(payment *InFlightPayment) error
+	GetInFlightPayment() (*InFlightPayment, error)
+	GetUnconfirmedPayments() ([]*PaymentTx, error)
+	GetPaymentTxs(txIds []string) (map[string]*PaymentTx, error)
+	UpdatePaymentTx(ptx *PaymentTx) error
+	ReplacePaymentTx(ptx *PaymentTx, txHash string) (*PaymentTx, error)
+	WritePayoutBatch(batch *PayoutBatch) error
+	GetPayoutBatch() (*PayoutBatch, error)
+	SubmitSignedPsbt(id, psbt string) error
+	FailSignedPsbt(id, reason string) error
+	CompletePayoutBatch(txHash string, batch *PayoutBatch) error
+	AbandonPayoutBatch(batch *PayoutBatch) error
+	GetAbandonedBatches() (map[string][]string, error)
+	WritePayoutSchedule(schedule *PayoutSchedule) error
+	GetPayoutSchedule() (*PayoutSchedule, error)
+	WriteSolvency(solvency *Solvency) error
+	GetSolvency() (*Solvency, error)
+	GetUTXOs() ([]*UTXO, error)
+	ReconcileUTXOs(add []*UTXO, remove []string) error
+}
+
+// Stats served by the API
+type StatsBackend interface {
+	GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error)
+	FlushStaleStats(window, largeWindow time.Duration) (int64, error)
+	CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error)
+	CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error)
+	CollectLuckStats(windows []int) (map[string]interface{}, error)
+}
+
+// Backend keeping the shares and rounds of a SQLBackend, the SQL transaction settles the block
+// before its round is moved or deleted
+type RoundsBackend interface {
+	Backend
+	checkPoWExist(height uint64, params []string) (bool, error)
+	writeRound(block *BlockData, diff int64, window time.Duration, acc ShareAccounting) error
+	takeCredits() (string, map[string]int64, error)
+	clearCredits(batch string) error
+	moveRound(block *BlockData) error
+	deleteRound(block *BlockData) error
+}
+
+var _ RoundsBackend = (*RedisClient)(nil)
+var _ RoundsBackend = (*MemoryBackend)(nil)
+var _ Backend = (*SQLBackend)(nil)
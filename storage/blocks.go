@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Version of the block record, bump it with a migration on incompatible changes.
+// Version 1 is the colon joined format of older pools
+const BlockRecordVersion = 2
+
+// States of a block, the sorted set it is kept in follows from it
+const (
+	BlockCandidate = "candidate"
+	BlockImmature  = "immature"
+	BlockMatured   = "matured"
+	BlockOrphaned  = "orphaned"
+)
+
+type BlockTransition struct {
+	State     string `json:"state"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Block found by the pool, stored as JSON in the candidates, immature and matured sets scored by height
+type BlockData struct {
+	Version      int    `json:"version"`
+	Height       int64  `json:"height"`
+	Hash         string `json:"hash"`
+	CoinBaseTxId string `json:"coinbaseTxid,omitempty"`
+	// Miner and worker who found the block
+	Login  string `json:"login,omitempty"`
+	Worker string `json:"worker,omitempty"`
+	// Pool node which found the block and the coinbase tag it mined with
+	Node        string `json:"node"`
+	CoinBaseTag string `json:"coinbaseTag"`
+	Timestamp   int64  `json:"timestamp"`
+	// Network difficulty at the block height
+	Difficulty  int64 `json:"difficulty"`
+	TotalShares int64 `json:"shares"`
+	// Block subsidy and transaction fees of the coinbase in Satoshi
+	Subsidy int64 `json:"subsidy"`
+	Fees    int64 `json:"fees"`
+	// Confirmations when the unlocker last moved the block
+	Confirmations int64             `json:"confirmations"`
+	State         string            `json:"state"`
+	Orphan        bool              `json:"orphan"`
+	Transitions   []BlockTransition `json:"transitions"`
+	// Header nonce and extra nonces, round keys are named by the nonce
+	Nonce   string `json:"nonce"`
+	ENonce1 string `json:"enonce1,omitempty"`
+	ENonce2 string `json:"enonce2,omitempty"`
+	// Credited to miners, and kept by the pool with keepTxFees, set by the unlocker
+	Reward      *big.Int `json:"reward,omitempty"`
+	ExtraReward *big.Int `json:"extraReward,omitempty"`
+	RoundHeight int64    `json:"-"`
+	// Coinbase outputs paying the pool, set by the unlocker when the block matures
+	CoinBaseOutputs []*UTXO `json:"-"`
+	// Member of the sorted set the block was read from
+	member string
+	// Read from the candidates or immature set, its round shares are still kept
+	pending bool
+}
+
+func (b *BlockData) RewardInSatoshi() int64 {
+	if b.Reward == nil {
+		return 0
+	}
+	return b.Reward.Int64()
+}
+
+func (b *BlockData) RoundKey() string {
+	return join(b.RoundHeight, b.Hash)
+}
+
+// Move the block to a new state, repeating the current state records nothing
+func (b *BlockData) Transition(state string) {
+	if b.State == state {
+		return
+	}
+	b.State = state
+	b.Orphan = state == BlockOrphaned
+	b.Transitions = append(b.Transitions, BlockTransition{State: state, Timestamp: MakeTimestamp() / 1000})
+}
+
+// Candidate of a block found by the share, TotalShares is set when its round is closed
+func newCandidate(login, id string, params []string, hash string, roundDiff int64, height uint64, coinBaseValue int64,
+	blkTotalFee int64, node, coinBaseTag string) *BlockData {
+	block := &BlockData{
+		Height:      int64(height),
+		Hash:        hash,
+		Login:       login,
+		Worker:      id,
+		Node:        node,
+		CoinBaseTag: coinBaseTag,
+		Timestamp:   MakeTimestamp() / 1000,
+		Difficulty:  roundDiff,
+		Subsidy:     coinBaseValue - blkTotalFee,
+		Fees:        blkTotalFee,
+		Nonce:       params[0],
+		ENonce1:     params[1],
+		ENonce2:     params[2],
+	}
+	block.Transition(BlockCandidate)
+	return block
+}
+
+// Copy of the block for the public API, the finder and the extra nonces are left out
+func (b *BlockData) Public() *BlockData {
+	public := *b
+	public.Login = ""
+	public.Worker = ""
+	public.ENonce1 = ""
+	public.ENonce2 = ""
+	return &public
+}
+
+func (b *BlockData) Pending() bool {
+	return b.pending
+}
+
+func (b *BlockData) key() string {
+	b.Version = BlockRecordVersion
+	data, _ := json.Marshal(b)
+	return string(data)
+}
+
+func convertCandidateResults(raw []redis.Z) []*BlockData {
+	return convertBlocks(raw, parseLegacyCandidate)
+}
+
+func convertBlockResults(rows ...[]redis.Z) []*BlockData {
+	var result []*BlockData
+	for _, row := range rows {
+		result = append(result, convertBlocks(row, parseLegacyBlock)...)
+	}
+	return result
+}
+
+func convertBlocks(rows []redis.Z, legacy func(string) *BlockData) []*BlockData {
+	var result []*BlockData
+	for _, v := range rows {
+		member := v.Member.(string)
+		var block *BlockData
+		if strings.HasPrefix(member, "{") {
+			err := json.Unmarshal([]byte(member), &block)
+			if err != nil {
+				Error.Printf("Invalid block record at height %v: %v", int64(v.Score), err)
+				continue
+			}
+		} else {
+			block = legacy(member)
+			if block == nil {
+				Error.Printf("Invalid block record at height %v: %q", int64(v.Score), member)
+				continue
+			}
+		}
+		block.Height = int64(v.Score)
+		block.RoundHeight = block.Height
+		block.member = member
+		result = append(result, block)
+	}
+	return result
+}
+
+// "nonce:eNonce1:eNonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee:node:coinBaseTagHex:blockHash"
+func parseLegacyCandidate(member string) *BlockData {
+	fields := strings.Split(member, ":")
+	if len(fields) < 8 {
+		return nil
+	}
+	block := &BlockData{Version: 1, Nonce: fields[0], ENonce1: fields[1], ENonce2: fields[2]}
+	block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
+	block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
+	block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
+	block.Fees, _ = strconv.ParseInt(fields[7], 10, 64)
+	coinBaseValue, _ := strconv.ParseInt(fields[6], 10, 64)
+	block.Subsidy = coinBaseValue - block.Fees
+	if len(fields) > 9 {
+		block.Node = fields[8]
+		block.CoinBaseTag = decodeTag(fields[9])
+	}
+	if len(fields) > 10 {
+		block.Hash = fields[10]
+	}
+	block.State = BlockCandidate
+	return block
+}
+
+// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:coinBaseValue:blkTotalFee:rewardInSatoshi:node:coinBaseTagHex"
+func parseLegacyBlock(member string) *BlockData {
+	fields := strings.Split(member, ":")
+	if len(fields) < 10 {
+		return nil
+	}
+	block := &BlockData{Version: 1, Nonce: fields[2]}
+	block.Orphan, _ = strconv.ParseBool(fields[1])
+	if fields[3] != "0x0" {
+		block.Hash = fields[3]
+	}
+	block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
+	block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
+	block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
+	block.Fees, _ = strconv.ParseInt(fields[8], 10, 64)
+	coinBaseValue, _ := strconv.ParseInt(fields[7], 10, 64)
+	block.Subsidy = coinBaseValue - block.Fees
+	block.Reward, _ = new(big.Int).SetString(fields[9], 10)
+	if len(fields) > 11 {
+		block.Node = fields[10]
+		block.CoinBaseTag = decodeTag(fields[11])
+	}
+	return block
+}
+
+// Blocks recorded at height in any state, legacy blocks get the state of their set
+func (r *RedisClient) GetBlocksAt(height int64) ([]*BlockData, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(height, 10), Max: strconv.FormatInt(height, 10)}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.ZRangeByScoreWithScores(r.formatKey("blocks", "candidates"), option)
+		tx.ZRangeByScoreWithScores(r.formatKey("blocks", "immature"), option)
+		tx.ZRangeByScoreWithScores(r.formatKey("blocks", "matured"), option)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sets := []struct {
+		legacy  func(string) *BlockData
+		state   string
+		pending bool
+	}{
+		{parseLegacyCandidate, BlockCandidate, true},
+		{parseLegacyBlock, BlockImmature, true},
+		{parseLegacyBlock, BlockMatured, false},
+	}
+	var result []*BlockData
+	for i, set := range sets {
+		for _, block := range convertBlocks(cmds[i].(*redis.ZSliceCmd).Val(), set.legacy) {
+			if len(block.State) == 0 {
+				block.State = set.state
+				if block.Orphan {
+					block.State = BlockOrphaned
+				}
+			}
+			block.pending = set.pending
+			result = append(result, block)
+		}
+	}
+	return result, nil
+}
+
+func (r *RedisClient) GetImmatureCredits(block *BlockData) (map[string]int64, error) {
+	values, err := r.client.HGetAllMap(r.formatKey("credits", "immature", block.RoundHeight, block.Hash)).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64)
+	for login, v := range values {
+		result[login], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return result, nil
+}
+
+// Move a candidate or immature block back to the candidates, its immature credits are taken back.
+// The unlocker checks it again and credits its round anew
+func (r *RedisClient) RequeueBlock(block *BlockData) error {
+	candidatesKey := r.formatKey("blocks", "candidates")
+	immatureKey := r.formatKey("blocks", "immature")
+	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
+	tx, err := r.client.Watch(candidatesKey, immatureKey, creditKey)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	inCandidates := tx.ZScore(candidatesKey, block.member).Err() == nil
+	inImmature := tx.ZScore(immatureKey, block.member).Err() == nil
+	if !inCandidates && !inImmature {
+		return fmt.Errorf("block %v is neither candidate nor immature", block.RoundKey())
+	}
+	immatureCredits, err := tx.HGetAllMap(creditKey).Result()
+	if err != nil {
+		return err
+	}
+
+	member := block.member
+	block.Reward = nil
+	block.ExtraReward = nil
+	block.Transition(BlockCandidate)
+	_, err = tx.Exec(func() error {
+		tx.ZRem(candidatesKey, member)
+		tx.ZRem(immatureKey, member)
+		tx.ZAdd(candidatesKey, redis.Z{Score: float64(block.Height), Member: block.key()})
+		if len(immatureCredits) == 0 {
+			return nil
+		}
+		totalImmature := int64(0)
+		var postings []Posting
+		for login, amountString := range immatureCredits {
+			amount, _ := strconv.ParseInt(amountString, 10, 64)
+			totalImmature += amount
+			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
+			postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: -amount})
+		}
+		tx.Del(creditKey)
+		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
+		postings = append(sortPostings(postings), Posting{Account: AccountBlocks, Amount: totalImmature})
+		r.writeLedger(tx, EntryRequeue, join(block.Height, block.Hash), "round credited anew", postings...)
+		return nil
+	})
+	return err
+}
+
+func decodeTag(tagHex string) string {
+	tag, err := hex.DecodeString(tagHex)
+	if err != nil {
+		return ""
+	}
+	return string(tag)
+}
+
+// Rewrite blocks of older versions as block records, returns how many were migrated
+func (r *RedisClient) MigrateBlocks() (int, error) {
+	sets := []struct {
+		name   string
+		legacy func(string) *BlockData
+		state  string
+	}{
+		{"candidates", parseLegacyCandidate, BlockCandidate},
+		{"immature", parseLegacyBlock, BlockImmature},
+		{"matured", parseLegacyBlock, BlockMatured},
+	}
+	migrated := 0
+	for _, set := range sets {
+		key := r.formatKey("blocks", set.name)
+		rows, err := r.client.ZRangeWithScores(key, 0, -1).Result()
+		if err != nil {
+			return migrated, err
+		}
+		var legacy []redis.Z
+		for _, v := range rows {
+			if !strings.HasPrefix(v.Member.(string), "{") {
+				legacy = append(legacy, v)
+			}
+		}
+		blocks := convertBlocks(legacy, set.legacy)
+		if len(blocks) == 0 {
+			continue
+		}
+
+		tx := r.client.Multi()
+		_, err = tx.Exec(func() error {
+			for _, block := range blocks {
+				// The time it was found is the only one known
+				state := set.state
+				if block.Orphan {
+					state = BlockOrphaned
+				}
+				block.State = state
+				block.Transitions = []BlockTransition{{State: state, Timestamp: block.Timestamp}}
+				tx.ZRem(key, block.member)
+				tx.ZAdd(key, redis.Z{Score: float64(block.Height), Member: block.key()})
+			}
+			return nil
+		})
+		tx.Close()
+		if err != nil {
+			return migrated, err
+		}
+		migrated += len(blocks)
+	}
+	return migrated, nil
+}
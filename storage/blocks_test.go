@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"gopkg.in/redis.v3"
+)
+
+func TestPublicBlock(t *testing.T) {
+	block := &BlockData{Height: 100, Hash: "aa", Login: "x", Worker: "rig", Nonce: "0x1", ENonce1: "0x2", ENonce2: "0x3"}
+	public := block.Public()
+	data, _ := json.Marshal(public)
+	for _, field := range []string{"login", "worker", "enonce1", "enonce2"} {
+		if strings.Contains(string(data), `"`+field+`"`) {
+			t.Errorf("Public block must not have %v: %s", field, data)
+		}
+	}
+	if public.Hash != "aa" || block.Login != "x" {
+		t.Errorf("Unexpected public block %+v of %+v", public, block)
+	}
+}
+
+func TestMigrateBlocks(t *testing.T) {
+	reset()
+
+	r.client.ZAdd(r.formatKey("blocks", "candidates"),
+		redis.Z{Score: 100, Member: "0x1:aa:bb:1000:500:400:5100:100:node:7467:hash100"})
+	r.client.ZAdd(r.formatKey("blocks", "matured"),
+		redis.Z{Score: 90, Member: "0:1:0x2:hash90:900:500:400:5100:100:0:node:7467"},
+		redis.Z{Score: 80, Member: "0:0:0x3:hash80:800:500:400:5100:100:5200:node:7467"})
+
+	n, err := r.MigrateBlocks()
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 migrated blocks, got %v: %v", n, err)
+	}
+	if n, _ = r.MigrateBlocks(); n != 0 {
+		t.Errorf("Migration must run once, migrated %v again", n)
+	}
+
+	candidates, _ := r.GetCandidates(100)
+	if len(candidates) != 1 {
+		t.Fatalf("Unexpected candidates %v", candidates)
+	}
+	c := candidates[0]
+	if c.Version != BlockRecordVersion || c.State != BlockCandidate || c.Hash != "hash100" || c.Nonce != "0x1" ||
+		c.Subsidy != 5000 || c.Fees != 100 || c.CoinBaseTag != "tg" || len(c.Transitions) != 1 {
+		t.Errorf("Unexpected candidate %+v", c)
+	}
+	matured, _ := r.GetMaturedBlocks(0)
+	if len(matured) != 2 || matured[0].State != BlockMatured || matured[0].RewardInSatoshi() != 5200 ||
+		matured[1].State != BlockOrphaned || !matured[1].Orphan {
+		t.Errorf("Unexpected matured blocks %+v", matured)
+	}
+}
+
+func TestRequeueBlock(t *testing.T) {
+	reset()
+
+	block := &BlockData{Height: 100, Hash: "hash100", Nonce: "0x1", Subsidy: 5000, Difficulty: 500, TotalShares: 400}
+	block.Transition(BlockCandidate)
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 100, Member: block.key()})
+
+	blocks, _ := r.GetBlocksAt(100)
+	if len(blocks) != 1 || !blocks[0].Pending() {
+		t.Fatalf("Unexpected blocks %+v", blocks)
+	}
+	block = blocks[0]
+	block.Reward = big.NewInt(5000)
+	r.WriteImmatureBlock(block, map[string]int64{"a": 3000, "b": 2000})
+
+	blocks, _ = r.GetBlocksAt(100)
+	if len(blocks) != 1 || blocks[0].State != BlockImmature {
+		t.Fatalf("Unexpected blocks %+v", blocks)
+	}
+	if err := r.RequeueBlock(blocks[0]); err != nil {
+		t.Fatalf("Requeue failed: %v", err)
+	}
+	if err := r.RequeueBlock(blocks[0]); err == nil {
+		t.Errorf("Requeued block must be looked up again")
+	}
+
+	candidates, _ := r.GetCandidates(100)
+	immature, _ := r.GetImmatureBlocks(100)
+	if len(candidates) != 1 || len(immature) != 0 || candidates[0].State != BlockCandidate || candidates[0].Reward != nil {
+		t.Errorf("Unexpected candidates %+v and immature blocks %+v", candidates, immature)
+	}
+	if n, _ := r.client.HGet(r.formatKey("miners", "a"), "immature").Int64(); n != 0 {
+		t.Errorf("Immature credit of a must be taken back, got %v", n)
+	}
+	if n, _ := r.client.HGet(r.formatKey("finances"), "immature").Int64(); n != 0 {
+		t.Errorf("Immature finances must be taken back, got %v", n)
+	}
+	if drifts, _ := r.ReconcileLedger(); len(drifts) != 0 {
+		t.Errorf("Ledger drifts after requeue: %v", drifts)
+	}
+}
+
+func TestUnlockerHalt(t *testing.T) {
+	reset()
+
+	if reason, _ := r.GetUnlockerHalt(); reason != "" {
+		t.Errorf("Unlocker must not be halted")
+	}
+	r.SetUnlockerHalt("node down")
+	if reason, _ := r.GetUnlockerHalt(); reason != "node down" {
+		t.Errorf("Unexpected halt reason %q", reason)
+	}
+	if cleared, _ := r.ClearUnlockerHalt(); !cleared {
+		t.Errorf("Halt must be cleared")
+	}
+	if reason, _ := r.GetUnlockerHalt(); reason != "" {
+		t.Errorf("Unlocker must not be halted after clear")
+	}
+}
@@ -0,0 +1,545 @@
+package storage
+
+import (
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackendConformance(t *testing.T) {
+	testBackend(t, func() Backend { return NewMemoryBackend() })
+}
+
+func TestRedisBackendConformance(t *testing.T) {
+	testBackend(t, func() Backend {
+		reset()
+		return r
+	})
+}
+
+// Behaviour every backend must share, each subtest starts from an empty backend
+func testBackend(t *testing.T, newBackend func() Backend) {
+	tests := []struct {
+		name string
+		test func(*testing.T, Backend)
+	}{
+		{"Shares", testBackendShares},
+		{"BlockLifecycle", testBackendBlockLifecycle},
+		{"Reorg", testBackendReorg},
+		{"Requeue", testBackendRequeue},
+		{"Balances", testBackendBalances},
+		{"Payments", testBackendPayments},
+		{"PayoutBatch", testBackendPayoutBatch},
+		{"Nodes", testBackendNodes},
+		{"Stats", testBackendStats},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { tt.test(t, newBackend()) })
+	}
+}
+
+// Write a block found by x after shares of x and y, returns it as candidate
+func writeTestBlock(t *testing.T, b Backend, height uint64, hash, nonce string) *BlockData {
+	acc := ShareAccounting{PPLNSShares: 10, ScoreDecay: time.Minute}
+	b.WriteShare("x", "1", []string{nonce, "0x0", "0x0"}, 10, height, time.Hour, acc)
+	b.WriteShare("y", "1", []string{nonce, "0x1", "0x0"}, 20, height, time.Hour, acc)
+	exist, err := b.WriteBlock("x", "1", []string{nonce, "0x2", "0x0"}, hash, 30, 100, height, 5100, 100, "node", "tag",
+		time.Hour, acc)
+	if err != nil || exist {
+		t.Fatalf("Block not written: %v", err)
+	}
+	blocks, _ := b.GetBlocksAt(int64(height))
+	for _, block := range blocks {
+		if block.Hash == hash {
+			return block
+		}
+	}
+	t.Fatalf("No block %v at %v", hash, height)
+	return nil
+}
+
+func testBackendShares(t *testing.T, b Backend) {
+	exist, _ := b.WriteShare("x", "1", []string{"0x0", "0x0", "0x0"}, 10, 1008, time.Hour, ShareAccounting{})
+	if exist {
+		t.Error("PoW must not exist")
+	}
+	exist, _ = b.WriteShare("z", "1", []string{"0x0", "0x0", "0x0"}, 10, 1010, time.Hour, ShareAccounting{})
+	if !exist {
+		t.Error("PoW must exist")
+	}
+	exist, _ = b.WriteShare("x", "1", []string{"0x0", "0x0", "0x0"}, 10, 1020, time.Hour, ShareAccounting{})
+	if exist {
+		t.Error("PoW of old heights must be forgotten")
+	}
+
+	block := writeTestBlock(t, b, 1030, "aa", "0x1")
+	if block.State != BlockCandidate || !block.Pending() || block.Login != "x" || block.Subsidy != 5000 || block.Fees != 100 {
+		t.Errorf("Unexpected candidate %+v", block)
+	}
+	shares, _ := b.GetRoundShares(1030, "0x1")
+	if !reflect.DeepEqual(shares, map[string]int64{"x": 60, "y": 20}) {
+		t.Errorf("Unexpected round shares %v", shares)
+	}
+	if block.TotalShares != 80 {
+		t.Errorf("Unexpected total shares %v", block.TotalShares)
+	}
+	window, _ := b.GetPPLNSShares(1030, "0x1")
+	if len(window) != 3 || window[0] != (PPLNSShare{Login: "x", Diff: 30}) {
+		t.Errorf("Unexpected PPLNS window %v", window)
+	}
+	log, _ := b.GetRoundShareLog(1030, "0x1")
+	if len(log) != 3 || log[0].Login != "x" || log[1].Login != "y" || log[2].Diff != 30 {
+		t.Errorf("Unexpected share log %v", log)
+	}
+	scores, _ := b.GetRoundScores(1030, "0x1", time.Minute)
+	if len(scores) != 2 || scores["y"] <= 0 {
+		t.Errorf("Unexpected round scores %v", scores)
+	}
+	if n, _ := b.GetNodeBlocksFound("node"); n != 1 {
+		t.Errorf("Unexpected blocks found %v", n)
+	}
+
+	b.WriteShare("x", "1", []string{"0x3", "0x0", "0x0"}, 10, 1031, time.Hour, ShareAccounting{Credit: 750})
+	b.WriteShare("x", "1", []string{"0x3", "0x1", "0x0"}, 10, 1031, time.Hour, ShareAccounting{Credit: 750})
+	if err := b.FlushCredits(); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := b.GetBalance("x"); balance != 1 {
+		t.Errorf("Whole satoshis of the PPS credit must go to balance, got %v", balance)
+	}
+}
+
+func testBackendBlockLifecycle(t *testing.T, b Backend) {
+	block := writeTestBlock(t, b, 100, "aa", "0x1")
+	orphan := writeTestBlock(t, b, 101, "bb", "0x2")
+	stale := writeTestBlock(t, b, 102, "cc", "0x3")
+
+	candidates, _ := b.GetCandidates(101)
+	if len(candidates) != 2 || candidates[0].Hash != "aa" || candidates[1].Hash != "bb" {
+		t.Fatalf("Unexpected candidates %+v", candidates)
+	}
+	if err := b.WritePendingOrphans([]*BlockData{stale}); err != nil {
+		t.Fatal(err)
+	}
+
+	block.Reward = big.NewInt(5000)
+	b.WriteImmatureBlock(block, map[string]int64{"x": 3000, "y": 1000})
+	orphan.Reward = big.NewInt(5000)
+	b.WriteImmatureBlock(orphan, map[string]int64{"x": 4000})
+	if credits, _ := b.GetImmatureCredits(block); !reflect.DeepEqual(credits, map[string]int64{"x": 3000, "y": 1000}) {
+		t.Errorf("Unexpected immature credits %v", credits)
+	}
+	if _, immature, _, _ := b.GetOwedBalances(); immature != 8000 {
+		t.Errorf("Unexpected immature total %v", immature)
+	}
+	immature, _ := b.GetImmatureBlocks(200)
+	if len(immature) != 3 || !immature[2].Orphan {
+		t.Fatalf("Unexpected immature blocks %+v", immature)
+	}
+
+	block = immature[0]
+	block.Reward = big.NewInt(5000)
+	block.CoinBaseOutputs = []*UTXO{{TxId: "cb", Vout: 0, Value: 5000, Height: 100, Coinbase: true}}
+	if err := b.WriteMaturedBlock(block, map[string]int64{"x": 3000, "y": 1000}, 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteOrphan(immature[1]); err != nil {
+		t.Fatal(err)
+	}
+	if shares, _ := b.GetRoundShares(100, "0x1"); len(shares) != 0 {
+		t.Errorf("Round shares of matured blocks must be removed, got %v", shares)
+	}
+	matured, _ := b.GetMaturedBlocks(0)
+	if len(matured) != 2 || matured[0].State != BlockMatured || matured[1].State != BlockOrphaned || matured[0].Pending() {
+		t.Fatalf("Unexpected matured blocks %+v", matured)
+	}
+	if len(matured[0].Transitions) != 3 {
+		t.Errorf("Unexpected transitions %+v", matured[0].Transitions)
+	}
+	if balance, _ := b.GetBalance("x"); balance != 3000 {
+		t.Errorf("Unexpected balance %v", balance)
+	}
+	if balance, immature, _, _ := b.GetOwedBalances(); balance != 4000 || immature != 0 {
+		t.Errorf("Unexpected owed balances %v, immature %v", balance, immature)
+	}
+	if utxos, _ := b.GetUTXOs(); len(utxos) != 1 || utxos[0].Outpoint() != "cb:0" {
+		t.Errorf("Unexpected UTXOs %v", utxos)
+	}
+	blocks, _ := b.GetBlocksAt(102)
+	if len(blocks) != 1 || blocks[0].State != BlockOrphaned || !blocks[0].Pending() {
+		t.Errorf("Unexpected blocks %+v", blocks)
+	}
+	if drifts, _ := b.ReconcileLedger(); len(drifts) != 0 {
+		t.Errorf("Unexpected drifts %v", drifts)
+	}
+	if n, err := b.MigrateBlocks(); n != 0 || err != nil {
+		t.Errorf("Block records must not be migrated, got %v: %v", n, err)
+	}
+}
+
+func testBackendReorg(t *testing.T, b Backend) {
+	block := writeTestBlock(t, b, 100, "aa", "0x1")
+	block.Reward = big.NewInt(5000)
+	b.WriteImmatureBlock(block, map[string]int64{"x": 3000, "y": 1000})
+	immature, _ := b.GetImmatureBlocks(100)
+	immature[0].Reward = big.NewInt(5000)
+	immature[0].CoinBaseOutputs = []*UTXO{{TxId: "cb", Vout: 0, Value: 5000, Height: 100, Coinbase: true}}
+	b.WriteMaturedBlock(immature[0], map[string]int64{"x": 3000, "y": 1000}, 0)
+	b.UpdateBalance("x", 2000)
+	b.WritePayments("tx", map[string]int64{"x": 2000})
+
+	matured, _ := b.GetMaturedBlocks(100)
+	total, err := b.WriteReorg(matured[0])
+	if err != nil || total != 4000 {
+		t.Fatalf("Unexpected rollback of %v: %v", total, err)
+	}
+	if balance, _ := b.GetBalance("x"); balance != -2000 {
+		t.Errorf("Unexpected balance %v", balance)
+	}
+	if utxos, _ := b.GetUTXOs(); len(utxos) != 0 {
+		t.Errorf("Coinbase outputs of the block must be forgotten, got %v", utxos)
+	}
+	matured, _ = b.GetMaturedBlocks(100)
+	if len(matured) != 1 || !matured[0].Orphan {
+		t.Errorf("Block must be orphaned, got %+v", matured)
+	}
+	if drifts, _ := b.ReconcileLedger(); len(drifts) != 0 {
+		t.Errorf("Unexpected drifts %v", drifts)
+	}
+}
+
+func testBackendRequeue(t *testing.T, b Backend) {
+	block := writeTestBlock(t, b, 100, "aa", "0x1")
+	block.Reward = big.NewInt(5000)
+	b.WriteImmatureBlock(block, map[string]int64{"x": 3000, "y": 2000})
+
+	blocks, _ := b.GetBlocksAt(100)
+	if len(blocks) != 1 || blocks[0].State != BlockImmature {
+		t.Fatalf("Unexpected blocks %+v", blocks)
+	}
+	if err := b.RequeueBlock(blocks[0]); err != nil {
+		t.Fatalf("Requeue failed: %v", err)
+	}
+	if err := b.RequeueBlock(blocks[0]); err == nil {
+		t.Errorf("Requeued block must be looked up again")
+	}
+	candidates, _ := b.GetCandidates(100)
+	if len(candidates) != 1 || candidates[0].State != BlockCandidate || candidates[0].Reward != nil {
+		t.Errorf("Unexpected candidates %+v", candidates)
+	}
+	if _, immature, _, _ := b.GetOwedBalances(); immature != 0 {
+		t.Errorf("Immature credits must be taken back, got %v", immature)
+	}
+	if drifts, _ := b.ReconcileLedger(); len(drifts) != 0 {
+		t.Errorf("Unexpected drifts %v", drifts)
+	}
+}
+
+func testBackendBalances(t *testing.T, b Backend) {
+	if exists, _ := b.IsMinerExists("x"); exists {
+		t.Error("Miner must not exist")
+	}
+	b.AdjustBalance("x", 1000, "test")
+	b.AdjustBalance("bitcoincash:qy", 500, "test")
+	if exists, _ := b.IsMinerExists("x"); !exists {
+		t.Error("Miner must exist")
+	}
+	payees, _ := b.GetPayees()
+	sort.Strings(payees)
+	if !reflect.DeepEqual(payees, []string{"bitcoincash:qy", "x"}) {
+		t.Errorf("Unexpected payees %v", payees)
+	}
+
+	b.SetPayoutThreshold("x", 2000)
+	if threshold, _ := b.GetPayoutThreshold("x"); threshold != 2000 {
+		t.Errorf("Unexpected threshold %v", threshold)
+	}
+	b.SetPayoutThreshold("x", 0)
+	if threshold, _ := b.GetPayoutThreshold("x"); threshold != 0 {
+		t.Errorf("Threshold must be removed, got %v", threshold)
+	}
+	b.SetLightningDestination("x", "x@ln.example")
+	dests, _ := b.GetLightningDestinations([]string{"x", "bitcoincash:qy"})
+	if !reflect.DeepEqual(dests, map[string]string{"x": "x@ln.example"}) {
+		t.Errorf("Unexpected destinations %v", dests)
+	}
+	empty, webhook := "", "https://example.com/hook"
+	b.UpdateMinerSettings("x", &MinerSettings{Lightning: &empty, Webhook: &webhook})
+	if dest, _ := b.GetLightningDestination("x"); dest != "" {
+		t.Errorf("Destination must be removed, got %q", dest)
+	}
+
+	challenge, expires, _ := b.IssueChallenge("x", time.Minute)
+	if live, _ := b.GetChallenge("x"); len(challenge) != 32 || live != challenge || expires < time.Now().Unix() {
+		t.Errorf("Unexpected challenge %q, issued %q expiring %v", live, challenge, expires)
+	}
+	if again, _, _ := b.IssueChallenge("x", time.Minute); again != challenge {
+		t.Errorf("Live challenge must be kept, got %q", again)
+	}
+	if taken, _ := b.TakeChallenge("x", "00"); taken {
+		t.Error("Only the live challenge can be taken")
+	}
+	if taken, _ := b.TakeChallenge("x", challenge); !taken {
+		t.Error("Challenge must be taken")
+	}
+	if taken, _ := b.TakeChallenge("x", challenge); taken {
+		t.Error("Challenge must be taken once")
+	}
+
+	balances, _ := b.LedgerBalances()
+	if balances["balance:x"] != 1000 || balances[AccountAdjustments] != -1500 {
+		t.Errorf("Unexpected ledger balances %v", balances)
+	}
+	if err := b.OpenLedger(); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteNetworkFee("tx1", "payout tx fee", 300)
+	b.WriteNetworkFee("tx1", "payout tx fee", 300)
+	balances, _ = b.LedgerBalances()
+	if balances[AccountNetworkFees] != 300 || balances[AccountPoolFee] != -300 {
+		t.Errorf("Network fee must be recorded once, got %v", balances)
+	}
+	if entries, _ := b.GetLedger(0, 10); len(entries) != 3 || entries[1].Id != 1 || entries[1].Note != "test" {
+		t.Errorf("Ledger with entries must not be opened, got %+v", entries)
+	}
+	if drifts, _ := b.ReconcileLedger(); len(drifts) != 0 {
+		t.Errorf("Unexpected drifts %v", drifts)
+	}
+}
+
+func testBackendPayments(t *testing.T, b Backend) {
+	b.AdjustBalance("x", 5000, "test")
+	b.AdjustBalance("y", 5000, "test")
+
+	if err := b.LockPayouts("x", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LockPayouts("x", 1000); err == nil {
+		t.Error("Payouts must be locked once")
+	}
+	if locked, _ := b.IsPayoutsLocked(); !locked {
+		t.Error("Payouts must be locked")
+	}
+	b.UpdateBalance("x", 1000)
+	b.UpdateBalance("y", 2000)
+	if pending := b.GetPendingPayments(); len(pending) != 2 {
+		t.Errorf("Unexpected pending payments %v", pending)
+	}
+	b.WritePayments("tx1", map[string]int64{"x": 1000, "y": 2000})
+	if locked, _ := b.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked")
+	}
+	if pending := b.GetPendingPayments(); len(pending) != 0 {
+		t.Errorf("Pending payments must be paid, got %v", pending)
+	}
+
+	unconfirmed, _ := b.GetUnconfirmedPayments()
+	if len(unconfirmed) != 1 || unconfirmed[0].TxId != "tx1" || unconfirmed[0].Status != PaymentPending {
+		t.Fatalf("Unexpected unconfirmed payments %+v", unconfirmed)
+	}
+	replacement, err := b.ReplacePaymentTx(unconfirmed[0], "tx2")
+	if err != nil || !reflect.DeepEqual(replacement.Replaces, []string{"tx1"}) {
+		t.Fatalf("Unexpected replacement %+v: %v", replacement, err)
+	}
+	txs, _ := b.GetPaymentTxs([]string{"tx1", "tx2", "tx3"})
+	if len(txs) != 2 || txs["tx1"].Status != PaymentReplaced || txs["tx1"].ReplacedBy != "tx2" {
+		t.Errorf("Unexpected payment txs %+v", txs)
+	}
+	replacement.Status = PaymentConfirmed
+	b.UpdatePaymentTx(replacement)
+	if unconfirmed, _ := b.GetUnconfirmedPayments(); len(unconfirmed) != 0 {
+		t.Errorf("Unexpected unconfirmed payments %+v", unconfirmed)
+	}
+
+	b.SetLightningDestination("x", "lnbc1")
+	if stats, _ := b.GetMinerStats("x", 10); stats["stats"].(map[string]interface{})["lightning"] != nil {
+		t.Errorf("Lightning destination must not be public, got %v", stats["stats"])
+	}
+	b.LockPayouts("x", 500)
+	b.UpdateBalance("x", 500)
+	b.WriteInFlightPayment(&InFlightPayment{Login: "x", PaymentHash: "hash", Amount: 500, Clear: true})
+	if inFlight, _ := b.GetInFlightPayment(); inFlight == nil || inFlight.PaymentHash != "hash" {
+		t.Errorf("Unexpected payment in flight %+v", inFlight)
+	}
+	b.WriteLightningPayment("x", "hash", 500, 3, true)
+	if dest, _ := b.GetLightningDestination("x"); dest != "" {
+		t.Errorf("Invoice must be cleared, got %q", dest)
+	}
+	if inFlight, _ := b.GetInFlightPayment(); inFlight != nil {
+		t.Errorf("Recorded payment must not be in flight, got %+v", inFlight)
+	}
+
+	stats, _ := b.GetMinerStats("x", 10)
+	payments := stats["payments"].([]map[string]interface{})
+	if stats["paymentsTotal"].(int64) != 2 || len(payments) != 2 {
+		t.Fatalf("Unexpected miner payments %v", stats)
+	}
+	for _, payment := range payments {
+		if payment["tx"] == "tx2" && payment["status"] != PaymentConfirmed {
+			t.Errorf("Payment must be annotated, got %v", payment)
+		}
+	}
+	if balance, _ := b.GetBalance("x"); balance != 3500 {
+		t.Errorf("Unexpected balance %v", balance)
+	}
+	b.UpdateBalance("y", 1000)
+	b.RollbackBalance("y", 1000)
+	if balance, _, pending, _ := b.GetOwedBalances(); balance != 6500 || pending != 0 {
+		t.Errorf("Unexpected owed balance %v, pending %v", balance, pending)
+	}
+	if drifts, _ := b.ReconcileLedger(); len(drifts) != 0 {
+		t.Errorf("Unexpected drifts %v", drifts)
+	}
+}
+
+func testBackendPayoutBatch(t *testing.T, b Backend) {
+	b.AdjustBalance("x", 5000, "test")
+	b.UpdateBalance("x", 1000)
+
+	batch := &PayoutBatch{Id: "b1", Psbt: "psbt", Inputs: []string{"in:0"}, Payments: map[string]int64{"x": 1000}}
+	if err := b.WritePayoutBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WritePayoutBatch(&PayoutBatch{Id: "b2"}); err == nil {
+		t.Error("Only one batch may be pending")
+	}
+	if err := b.SubmitSignedPsbt("b2", "signed"); err == nil {
+		t.Error("Only the pending batch may be signed")
+	}
+	b.SubmitSignedPsbt("b1", "signed")
+	pending, _ := b.GetPayoutBatch()
+	if pending == nil || pending.SignedPsbt != "signed" {
+		t.Fatalf("Unexpected batch %+v", pending)
+	}
+	b.AbandonPayoutBatch(pending)
+	if pending, _ := b.GetPayoutBatch(); pending != nil {
+		t.Errorf("Batch must be abandoned, got %+v", pending)
+	}
+	abandoned, _ := b.GetAbandonedBatches()
+	if !reflect.DeepEqual(abandoned, map[string][]string{"b1": {"in:0"}}) {
+		t.Errorf("Unexpected abandoned batches %v", abandoned)
+	}
+
+	b.UpdateBalance("x", 1000)
+	batch = &PayoutBatch{Id: "b3", Inputs: []string{"in:0"}, Payments: map[string]int64{"x": 1000}, Conflicts: []string{"b1"}}
+	b.WritePayoutBatch(batch)
+	b.CompletePayoutBatch("tx", batch)
+	if abandoned, _ := b.GetAbandonedBatches(); len(abandoned) != 0 {
+		t.Errorf("Conflicted batches must be dropped, got %v", abandoned)
+	}
+	if balance, _, pending, _ := b.GetOwedBalances(); balance != 4000 || pending != 0 {
+		t.Errorf("Unexpected owed balance %v, pending %v", balance, pending)
+	}
+
+	b.WritePayoutSchedule(&PayoutSchedule{Next: 10, Threshold: 1000})
+	if schedule, _ := b.GetPayoutSchedule(); schedule == nil || schedule.Next != 10 {
+		t.Errorf("Unexpected schedule %+v", schedule)
+	}
+	b.WriteSolvency(&Solvency{Wallet: 5000, Surplus: 1000})
+	if solvency, _ := b.GetSolvency(); solvency == nil || solvency.Surplus != 1000 {
+		t.Errorf("Unexpected solvency %+v", solvency)
+	}
+	b.ReconcileUTXOs([]*UTXO{{TxId: "a", Vout: 1, Value: 10}, {TxId: "b", Vout: 0, Value: 20}}, nil)
+	b.ReconcileUTXOs(nil, []string{"a:1"})
+	if utxos, _ := b.GetUTXOs(); len(utxos) != 1 || utxos[0].Outpoint() != "b:0" {
+		t.Errorf("Unexpected UTXOs %v", utxos)
+	}
+}
+
+func testBackendNodes(t *testing.T, b Backend) {
+	if pong, err := b.Check(); err != nil || pong != "PONG" {
+		t.Errorf("Unexpected check %q: %v", pong, err)
+	}
+	b.WriteNodeState("node", 100, big.NewInt(1000))
+	nodes, _ := b.GetNodeStates()
+	if len(nodes) != 1 || nodes[0]["height"] != "100" || nodes[0]["difficulty"] != "1000" {
+		t.Errorf("Unexpected node states %v", nodes)
+	}
+
+	ss := &StratumSession{ExtraNonce1: "00010002", ExtraNonce2Size: 4, Target: "00ff", Login: "x", Id: "rig", Authorized: true, Node: "node"}
+	b.WriteStratumSession("sid", ss, time.Minute)
+	if resumed, _ := b.TakeStratumSession("sid"); !reflect.DeepEqual(ss, resumed) {
+		t.Errorf("Invalid resumed session: %v", resumed)
+	}
+	if resumed, _ := b.TakeStratumSession("sid"); resumed != nil {
+		t.Error("Session must be resumed only once")
+	}
+	b.LeaseExtraNonce("00010002", "node", time.Minute)
+	if leased, _ := b.IsExtraNonceLeased("00010002"); !leased {
+		t.Error("Extranonce must be leased")
+	}
+	if leased, _ := b.IsExtraNonceLeased("00010003"); leased {
+		t.Error("Extranonce must not be leased")
+	}
+
+	b.AddPriorityTx("a")
+	b.AddExcludedTx("b")
+	b.AddExcludedTx("c")
+	b.RemoveExcludedTx("b")
+	priority, _ := b.GetPriorityTxs()
+	excluded, _ := b.GetExcludedTxs()
+	if !reflect.DeepEqual(priority, []string{"a"}) || !reflect.DeepEqual(excluded, []string{"c"}) {
+		t.Errorf("Unexpected tx policy %v %v", priority, excluded)
+	}
+	b.RemovePriorityTx("a")
+	if priority, _ := b.GetPriorityTxs(); len(priority) != 0 {
+		t.Errorf("Unexpected priority txs %v", priority)
+	}
+	if list, err := b.GetBlacklist(); err != nil || len(list) != 0 {
+		t.Errorf("Unexpected blacklist %v: %v", list, err)
+	}
+
+	b.SetUnlockerHalt("node down")
+	if reason, _ := b.GetUnlockerHalt(); reason != "node down" {
+		t.Errorf("Unexpected halt reason %q", reason)
+	}
+	if cleared, _ := b.ClearUnlockerHalt(); !cleared {
+		t.Error("Halt must be cleared")
+	}
+	if cleared, _ := b.ClearUnlockerHalt(); cleared {
+		t.Error("Halt must be cleared once")
+	}
+}
+
+func testBackendStats(t *testing.T, b Backend) {
+	writeTestBlock(t, b, 100, "aa", "0x1")
+	b.WriteShare("x", "2", []string{"0x5", "0x0", "0x0"}, 1000, 101, time.Hour, ShareAccounting{})
+
+	stats, err := b.CollectStats(time.Minute, 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["candidatesTotal"].(int64) != 1 || len(stats["candidates"].([]*BlockData)) != 1 {
+		t.Errorf("Unexpected candidates %v", stats["candidates"])
+	}
+	if stats["minersTotal"].(int) != 2 || stats["hashrate"].(int64) <= 0 {
+		t.Errorf("Unexpected miners %v", stats["miners"])
+	}
+	if stats["stats"].(map[string]interface{})["roundShares"] != int64(1000) {
+		t.Errorf("Unexpected pool stats %v", stats["stats"])
+	}
+
+	workers, _ := b.CollectWorkersStats(time.Minute, time.Hour, "x")
+	if workers["workersTotal"].(int) != 2 || workers["workersOnline"].(int64) != 2 {
+		t.Errorf("Unexpected workers %v", workers)
+	}
+	miner, _ := b.GetMinerStats("x", 10)
+	if miner["roundShares"].(int64) != 1000 || miner["stats"].(map[string]interface{})["blocksFound"] != int64(1) {
+		t.Errorf("Unexpected miner stats %v", miner)
+	}
+	if n, _ := b.FlushStaleStats(time.Minute, time.Hour); n != 0 {
+		t.Errorf("Fresh stats must be kept, flushed %v", n)
+	}
+
+	block := writeTestBlock(t, b, 110, "bb", "0x2")
+	b.WritePendingOrphans([]*BlockData{block})
+	luck, _ := b.CollectLuckStats([]int{1, 5})
+	if _, ok := luck["1"]; !ok || len(luck) != 1 {
+		t.Errorf("Unexpected luck %v", luck)
+	}
+	if luck["1"].(map[string]float64)["orphanRate"] != 1 {
+		t.Errorf("Latest block must be the orphan, got %v", luck)
+	}
+}
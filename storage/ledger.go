@@ -0,0 +1,423 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Miner accounts are suffixed with the login, e.g. "balance:<login>"
+const (
+	AccountImmature = "immature"
+	AccountBalance  = "balance"
+	AccountPending  = "pending"
+	AccountPaid     = "paid"
+)
+
+// Pool accounts balancing the miner accounts
+const (
+	// Block rewards, negative by what was mined
+	AccountBlocks = "pool:blocks"
+	// Pool fee and rounding left of block rewards
+	AccountPoolFee = "pool:fee"
+	// PPS reserve funding share credits
+	AccountReserve = "pool:reserve"
+	// Lightning routing and on-chain tx fees paid by the pool
+	AccountNetworkFees = "pool:networkFees"
+	// Counterpart of manual adjustments
+	AccountAdjustments = "pool:adjustments"
+	// Balances that existed before the ledger
+	AccountOpening = "pool:opening"
+)
+
+const (
+	EntryOpening    = "opening"
+	EntryImmature   = "immature"
+	EntryOrphan     = "orphan"
+	EntryCredit     = "credit"
+	EntryPPSCredit  = "ppsCredit"
+	EntryPayout     = "payout"
+	EntryRollback   = "rollback"
+	EntryPaid       = "paid"
+	EntryFee        = "fee"
+	EntryAdjustment = "adjustment"
+	EntryReorg      = "reorg"
+	EntryRequeue    = "requeue"
+)
+
+var minerAccounts = []string{AccountImmature, AccountBalance, AccountPending, AccountPaid}
+
+type Posting struct {
+	Account string `json:"account"`
+	Amount  int64  `json:"amount"`
+}
+
+// Append-only ledger entry, its postings sum up to zero
+type LedgerEntry struct {
+	// Position in the ledger, not stored
+	Id   int64  `json:"id"`
+	Kind string `json:"kind"`
+	// Block "height:hash", payment tx or payment hash
+	Ref       string    `json:"ref,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Postings  []Posting `json:"postings"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+// Difference between the ledger and a balance key
+type LedgerDrift struct {
+	// Miner account or finances field
+	Account string `json:"account"`
+	Ledger  int64  `json:"ledger"`
+	Actual  int64  `json:"actual"`
+}
+
+func MinerAccount(account, login string) string {
+	return account + ":" + login
+}
+
+// Split a miner account into its kind and login, logins may contain colons
+func ParseMinerAccount(account string) (string, string, bool) {
+	i := strings.Index(account, ":")
+	if i < 0 || account[:i] == "pool" {
+		return "", "", false
+	}
+	return account[:i], account[i+1:], true
+}
+
+func (r *RedisClient) writeLedger(tx *redis.Multi, kind, ref, note string, postings ...Posting) {
+	if data, ok := encodeLedgerEntry(kind, ref, note, postings); ok {
+		ledgerScript.Eval(tx, r.ledgerKeys(), ledgerArgs(data, kind, ref, false, postings))
+	}
+}
+
+func (r *RedisClient) ledgerKeys() []string {
+	return []string{r.formatKey("ledger"), r.formatKey("ledger", "totals"), r.formatKey("ledger", "index")}
+}
+
+// Appends an entry, adds its postings to the running totals and indexes it by kind and ref.
+// A unique entry is skipped if one with its kind and ref exists
+var ledgerScript = redis.NewScript(`
+if ARGV[3] == '1' and redis.call('HEXISTS', KEYS[3], ARGV[2]) == 1 then
+	return -1
+end
+local id = redis.call('RPUSH', KEYS[1], ARGV[1]) - 1
+if ARGV[2] ~= '' then
+	redis.call('HSET', KEYS[3], ARGV[2], id)
+end
+for i = 4, #ARGV, 2 do
+	redis.call('HINCRBY', KEYS[2], ARGV[i], ARGV[i + 1])
+end
+return id
+`)
+
+func ledgerArgs(data, kind, ref string, unique bool, postings []Posting) []string {
+	args := []string{data, ledgerIndex(kind, ref), "0"}
+	if unique {
+		args[2] = "1"
+	}
+	for _, p := range nonZeroPostings(postings) {
+		args = append(args, p.Account, strconv.FormatInt(p.Amount, 10))
+	}
+	return args
+}
+
+// Index field of an entry, entries without ref are not indexed
+func ledgerIndex(kind, ref string) string {
+	if len(ref) == 0 {
+		return ""
+	}
+	return kind + ":" + ref
+}
+
+// Entries without postings other than zero are not recorded
+func encodeLedgerEntry(kind, ref, note string, postings []Posting) (string, bool) {
+	entry := LedgerEntry{Kind: kind, Ref: ref, Note: note, Postings: nonZeroPostings(postings), Timestamp: MakeTimestamp() / 1000}
+	if len(entry.Postings) == 0 {
+		return "", false
+	}
+	data, _ := json.Marshal(entry)
+	return string(data), true
+}
+
+func nonZeroPostings(postings []Posting) []Posting {
+	var result []Posting
+	for _, p := range postings {
+		if p.Amount != 0 {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func decodeLedgerEntries(values []string, start int64) ([]*LedgerEntry, error) {
+	result := make([]*LedgerEntry, 0, len(values))
+	for i, data := range values {
+		var entry *LedgerEntry
+		err := json.Unmarshal([]byte(data), &entry)
+		if err != nil {
+			return nil, err
+		}
+		entry.Id = start + int64(i)
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// Move an amount of a miner between two of their accounts
+func (r *RedisClient) writeTransfer(tx *redis.Multi, kind, ref, login, from, to string, amount int64) {
+	r.writeLedger(tx, kind, ref, "",
+		Posting{Account: MinerAccount(from, login), Amount: -amount},
+		Posting{Account: MinerAccount(to, login), Amount: amount})
+}
+
+// Ledger entries from start on, at most limit of them
+func (r *RedisClient) GetLedger(start, limit int64) ([]*LedgerEntry, error) {
+	values, err := r.client.LRange(r.formatKey("ledger"), start, start+limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeLedgerEntries(values, start)
+}
+
+// Latest entry of a kind with the ref, nil if there is none
+func (r *RedisClient) findLedgerEntry(kind, ref string) (*LedgerEntry, error) {
+	id, err := r.client.HGet(r.formatKey("ledger", "index"), ledgerIndex(kind, ref)).Int64()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries, err := r.GetLedger(id, 1)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// Balances of all accounts, kept as running totals of the ledger
+func (r *RedisClient) LedgerBalances() (map[string]int64, error) {
+	totals, err := r.client.HGetAllMap(r.formatKey("ledger", "totals")).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64)
+	for account, amount := range totals {
+		result[account] = parseInt64(amount)
+	}
+	return result, nil
+}
+
+// Totals and index of the ledger replayed from its entries
+func replayLedger(backend BalancesBackend) (map[string]int64, map[string]int64, error) {
+	const chunk = 1000
+	totals := make(map[string]int64)
+	index := make(map[string]int64)
+	for start := int64(0); ; start += chunk {
+		entries, err := backend.GetLedger(start, chunk)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			for _, p := range entry.Postings {
+				totals[p.Account] += p.Amount
+			}
+			if field := ledgerIndex(entry.Kind, entry.Ref); len(field) > 0 {
+				index[field] = entry.Id
+			}
+		}
+		if len(entries) < chunk {
+			return totals, index, nil
+		}
+	}
+}
+
+// Record balances of a pool that ran without ledger, does nothing once the ledger has entries.
+// A ledger written before its totals were kept gets them
+func (r *RedisClient) OpenLedger() error {
+	for i := 0; i < 3; i++ {
+		err := r.openLedger()
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return redis.TxFailedErr
+}
+
+func (r *RedisClient) openLedger() error {
+	ledgerKey := r.formatKey("ledger")
+	// Every balance change goes to the finances too, miners who appear meanwhile fail the transaction
+	tx, err := r.client.Watch(ledgerKey, r.formatKey("ledger", "totals"), r.formatKey("finances"))
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	n, err := tx.LLen(ledgerKey).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return r.indexLedger(tx)
+	}
+	logins, err := r.GetPayees()
+	if err != nil {
+		return err
+	}
+	minerKeys := make([]string, len(logins))
+	for i, login := range logins {
+		minerKeys[i] = r.formatKey("miners", login)
+	}
+	if len(minerKeys) > 0 {
+		err = tx.Watch(minerKeys...).Err()
+		if err != nil {
+			return err
+		}
+	}
+	var postings []Posting
+	total := int64(0)
+	for _, login := range logins {
+		miner, err := tx.HGetAllMap(r.formatKey("miners", login)).Result()
+		if err != nil {
+			return err
+		}
+		for _, account := range minerAccounts {
+			amount := parseInt64(miner[account])
+			if amount != 0 {
+				postings = append(postings, Posting{Account: MinerAccount(account, login), Amount: amount})
+				total += amount
+			}
+		}
+	}
+	if len(postings) == 0 {
+		return nil
+	}
+	postings = append(sortPostings(postings), Posting{Account: AccountOpening, Amount: -total})
+
+	_, err = tx.Exec(func() error {
+		r.writeLedger(tx, EntryOpening, "", "balances before the ledger", postings...)
+		return nil
+	})
+	return err
+}
+
+// Write the totals and index of a ledger that has none, the ledger and its totals are watched
+func (r *RedisClient) indexLedger(tx *redis.Multi) error {
+	exists, err := tx.Exists(r.formatKey("ledger", "totals")).Result()
+	if err != nil || exists {
+		return err
+	}
+	totals, index, err := replayLedger(r)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(func() error {
+		for account, amount := range totals {
+			tx.HSet(r.formatKey("ledger", "totals"), account, strconv.FormatInt(amount, 10))
+		}
+		for field, id := range index {
+			tx.HSet(r.formatKey("ledger", "index"), field, strconv.FormatInt(id, 10))
+		}
+		return nil
+	})
+	return err
+}
+
+// Record a tx fee the pool paid on chain, once per tx
+func (r *RedisClient) WriteNetworkFee(txId, note string, fee int64) error {
+	postings := networkFeePostings(fee)
+	data, ok := encodeLedgerEntry(EntryFee, txId, note, postings)
+	if !ok {
+		return nil
+	}
+	return ledgerScript.Run(r.client, r.ledgerKeys(), ledgerArgs(data, EntryFee, txId, true, postings)).Err()
+}
+
+// Network fees are paid out of the pool fee
+func networkFeePostings(fee int64) []Posting {
+	return []Posting{{Account: AccountPoolFee, Amount: -fee}, {Account: AccountNetworkFees, Amount: fee}}
+}
+
+// Compare the ledger with the balance keys of every miner and the pool finances
+func (r *RedisClient) ReconcileLedger() ([]LedgerDrift, error) {
+	balances, err := r.LedgerBalances()
+	if err != nil {
+		return nil, err
+	}
+	logins, err := r.GetPayees()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, login := range logins {
+		known[login] = true
+	}
+	// Miners whose balance keys are gone still count
+	for account := range balances {
+		if _, login, ok := ParseMinerAccount(account); ok && !known[login] {
+			known[login] = true
+			logins = append(logins, login)
+		}
+	}
+
+	var drifts []LedgerDrift
+	totals := make(map[string]int64)
+	for _, login := range logins {
+		miner, err := r.client.HGetAllMap(r.formatKey("miners", login)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, account := range minerAccounts {
+			ledger := balances[MinerAccount(account, login)]
+			actual := parseInt64(miner[account])
+			totals[account] += ledger
+			if ledger != actual {
+				drifts = append(drifts, LedgerDrift{Account: MinerAccount(account, login), Ledger: ledger, Actual: actual})
+			}
+		}
+	}
+
+	finances, err := r.client.HGetAllMap(r.formatKey("finances")).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range minerAccounts {
+		actual := parseInt64(finances[account])
+		if totals[account] != actual {
+			drifts = append(drifts, LedgerDrift{Account: "finances:" + account, Ledger: totals[account], Actual: actual})
+		}
+	}
+	return drifts, nil
+}
+
+// Credit or debit a miner balance by hand, e.g. to settle a failed payment
+func (r *RedisClient) AdjustBalance(login string, amount int64, note string) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+		r.writeLedger(tx, EntryAdjustment, "", note,
+			Posting{Account: MinerAccount(AccountBalance, login), Amount: amount},
+			Posting{Account: AccountAdjustments, Amount: -amount})
+		return nil
+	})
+	return err
+}
+
+func parseInt64(s string) int64 {
+	v, _ := strconv.ParseInt(s, 10, 64)
+	return v
+}
+
+// Map iteration order must not leak into the ledger
+func sortPostings(postings []Posting) []Posting {
+	sort.Slice(postings, func(i, j int) bool { return postings[i].Account < postings[j].Account })
+	return postings
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestLedger(t *testing.T) {
+	reset()
+
+	block := &BlockData{Height: 100, RoundHeight: 100, Hash: "aa", Nonce: "0x1", Reward: big.NewInt(5000)}
+	r.WriteImmatureBlock(block, map[string]int64{"x": 3000, "y": 1000})
+	r.WriteMaturedBlock(block, map[string]int64{"x": 3000, "y": 1000}, 0)
+	r.UpdateBalance("x", 2000)
+	r.WritePayments("bb", map[string]int64{"x": 2000})
+	r.UpdateBalance("y", 500)
+	r.RollbackBalance("y", 500)
+	r.AdjustBalance("y", -100, "test")
+
+	balances, err := r.LedgerBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{
+		"balance:x": 1000, "paid:x": 2000, "balance:y": 900, "immature:x": 0, "immature:y": 0,
+		AccountBlocks: -5000, AccountPoolFee: 1000, AccountAdjustments: 100,
+	}
+	for account, amount := range expected {
+		if balances[account] != amount {
+			t.Errorf("Unexpected %v %v, expected %v", account, balances[account], amount)
+		}
+	}
+	entries, _ := r.GetLedger(0, 100)
+	for _, entry := range entries {
+		sum := int64(0)
+		for _, p := range entry.Postings {
+			sum += p.Amount
+		}
+		if sum != 0 {
+			t.Errorf("Unbalanced %v entry %v", entry.Kind, entry.Postings)
+		}
+	}
+
+	drifts, err := r.ReconcileLedger()
+	if err != nil || len(drifts) != 0 {
+		t.Fatalf("Unexpected drifts %v: %v", drifts, err)
+	}
+	r.client.HIncrBy(r.formatKey("miners", "x"), "balance", 5)
+	drifts, _ = r.ReconcileLedger()
+	if len(drifts) != 1 || drifts[0].Account != "balance:x" || drifts[0].Actual-drifts[0].Ledger != 5 {
+		t.Errorf("Unexpected drifts %v", drifts)
+	}
+}
+
+func TestOpenLedger(t *testing.T) {
+	reset()
+
+	r.client.HSet(r.formatKey("miners", "x"), "balance", "700")
+	r.client.HSet(r.formatKey("miners", "x"), "paid", "300")
+	r.client.HSet(r.formatKey("finances"), "balance", "700")
+	r.client.HSet(r.formatKey("finances"), "paid", "300")
+	r.OpenLedger()
+	r.OpenLedger()
+
+	entries, _ := r.GetLedger(0, 10)
+	if len(entries) != 1 || entries[0].Kind != EntryOpening {
+		t.Fatalf("Unexpected ledger %v", entries)
+	}
+	if drifts, _ := r.ReconcileLedger(); len(drifts) != 0 {
+		t.Errorf("Unexpected drifts %v", drifts)
+	}
+}
+
+func TestWriteReorg(t *testing.T) {
+	reset()
+
+	block := &BlockData{Height: 100, RoundHeight: 100, Hash: "aa", Nonce: "0x1", Reward: big.NewInt(5000), Subsidy: 5000}
+	r.WriteImmatureBlock(block, map[string]int64{"x": 3000, "y": 1000})
+	r.WriteMaturedBlock(block, map[string]int64{"x": 3000, "y": 1000}, 0)
+	r.UpdateBalance("x", 2000)
+	r.WritePayments("bb", map[string]int64{"x": 2000})
+
+	matured, _ := r.GetMaturedBlocks(100)
+	if len(matured) != 1 || matured[0].Hash != "aa" || matured[0].Orphan {
+		t.Fatalf("Unexpected matured blocks %v", matured)
+	}
+	total, err := r.WriteReorg(matured[0])
+	if err != nil || total != 4000 {
+		t.Fatalf("Unexpected rollback of %v: %v", total, err)
+	}
+	balances, _ := r.LedgerBalances()
+	expected := map[string]int64{"balance:x": -2000, "paid:x": 2000, "balance:y": 0, AccountBlocks: 0, AccountPoolFee: 0}
+	for account, amount := range expected {
+		if balances[account] != amount {
+			t.Errorf("Unexpected %v %v, expected %v", account, balances[account], amount)
+		}
+	}
+	if drifts, _ := r.ReconcileLedger(); len(drifts) != 0 {
+		t.Errorf("Unexpected drifts %v", drifts)
+	}
+	matured, _ = r.GetMaturedBlocks(100)
+	if len(matured) != 1 || !matured[0].Orphan {
+		t.Errorf("Block must be orphaned, got %v", matured)
+	}
+}
@@ -0,0 +1,1821 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// Pool storage kept in process, for tests and pools that can afford to lose their state on restart.
+// Keys and values follow the Redis backend, every method runs under one lock like a MULTI block
+type MemoryBackend struct {
+	mu      sync.Mutex
+	values  map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	lists   map[string][]string
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		values:  make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		zsets:   make(map[string]map[string]float64),
+		lists:   make(map[string][]string),
+		sets:    make(map[string]map[string]bool),
+		expires: make(map[string]time.Time),
+	}
+}
+
+// Drop the key if it expired
+func (m *MemoryBackend) touch(key string) {
+	if at, ok := m.expires[key]; ok && !time.Now().Before(at) {
+		m.drop(key)
+	}
+}
+
+func (m *MemoryBackend) drop(key string) {
+	delete(m.values, key)
+	delete(m.hashes, key)
+	delete(m.zsets, key)
+	delete(m.lists, key)
+	delete(m.sets, key)
+	delete(m.expires, key)
+}
+
+func (m *MemoryBackend) expire(key string, expire time.Duration) {
+	if expire > 0 {
+		m.expires[key] = time.Now().Add(expire)
+	} else {
+		delete(m.expires, key)
+	}
+}
+
+func (m *MemoryBackend) exists(key string) bool {
+	m.touch(key)
+	_, v := m.values[key]
+	_, h := m.hashes[key]
+	_, z := m.zsets[key]
+	_, l := m.lists[key]
+	_, s := m.sets[key]
+	return v || h || z || l || s
+}
+
+func (m *MemoryBackend) del(keys ...string) int64 {
+	n := int64(0)
+	for _, key := range keys {
+		if m.exists(key) {
+			n++
+		}
+		m.drop(key)
+	}
+	return n
+}
+
+func (m *MemoryBackend) rename(from, to string) {
+	if !m.exists(from) {
+		return
+	}
+	m.del(to)
+	if v, ok := m.values[from]; ok {
+		m.values[to] = v
+	}
+	if h, ok := m.hashes[from]; ok {
+		m.hashes[to] = h
+	}
+	if z, ok := m.zsets[from]; ok {
+		m.zsets[to] = z
+	}
+	if l, ok := m.lists[from]; ok {
+		m.lists[to] = l
+	}
+	if s, ok := m.sets[from]; ok {
+		m.sets[to] = s
+	}
+	if at, ok := m.expires[from]; ok {
+		m.expires[to] = at
+	}
+	m.drop(from)
+}
+
+// Keys of any type starting with prefix
+func (m *MemoryBackend) scan(prefix string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if strings.HasPrefix(key, prefix) && !seen[key] && m.exists(key) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.values {
+		add(key)
+	}
+	for key := range m.hashes {
+		add(key)
+	}
+	for key := range m.zsets {
+		add(key)
+	}
+	for key := range m.lists {
+		add(key)
+	}
+	for key := range m.sets {
+		add(key)
+	}
+	return keys
+}
+
+func (m *MemoryBackend) get(key string) (string, bool) {
+	m.touch(key)
+	v, ok := m.values[key]
+	return v, ok
+}
+
+func (m *MemoryBackend) set(key, value string, expire time.Duration) {
+	m.del(key)
+	m.values[key] = value
+	m.expire(key, expire)
+}
+
+// Fields of a hash, nil if it doesn't exist. Callers must not modify it
+func (m *MemoryBackend) hgetall(key string) map[string]string {
+	m.touch(key)
+	return m.hashes[key]
+}
+
+func (m *MemoryBackend) hget(key, field string) (string, bool) {
+	v, ok := m.hgetall(key)[field]
+	return v, ok
+}
+
+func (m *MemoryBackend) hset(key, field, value string) {
+	m.touch(key)
+	h, ok := m.hashes[key]
+	if !ok {
+		h = make(map[string]string)
+		m.hashes[key] = h
+	}
+	h[field] = value
+}
+
+// Hashes left without fields are removed
+func (m *MemoryBackend) hdel(key string, fields ...string) {
+	h := m.hgetall(key)
+	for _, field := range fields {
+		delete(h, field)
+	}
+	if h != nil && len(h) == 0 {
+		m.del(key)
+	}
+}
+
+func (m *MemoryBackend) hincrBy(key, field string, n int64) int64 {
+	v, _ := m.hget(key, field)
+	value := parseInt64(v) + n
+	m.hset(key, field, strconv.FormatInt(value, 10))
+	return value
+}
+
+func (m *MemoryBackend) hincrByFloat(key, field string, f float64) float64 {
+	v, _ := m.hget(key, field)
+	value, _ := strconv.ParseFloat(v, 64)
+	value += f
+	m.hset(key, field, strconv.FormatFloat(value, 'f', -1, 64))
+	return value
+}
+
+func (m *MemoryBackend) hmget(key string, fields ...string) map[string]string {
+	result := make(map[string]string)
+	h := m.hgetall(key)
+	for _, field := range fields {
+		if v, ok := h[field]; ok {
+			result[field] = v
+		}
+	}
+	return result
+}
+
+// Returns whether the member is new, an existing member gets the new score
+func (m *MemoryBackend) zadd(key string, score float64, member string) bool {
+	m.touch(key)
+	z, ok := m.zsets[key]
+	if !ok {
+		z = make(map[string]float64)
+		m.zsets[key] = z
+	}
+	_, exists := z[member]
+	z[member] = score
+	return !exists
+}
+
+func (m *MemoryBackend) zincrBy(key string, n float64, member string) {
+	score, _ := m.zscore(key, member)
+	m.zadd(key, score+n, member)
+}
+
+func (m *MemoryBackend) zscore(key, member string) (float64, bool) {
+	m.touch(key)
+	score, ok := m.zsets[key][member]
+	return score, ok
+}
+
+func (m *MemoryBackend) zrem(key string, members ...string) {
+	m.touch(key)
+	z := m.zsets[key]
+	for _, member := range members {
+		delete(z, member)
+	}
+	if z != nil && len(z) == 0 {
+		m.del(key)
+	}
+}
+
+func (m *MemoryBackend) zcard(key string) int64 {
+	m.touch(key)
+	return int64(len(m.zsets[key]))
+}
+
+// Members ordered by score then member, reversed with rev
+func (m *MemoryBackend) zsorted(key string, rev bool) []redis.Z {
+	m.touch(key)
+	var result []redis.Z
+	for member, score := range m.zsets[key] {
+		result = append(result, redis.Z{Score: score, Member: member})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if rev {
+			a, b = b, a
+		}
+		if a.Score != b.Score {
+			return a.Score < b.Score
+		}
+		return a.Member.(string) < b.Member.(string)
+	})
+	return result
+}
+
+// Members by rank from start to stop, negative ranks count from the end
+func (m *MemoryBackend) zrange(key string, start, stop int64, rev bool) []redis.Z {
+	all := m.zsorted(key, rev)
+	start, stop, ok := rangeIndexes(int64(len(all)), start, stop)
+	if !ok {
+		return nil
+	}
+	return all[start : stop+1]
+}
+
+func (m *MemoryBackend) zrangeByScore(key string, min, max float64) []redis.Z {
+	var result []redis.Z
+	for _, z := range m.zsorted(key, false) {
+		if z.Score >= min && z.Score <= max {
+			result = append(result, z)
+		}
+	}
+	return result
+}
+
+// Remove members scored below max
+func (m *MemoryBackend) zremBelow(key string, max float64) int64 {
+	n := int64(0)
+	for _, z := range m.zsorted(key, false) {
+		if z.Score < max {
+			m.zrem(key, z.Member.(string))
+			n++
+		}
+	}
+	return n
+}
+
+func (m *MemoryBackend) lpush(key string, values ...string) {
+	m.touch(key)
+	for _, v := range values {
+		m.lists[key] = append([]string{v}, m.lists[key]...)
+	}
+}
+
+func (m *MemoryBackend) rpush(key string, values ...string) {
+	m.touch(key)
+	m.lists[key] = append(m.lists[key], values...)
+}
+
+func (m *MemoryBackend) lrange(key string, start, stop int64) []string {
+	m.touch(key)
+	list := m.lists[key]
+	start, stop, ok := rangeIndexes(int64(len(list)), start, stop)
+	if !ok {
+		return nil
+	}
+	return append([]string{}, list[start:stop+1]...)
+}
+
+func (m *MemoryBackend) ltrim(key string, start, stop int64) {
+	list := m.lrange(key, start, stop)
+	if len(list) == 0 {
+		m.del(key)
+		return
+	}
+	m.lists[key] = list
+}
+
+func (m *MemoryBackend) llen(key string) int64 {
+	m.touch(key)
+	return int64(len(m.lists[key]))
+}
+
+func (m *MemoryBackend) sadd(key, member string) {
+	m.touch(key)
+	s, ok := m.sets[key]
+	if !ok {
+		s = make(map[string]bool)
+		m.sets[key] = s
+	}
+	s[member] = true
+}
+
+func (m *MemoryBackend) srem(key, member string) {
+	m.touch(key)
+	s := m.sets[key]
+	delete(s, member)
+	if s != nil && len(s) == 0 {
+		m.del(key)
+	}
+}
+
+func (m *MemoryBackend) smembers(key string) []string {
+	m.touch(key)
+	result := []string{}
+	for member := range m.sets[key] {
+		result = append(result, member)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Redis range semantics: inclusive, negative indexes count from the end
+func rangeIndexes(n, start, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, start <= stop && start < n
+}
+
+func roundKey(kind string, height int64, nonce string) string {
+	if len(kind) == 0 {
+		return join("shares", "round"+strconv.FormatInt(height, 10), nonce)
+	}
+	return join("shares", kind, "round"+strconv.FormatInt(height, 10), nonce)
+}
+
+func (m *MemoryBackend) Check() (string, error) {
+	return "PONG", nil
+}
+
+// Nothing to save, the memory backend is lost on restart
+func (m *MemoryBackend) BgSave() (string, error) {
+	return "OK", nil
+}
+
+func (m *MemoryBackend) GetBlacklist() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.smembers("blacklist"), nil
+}
+
+func (m *MemoryBackend) GetWhitelist() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.smembers("whitelist"), nil
+}
+
+func (m *MemoryBackend) WriteNodeState(id string, height uint32, diff *big.Int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := MakeTimestamp() / 1000
+	m.hset("nodes", join(id, "name"), id)
+	m.hset("nodes", join(id, "height"), strconv.FormatUint(uint64(height), 10))
+	m.hset("nodes", join(id, "difficulty"), diff.String())
+	m.hset("nodes", join(id, "lastBeat"), strconv.FormatInt(now, 10))
+	return nil
+}
+
+func (m *MemoryBackend) GetNodeStates() ([]map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertNodeStates(m.hgetall("nodes")), nil
+}
+
+func (m *MemoryBackend) GetNodeBlocksFound(id string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, _ := m.hget("nodes", join(id, "blocksFound"))
+	return parseInt64(v), nil
+}
+
+func (m *MemoryBackend) WriteStratumSession(sid string, ss *StratumSession, expire time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := join("sessions", sid)
+	for field, value := range ss.fields() {
+		m.hset(key, field, value)
+	}
+	m.expire(key, expire)
+	return nil
+}
+
+func (m *MemoryBackend) TakeStratumSession(sid string) (*StratumSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := join("sessions", sid)
+	ss := parseStratumSession(m.hgetall(key))
+	m.del(key)
+	return ss, nil
+}
+
+func (m *MemoryBackend) LeaseExtraNonce(extraNonce1, node string, expire time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(join("extranonces", extraNonce1), node, expire)
+	return nil
+}
+
+func (m *MemoryBackend) IsExtraNonceLeased(extraNonce1 string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.exists(join("extranonces", extraNonce1)), nil
+}
+
+func (m *MemoryBackend) GetPriorityTxs() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.smembers(join("txpolicy", "priority")), nil
+}
+
+func (m *MemoryBackend) AddPriorityTx(txId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sadd(join("txpolicy", "priority"), txId)
+	return nil
+}
+
+func (m *MemoryBackend) RemovePriorityTx(txId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.srem(join("txpolicy", "priority"), txId)
+	return nil
+}
+
+func (m *MemoryBackend) GetExcludedTxs() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.smembers(join("txpolicy", "excluded")), nil
+}
+
+func (m *MemoryBackend) AddExcludedTx(txId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sadd(join("txpolicy", "excluded"), txId)
+	return nil
+}
+
+func (m *MemoryBackend) RemoveExcludedTx(txId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.srem(join("txpolicy", "excluded"), txId)
+	return nil
+}
+
+func (m *MemoryBackend) SetUnlockerHalt(reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(join("unlocker", "halt"), reason, 0)
+	return nil
+}
+
+func (m *MemoryBackend) GetUnlockerHalt() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reason, _ := m.get(join("unlocker", "halt"))
+	return reason, nil
+}
+
+func (m *MemoryBackend) ClearUnlockerHalt() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.del(join("unlocker", "halt")) > 0, nil
+}
+
+func (m *MemoryBackend) checkPoWExist(height uint64, params []string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.powExists(height, params), nil
+}
+
+func (m *MemoryBackend) powExists(height uint64, params []string) bool {
+	m.zremBelow("pow", float64(int64(height)-3))
+	return !m.zadd("pow", float64(height), strings.Join(params, ":"))
+}
+
+func (m *MemoryBackend) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration,
+	acc ShareAccounting) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.powExists(height, params) {
+		return true, nil
+	}
+	ms := MakeTimestamp()
+	ts := ms / 1000
+	m.writeShare(ms, ts, login, id, diff, window, acc)
+	m.hincrBy("stats", "roundShares", diff)
+	return false, nil
+}
+
+func (m *MemoryBackend) WriteInvalidShare(ms, ts int64, login, id string, diff int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zadd("invalidhashrate", float64(ts), join(diff, login, id, ms))
+	return nil
+}
+
+func (m *MemoryBackend) WriteRejectShare(ms, ts int64, login, id string, diff int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zadd("rejecthashrate", float64(ts), join(diff, login, id, ms))
+	return nil
+}
+
+func (m *MemoryBackend) WriteBlock(login, id string, params []string, hash string, diff, roundDiff int64, height uint64,
+	coinBaseValue int64, blkTotalFee int64, node, coinBaseTag string, window time.Duration, acc ShareAccounting) (bool, error) {
+	if exist, _ := m.checkPoWExist(height, params); exist {
+		return true, nil
+	}
+	block := newCandidate(login, id, params, hash, roundDiff, height, coinBaseValue, blkTotalFee, node, coinBaseTag)
+	m.writeRound(block, diff, window, acc)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.zadd(join("blocks", "candidates"), float64(height), block.key())
+	return false, nil
+}
+
+func (m *MemoryBackend) writeRound(block *BlockData, diff int64, window time.Duration, acc ShareAccounting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ms := MakeTimestamp()
+	ts := block.Timestamp
+	round := block.Height
+
+	m.writeShare(ms, ts, block.Login, block.Worker, diff, window, acc)
+	m.hset("stats", "lastBlockFound", strconv.FormatInt(ts, 10))
+	m.hdel("stats", "roundShares")
+	m.zincrBy("finders", 1, block.Login)
+	m.hincrBy(join("miners", block.Login), "blocksFound", 1)
+	m.hincrBy("nodes", join(block.Node, "blocksFound"), 1)
+	m.rename(join("shares", "roundCurrent"), roundKey("", round, block.Nonce))
+	if acc.ScoreDecay > 0 {
+		m.rename(join("shares", "scoreCurrent"), roundKey("score", round, block.Nonce))
+		m.rename(join("shares", "log", "roundCurrent"), roundKey("log", round, block.Nonce))
+	}
+	if acc.PPLNSShares > 0 {
+		// Snapshot of the window the block is rewarded from
+		if window := m.lrange(join("shares", "pplns"), 0, acc.PPLNSShares-1); len(window) > 0 {
+			m.rpush(roundKey("pplns", round, block.Nonce), window...)
+		}
+	}
+	block.TotalShares = 0
+	for _, v := range m.hgetall(roundKey("", round, block.Nonce)) {
+		block.TotalShares += parseInt64(v)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) writeShare(ms, ts int64, login, id string, diff int64, expire time.Duration,
+	acc ShareAccounting) {
+	m.hincrBy(join("shares", "roundCurrent"), login, diff)
+	if acc.PPLNSShares > 0 {
+		m.lpush(join("shares", "pplns"), join(diff, login))
+		m.ltrim(join("shares", "pplns"), 0, acc.PPLNSShares-1)
+	}
+	if acc.ScoreDecay > 0 {
+		epoch, score := shareScore(ms, diff, acc.ScoreDecay)
+		m.hincrByFloat(join("shares", "scoreCurrent"), join(epoch, login), score)
+		m.rpush(join("shares", "log", "roundCurrent"), join(ms, diff, login))
+	}
+	if acc.Credit > 0 && acc.pendingCredit {
+		m.hincrBy(join("credits", "pending"), login, acc.Credit)
+	} else if acc.Credit > 0 {
+		m.creditShare(login, acc.Credit)
+	}
+	m.zadd("hashrate", float64(ts), join(diff, login, id, ms))
+	m.zadd(join("hashrate", login), float64(ts), join(diff, id, ms))
+	m.expire(join("hashrate", login), expire)
+	m.hset(join("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+}
+
+// Adds a PPS credit in millisatoshi, whole satoshis go from the reserve to the balance
+func (m *MemoryBackend) creditShare(login string, credit int64) {
+	amount := m.hincrBy(join("miners", login), "ppsCredit", credit) / 1000
+	if amount < 1 {
+		return
+	}
+	m.hincrBy(join("miners", login), "ppsCredit", -amount*1000)
+	m.hincrBy(join("miners", login), "balance", amount)
+	m.hincrBy("finances", "balance", amount)
+	m.hincrBy("finances", "ppsCredited", amount)
+	m.hincrBy("finances", "reserve", -amount)
+	m.writeLedger(EntryPPSCredit, "", "",
+		Posting{Account: AccountReserve, Amount: -amount},
+		Posting{Account: MinerAccount(AccountBalance, login), Amount: amount})
+}
+
+// Credits are settled with their shares
+func (m *MemoryBackend) FlushCredits() error {
+	return nil
+}
+
+func (m *MemoryBackend) takeCredits() (string, map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.exists(join("credits", "batch")) {
+		if !m.exists(join("credits", "pending")) {
+			return "", nil, nil
+		}
+		id, err := newBatchId()
+		if err != nil {
+			return "", nil, err
+		}
+		m.rename(join("credits", "pending"), join("credits", "batch"))
+		m.set(join("credits", "batch", "id"), id, 0)
+	}
+	batch, _ := m.get(join("credits", "batch", "id"))
+	credits := make(map[string]int64)
+	for login, v := range m.hgetall(join("credits", "batch")) {
+		credits[login] = parseInt64(v)
+	}
+	return batch, credits, nil
+}
+
+func (m *MemoryBackend) clearCredits(batch string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id, _ := m.get(join("credits", "batch", "id")); id == batch {
+		m.del(join("credits", "batch"), join("credits", "batch", "id"))
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]int64)
+	for login, v := range m.hgetall(roundKey("", height, nonce)) {
+		result[login] = parseInt64(v)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetPPLNSShares(height int64, nonce string) ([]PPLNSShare, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return parsePPLNSShares(m.lrange(roundKey("pplns", height, nonce), 0, -1)), nil
+}
+
+func (m *MemoryBackend) GetRoundScores(height int64, nonce string, decay time.Duration) (map[string]float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return parseRoundScores(m.hgetall(roundKey("score", height, nonce)), decay), nil
+}
+
+func (m *MemoryBackend) GetRoundShareLog(height int64, nonce string) ([]ShareLogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return parseShareLog(m.lrange(roundKey("log", height, nonce), 0, -1)), nil
+}
+
+func (m *MemoryBackend) GetCandidates(maxHeight int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertCandidateResults(m.zrangeByScore(join("blocks", "candidates"), 0, float64(maxHeight))), nil
+}
+
+func (m *MemoryBackend) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertBlockResults(m.zrangeByScore(join("blocks", "immature"), 0, float64(maxHeight))), nil
+}
+
+func (m *MemoryBackend) GetMaturedBlocks(minHeight int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertBlockResults(m.zrangeByScore(join("blocks", "matured"), float64(minHeight), math.Inf(1))), nil
+}
+
+func (m *MemoryBackend) GetBlocksAt(height int64) ([]*BlockData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sets := []struct {
+		name    string
+		legacy  func(string) *BlockData
+		state   string
+		pending bool
+	}{
+		{"candidates", parseLegacyCandidate, BlockCandidate, true},
+		{"immature", parseLegacyBlock, BlockImmature, true},
+		{"matured", parseLegacyBlock, BlockMatured, false},
+	}
+	var result []*BlockData
+	for _, set := range sets {
+		rows := m.zrangeByScore(join("blocks", set.name), float64(height), float64(height))
+		for _, block := range convertBlocks(rows, set.legacy) {
+			if len(block.State) == 0 {
+				block.State = set.state
+				if block.Orphan {
+					block.State = BlockOrphaned
+				}
+			}
+			block.pending = set.pending
+			result = append(result, block)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetImmatureCredits(block *BlockData) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]int64)
+	for login, v := range m.hgetall(join("credits", "immature", block.RoundHeight, block.Hash)) {
+		result[login] = parseInt64(v)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	block.Transition(BlockImmature)
+	m.writeImmatureBlock(block)
+	total := int64(0)
+	var postings []Posting
+	for login, amount := range roundRewards {
+		total += amount
+		m.hincrBy(join("miners", login), "immature", amount)
+		creditKey := join("credits", "immature", block.Height, block.Hash)
+		if _, ok := m.hget(creditKey, login); !ok {
+			m.hset(creditKey, login, strconv.FormatInt(amount, 10))
+		}
+		postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: amount})
+	}
+	m.hincrBy("finances", "immature", total)
+	postings = append(postings, Posting{Account: AccountBlocks, Amount: -total})
+	m.writeLedger(EntryImmature, join(block.Height, block.Hash), "", sortPostings(postings)...)
+	return nil
+}
+
+func (m *MemoryBackend) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, reserve int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	creditKey := join("credits", "immature", block.RoundHeight, block.Hash)
+	immatureCredits := m.hgetall(creditKey)
+
+	block.Transition(BlockMatured)
+	m.writeMaturedBlock(block)
+	m.zadd(join("credits", "all"), float64(block.Height), join(block.Hash, MakeTimestamp()/1000, block.Reward))
+
+	// Decrement immature balances
+	totalImmature := int64(0)
+	var postings []Posting
+	for login, amountString := range immatureCredits {
+		amount := parseInt64(amountString)
+		totalImmature += amount
+		m.hincrBy(join("miners", login), "immature", -amount)
+		postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: -amount})
+	}
+
+	// Increment balances
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		m.hincrBy(join("miners", login), "balance", amount)
+		if _, ok := m.hget(join("credits", block.Height, block.Hash), login); !ok {
+			m.hset(join("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+		}
+		postings = append(postings, Posting{Account: MinerAccount(AccountBalance, login), Amount: amount})
+	}
+	revenue := block.RewardInSatoshi()
+	if block.ExtraReward != nil {
+		revenue += block.ExtraReward.Int64()
+	}
+	postings = append(sortPostings(postings),
+		Posting{Account: AccountBlocks, Amount: totalImmature - revenue},
+		Posting{Account: AccountReserve, Amount: reserve},
+		Posting{Account: AccountPoolFee, Amount: revenue - total - reserve})
+	m.writeLedger(EntryCredit, join(block.Height, block.Hash), "", postings...)
+	m.del(creditKey)
+	for _, utxo := range block.CoinBaseOutputs {
+		m.writeUTXO(utxo)
+	}
+	m.hincrBy("finances", "balance", total)
+	m.hincrBy("finances", "immature", -totalImmature)
+	m.hset("finances", "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+	m.hset("finances", "lastCreditHash", block.Hash)
+	m.hincrBy("finances", "totalMined", block.RewardInSatoshi())
+	if reserve != 0 {
+		m.hincrBy("finances", "reserve", reserve)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) WriteOrphan(block *BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	creditKey := join("credits", "immature", block.RoundHeight, block.Hash)
+	immatureCredits := m.hgetall(creditKey)
+
+	block.Transition(BlockOrphaned)
+	m.writeMaturedBlock(block)
+
+	// Decrement immature balances
+	totalImmature := int64(0)
+	var postings []Posting
+	for login, amountString := range immatureCredits {
+		amount := parseInt64(amountString)
+		totalImmature += amount
+		m.hincrBy(join("miners", login), "immature", -amount)
+		postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: -amount})
+	}
+	m.del(creditKey)
+	m.hincrBy("finances", "immature", -totalImmature)
+	postings = append(sortPostings(postings), Posting{Account: AccountBlocks, Amount: totalImmature})
+	m.writeLedger(EntryOrphan, join(block.Height, block.Hash), "", postings...)
+	return nil
+}
+
+func (m *MemoryBackend) WritePendingOrphans(blocks []*BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, block := range blocks {
+		block.Transition(BlockOrphaned)
+		m.writeImmatureBlock(block)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) WriteReorg(block *BlockData) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ref := join(block.Height, block.Hash)
+	credit, err := m.findLedgerEntry(EntryCredit, ref)
+	if err != nil {
+		return 0, err
+	}
+	creditKey := join("credits", block.Height, block.Hash)
+	var credits map[string]string
+	if credit == nil {
+		credits = m.hgetall(creditKey)
+	}
+	postings, total, reserve := reorgPostings(credit, credits)
+
+	block.Transition(BlockOrphaned)
+	for _, p := range postings {
+		if kind, login, ok := ParseMinerAccount(p.Account); ok && kind == AccountBalance {
+			m.hincrBy(join("miners", login), "balance", p.Amount)
+		}
+	}
+	m.zrem(join("blocks", "matured"), block.member)
+	m.zadd(join("blocks", "matured"), float64(block.Height), block.key())
+	for _, v := range m.zrangeByScore(join("credits", "all"), float64(block.Height), float64(block.Height)) {
+		if member := v.Member.(string); strings.HasPrefix(member, block.Hash+":") {
+			m.zrem(join("credits", "all"), member)
+		}
+	}
+	m.del(creditKey)
+	for outpoint, data := range m.hgetall("utxos") {
+		var utxo *UTXO
+		if json.Unmarshal([]byte(data), &utxo) == nil && utxo.Coinbase && utxo.Height == block.Height {
+			m.hdel("utxos", outpoint)
+		}
+	}
+	m.hincrBy("finances", "balance", -total)
+	m.hincrBy("finances", "totalMined", -block.RewardInSatoshi())
+	if reserve != 0 {
+		m.hincrBy("finances", "reserve", -reserve)
+	}
+	m.writeLedger(EntryReorg, ref, "block left the main chain", postings...)
+	return total, nil
+}
+
+func (m *MemoryBackend) RequeueBlock(block *BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	candidatesKey := join("blocks", "candidates")
+	immatureKey := join("blocks", "immature")
+	creditKey := join("credits", "immature", block.RoundHeight, block.Hash)
+	_, inCandidates := m.zscore(candidatesKey, block.member)
+	_, inImmature := m.zscore(immatureKey, block.member)
+	if !inCandidates && !inImmature {
+		return fmt.Errorf("block %v is neither candidate nor immature", block.RoundKey())
+	}
+	immatureCredits := m.hgetall(creditKey)
+
+	member := block.member
+	block.Reward = nil
+	block.ExtraReward = nil
+	block.Transition(BlockCandidate)
+	m.zrem(candidatesKey, member)
+	m.zrem(immatureKey, member)
+	m.zadd(candidatesKey, float64(block.Height), block.key())
+	if len(immatureCredits) == 0 {
+		return nil
+	}
+	totalImmature := int64(0)
+	var postings []Posting
+	for login, amountString := range immatureCredits {
+		amount := parseInt64(amountString)
+		totalImmature += amount
+		m.hincrBy(join("miners", login), "immature", -amount)
+		postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: -amount})
+	}
+	m.del(creditKey)
+	m.hincrBy("finances", "immature", -totalImmature)
+	postings = append(sortPostings(postings), Posting{Account: AccountBlocks, Amount: totalImmature})
+	m.writeLedger(EntryRequeue, join(block.Height, block.Hash), "round credited anew", postings...)
+	return nil
+}
+
+// Blocks are always written as records, there is nothing to migrate
+func (m *MemoryBackend) MigrateBlocks() (int, error) {
+	return 0, nil
+}
+
+func (m *MemoryBackend) writeImmatureBlock(block *BlockData) {
+	if block.Height != block.RoundHeight {
+		m.rename(roundKey("", block.RoundHeight, block.Nonce), roundKey("", block.Height, block.Nonce))
+	}
+	m.zrem(join("blocks", "candidates"), block.member)
+	m.zadd(join("blocks", "immature"), float64(block.Height), block.key())
+}
+
+func (m *MemoryBackend) moveRound(block *BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if block.Height != block.RoundHeight {
+		m.rename(roundKey("", block.RoundHeight, block.Nonce), roundKey("", block.Height, block.Nonce))
+	}
+	return nil
+}
+
+func (m *MemoryBackend) deleteRound(block *BlockData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.del(roundKey("", block.RoundHeight, block.Nonce), roundKey("pplns", block.RoundHeight, block.Nonce),
+		roundKey("score", block.RoundHeight, block.Nonce), roundKey("log", block.RoundHeight, block.Nonce))
+	return nil
+}
+
+func (m *MemoryBackend) writeMaturedBlock(block *BlockData) {
+	m.del(roundKey("", block.RoundHeight, block.Nonce), roundKey("pplns", block.RoundHeight, block.Nonce),
+		roundKey("score", block.RoundHeight, block.Nonce), roundKey("log", block.RoundHeight, block.Nonce))
+	m.zrem(join("blocks", "immature"), block.member)
+	m.zadd(join("blocks", "matured"), float64(block.Height), block.key())
+}
+
+func (m *MemoryBackend) writeUTXO(utxo *UTXO) {
+	data, _ := json.Marshal(utxo)
+	m.hset("utxos", utxo.Outpoint(), string(data))
+}
+
+func (m *MemoryBackend) GetUTXOs() ([]*UTXO, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []*UTXO
+	for _, data := range m.hgetall("utxos") {
+		var utxo *UTXO
+		err := json.Unmarshal([]byte(data), &utxo)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, utxo)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) ReconcileUTXOs(add []*UTXO, remove []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, utxo := range add {
+		m.writeUTXO(utxo)
+	}
+	m.hdel("utxos", remove...)
+	return nil
+}
+
+func (m *MemoryBackend) IsMinerExists(login string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.exists(join("miners", login)), nil
+}
+
+func (m *MemoryBackend) GetPayees() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.payees(), nil
+}
+
+func (m *MemoryBackend) payees() []string {
+	var result []string
+	for _, key := range m.scan("miners:") {
+		result = append(result, strings.TrimPrefix(key, "miners:"))
+	}
+	return result
+}
+
+func (m *MemoryBackend) GetBalance(login string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, _ := m.hget(join("miners", login), "balance")
+	return parseInt64(v), nil
+}
+
+func (m *MemoryBackend) GetOwedBalances() (int64, int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var balance, immature, pending int64
+	for _, login := range m.payees() {
+		miner := m.hgetall(join("miners", login))
+		balance += parseInt64(miner["balance"])
+		immature += parseInt64(miner["immature"])
+		pending += parseInt64(miner["pending"])
+	}
+	return balance, immature, pending, nil
+}
+
+func (m *MemoryBackend) UpdateBalance(login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts := MakeTimestamp() / 1000
+	m.hincrBy(join("miners", login), "balance", -amount)
+	m.hincrBy(join("miners", login), "pending", amount)
+	m.hincrBy("finances", "balance", -amount)
+	m.hincrBy("finances", "pending", amount)
+	m.zadd(join("payments", "pending"), float64(ts), join(login, amount))
+	m.writeTransfer(EntryPayout, "", login, AccountBalance, AccountPending, amount)
+	return nil
+}
+
+func (m *MemoryBackend) RollbackBalance(login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hincrBy(join("miners", login), "balance", amount)
+	m.hincrBy(join("miners", login), "pending", -amount)
+	m.hincrBy("finances", "balance", amount)
+	m.hincrBy("finances", "pending", -amount)
+	m.zrem(join("payments", "pending"), join(login, amount))
+	m.writeTransfer(EntryRollback, "", login, AccountPending, AccountBalance, amount)
+	return nil
+}
+
+func (m *MemoryBackend) AdjustBalance(login string, amount int64, note string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hincrBy(join("miners", login), "balance", amount)
+	m.hincrBy("finances", "balance", amount)
+	m.writeLedger(EntryAdjustment, "", note,
+		Posting{Account: MinerAccount(AccountBalance, login), Amount: amount},
+		Posting{Account: AccountAdjustments, Amount: -amount})
+	return nil
+}
+
+func (m *MemoryBackend) GetPayoutThreshold(login string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, _ := m.hget(join("miners", login), "threshold")
+	return parseInt64(v), nil
+}
+
+func (m *MemoryBackend) SetPayoutThreshold(login string, threshold int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if threshold == 0 {
+		m.hdel(join("miners", login), "threshold")
+	} else {
+		m.hset(join("miners", login), "threshold", strconv.FormatInt(threshold, 10))
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetLightningDestination(login string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dest, _ := m.hget(join("miners", login), "lightning")
+	return dest, nil
+}
+
+func (m *MemoryBackend) SetLightningDestination(login, dest string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(dest) == 0 {
+		m.hdel(join("miners", login), "lightning")
+	} else {
+		m.hset(join("miners", login), "lightning", dest)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetLightningDestinations(logins []string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]string)
+	for _, login := range logins {
+		if dest, ok := m.hget(join("miners", login), "lightning"); ok {
+			result[login] = dest
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) IssueChallenge(login string, expire time.Duration) (string, int64, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := join("challenge", login)
+	if challenge, ok := m.get(key); ok {
+		return challenge, m.expires[key].Unix(), nil
+	}
+	challenge := hex.EncodeToString(nonce)
+	m.set(key, challenge, expire)
+	return challenge, m.expires[key].Unix(), nil
+}
+
+func (m *MemoryBackend) GetChallenge(login string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	challenge, _ := m.get(join("challenge", login))
+	return challenge, nil
+}
+
+func (m *MemoryBackend) TakeChallenge(login, challenge string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if live, ok := m.get(join("challenge", login)); !ok || live != challenge {
+		return false, nil
+	}
+	m.del(join("challenge", login))
+	return true, nil
+}
+
+func (m *MemoryBackend) UpdateMinerSettings(login string, settings *MinerSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for field, value := range settings.fields() {
+		if len(value) == 0 {
+			m.hdel(join("miners", login), field)
+		} else {
+			m.hset(join("miners", login), field, value)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) writeLedger(kind, ref, note string, postings ...Posting) {
+	data, ok := encodeLedgerEntry(kind, ref, note, postings)
+	if !ok {
+		return
+	}
+	m.rpush("ledger", data)
+	if field := ledgerIndex(kind, ref); len(field) > 0 {
+		m.hset(join("ledger", "index"), field, strconv.FormatInt(m.llen("ledger")-1, 10))
+	}
+	for _, p := range postings {
+		m.hincrBy(join("ledger", "totals"), p.Account, p.Amount)
+	}
+}
+
+func (m *MemoryBackend) writeTransfer(kind, ref, login, from, to string, amount int64) {
+	m.writeLedger(kind, ref, "",
+		Posting{Account: MinerAccount(from, login), Amount: -amount},
+		Posting{Account: MinerAccount(to, login), Amount: amount})
+}
+
+func (m *MemoryBackend) GetLedger(start, limit int64) ([]*LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return decodeLedgerEntries(m.lrange("ledger", start, start+limit-1), start)
+}
+
+func (m *MemoryBackend) findLedgerEntry(kind, ref string) (*LedgerEntry, error) {
+	id, ok := m.hget(join("ledger", "index"), ledgerIndex(kind, ref))
+	if !ok {
+		return nil, nil
+	}
+	entries, err := decodeLedgerEntries(m.lrange("ledger", parseInt64(id), parseInt64(id)), parseInt64(id))
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+func (m *MemoryBackend) LedgerBalances() (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]int64)
+	for account, amount := range m.hgetall(join("ledger", "totals")) {
+		result[account] = parseInt64(amount)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) WriteNetworkFee(txId, note string, fee int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.hget(join("ledger", "index"), ledgerIndex(EntryFee, txId)); ok {
+		return nil
+	}
+	m.writeLedger(EntryFee, txId, note, networkFeePostings(fee)...)
+	return nil
+}
+
+func (m *MemoryBackend) OpenLedger() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.llen("ledger") > 0 {
+		return nil
+	}
+	var postings []Posting
+	total := int64(0)
+	for _, login := range m.payees() {
+		miner := m.hgetall(join("miners", login))
+		for _, account := range minerAccounts {
+			amount := parseInt64(miner[account])
+			if amount != 0 {
+				postings = append(postings, Posting{Account: MinerAccount(account, login), Amount: amount})
+				total += amount
+			}
+		}
+	}
+	if len(postings) == 0 {
+		return nil
+	}
+	postings = append(sortPostings(postings), Posting{Account: AccountOpening, Amount: -total})
+	m.writeLedger(EntryOpening, "", "balances before the ledger", postings...)
+	return nil
+}
+
+func (m *MemoryBackend) ReconcileLedger() ([]LedgerDrift, error) {
+	balances, err := m.LedgerBalances()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	logins := m.payees()
+	known := make(map[string]bool)
+	for _, login := range logins {
+		known[login] = true
+	}
+	// Miners whose balance keys are gone still count
+	for account := range balances {
+		if _, login, ok := ParseMinerAccount(account); ok && !known[login] {
+			known[login] = true
+			logins = append(logins, login)
+		}
+	}
+	sort.Strings(logins)
+
+	var drifts []LedgerDrift
+	totals := make(map[string]int64)
+	for _, login := range logins {
+		miner := m.hgetall(join("miners", login))
+		for _, account := range minerAccounts {
+			ledger := balances[MinerAccount(account, login)]
+			actual := parseInt64(miner[account])
+			totals[account] += ledger
+			if ledger != actual {
+				drifts = append(drifts, LedgerDrift{Account: MinerAccount(account, login), Ledger: ledger, Actual: actual})
+			}
+		}
+	}
+	finances := m.hgetall("finances")
+	for _, account := range minerAccounts {
+		actual := parseInt64(finances[account])
+		if totals[account] != actual {
+			drifts = append(drifts, LedgerDrift{Account: "finances:" + account, Ledger: totals[account], Actual: actual})
+		}
+	}
+	return drifts, nil
+}
+
+func (m *MemoryBackend) LockPayouts(login string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := join("payments", "lock")
+	if _, ok := m.get(key); ok {
+		return fmt.Errorf("Unable to acquire lock '%s'", key)
+	}
+	m.set(key, join(login, amount), 0)
+	return nil
+}
+
+func (m *MemoryBackend) UnlockPayouts() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.del(join("payments", "lock"), join("payments", "inflight"))
+	return nil
+}
+
+func (m *MemoryBackend) WriteInFlightPayment(payment *InFlightPayment) error {
+	data, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(join("payments", "inflight"), string(data), 0)
+	return nil
+}
+
+func (m *MemoryBackend) GetInFlightPayment() (*InFlightPayment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.get(join("payments", "inflight"))
+	if !ok {
+		return nil, nil
+	}
+	var payment *InFlightPayment
+	err := json.Unmarshal([]byte(data), &payment)
+	return payment, err
+}
+
+func (m *MemoryBackend) IsPayoutsLocked() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.get(join("payments", "lock"))
+	return ok, nil
+}
+
+func (m *MemoryBackend) GetPendingPayments() []*PendingPayment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return convertPendingPayments(m.zrange(join("payments", "pending"), 0, -1, true))
+}
+
+func (m *MemoryBackend) WritePayment(login, txHash string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts := MakeTimestamp() / 1000
+	m.hincrBy(join("miners", login), "pending", -amount)
+	m.hincrBy(join("miners", login), "paid", amount)
+	m.hincrBy("finances", "pending", -amount)
+	m.hincrBy("finances", "paid", amount)
+	m.zadd(join("payments", "all"), float64(ts), join(txHash, login, amount))
+	m.zadd(join("payments", login), float64(ts), join(txHash, amount))
+	m.zrem(join("payments", "pending"), join(login, amount))
+	m.del(join("payments", "lock"))
+	m.writeTransfer(EntryPaid, txHash, login, AccountPending, AccountPaid, amount)
+	return nil
+}
+
+func (m *MemoryBackend) WritePayments(txHash string, payments map[string]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writePayments(txHash, payments)
+	return nil
+}
+
+func (m *MemoryBackend) writePayments(txHash string, payments map[string]int64) {
+	ts := MakeTimestamp() / 1000
+
+	logins := make([]string, 0, len(payments))
+	for login := range payments {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	for _, login := range logins {
+		amount := payments[login]
+		m.hincrBy(join("miners", login), "pending", -amount)
+		m.hincrBy(join("miners", login), "paid", amount)
+		m.hincrBy("finances", "pending", -amount)
+		m.hincrBy("finances", "paid", amount)
+		m.zadd(join("payments", "all"), float64(ts), join(txHash, login, amount))
+		m.zadd(join("payments", login), float64(ts), join(txHash, amount))
+		m.zrem(join("payments", "pending"), join(login, amount))
+		m.writeTransfer(EntryPaid, txHash, login, AccountPending, AccountPaid, amount)
+	}
+	m.del(join("payments", "lock"))
+	m.writePaymentTx(&PaymentTx{TxId: txHash, Payments: payments, Sent: ts, Status: PaymentPending})
+}
+
+func (m *MemoryBackend) WriteLightningPayment(login, paymentHash string, amount, fee int64, clearDestination bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts := MakeTimestamp() / 1000
+	m.hincrBy(join("miners", login), "pending", -amount)
+	m.hincrBy(join("miners", login), "paid", amount)
+	m.hincrBy("finances", "pending", -amount)
+	m.hincrBy("finances", "paid", amount)
+	m.zadd(join("payments", "all"), float64(ts), join(paymentHash, login, amount))
+	m.zadd(join("payments", login), float64(ts), join(paymentHash, amount))
+	m.zrem(join("payments", "pending"), join(login, amount))
+	m.writeTransfer(EntryPaid, paymentHash, login, AccountPending, AccountPaid, amount)
+	m.writeLedger(EntryFee, paymentHash, "Lightning routing fee", networkFeePostings(fee)...)
+	if clearDestination {
+		m.hdel(join("miners", login), "lightning")
+	}
+	m.del(join("payments", "lock"), join("payments", "inflight"))
+	m.writePaymentTx(&PaymentTx{
+		TxId:      paymentHash,
+		Payments:  map[string]int64{login: amount},
+		Sent:      ts,
+		Status:    PaymentConfirmed,
+		Lightning: true,
+		Fee:       fee,
+	})
+	return nil
+}
+
+func (m *MemoryBackend) writePaymentTx(ptx *PaymentTx) {
+	data, _ := json.Marshal(ptx)
+	m.hset(join("payments", "txs"), ptx.TxId, string(data))
+	if ptx.Status == PaymentPending {
+		m.sadd(join("payments", "unconfirmed"), ptx.TxId)
+	} else {
+		m.srem(join("payments", "unconfirmed"), ptx.TxId)
+	}
+}
+
+func (m *MemoryBackend) GetUnconfirmedPayments() ([]*PaymentTx, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	txIds := m.smembers(join("payments", "unconfirmed"))
+	if len(txIds) == 0 {
+		return nil, nil
+	}
+	txs, err := m.paymentTxs(txIds)
+	if err != nil {
+		return nil, err
+	}
+	return sortPaymentTxs(txIds, txs), nil
+}
+
+func (m *MemoryBackend) GetPaymentTxs(txIds []string) (map[string]*PaymentTx, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paymentTxs(txIds)
+}
+
+func (m *MemoryBackend) paymentTxs(txIds []string) (map[string]*PaymentTx, error) {
+	result := make(map[string]*PaymentTx)
+	for _, data := range m.hmget(join("payments", "txs"), txIds...) {
+		var ptx *PaymentTx
+		err := json.Unmarshal([]byte(data), &ptx)
+		if err != nil {
+			return nil, err
+		}
+		result[ptx.TxId] = ptx
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) UpdatePaymentTx(ptx *PaymentTx) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writePaymentTx(ptx)
+	return nil
+}
+
+func (m *MemoryBackend) ReplacePaymentTx(ptx *PaymentTx, txHash string) (*PaymentTx, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	replacement := ptx.replace(txHash)
+	for login, amount := range ptx.Payments {
+		m.zrem(join("payments", "all"), join(ptx.TxId, login, amount))
+		m.zadd(join("payments", "all"), float64(ptx.Sent), join(txHash, login, amount))
+		m.zrem(join("payments", login), join(ptx.TxId, amount))
+		m.zadd(join("payments", login), float64(ptx.Sent), join(txHash, amount))
+	}
+	m.writePaymentTx(ptx)
+	m.writePaymentTx(replacement)
+	return replacement, nil
+}
+
+func (m *MemoryBackend) WritePayoutBatch(batch *PayoutBatch) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.get(join("payments", "batch")); ok {
+		return errors.New("another payout batch is pending")
+	}
+	m.set(join("payments", "batch"), string(data), 0)
+	return nil
+}
+
+func (m *MemoryBackend) GetPayoutBatch() (*PayoutBatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.get(join("payments", "batch"))
+	if !ok {
+		return nil, nil
+	}
+	var batch *PayoutBatch
+	err := json.Unmarshal([]byte(data), &batch)
+	return batch, err
+}
+
+func (m *MemoryBackend) SubmitSignedPsbt(id, psbt string) error {
+	return m.updatePayoutBatch(id, func(batch *PayoutBatch) {
+		batch.SignedPsbt = psbt
+		batch.Failed = ""
+	})
+}
+
+func (m *MemoryBackend) FailSignedPsbt(id, reason string) error {
+	return m.updatePayoutBatch(id, func(batch *PayoutBatch) {
+		batch.SignedPsbt = ""
+		batch.Failed = reason
+	})
+}
+
+func (m *MemoryBackend) updatePayoutBatch(id string, update func(batch *PayoutBatch)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.get(join("payments", "batch"))
+	if !ok {
+		return errors.New("no pending payout batch")
+	}
+	var batch PayoutBatch
+	err := json.Unmarshal([]byte(data), &batch)
+	if err != nil {
+		return err
+	}
+	if batch.Id != id {
+		return fmt.Errorf("payout batch %s is not pending", id)
+	}
+	update(&batch)
+	updated, err := json.Marshal(&batch)
+	if err != nil {
+		return err
+	}
+	m.set(join("payments", "batch"), string(updated), 0)
+	return nil
+}
+
+func (m *MemoryBackend) CompletePayoutBatch(txHash string, batch *PayoutBatch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writePayments(txHash, batch.Payments)
+	m.del(join("payments", "batch"))
+	m.hdel(join("payments", "abandoned"), batch.Conflicts...)
+	return nil
+}
+
+func (m *MemoryBackend) AbandonPayoutBatch(batch *PayoutBatch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for login, amount := range batch.Payments {
+		m.hincrBy(join("miners", login), "balance", amount)
+		m.hincrBy(join("miners", login), "pending", -amount)
+		m.hincrBy("finances", "balance", amount)
+		m.hincrBy("finances", "pending", -amount)
+		m.zrem(join("payments", "pending"), join(login, amount))
+		m.writeTransfer(EntryRollback, batch.Id, login, AccountPending, AccountBalance, amount)
+	}
+	m.hset(join("payments", "abandoned"), batch.Id, strings.Join(batch.Inputs, ","))
+	m.del(join("payments", "batch"), join("payments", "lock"))
+	return nil
+}
+
+func (m *MemoryBackend) GetAbandonedBatches() (map[string][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string][]string)
+	for id, inputs := range m.hgetall(join("payments", "abandoned")) {
+		result[id] = strings.Split(inputs, ",")
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) WritePayoutSchedule(schedule *PayoutSchedule) error {
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(join("payments", "schedule"), string(data), 0)
+	return nil
+}
+
+func (m *MemoryBackend) GetPayoutSchedule() (*PayoutSchedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.get(join("payments", "schedule"))
+	if !ok {
+		return nil, nil
+	}
+	var schedule *PayoutSchedule
+	err := json.Unmarshal([]byte(data), &schedule)
+	return schedule, err
+}
+
+func (m *MemoryBackend) WriteSolvency(solvency *Solvency) error {
+	data, err := json.Marshal(solvency)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(join("finances", "solvency"), string(data), 0)
+	return nil
+}
+
+func (m *MemoryBackend) GetSolvency() (*Solvency, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.get(join("finances", "solvency"))
+	if !ok {
+		return nil, nil
+	}
+	var solvency *Solvency
+	err := json.Unmarshal([]byte(data), &solvency)
+	return solvency, err
+}
+
+func (m *MemoryBackend) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
+	stats := make(map[string]interface{})
+
+	m.mu.Lock()
+	miner := make(map[string]string)
+	for field, value := range m.hgetall(join("miners", login)) {
+		miner[field] = value
+	}
+	for _, field := range privateMinerFields {
+		delete(miner, field)
+	}
+	stats["stats"] = convertStringMap(miner)
+	payments := convertPaymentsResults(m.zrange(join("payments", login), 0, maxPayments-1, true))
+	stats["paymentsTotal"] = m.zcard(join("payments", login))
+	roundShares, _ := m.hget(join("shares", "roundCurrent"), login)
+	stats["roundShares"] = parseInt64(roundShares)
+	m.mu.Unlock()
+
+	err := annotatePayments(m, payments)
+	if err != nil {
+		return nil, err
+	}
+	stats["payments"] = payments
+	return stats, nil
+}
+
+func (m *MemoryBackend) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := MakeTimestamp() / 1000
+	max := float64(now - int64(window/time.Second))
+	total := m.zremBelow("hashrate", max)
+	total += m.zremBelow("invalidhashrate", max)
+	total += m.zremBelow("rejecthashrate", max)
+
+	max = float64(now - int64(largeWindow/time.Second))
+	for _, key := range m.scan("hashrate:") {
+		total += m.zremBelow(key, max)
+	}
+	return total, nil
+}
+
+func (m *MemoryBackend) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+	window := int64(smallWindow / time.Second)
+	stats := make(map[string]interface{})
+	now := MakeTimestamp() / 1000
+
+	m.mu.Lock()
+	m.zremBelow("hashrate", float64(now-window))
+	hashrate := m.zrange("hashrate", 0, -1, false)
+	stats["stats"] = convertStringMap(m.hgetall("stats"))
+	stats["candidates"] = convertCandidateResults(m.zrange(join("blocks", "candidates"), 0, -1, true))
+	stats["candidatesTotal"] = m.zcard(join("blocks", "candidates"))
+	stats["immature"] = convertBlockResults(m.zrange(join("blocks", "immature"), 0, -1, true))
+	stats["immatureTotal"] = m.zcard(join("blocks", "immature"))
+	stats["matured"] = convertBlockResults(m.zrange(join("blocks", "matured"), 0, maxBlocks-1, true))
+	stats["maturedTotal"] = m.zcard(join("blocks", "matured"))
+	payments := convertPaymentsResults(m.zrange(join("payments", "all"), 0, maxPayments-1, true))
+	stats["paymentsTotal"] = m.zcard(join("payments", "all"))
+	reserve, _ := m.hget("finances", "reserve")
+	stats["reserve"], _ = strconv.ParseInt(reserve, 10, 64)
+	m.mu.Unlock()
+
+	err := annotatePayments(m, payments)
+	if err != nil {
+		return nil, err
+	}
+	stats["payments"] = payments
+
+	totalHashrate, miners := convertMinersStats(window, hashrate)
+	stats["miners"] = miners
+	stats["minersTotal"] = len(miners)
+	stats["hashrate"] = totalHashrate
+	return stats, nil
+}
+
+func (m *MemoryBackend) CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error) {
+	smallWindow := int64(sWindow / time.Second)
+	largeWindow := int64(lWindow / time.Second)
+	now := MakeTimestamp() / 1000
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.zremBelow(join("hashrate", login), float64(now-largeWindow))
+	return workersStats(smallWindow, largeWindow, m.zrange(join("hashrate", login), 0, -1, false)), nil
+}
+
+func (m *MemoryBackend) CollectLuckStats(windows []int) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	max := int64(windows[len(windows)-1])
+	blocks := convertBlockResults(m.zrange(join("blocks", "immature"), 0, -1, true),
+		m.zrange(join("blocks", "matured"), 0, max-1, true))
+	return luckStats(blocks, windows), nil
+}
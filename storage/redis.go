@@ -1,8 +1,14 @@
 package storage
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -25,62 +31,45 @@ type RedisClient struct {
 	prefix string
 }
 
-type BlockData struct {
-	Height         int64    `json:"height"`
-	Timestamp      int64    `json:"timestamp"`
-	Difficulty     int64    `json:"difficulty"`
-	TotalShares    int64    `json:"shares"`
-	Uncle          bool     `json:"uncle"`
-	UncleHeight    int64    `json:"uncleHeight"`
-	Orphan         bool     `json:"orphan"`
-	Hash           string   `json:"hash"`
-	Nonce          string   `json:"-"`
-	ENonce1        string   `json:"-"`
-	ENonce2        string   `json:"-"`
-	CoinBaseValue  *big.Int `json:"-"`
-	BlkTotalFee    *big.Int `json:"-"`
-	Reward         *big.Int `json:"-"`
-	ExtraReward    *big.Int `json:"-"`
-	ImmatureReward string   `json:"-"`
-	RewardString   string   `json:"reward"`
-	RoundHeight    int64    `json:"-"`
-	candidateKey   string
-	immatureKey    string
+// Stratum session kept for a while after disconnect so the miner can resume it
+type StratumSession struct {
+	ExtraNonce1     string
+	ExtraNonce2Size int
+	Target          string
+	Login           string
+	Id              string
+	Authorized      bool
+	Node            string
 }
 
-type HashRateStatsData struct {
-	SharesCount uint64 `json:"sharesCount"`
-	TotalWorks  uint64 `json:"totalWorks"`
-}
-
-func (b *BlockData) RewardInSatoshi() int64 {
-	return b.Reward.Int64()
+// Reward accounting of a share under the pool's reward scheme
+type ShareAccounting struct {
+	// Cap of the PPLNS share window, 0 if it isn't kept
+	PPLNSShares int64
+	// Pay per share credit in millisatoshi, 0 unless the pool pays per share
+	Credit int64
+	// Score decay constant, 0 unless shares are scored
+	ScoreDecay time.Duration
+	// Credit is added to the pending credits instead, the SQL backend settles them in batches
+	pendingCredit bool
 }
 
-func (b *BlockData) serializeHash() string {
-	if len(b.Hash) > 0 {
-		return b.Hash
-	} else {
-		return "0x0"
-	}
+// Entry of a round's share log
+type ShareLogEntry struct {
+	Timestamp int64
+	Diff      int64
+	Login     string
 }
 
-func (b *BlockData) RoundKey() string {
-	return join(b.RoundHeight, b.Hash)
+// Share of the PPLNS window, newest first
+type PPLNSShare struct {
+	Login string
+	Diff  int64
 }
 
-func (b *BlockData) key() string {
-	return join(
-		b.UncleHeight,
-		b.Orphan,
-		b.Nonce,
-		b.serializeHash(),
-		b.Timestamp,
-		b.Difficulty,
-		b.TotalShares,
-		b.CoinBaseValue,
-		b.BlkTotalFee,
-		b.Reward)
+type HashRateStatsData struct {
+	SharesCount uint64 `json:"sharesCount"`
+	TotalWorks  uint64 `json:"totalWorks"`
 }
 
 type Miner struct {
@@ -105,6 +94,15 @@ func NewRedisClient(cfg *Config, prefix string) *RedisClient {
 	return &RedisClient{client: client, prefix: prefix}
 }
 
+// Share the connection pool with another key namespace
+func (r *RedisClient) WithPrefix(prefix string) *RedisClient {
+	return &RedisClient{client: r.client, prefix: prefix}
+}
+
+func (r *RedisClient) Prefix() string {
+	return r.prefix
+}
+
 func (r *RedisClient) Client() *redis.Client {
 	return r.client
 }
@@ -151,13 +149,94 @@ func (r *RedisClient) WriteNodeState(id string, height uint32, diff *big.Int) er
 	return err
 }
 
+func (r *RedisClient) GetNodeBlocksFound(id string) (int64, error) {
+	cmd := r.client.HGet(r.formatKey("nodes"), join(id, "blocksFound"))
+	if cmd.Err() == redis.Nil {
+		return 0, nil
+	} else if cmd.Err() != nil {
+		return 0, cmd.Err()
+	}
+	return cmd.Int64()
+}
+
+func (r *RedisClient) WriteStratumSession(sid string, ss *StratumSession, expire time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.HMSetMap(r.formatKey("sessions", sid), ss.fields())
+		tx.Expire(r.formatKey("sessions", sid), expire)
+		return nil
+	})
+	return err
+}
+
+// Get and remove a suspended session, so only one connection can resume it
+func (r *RedisClient) TakeStratumSession(sid string) (*StratumSession, error) {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.HGetAllMap(r.formatKey("sessions", sid))
+		tx.Del(r.formatKey("sessions", sid))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m, _ := cmds[0].(*redis.StringStringMapCmd).Result()
+	return parseStratumSession(m), nil
+}
+
+func (ss *StratumSession) fields() map[string]string {
+	return map[string]string{
+		"extraNonce1":     ss.ExtraNonce1,
+		"extraNonce2Size": strconv.Itoa(ss.ExtraNonce2Size),
+		"target":          ss.Target,
+		"login":           ss.Login,
+		"id":              ss.Id,
+		"authorized":      strconv.FormatBool(ss.Authorized),
+		"node":            ss.Node,
+	}
+}
+
+func parseStratumSession(m map[string]string) *StratumSession {
+	if len(m) == 0 {
+		return nil
+	}
+	ss := &StratumSession{
+		ExtraNonce1: m["extraNonce1"],
+		Target:      m["target"],
+		Login:       m["login"],
+		Id:          m["id"],
+		Node:        m["node"],
+	}
+	ss.ExtraNonce2Size, _ = strconv.Atoi(m["extraNonce2Size"])
+	ss.Authorized, _ = strconv.ParseBool(m["authorized"])
+	return ss
+}
+
+// Reserve an extranonce1 prefix for a suspended or resumed session, its node must not hand it out meanwhile
+func (r *RedisClient) LeaseExtraNonce(extraNonce1, node string, expire time.Duration) error {
+	return r.client.Set(r.formatKey("extranonces", extraNonce1), node, expire).Err()
+}
+
+func (r *RedisClient) IsExtraNonceLeased(extraNonce1 string) (bool, error) {
+	return r.client.Exists(r.formatKey("extranonces", extraNonce1)).Result()
+}
+
 func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
+	return convertNodeStates(cmd.Val()), nil
+}
+
+// Group the "id:field" entries of the nodes hash by node
+func convertNodeStates(nodes map[string]string) []map[string]interface{} {
 	m := make(map[string]map[string]interface{})
-	for key, value := range cmd.Val() {
+	for key, value := range nodes {
 		parts := strings.Split(key, ":")
 		if val, ok := m[parts[0]]; ok {
 			val[parts[1]] = value
@@ -173,7 +252,33 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 		v[i] = value
 		i++
 	}
-	return v, nil
+	return v
+}
+
+// Transactions forced into our block templates
+func (r *RedisClient) GetPriorityTxs() ([]string, error) {
+	return r.client.SMembers(r.formatKey("txpolicy", "priority")).Result()
+}
+
+func (r *RedisClient) AddPriorityTx(txId string) error {
+	return r.client.SAdd(r.formatKey("txpolicy", "priority"), txId).Err()
+}
+
+func (r *RedisClient) RemovePriorityTx(txId string) error {
+	return r.client.SRem(r.formatKey("txpolicy", "priority"), txId).Err()
+}
+
+// Transactions kept out of our block templates
+func (r *RedisClient) GetExcludedTxs() ([]string, error) {
+	return r.client.SMembers(r.formatKey("txpolicy", "excluded")).Result()
+}
+
+func (r *RedisClient) AddExcludedTx(txId string) error {
+	return r.client.SAdd(r.formatKey("txpolicy", "excluded"), txId).Err()
+}
+
+func (r *RedisClient) RemoveExcludedTx(txId string) error {
+	return r.client.SRem(r.formatKey("txpolicy", "excluded"), txId).Err()
 }
 
 func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
@@ -182,7 +287,8 @@ func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error
 	return val == 0, err
 }
 
-func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
+func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration,
+	acc ShareAccounting) (bool, error) {
 	exist, err := r.checkPoWExist(height, params)
 	if err != nil {
 		return false, err
@@ -198,7 +304,7 @@ func (r *RedisClient) WriteShare(login, id string, params []string, diff int64,
 		ms := MakeTimestamp()
 		ts := ms / 1000
 
-		r.writeShare(tx, ms, ts, login, id, diff, window)
+		r.writeShare(tx, ms, ts, login, id, diff, window, acc)
 		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
 		return nil
 	})
@@ -221,55 +327,182 @@ func (r *RedisClient) WriteRejectShare(ms, ts int64, login, id string, diff int6
 	return nil
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64,
-	coinBaseValue int64, blkTotalFee int64, window time.Duration) (bool, error) {
+// Copies the PPLNS window in chunks, unpack is limited by the Lua stack
+var pplnsScript = redis.NewScript(`
+local window = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1)
+for i = 1, #window, 1000 do
+	redis.call('RPUSH', KEYS[2], unpack(window, i, math.min(i + 999, #window)))
+end
+return #window
+`)
+
+// hash is the block hash computed by the proxy, candidates are confirmed by it
+func (r *RedisClient) WriteBlock(login, id string, params []string, hash string, diff, roundDiff int64, height uint64,
+	coinBaseValue int64, blkTotalFee int64, node, coinBaseTag string, window time.Duration, acc ShareAccounting) (bool, error) {
 	exist, err := r.checkPoWExist(height, params)
+	if err != nil || exist {
+		return exist, err
+	}
+	block := newCandidate(login, id, params, hash, roundDiff, height, coinBaseValue, blkTotalFee, node, coinBaseTag)
+	err = r.writeRound(block, diff, window, acc)
 	if err != nil {
 		return false, err
 	}
-	if exist {
-		return true, nil
-	}
+	cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: block.key()})
+	return false, cmd.Err()
+}
+
+// Write the share that found the candidate and close its round, the total shares of the round are set on the block
+func (r *RedisClient) writeRound(block *BlockData, diff int64, window time.Duration, acc ShareAccounting) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
 	ms := MakeTimestamp()
-	ts := ms / 1000
+	ts := block.Timestamp
 
-	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
+	var roundShares *redis.StringStringMapCmd
+	_, err := tx.Exec(func() error {
+		r.writeShare(tx, ms, ts, block.Login, block.Worker, diff, window, acc)
 		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
 		tx.HDel(r.formatKey("stats"), "roundShares")
-		tx.ZIncrBy(r.formatKey("finders"), 1, login)
-		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
-		tx.HGetAllMap(r.formatRound(int64(height), params[0]))
+		tx.ZIncrBy(r.formatKey("finders"), 1, block.Login)
+		tx.HIncrBy(r.formatKey("miners", block.Login), "blocksFound", 1)
+		tx.HIncrBy(r.formatKey("nodes"), join(block.Node, "blocksFound"), 1)
+		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(block.Height, block.Nonce))
+		roundShares = tx.HGetAllMap(r.formatRound(block.Height, block.Nonce))
+		if acc.ScoreDecay > 0 {
+			tx.Rename(r.formatKey("shares", "scoreCurrent"), r.formatScoreRound(block.Height, block.Nonce))
+			tx.Rename(r.formatKey("shares", "log", "roundCurrent"), r.formatShareLog(block.Height, block.Nonce))
+		}
+		if acc.PPLNSShares > 0 {
+			// Snapshot of the window the block is rewarded from
+			pplnsScript.Eval(tx, []string{r.formatKey("shares", "pplns"), r.formatPPLNSRound(block.Height, block.Nonce)},
+				[]string{strconv.FormatInt(acc.PPLNSShares, 10)})
+		}
 		return nil
 	})
 	if err != nil {
-		return false, err
-	} else {
-		sharesMap, _ := cmds[10].(*redis.StringStringMapCmd).Result()
-		totalShares := int64(0)
-		for _, v := range sharesMap {
-			n, _ := strconv.ParseInt(v, 10, 64)
-			totalShares += n
-		}
-		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares, coinBaseValue, blkTotalFee)
-		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
-		return false, cmd.Err()
+		return err
+	}
+	sharesMap, _ := roundShares.Result()
+	block.TotalShares = 0
+	for _, v := range sharesMap {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		block.TotalShares += n
 	}
+	return nil
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
+func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration,
+	acc ShareAccounting) {
 	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+	if acc.PPLNSShares > 0 {
+		// Login goes last, cashaddr logins contain colons
+		tx.LPush(r.formatKey("shares", "pplns"), join(diff, login))
+		tx.LTrim(r.formatKey("shares", "pplns"), 0, acc.PPLNSShares-1)
+	}
+	if acc.ScoreDecay > 0 {
+		epoch, score := shareScore(ms, diff, acc.ScoreDecay)
+		tx.HIncrByFloat(r.formatKey("shares", "scoreCurrent"), join(epoch, login), score)
+		tx.RPush(r.formatKey("shares", "log", "roundCurrent"), join(ms, diff, login))
+	}
+	if acc.Credit > 0 && acc.pendingCredit {
+		tx.HIncrBy(r.formatKey("credits", "pending"), login, acc.Credit)
+	} else if acc.Credit > 0 {
+		keys := []string{r.formatKey("miners", login), r.formatKey("finances"), r.formatKey("ledger"),
+			r.formatKey("ledger", "totals")}
+		creditScript.Eval(tx, keys, []string{strconv.FormatInt(acc.Credit, 10), EntryPPSCredit, AccountReserve,
+			MinerAccount(AccountBalance, login), strconv.FormatInt(ts, 10)})
+	}
 	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
 	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
 	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
 	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
 }
 
+// Adds a PPS credit in millisatoshi to the miner and moves its whole satoshis from the reserve to the balance,
+// in one step so concurrent shares can't settle the same credit twice
+var creditScript = redis.NewScript(`
+local credit = redis.call('HINCRBY', KEYS[1], 'ppsCredit', ARGV[1])
+local amount = math.floor(credit / 1000)
+if amount < 1 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], 'ppsCredit', -amount * 1000)
+redis.call('HINCRBY', KEYS[1], 'balance', amount)
+redis.call('HINCRBY', KEYS[2], 'balance', amount)
+redis.call('HINCRBY', KEYS[2], 'ppsCredited', amount)
+redis.call('HINCRBY', KEYS[2], 'reserve', -amount)
+redis.call('RPUSH', KEYS[3], cjson.encode({kind = ARGV[2], timestamp = tonumber(ARGV[5]),
+	postings = {{account = ARGV[3], amount = -amount}, {account = ARGV[4], amount = amount}}}))
+redis.call('HINCRBY', KEYS[4], ARGV[3], -amount)
+redis.call('HINCRBY', KEYS[4], ARGV[4], amount)
+return amount
+`)
+
+// Credits are settled with their shares
+func (r *RedisClient) FlushCredits() error {
+	return nil
+}
+
+// Pending credits move to a batch kept until it is cleared, the batch id tells retries of the batch apart
+var takeCreditsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+		return {}
+	end
+	redis.call('RENAME', KEYS[1], KEYS[2])
+	redis.call('SET', KEYS[3], ARGV[1])
+end
+return {redis.call('GET', KEYS[3]), redis.call('HGETALL', KEYS[2])}
+`)
+
+var clearCreditsScript = redis.NewScript(`
+if redis.call('GET', KEYS[2]) == ARGV[1] then
+	redis.call('DEL', KEYS[1], KEYS[2])
+end
+return 0
+`)
+
+// Batch of the pending PPS credits in millisatoshi by login, the same batch is returned until it is cleared
+func (r *RedisClient) takeCredits() (string, map[string]int64, error) {
+	id, err := newBatchId()
+	if err != nil {
+		return "", nil, err
+	}
+	keys := []string{r.formatKey("credits", "pending"), r.formatKey("credits", "batch"), r.formatKey("credits", "batch", "id")}
+	reply, err := takeCreditsScript.Run(r.client, keys, []string{id}).Result()
+	if err != nil {
+		return "", nil, err
+	}
+	values, _ := reply.([]interface{})
+	if len(values) != 2 {
+		return "", nil, nil
+	}
+	batch, _ := values[0].(string)
+	fields, _ := values[1].([]interface{})
+	credits := make(map[string]int64)
+	for i := 0; i+1 < len(fields); i += 2 {
+		login, _ := fields[i].(string)
+		credit, _ := fields[i+1].(string)
+		credits[login], _ = strconv.ParseInt(credit, 10, 64)
+	}
+	return batch, credits, nil
+}
+
+// Random id of a credit batch, ids of a reset Redis must not match the last batch settled in SQL
+func newBatchId() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	return hex.EncodeToString(id), err
+}
+
+// Delete the batch unless another one replaced it
+func (r *RedisClient) clearCredits(batch string) error {
+	keys := []string{r.formatKey("credits", "batch"), r.formatKey("credits", "batch", "id")}
+	return clearCreditsScript.Run(r.client, keys, []string{batch}).Err()
+}
+
 func (r *RedisClient) formatKey(args ...interface{}) string {
 	return join(r.prefix, join(args...))
 }
@@ -278,6 +511,44 @@ func (r *RedisClient) formatRound(height int64, nonce string) string {
 	return r.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
 }
 
+func (r *RedisClient) formatPPLNSRound(height int64, nonce string) string {
+	return r.formatKey("shares", "pplns", "round"+strconv.FormatInt(height, 10), nonce)
+}
+
+func (r *RedisClient) formatScoreRound(height int64, nonce string) string {
+	return r.formatKey("shares", "score", "round"+strconv.FormatInt(height, 10), nonce)
+}
+
+func (r *RedisClient) formatShareLog(height int64, nonce string) string {
+	return r.formatKey("shares", "log", "round"+strconv.FormatInt(height, 10), nonce)
+}
+
+// Scores are kept per epoch of scoreEpochSpan decay constants so exp() stays finite in long rounds
+const scoreEpochSpan = 256
+
+// Epoch of a share and its score, diff*exp(age/decay) with age counted from the epoch start
+func shareScore(ms, diff int64, decay time.Duration) (int64, float64) {
+	c := float64(decay / time.Millisecond)
+	span := int64(c * scoreEpochSpan)
+	epoch := ms / span * span
+	return epoch, float64(diff) * math.Exp(float64(ms-epoch)/c)
+}
+
+// Rebuild the per login scores of a round from its share log
+func ScoresFromShareLog(log []ShareLogEntry, decay time.Duration) map[string]float64 {
+	scores := make(map[string]float64)
+	if len(log) == 0 {
+		return scores
+	}
+	// Weigh from the last share, older shares decay towards 0
+	c := float64(decay / time.Millisecond)
+	last := log[len(log)-1].Timestamp
+	for _, e := range log {
+		scores[e.Login] += float64(e.Diff) * math.Exp(float64(e.Timestamp-last)/c)
+	}
+	return scores
+}
+
 func join(args ...interface{}) string {
 	s := make([]string, len(args))
 	for i, v := range args {
@@ -316,7 +587,7 @@ func (r *RedisClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertCandidateResults(cmd), nil
+	return convertCandidateResults(cmd.Val()), nil
 }
 
 func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
@@ -325,200 +596,1019 @@ func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertBlockResults(cmd), nil
+	return convertBlockResults(cmd.Val()), nil
+}
+
+// Matured blocks from minHeight on, orphans included
+func (r *RedisClient) GetMaturedBlocks(minHeight int64) ([]*BlockData, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(minHeight, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "matured"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertBlockResults(cmd.Val()), nil
+}
+
+func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	cmd := r.client.HGetAllMap(r.formatRound(height, nonce))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	sharesMap, _ := cmd.Result()
+	for login, v := range sharesMap {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		result[login] = n
+	}
+	return result, nil
+}
+
+// PPLNS window snapshot of a round, newest share first
+func (r *RedisClient) GetPPLNSShares(height int64, nonce string) ([]PPLNSShare, error) {
+	cmd := r.client.LRange(r.formatPPLNSRound(height, nonce), 0, -1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return parsePPLNSShares(cmd.Val()), nil
+}
+
+// "diff:login" entries of a PPLNS window
+func parsePPLNSShares(values []string) []PPLNSShare {
+	var result []PPLNSShare
+	for _, v := range values {
+		fields := strings.SplitN(v, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		diff, _ := strconv.ParseInt(fields[0], 10, 64)
+		result = append(result, PPLNSShare{Login: fields[1], Diff: diff})
+	}
+	return result
+}
+
+// Per login scores of a round, brought to the scale of its latest epoch
+func (r *RedisClient) GetRoundScores(height int64, nonce string, decay time.Duration) (map[string]float64, error) {
+	cmd := r.client.HGetAllMap(r.formatScoreRound(height, nonce))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return parseRoundScores(cmd.Val(), decay), nil
+}
+
+// "epoch:login" scores of a round decayed to its latest epoch
+func parseRoundScores(values map[string]string, decay time.Duration) map[string]float64 {
+	type epochScore struct {
+		epoch int64
+		login string
+		score float64
+	}
+	var entries []epochScore
+	lastEpoch := int64(0)
+	for k, v := range values {
+		fields := strings.SplitN(k, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		epoch, _ := strconv.ParseInt(fields[0], 10, 64)
+		score, _ := strconv.ParseFloat(v, 64)
+		entries = append(entries, epochScore{epoch, fields[1], score})
+		if epoch > lastEpoch {
+			lastEpoch = epoch
+		}
+	}
+	c := float64(decay / time.Millisecond)
+	result := make(map[string]float64)
+	for _, e := range entries {
+		result[e.login] += e.score * math.Exp(float64(e.epoch-lastEpoch)/c)
+	}
+	return result
+}
+
+// Share log of a round, oldest share first
+func (r *RedisClient) GetRoundShareLog(height int64, nonce string) ([]ShareLogEntry, error) {
+	cmd := r.client.LRange(r.formatShareLog(height, nonce), 0, -1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return parseShareLog(cmd.Val()), nil
+}
+
+// "ms:diff:login" entries of a share log
+func parseShareLog(values []string) []ShareLogEntry {
+	var result []ShareLogEntry
+	for _, v := range values {
+		fields := strings.SplitN(v, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		ts, _ := strconv.ParseInt(fields[0], 10, 64)
+		diff, _ := strconv.ParseInt(fields[1], 10, 64)
+		result = append(result, ShareLogEntry{Timestamp: ts, Diff: diff, Login: fields[2]})
+	}
+	return result
+}
+
+func (r *RedisClient) GetPayees() ([]string, error) {
+	payees := make(map[string]struct{})
+	var result []string
+	var c int64
+
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range keys {
+			// Cashaddr logins contain colons
+			login := strings.TrimPrefix(row, r.formatKey("miners")+":")
+			payees[login] = struct{}{}
+		}
+		if c == 0 {
+			break
+		}
+	}
+	for login, _ := range payees {
+		result = append(result, login)
+	}
+	return result, nil
+}
+
+func (r *RedisClient) GetBalance(login string) (int64, error) {
+	cmd := r.client.HGet(r.formatKey("miners", login), "balance")
+	if cmd.Err() == redis.Nil {
+		return 0, nil
+	} else if cmd.Err() != nil {
+		return 0, cmd.Err()
+	}
+	return cmd.Int64()
+}
+
+// Payout threshold chosen by the miner, 0 if unset
+func (r *RedisClient) GetPayoutThreshold(login string) (int64, error) {
+	cmd := r.client.HGet(r.formatKey("miners", login), "threshold")
+	if cmd.Err() == redis.Nil {
+		return 0, nil
+	} else if cmd.Err() != nil {
+		return 0, cmd.Err()
+	}
+	return cmd.Int64()
+}
+
+// Set the miner payout threshold, 0 restores the pool default
+func (r *RedisClient) SetPayoutThreshold(login string, threshold int64) error {
+	if threshold == 0 {
+		return r.client.HDel(r.formatKey("miners", login), "threshold").Err()
+	}
+	return r.client.HSet(r.formatKey("miners", login), "threshold", strconv.FormatInt(threshold, 10)).Err()
+}
+
+// Lightning destination registered by the miner, empty if unset
+func (r *RedisClient) GetLightningDestination(login string) (string, error) {
+	dest, err := r.client.HGet(r.formatKey("miners", login), "lightning").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return dest, err
+}
+
+// Set a BOLT11 invoice, LNURL or Lightning address, empty removes the destination
+func (r *RedisClient) SetLightningDestination(login, dest string) error {
+	if len(dest) == 0 {
+		return r.client.HDel(r.formatKey("miners", login), "lightning").Err()
+	}
+	return r.client.HSet(r.formatKey("miners", login), "lightning", dest).Err()
+}
+
+// Lightning destinations of all miners who registered one
+func (r *RedisClient) GetLightningDestinations(logins []string) (map[string]string, error) {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, login := range logins {
+			tx.HGet(r.formatKey("miners", login), "lightning")
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for i, cmd := range cmds {
+		dest, err := cmd.(*redis.StringCmd).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result[logins[i]] = dest
+	}
+	return result, nil
+}
+
+// Settings a miner changes with a signed message, nil fields are left unchanged and empty ones removed
+type MinerSettings struct {
+	Threshold *int64  `json:"threshold,omitempty"`
+	Lightning *string `json:"lightning,omitempty"`
+	Webhook   *string `json:"webhook,omitempty"`
+	Email     *string `json:"email,omitempty"`
+}
+
+// Fields of miners:<login> not shown by the public API
+var privateMinerFields = []string{"lightning", "webhook", "email"}
+
+// Issue a random challenge the miner signs to prove ownership and its expiry in unix seconds.
+// A live challenge is returned instead, so nobody can replace the one a miner is signing
+func (r *RedisClient) IssueChallenge(login string, expire time.Duration) (string, int64, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", 0, err
+	}
+	challenge := hex.EncodeToString(nonce)
+	key := r.formatKey("challenge", login)
+	issued, err := r.client.SetNX(key, challenge, expire).Result()
+	if err != nil {
+		return "", 0, err
+	}
+	if issued {
+		return challenge, time.Now().Add(expire).Unix(), nil
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.Get(key)
+		tx.PTTL(key)
+		return nil
+	})
+	if err == redis.Nil {
+		// Expired meanwhile
+		return r.IssueChallenge(login, expire)
+	} else if err != nil {
+		return "", 0, err
+	}
+	return cmds[0].(*redis.StringCmd).Val(), time.Now().Add(cmds[1].(*redis.DurationCmd).Val()).Unix(), nil
+}
+
+// Live challenge of the miner, empty if none or expired
+func (r *RedisClient) GetChallenge(login string) (string, error) {
+	challenge, err := r.client.Get(r.formatKey("challenge", login)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return challenge, err
+}
+
+// Remove the challenge once it was signed, false if it expired or was taken already
+func (r *RedisClient) TakeChallenge(login, challenge string) (bool, error) {
+	key := r.formatKey("challenge", login)
+	tx, err := r.client.Watch(key)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+
+	live, err := tx.Get(key).Result()
+	if err == redis.Nil || live != challenge {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(func() error {
+		tx.Del(key)
+		return nil
+	})
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RedisClient) UpdateMinerSettings(login string, settings *MinerSettings) error {
+	fields := settings.fields()
+
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		for field, value := range fields {
+			if len(value) == 0 {
+				tx.HDel(r.formatKey("miners", login), field)
+			} else {
+				tx.HSet(r.formatKey("miners", login), field, value)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Fields of miners:<login> to set, empty ones are removed
+func (settings *MinerSettings) fields() map[string]string {
+	fields := make(map[string]string)
+	if settings.Threshold != nil {
+		fields["threshold"] = ""
+		if *settings.Threshold > 0 {
+			fields["threshold"] = strconv.FormatInt(*settings.Threshold, 10)
+		}
+	}
+	if settings.Lightning != nil {
+		fields["lightning"] = *settings.Lightning
+	}
+	if settings.Webhook != nil {
+		fields["webhook"] = *settings.Webhook
+	}
+	if settings.Email != nil {
+		fields["email"] = *settings.Email
+	}
+	return fields
+}
+
+// Payout settings and next run published by the payouts processor for the API
+type PayoutSchedule struct {
+	// Unix time of the next payout run
+	Next int64 `json:"next"`
+	// Fee rate estimate of the last run in sat/vB
+	FeeRate    float64 `json:"feeRate"`
+	MaxFeeRate float64 `json:"maxFeeRate"`
+	// Fees above the ceiling defer payouts
+	Deferred     bool  `json:"deferred"`
+	Threshold    int64 `json:"threshold"`
+	MinThreshold int64 `json:"minThreshold"`
+	// Every payee pays the fee of their own output
+	OutputFee bool `json:"outputFee"`
+	// Smallest balance paid over Lightning, 0 if Lightning payouts are disabled
+	LightningMinAmount int64 `json:"lightningMinAmount"`
+	Updated            int64 `json:"updated"`
+}
+
+// Effective threshold of a miner, custom thresholds below the pool minimum are ignored
+func (s *PayoutSchedule) PayeeThreshold(custom int64) int64 {
+	if custom > 0 && custom >= s.MinThreshold {
+		return custom
+	}
+	return s.Threshold
+}
+
+func (r *RedisClient) WritePayoutSchedule(schedule *PayoutSchedule) error {
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.formatKey("payments", "schedule"), string(data), 0).Err()
+}
+
+// Last published payout schedule, nil if payouts never ran
+func (r *RedisClient) GetPayoutSchedule() (*PayoutSchedule, error) {
+	data, err := r.client.Get(r.formatKey("payments", "schedule")).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var schedule *PayoutSchedule
+	err = json.Unmarshal([]byte(data), &schedule)
+	return schedule, err
+}
+
+// Pool wallet compared with what the pool owes, published by the payouts processor
+type Solvency struct {
+	// Confirmed, unconfirmed and immature wallet balance
+	Wallet int64 `json:"wallet"`
+	// Owed to miners
+	Balance  int64 `json:"balance"`
+	Immature int64 `json:"immature"`
+	Pending  int64 `json:"pending"`
+	// Pool fee earnings kept in the wallet
+	PoolFee int64 `json:"poolFee"`
+	// Wallet minus owed balances and pool fee, negative on a deficit
+	Surplus int64 `json:"surplus"`
+	Updated int64 `json:"updated"`
+}
+
+// Sum of miners' balance, immature and pending, added up per miner
+func (r *RedisClient) GetOwedBalances() (int64, int64, int64, error) {
+	logins, err := r.GetPayees()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var balance, immature, pending int64
+	for _, login := range logins {
+		miner, err := r.client.HGetAllMap(r.formatKey("miners", login)).Result()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		balance += parseInt64(miner["balance"])
+		immature += parseInt64(miner["immature"])
+		pending += parseInt64(miner["pending"])
+	}
+	return balance, immature, pending, nil
+}
+
+func (r *RedisClient) WriteSolvency(solvency *Solvency) error {
+	data, err := json.Marshal(solvency)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.formatKey("finances", "solvency"), string(data), 0).Err()
+}
+
+// Last published solvency, nil if never checked
+func (r *RedisClient) GetSolvency() (*Solvency, error) {
+	data, err := r.client.Get(r.formatKey("finances", "solvency")).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var solvency *Solvency
+	err = json.Unmarshal([]byte(data), &solvency)
+	return solvency, err
+}
+
+func (r *RedisClient) LockPayouts(login string, amount int64) error {
+	key := r.formatKey("payments", "lock")
+	result := r.client.SetNX(key, join(login, amount), 0).Val()
+	if !result {
+		return fmt.Errorf("Unable to acquire lock '%s'", key)
+	}
+	return nil
+}
+
+func (r *RedisClient) UnlockPayouts() error {
+	_, err := r.client.Del(r.formatKey("payments", "lock"), r.formatKey("payments", "inflight")).Result()
+	return err
+}
+
+// Reason the block unlocker halted for, it keeps running until it is cleared
+func (r *RedisClient) SetUnlockerHalt(reason string) error {
+	return r.client.Set(r.formatKey("unlocker", "halt"), reason, 0).Err()
+}
+
+// Empty if the block unlocker runs
+func (r *RedisClient) GetUnlockerHalt() (string, error) {
+	reason, err := r.client.Get(r.formatKey("unlocker", "halt")).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return reason, err
+}
+
+func (r *RedisClient) ClearUnlockerHalt() (bool, error) {
+	n, err := r.client.Del(r.formatKey("unlocker", "halt")).Result()
+	return n > 0, err
+}
+
+func (r *RedisClient) IsPayoutsLocked() (bool, error) {
+	_, err := r.client.Get(r.formatKey("payments", "lock")).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else {
+		return true, nil
+	}
+}
+
+type PendingPayment struct {
+	Timestamp int64  `json:"timestamp"`
+	Amount    int64  `json:"amount"`
+	Address   string `json:"login"`
+}
+
+func (r *RedisClient) GetPendingPayments() []*PendingPayment {
+	raw := r.client.ZRevRangeWithScores(r.formatKey("payments", "pending"), 0, -1)
+	return convertPendingPayments(raw.Val())
+}
+
+func convertPendingPayments(raw []redis.Z) []*PendingPayment {
+	var result []*PendingPayment
+	for _, v := range raw {
+		// timestamp -> "address:amount"
+		payment := PendingPayment{}
+		payment.Timestamp = int64(v.Score)
+		member := v.Member.(string)
+		i := strings.LastIndex(member, ":")
+		payment.Address = member[:i]
+		payment.Amount, _ = strconv.ParseInt(member[i+1:], 10, 64)
+		result = append(result, &payment)
+	}
+	return result
+}
+
+// Deduct miner's balance for payment
+func (r *RedisClient) UpdateBalance(login string, amount int64) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	ts := MakeTimestamp() / 1000
+
+	_, err := tx.Exec(func() error {
+		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
+		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
+		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
+		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
+		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+		r.writeTransfer(tx, EntryPayout, "", login, AccountBalance, AccountPending, amount)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) RollbackBalance(login string, amount int64) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+		r.writeTransfer(tx, EntryRollback, "", login, AccountPending, AccountBalance, amount)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	ts := MakeTimestamp() / 1000
+
+	_, err := tx.Exec(func() error {
+		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
+		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
+		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
+		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
+		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+		tx.Del(r.formatKey("payments", "lock"))
+		r.writeTransfer(tx, EntryPaid, txHash, login, AccountPending, AccountPaid, amount)
+		return nil
+	})
+	return err
+}
+
+// Record the payments batched in one transaction and release the payouts lock
+func (r *RedisClient) WritePayments(txHash string, payments map[string]int64) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		r.writePayments(tx, txHash, payments)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) writePayments(tx *redis.Multi, txHash string, payments map[string]int64) {
+	ts := MakeTimestamp() / 1000
+
+	for login, amount := range payments {
+		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
+		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
+		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
+		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
+		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+		r.writeTransfer(tx, EntryPaid, txHash, login, AccountPending, AccountPaid, amount)
+	}
+	tx.Del(r.formatKey("payments", "lock"))
+
+	// Watch the tx until it is confirmed
+	r.writePaymentTx(tx, &PaymentTx{TxId: txHash, Payments: payments, Sent: ts, Status: PaymentPending})
+}
+
+// Lightning payment sent under the payouts lock whose outcome isn't recorded yet. It stays until the payment
+// is recorded or payouts are unlocked, so a payment that timed out is looked up on the node instead of credited back
+type InFlightPayment struct {
+	Login       string `json:"login"`
+	PaymentHash string `json:"paymentHash"`
+	Amount      int64  `json:"amount"`
+	// Single use destination, removed once paid
+	Clear bool  `json:"clear"`
+	Sent  int64 `json:"sent"`
+}
+
+func (r *RedisClient) WriteInFlightPayment(payment *InFlightPayment) error {
+	data, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(r.formatKey("payments", "inflight"), string(data), 0).Err()
+}
+
+// Nil if no Lightning payment is in flight
+func (r *RedisClient) GetInFlightPayment() (*InFlightPayment, error) {
+	data, err := r.client.Get(r.formatKey("payments", "inflight")).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var payment *InFlightPayment
+	err = json.Unmarshal([]byte(data), &payment)
+	return payment, err
+}
+
+// Record a settled Lightning payment keyed by its payment hash, the routing fee is paid by the pool
+func (r *RedisClient) WriteLightningPayment(login, paymentHash string, amount, fee int64, clearDestination bool) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	ts := MakeTimestamp() / 1000
+
+	_, err := tx.Exec(func() error {
+		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
+		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
+		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(paymentHash, login, amount)})
+		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(paymentHash, amount)})
+		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+		r.writeTransfer(tx, EntryPaid, paymentHash, login, AccountPending, AccountPaid, amount)
+		r.writeLedger(tx, EntryFee, paymentHash, "Lightning routing fee", networkFeePostings(fee)...)
+		// Invoices are single use
+		if clearDestination {
+			tx.HDel(r.formatKey("miners", login), "lightning")
+		}
+		tx.Del(r.formatKey("payments", "lock"), r.formatKey("payments", "inflight"))
+		r.writePaymentTx(tx, &PaymentTx{
+			TxId:      paymentHash,
+			Payments:  map[string]int64{login: amount},
+			Sent:      ts,
+			Status:    PaymentConfirmed,
+			Lightning: true,
+			Fee:       fee,
+		})
+		return nil
+	})
+	return err
+}
+
+const (
+	PaymentPending    = "pending"
+	PaymentConfirmed  = "confirmed"
+	PaymentReplaced   = "replaced"
+	PaymentConflicted = "conflicted"
+)
+
+// Payout transaction tracked until it is confirmed deep enough
+type PaymentTx struct {
+	TxId          string           `json:"txid"`
+	Payments      map[string]int64 `json:"payments"`
+	Sent          int64            `json:"sent"`
+	Status        string           `json:"status"`
+	Confirmations int64            `json:"confirmations"`
+	// Txs this one replaced by fee bumps, oldest first
+	Replaces   []string `json:"replaces,omitempty"`
+	ReplacedBy string   `json:"replacedBy,omitempty"`
+	// CPFP children paying for this tx, each spends the output of the one before, oldest first
+	Children []string `json:"children,omitempty"`
+	Bumped   int64    `json:"bumped,omitempty"`
+	// Paid over Lightning, TxId is the payment hash
+	Lightning bool `json:"lightning,omitempty"`
+	// Lightning routing fee in Satoshi
+	Fee int64 `json:"fee,omitempty"`
+}
+
+func (r *RedisClient) writePaymentTx(tx *redis.Multi, ptx *PaymentTx) {
+	data, _ := json.Marshal(ptx)
+	tx.HSet(r.formatKey("payments", "txs"), ptx.TxId, string(data))
+	if ptx.Status == PaymentPending {
+		tx.SAdd(r.formatKey("payments", "unconfirmed"), ptx.TxId)
+	} else {
+		tx.SRem(r.formatKey("payments", "unconfirmed"), ptx.TxId)
+	}
+}
+
+// Payout txs not yet confirmed deep enough
+func (r *RedisClient) GetUnconfirmedPayments() ([]*PaymentTx, error) {
+	txIds, err := r.client.SMembers(r.formatKey("payments", "unconfirmed")).Result()
+	if err != nil || len(txIds) == 0 {
+		return nil, err
+	}
+	txs, err := r.GetPaymentTxs(txIds)
+	if err != nil {
+		return nil, err
+	}
+	return sortPaymentTxs(txIds, txs), nil
+}
+
+// Tracked payout txs by id, unknown ids are left out
+func (r *RedisClient) GetPaymentTxs(txIds []string) (map[string]*PaymentTx, error) {
+	result := make(map[string]*PaymentTx)
+	if len(txIds) == 0 {
+		return result, nil
+	}
+	values, err := r.client.HMGet(r.formatKey("payments", "txs"), txIds...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var ptx *PaymentTx
+		err = json.Unmarshal([]byte(data), &ptx)
+		if err != nil {
+			return nil, err
+		}
+		result[ptx.TxId] = ptx
+	}
+	return result, nil
+}
+
+// Payout txs ordered by the time they were sent
+func sortPaymentTxs(txIds []string, txs map[string]*PaymentTx) []*PaymentTx {
+	var result []*PaymentTx
+	for _, txId := range txIds {
+		if ptx, ok := txs[txId]; ok {
+			result = append(result, ptx)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Sent < result[j].Sent })
+	return result
+}
+
+func (r *RedisClient) UpdatePaymentTx(ptx *PaymentTx) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		r.writePaymentTx(tx, ptx)
+		return nil
+	})
+	return err
+}
+
+// Move the payments of a fee bumped tx to its replacement and track the replacement instead
+func (r *RedisClient) ReplacePaymentTx(ptx *PaymentTx, txHash string) (*PaymentTx, error) {
+	replacement := ptx.replace(txHash)
+
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		for login, amount := range ptx.Payments {
+			tx.ZRem(r.formatKey("payments", "all"), join(ptx.TxId, login, amount))
+			tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ptx.Sent), Member: join(txHash, login, amount)})
+			tx.ZRem(r.formatKey("payments", login), join(ptx.TxId, amount))
+			tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ptx.Sent), Member: join(txHash, amount)})
+		}
+		r.writePaymentTx(tx, ptx)
+		r.writePaymentTx(tx, replacement)
+		return nil
+	})
+	return replacement, err
 }
 
-func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
-	result := make(map[string]int64)
-	cmd := r.client.HGetAllMap(r.formatRound(height, nonce))
-	if cmd.Err() != nil {
-		return nil, cmd.Err()
-	}
-	sharesMap, _ := cmd.Result()
-	for login, v := range sharesMap {
-		n, _ := strconv.ParseInt(v, 10, 64)
-		result[login] = n
+// Mark the tx replaced and return its replacement paying the same payments
+func (ptx *PaymentTx) replace(txHash string) *PaymentTx {
+	replacement := &PaymentTx{
+		TxId:     txHash,
+		Payments: ptx.Payments,
+		Sent:     ptx.Sent,
+		Status:   PaymentPending,
+		Replaces: append(append([]string{}, ptx.Replaces...), ptx.TxId),
+		Bumped:   MakeTimestamp() / 1000,
 	}
-	return result, nil
+	ptx.Status = PaymentReplaced
+	ptx.ReplacedBy = txHash
+	return replacement
 }
 
-func (r *RedisClient) GetPayees() ([]string, error) {
-	payees := make(map[string]struct{})
-	var result []string
-	var c int64
-
-	for {
-		var keys []string
-		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
-		if err != nil {
-			return nil, err
+// Add the tracking status to payments of tracked txs
+func annotatePayments(backend PaymentsBackend, payments []map[string]interface{}) error {
+	txIds := make([]string, len(payments))
+	for i, payment := range payments {
+		txIds[i] = payment["tx"].(string)
+	}
+	txs, err := backend.GetPaymentTxs(txIds)
+	if err != nil {
+		return err
+	}
+	for _, payment := range payments {
+		ptx, ok := txs[payment["tx"].(string)]
+		if !ok {
+			continue
 		}
-		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
-			payees[login] = struct{}{}
+		payment["status"] = ptx.Status
+		payment["confirmations"] = ptx.Confirmations
+		if len(ptx.Replaces) > 0 {
+			payment["replaces"] = ptx.Replaces
 		}
-		if c == 0 {
-			break
+		if ptx.Lightning {
+			payment["lightning"] = true
 		}
 	}
-	for login, _ := range payees {
-		result = append(result, login)
-	}
-	return result, nil
+	return nil
 }
 
-func (r *RedisClient) GetBalance(login string) (int64, error) {
-	cmd := r.client.HGet(r.formatKey("miners", login), "balance")
-	if cmd.Err() == redis.Nil {
-		return 0, nil
-	} else if cmd.Err() != nil {
-		return 0, cmd.Err()
-	}
-	return cmd.Int64()
+// Payout batch waiting for an offline signature, its balances stay pending until broadcast
+type PayoutBatch struct {
+	Id         string           `json:"id"`
+	Psbt       string           `json:"psbt"`
+	SignedPsbt string           `json:"signedPsbt,omitempty"`
+	TxId       string           `json:"txid"`
+	Inputs     []string         `json:"inputs"`
+	Payments   map[string]int64 `json:"payments"`
+	Fee        int64            `json:"fee"`
+	Created    int64            `json:"created"`
+	// Abandoned batches this one conflicts with
+	Conflicts []string `json:"conflicts,omitempty"`
+	// Why the last signed PSBT was refused
+	Failed string `json:"failed,omitempty"`
 }
 
-func (r *RedisClient) LockPayouts(login string, amount int64) error {
-	key := r.formatKey("payments", "lock")
-	result := r.client.SetNX(key, join(login, amount), 0).Val()
-	if !result {
-		return fmt.Errorf("Unable to acquire lock '%s'", key)
+func (r *RedisClient) WritePayoutBatch(batch *PayoutBatch) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	ok, err := r.client.SetNX(r.formatKey("payments", "batch"), string(data), 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("another payout batch is pending")
 	}
 	return nil
 }
 
-func (r *RedisClient) UnlockPayouts() error {
-	key := r.formatKey("payments", "lock")
-	_, err := r.client.Del(key).Result()
-	return err
-}
-
-func (r *RedisClient) IsPayoutsLocked() (bool, error) {
-	_, err := r.client.Get(r.formatKey("payments", "lock")).Result()
+// Pending payout batch, nil if there is none
+func (r *RedisClient) GetPayoutBatch() (*PayoutBatch, error) {
+	data, err := r.client.Get(r.formatKey("payments", "batch")).Result()
 	if err == redis.Nil {
-		return false, nil
+		return nil, nil
 	} else if err != nil {
-		return false, err
-	} else {
-		return true, nil
+		return nil, err
 	}
+	var batch *PayoutBatch
+	err = json.Unmarshal([]byte(data), &batch)
+	return batch, err
 }
 
-type PendingPayment struct {
-	Timestamp int64  `json:"timestamp"`
-	Amount    int64  `json:"amount"`
-	Address   string `json:"login"`
+// Attach the signed PSBT to the pending batch, the payouts processor broadcasts it
+func (r *RedisClient) SubmitSignedPsbt(id, psbt string) error {
+	return r.updatePayoutBatch(id, func(batch *PayoutBatch) {
+		batch.SignedPsbt = psbt
+		batch.Failed = ""
+	})
 }
 
-func (r *RedisClient) GetPendingPayments() []*PendingPayment {
-	raw := r.client.ZRevRangeWithScores(r.formatKey("payments", "pending"), 0, -1)
-	var result []*PendingPayment
-	for _, v := range raw.Val() {
-		// timestamp -> "address:amount"
-		payment := PendingPayment{}
-		payment.Timestamp = int64(v.Score)
-		fields := strings.Split(v.Member.(string), ":")
-		payment.Address = fields[0]
-		payment.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
-		result = append(result, &payment)
-	}
-	return result
+// Drop the signed PSBT of the pending batch with the reason it failed, the batch waits for a new one
+func (r *RedisClient) FailSignedPsbt(id, reason string) error {
+	return r.updatePayoutBatch(id, func(batch *PayoutBatch) {
+		batch.SignedPsbt = ""
+		batch.Failed = reason
+	})
 }
 
-// Deduct miner's balance for payment
-func (r *RedisClient) UpdateBalance(login string, amount int64) error {
-	tx := r.client.Multi()
+func (r *RedisClient) updatePayoutBatch(id string, update func(batch *PayoutBatch)) error {
+	key := r.formatKey("payments", "batch")
+	tx, err := r.client.Watch(key)
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	ts := MakeTimestamp() / 1000
-
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
-		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
-		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+	data, err := tx.Get(key).Result()
+	if err == redis.Nil {
+		return errors.New("no pending payout batch")
+	} else if err != nil {
+		return err
+	}
+	var batch PayoutBatch
+	err = json.Unmarshal([]byte(data), &batch)
+	if err != nil {
+		return err
+	}
+	if batch.Id != id {
+		return fmt.Errorf("payout batch %s is not pending", id)
+	}
+	update(&batch)
+	updated, err := json.Marshal(&batch)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(func() error {
+		tx.Set(key, string(updated), 0)
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) RollbackBalance(login string, amount int64) error {
+// Record the payments of a broadcast batch, drop the batch and the abandoned batches it conflicted with
+func (r *RedisClient) CompletePayoutBatch(txHash string, batch *PayoutBatch) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
 	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+		r.writePayments(tx, txHash, batch.Payments)
+		tx.Del(r.formatKey("payments", "batch"))
+		for _, id := range batch.Conflicts {
+			tx.HDel(r.formatKey("payments", "abandoned"), id)
+		}
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
+// Credit back the balances of a batch that was never broadcast and remember its inputs,
+// the next batch must spend one of them so the two can't both confirm
+func (r *RedisClient) AbandonPayoutBatch(batch *PayoutBatch) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
-	ts := MakeTimestamp() / 1000
-
 	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+		for login, amount := range batch.Payments {
+			tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+			tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+			tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+			tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+			tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+			r.writeTransfer(tx, EntryRollback, batch.Id, login, AccountPending, AccountBalance, amount)
+		}
+		tx.HSet(r.formatKey("payments", "abandoned"), batch.Id, strings.Join(batch.Inputs, ","))
+		tx.Del(r.formatKey("payments", "batch"))
 		tx.Del(r.formatKey("payments", "lock"))
 		return nil
 	})
 	return err
 }
 
+// Inputs of abandoned batches not yet conflicted by a broadcast batch
+func (r *RedisClient) GetAbandonedBatches() (map[string][]string, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("payments", "abandoned"))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	result := make(map[string][]string)
+	for id, inputs := range cmd.Val() {
+		result[id] = strings.Split(inputs, ",")
+	}
+	return result, nil
+}
+
 func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
+	block.Transition(BlockImmature)
 	_, err := tx.Exec(func() error {
 		r.writeImmatureBlock(tx, block)
 		total := int64(0)
+		var postings []Posting
 		for login, amount := range roundRewards {
 			total += amount
 			tx.HIncrBy(r.formatKey("miners", login), "immature", amount)
 			tx.HSetNX(r.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+			postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: amount})
 		}
 		tx.HIncrBy(r.formatKey("finances"), "immature", total)
+		postings = append(postings, Posting{Account: AccountBlocks, Amount: -total})
+		r.writeLedger(tx, EntryImmature, join(block.Height, block.Hash), "", sortPostings(postings)...)
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
+// reserve is the part of the block revenue kept for the pool risk reserve
+func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, reserve int64) error {
 	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
 	tx, err := r.client.Watch(creditKey)
-	// Must decrement immatures using existing log entry
-	immatureCredits := tx.HGetAllMap(creditKey)
 	if err != nil {
 		return err
 	}
+	// Must decrement immatures using existing log entry
+	immatureCredits := tx.HGetAllMap(creditKey)
 	defer tx.Close()
 
 	ts := MakeTimestamp() / 1000
 	value := join(block.Hash, ts, block.Reward)
 
+	block.Transition(BlockMatured)
 	_, err = tx.Exec(func() error {
 		r.writeMaturedBlock(tx, block)
 		tx.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
 
 		// Decrement immature balances
 		totalImmature := int64(0)
+		var postings []Posting
 		for login, amountString := range immatureCredits.Val() {
 			amount, _ := strconv.ParseInt(amountString, 10, 64)
 			totalImmature += amount
 			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
+			postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: -amount})
 		}
 
 		// Increment balances
@@ -528,13 +1618,30 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 			// NOTICE: Maybe expire round reward entry in 604800 (a week)?
 			tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
 			tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+			postings = append(postings, Posting{Account: MinerAccount(AccountBalance, login), Amount: amount})
+		}
+		// Immature credits go back to the block, which pays balances, reserve and the pool fee
+		revenue := block.RewardInSatoshi()
+		if block.ExtraReward != nil {
+			revenue += block.ExtraReward.Int64()
 		}
+		postings = append(sortPostings(postings),
+			Posting{Account: AccountBlocks, Amount: totalImmature - revenue},
+			Posting{Account: AccountReserve, Amount: reserve},
+			Posting{Account: AccountPoolFee, Amount: revenue - total - reserve})
+		r.writeLedger(tx, EntryCredit, join(block.Height, block.Hash), "", postings...)
 		tx.Del(creditKey)
+		for _, utxo := range block.CoinBaseOutputs {
+			r.writeUTXO(tx, utxo)
+		}
 		tx.HIncrBy(r.formatKey("finances"), "balance", total)
 		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
 		tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
 		tx.HSet(r.formatKey("finances"), "lastCreditHash", block.Hash)
 		tx.HIncrBy(r.formatKey("finances"), "totalMined", block.RewardInSatoshi())
+		if reserve != 0 {
+			tx.HIncrBy(r.formatKey("finances"), "reserve", reserve)
+		}
 		return nil
 	})
 	return err
@@ -543,36 +1650,167 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 func (r *RedisClient) WriteOrphan(block *BlockData) error {
 	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
 	tx, err := r.client.Watch(creditKey)
-	// Must decrement immatures using existing log entry
-	immatureCredits := tx.HGetAllMap(creditKey)
 	if err != nil {
 		return err
 	}
+	// Must decrement immatures using existing log entry
+	immatureCredits := tx.HGetAllMap(creditKey)
 	defer tx.Close()
 
+	block.Transition(BlockOrphaned)
 	_, err = tx.Exec(func() error {
 		r.writeMaturedBlock(tx, block)
 
 		// Decrement immature balances
 		totalImmature := int64(0)
+		var postings []Posting
 		for login, amountString := range immatureCredits.Val() {
 			amount, _ := strconv.ParseInt(amountString, 10, 64)
 			totalImmature += amount
 			tx.HIncrBy(r.formatKey("miners", login), "immature", (amount * -1))
+			postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: -amount})
 		}
 		tx.Del(creditKey)
 		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
+		postings = append(sortPostings(postings), Posting{Account: AccountBlocks, Amount: totalImmature})
+		r.writeLedger(tx, EntryOrphan, join(block.Height, block.Hash), "", postings...)
 		return nil
 	})
 	return err
 }
 
+// Take back the credits of a matured block that left the main chain, balances already paid out go negative.
+// Returns the total taken from miner balances
+func (r *RedisClient) WriteReorg(block *BlockData) (int64, error) {
+	for i := 0; i < 3; i++ {
+		total, err := r.writeReorg(block)
+		if err != redis.TxFailedErr {
+			return total, err
+		}
+	}
+	return 0, redis.TxFailedErr
+}
+
+func (r *RedisClient) writeReorg(block *BlockData) (int64, error) {
+	ref := join(block.Height, block.Hash)
+	creditKey := r.formatKey("credits", block.Height, block.Hash)
+	// The credit entry is found through the index, PPS credits append to the ledger without touching it
+	tx, err := r.client.Watch(creditKey, r.formatKey("credits", "all"), r.formatKey("ledger", "index"),
+		r.formatKey("utxos"))
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	credit, err := r.findLedgerEntry(EntryCredit, ref)
+	if err != nil {
+		return 0, err
+	}
+	var credits map[string]string
+	if credit == nil {
+		// Matured before the ledger, only the miner credits are known
+		credits, err = r.client.HGetAllMap(creditKey).Result()
+		if err != nil {
+			return 0, err
+		}
+	}
+	postings, total, reserve := reorgPostings(credit, credits)
+	utxos, err := r.GetUTXOs()
+	if err != nil {
+		return 0, err
+	}
+	var spent []string
+	for _, utxo := range utxos {
+		if utxo.Coinbase && utxo.Height == block.Height {
+			spent = append(spent, utxo.Outpoint())
+		}
+	}
+	allCredits, err := r.client.ZRangeByScore(r.formatKey("credits", "all"), redis.ZRangeByScore{
+		Min: strconv.FormatInt(block.Height, 10), Max: strconv.FormatInt(block.Height, 10)}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	block.Transition(BlockOrphaned)
+	_, err = tx.Exec(func() error {
+		for _, p := range postings {
+			if kind, login, ok := ParseMinerAccount(p.Account); ok && kind == AccountBalance {
+				tx.HIncrBy(r.formatKey("miners", login), "balance", p.Amount)
+			}
+		}
+		tx.ZRem(r.formatKey("blocks", "matured"), block.member)
+		tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
+		for _, v := range allCredits {
+			if strings.HasPrefix(v, block.Hash+":") {
+				tx.ZRem(r.formatKey("credits", "all"), v)
+			}
+		}
+		tx.Del(creditKey)
+		if len(spent) > 0 {
+			tx.HDel(r.formatKey("utxos"), spent...)
+		}
+		tx.HIncrBy(r.formatKey("finances"), "balance", -total)
+		tx.HIncrBy(r.formatKey("finances"), "totalMined", -block.RewardInSatoshi())
+		if reserve != 0 {
+			tx.HIncrBy(r.formatKey("finances"), "reserve", -reserve)
+		}
+		r.writeLedger(tx, EntryReorg, ref, "block left the main chain", postings...)
+		return nil
+	})
+	return total, err
+}
+
+// Postings reversing the credit entry of a block, or its miner credits if it matured before the ledger.
+// Returns them with the totals taken from miner balances and from the reserve
+func reorgPostings(credit *LedgerEntry, credits map[string]string) ([]Posting, int64, int64) {
+	var postings []Posting
+	if credit != nil {
+		// Reverse the credit, immature postings were settled by the block maturing and
+		// the block account gets back the whole revenue
+		settled := int64(0)
+		for _, p := range credit.Postings {
+			if kind, _, ok := ParseMinerAccount(p.Account); ok && kind == AccountImmature {
+				settled += p.Amount
+				continue
+			}
+			postings = append(postings, Posting{Account: p.Account, Amount: -p.Amount})
+		}
+		blocks := Posting{Account: AccountBlocks, Amount: -settled}
+		for i := 0; i < len(postings); i++ {
+			if postings[i].Account == AccountBlocks {
+				blocks.Amount += postings[i].Amount
+				postings = append(postings[:i], postings[i+1:]...)
+				i--
+			}
+		}
+		postings = append(postings, blocks)
+	} else {
+		for login, amountString := range credits {
+			amount, _ := strconv.ParseInt(amountString, 10, 64)
+			postings = append(postings, Posting{Account: MinerAccount(AccountBalance, login), Amount: -amount})
+		}
+	}
+	total, reserve := int64(0), int64(0)
+	for _, p := range postings {
+		if kind, _, ok := ParseMinerAccount(p.Account); ok && kind == AccountBalance {
+			total -= p.Amount
+		} else if p.Account == AccountReserve {
+			reserve -= p.Amount
+		}
+	}
+	if credit == nil {
+		postings = append(postings, Posting{Account: AccountBlocks, Amount: total})
+	}
+	return postings, total, reserve
+}
+
 func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
 	_, err := tx.Exec(func() error {
 		for _, block := range blocks {
+			block.Transition(BlockOrphaned)
 			r.writeImmatureBlock(tx, block)
 		}
 		return nil
@@ -585,13 +1823,87 @@ func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
 	if block.Height != block.RoundHeight {
 		tx.Rename(r.formatRound(block.RoundHeight, block.Nonce), r.formatRound(block.Height, block.Nonce))
 	}
-	tx.ZRem(r.formatKey("blocks", "candidates"), block.candidateKey)
+	tx.ZRem(r.formatKey("blocks", "candidates"), block.member)
 	tx.ZAdd(r.formatKey("blocks", "immature"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
 
+// Wallet output tracked by the payouts, matured coinbase outputs are recorded with their block
+type UTXO struct {
+	TxId    string `json:"txid"`
+	Vout    uint32 `json:"vout"`
+	Value   int64  `json:"value"`
+	Address string `json:"address,omitempty"`
+	// Block height, of change and other wallet outputs the height their confirmations date them at
+	Height   int64 `json:"height"`
+	Coinbase bool  `json:"coinbase"`
+}
+
+func (u *UTXO) Outpoint() string {
+	return u.TxId + ":" + strconv.FormatUint(uint64(u.Vout), 10)
+}
+
+func (r *RedisClient) writeUTXO(tx *redis.Multi, utxo *UTXO) {
+	data, _ := json.Marshal(utxo)
+	tx.HSet(r.formatKey("utxos"), utxo.Outpoint(), string(data))
+}
+
+func (r *RedisClient) GetUTXOs() ([]*UTXO, error) {
+	values, err := r.client.HGetAllMap(r.formatKey("utxos")).Result()
+	if err != nil {
+		return nil, err
+	}
+	var result []*UTXO
+	for _, data := range values {
+		var utxo *UTXO
+		err = json.Unmarshal([]byte(data), &utxo)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, utxo)
+	}
+	return result, nil
+}
+
+// Track new wallet outputs and forget spent ones
+func (r *RedisClient) ReconcileUTXOs(add []*UTXO, remove []string) error {
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		for _, utxo := range add {
+			r.writeUTXO(tx, utxo)
+		}
+		if len(remove) > 0 {
+			tx.HDel(r.formatKey("utxos"), remove...)
+		}
+		return nil
+	})
+	return err
+}
+
+// Rename the round of a block that moved to another height
+func (r *RedisClient) moveRound(block *BlockData) error {
+	if block.Height == block.RoundHeight {
+		return nil
+	}
+	return r.client.Rename(r.formatRound(block.RoundHeight, block.Nonce), r.formatRound(block.Height, block.Nonce)).Err()
+}
+
+// Drop the shares of a settled round
+func (r *RedisClient) deleteRound(block *BlockData) error {
+	return r.client.Del(r.formatRound(block.RoundHeight, block.Nonce), r.formatPPLNSRound(block.RoundHeight, block.Nonce),
+		r.formatScoreRound(block.RoundHeight, block.Nonce), r.formatShareLog(block.RoundHeight, block.Nonce)).Err()
+}
+
 func (r *RedisClient) writeMaturedBlock(tx *redis.Multi, block *BlockData) {
 	tx.Del(r.formatRound(block.RoundHeight, block.Nonce))
-	tx.ZRem(r.formatKey("blocks", "immature"), block.immatureKey)
+	tx.Del(r.formatPPLNSRound(block.RoundHeight, block.Nonce))
+	tx.Del(r.formatScoreRound(block.RoundHeight, block.Nonce))
+	tx.Del(r.formatShareLog(block.RoundHeight, block.Nonce))
+	tx.ZRem(r.formatKey("blocks", "immature"), block.member)
 	tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
 
@@ -617,8 +1929,15 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
 		return nil, err
 	} else {
 		result, _ := cmds[0].(*redis.StringStringMapCmd).Result()
+		for _, field := range privateMinerFields {
+			delete(result, field)
+		}
 		stats["stats"] = convertStringMap(result)
-		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd))
+		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd).Val())
+		err = annotatePayments(r, payments)
+		if err != nil {
+			return nil, err
+		}
 		stats["payments"] = payments
 		stats["paymentsTotal"] = cmds[2].(*redis.IntCmd).Val()
 		roundShares, _ := cmds[3].(*redis.StringCmd).Int64()
@@ -674,7 +1993,7 @@ func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64,
 			return total, err
 		}
 		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
+			login := strings.TrimPrefix(row, r.formatKey("hashrate")+":")
 			if _, ok := miners[login]; !ok {
 				n, err := r.client.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", max).Result()
 				if err != nil {
@@ -713,6 +2032,7 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 		tx.ZCard(r.formatKey("blocks", "matured"))
 		tx.ZCard(r.formatKey("payments", "all"))
 		tx.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, maxPayments-1)
+		tx.HGetAllMap(r.formatKey("finances"))
 		return nil
 	})
 
@@ -722,23 +2042,29 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 
 	result, _ := cmds[2].(*redis.StringStringMapCmd).Result()
 	stats["stats"] = convertStringMap(result)
-	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
+	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd).Val())
 	stats["candidates"] = candidates
 	stats["candidatesTotal"] = cmds[6].(*redis.IntCmd).Val()
 
-	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
+	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd).Val())
 	stats["immature"] = immature
 	stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
 
-	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
+	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd).Val())
 	stats["matured"] = matured
 	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
 
-	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
+	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd).Val())
+	err = annotatePayments(r, payments)
+	if err != nil {
+		return nil, err
+	}
 	stats["payments"] = payments
 	stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
+	finances, _ := cmds[11].(*redis.StringStringMapCmd).Result()
+	stats["reserve"], _ = strconv.ParseInt(finances["reserve"], 10, 64)
 
-	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
+	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd).Val())
 	stats["miners"] = miners
 	stats["minersTotal"] = len(miners)
 	stats["hashrate"] = totalHashrate
@@ -748,7 +2074,6 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error) {
 	smallWindow := int64(sWindow / time.Second)
 	largeWindow := int64(lWindow / time.Second)
-	stats := make(map[string]interface{})
 
 	tx := r.client.Multi()
 	defer tx.Close()
@@ -765,11 +2090,18 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 		return nil, err
 	}
 
+	return workersStats(smallWindow, largeWindow, cmds[1].(*redis.ZSliceCmd).Val()), nil
+}
+
+// Hashrate of the workers of a miner over both windows from its hashrate entries
+func workersStats(smallWindow, largeWindow int64, raw []redis.Z) map[string]interface{} {
+	stats := make(map[string]interface{})
+	now := MakeTimestamp() / 1000
 	totalHashrate := int64(0)
 	currentHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
-	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
+	workers := convertWorkersStats(smallWindow, raw)
 
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
@@ -806,7 +2138,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
-	return stats, nil
+	return stats
 }
 
 func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
@@ -825,18 +2157,21 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 	if err != nil {
 		return stats, err
 	}
-	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd), cmds[1].(*redis.ZSliceCmd))
+	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd).Val(), cmds[1].(*redis.ZSliceCmd).Val())
+	return luckStats(blocks, windows), nil
+}
+
+// Luck and orphan rate of the latest blocks over each window, the windows longer than all blocks are left out
+func luckStats(blocks []*BlockData, windows []int) map[string]interface{} {
+	stats := make(map[string]interface{})
 
-	calcLuck := func(max int) (int, float64, float64, float64) {
+	calcLuck := func(max int) (int, float64, float64) {
 		var total int
-		var sharesDiff, uncles, orphans float64
+		var sharesDiff, orphans float64
 		for i, block := range blocks {
 			if i > (max - 1) {
 				break
 			}
-			if block.Uncle {
-				uncles++
-			}
 			if block.Orphan {
 				orphans++
 			}
@@ -845,85 +2180,30 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 		}
 		if total > 0 {
 			sharesDiff /= float64(total)
-			uncles /= float64(total)
 			orphans /= float64(total)
 		}
-		return total, sharesDiff, uncles, orphans
+		return total, sharesDiff, orphans
 	}
 	for _, max := range windows {
-		total, sharesDiff, uncleRate, orphanRate := calcLuck(max)
+		total, sharesDiff, orphanRate := calcLuck(max)
 		row := map[string]float64{
-			"luck": sharesDiff, "uncleRate": uncleRate, "orphanRate": orphanRate,
+			"luck": sharesDiff, "orphanRate": orphanRate,
 		}
 		stats[strconv.Itoa(total)] = row
 		if total < max {
 			break
 		}
 	}
-	return stats, nil
-}
-
-func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
-	var result []*BlockData
-	for _, v := range raw.Val() {
-		// "nonce:eNonce1:eNonce2:timestamp:diff:totalShares:coinBaseValue:blkTotalFee"
-		block := BlockData{}
-		block.Height = int64(v.Score)
-		block.RoundHeight = block.Height
-		fields := strings.Split(v.Member.(string), ":")
-		block.Nonce = fields[0]
-		block.ENonce1 = fields[1]
-		block.ENonce2 = fields[2]
-		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
-		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
-		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
-		coinBaseValue, _ := strconv.ParseInt(fields[6], 10, 64)
-		block.CoinBaseValue = big.NewInt(coinBaseValue)
-		blkTotalFee, _ := strconv.ParseInt(fields[7], 10, 64)
-		block.BlkTotalFee = big.NewInt(blkTotalFee)
-		block.candidateKey = v.Member.(string)
-		result = append(result, &block)
-	}
-	return result
-}
-
-func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
-	var result []*BlockData
-	for _, row := range rows {
-		for _, v := range row.Val() {
-			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:coinBaseValue:blkTotalFee:rewardInSatoshi"
-			block := BlockData{}
-			block.Height = int64(v.Score)
-			block.RoundHeight = block.Height
-			fields := strings.Split(v.Member.(string), ":")
-			block.UncleHeight = 0
-			block.Uncle = false
-			block.Orphan, _ = strconv.ParseBool(fields[1])
-			block.Nonce = fields[2]
-			block.Hash = fields[3]
-			block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
-			block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
-			block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
-
-			block.CoinBaseValue, _ = new(big.Int).SetString(fields[7], 10)
-			block.BlkTotalFee, _ = new(big.Int).SetString(fields[8], 10)
-
-			block.RewardString = fields[9]
-			block.ImmatureReward = fields[9]
-			block.immatureKey = v.Member.(string)
-			result = append(result, &block)
-		}
-	}
-	return result
+	return stats
 }
 
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
 // TS => diff, id, ms
-func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
+func convertWorkersStats(window int64, raw []redis.Z) map[string]Worker {
 	now := MakeTimestamp() / 1000
 	workers := make(map[string]Worker)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -949,12 +2229,12 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
 	return workers
 }
 
-func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
+func convertMinersStats(window int64, raw []redis.Z) (int64, map[string]Miner) {
 	now := MakeTimestamp() / 1000
 	miners := make(map[string]Miner)
 	totalHashrate := int64(0)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -992,19 +2272,17 @@ func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]M
 	return totalHashrate, miners
 }
 
-func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
+func convertPaymentsResults(raw []redis.Z) []map[string]interface{} {
 	var result []map[string]interface{}
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		tx := make(map[string]interface{})
 		tx["timestamp"] = int64(v.Score)
 		fields := strings.Split(v.Member.(string), ":")
 		tx["tx"] = fields[0]
-		// Individual or whole payments row
-		if len(fields) < 3 {
-			tx["amount"], _ = strconv.ParseInt(fields[1], 10, 64)
-		} else {
-			tx["address"] = fields[1]
-			tx["amount"], _ = strconv.ParseInt(fields[2], 10, 64)
+		// Individual or whole payments row, cashaddr logins contain colons
+		tx["amount"], _ = strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if len(fields) > 2 {
+			tx["address"] = strings.Join(fields[1:len(fields)-1], ":")
 		}
 		result = append(result, tx)
 	}
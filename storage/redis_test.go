@@ -1,11 +1,14 @@
 package storage
 
 import (
+	"math"
 	"os"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
+	. "github.com/PowPool/btcpool/util"
 	"gopkg.in/redis.v3"
 )
 
@@ -24,23 +27,23 @@ func TestMain(m *testing.M) {
 func TestWriteShareCheckExist(t *testing.T) {
 	reset()
 
-	exist, _ := r.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0)
+	exist, _ := r.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0, ShareAccounting{})
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x1", "0x0"}, 10, 1008, 0)
+	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x1", "0x0"}, 10, 1008, 0, ShareAccounting{})
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1010, 0)
+	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1010, 0, ShareAccounting{})
 	if exist {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("z", "x", []string{"0x0", "0x0", "0x1"}, 100, 1016, 0)
+	exist, _ = r.WriteShare("z", "x", []string{"0x0", "0x0", "0x1"}, 100, 1016, 0, ShareAccounting{})
 	if !exist {
 		t.Error("PoW must exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1025, 0)
+	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1025, 0, ShareAccounting{})
 	if exist {
 		t.Error("PoW must not exist")
 	}
@@ -292,32 +295,31 @@ func TestGetPendingPayments(t *testing.T) {
 func TestCollectLuckStats(t *testing.T) {
 	reset()
 
-	members := []redis.Z{
-		redis.Z{Score: 0, Member: "1:0:0x0:0x0:0:100:100:0"},
+	block := func(height, diff, shares int64, orphan bool) redis.Z {
+		b := &BlockData{Height: height, Difficulty: diff, TotalShares: shares}
+		if orphan {
+			b.Transition(BlockOrphaned)
+		}
+		return redis.Z{Score: float64(height), Member: b.key()}
 	}
-	r.client.ZAdd(r.formatKey("blocks:immature"), members...)
-	members = []redis.Z{
-		redis.Z{Score: 1, Member: "1:0:0x2:0x0:0:50:100:0"},
-		redis.Z{Score: 2, Member: "0:1:0x1:0x0:0:100:100:0"},
-		redis.Z{Score: 3, Member: "0:0:0x3:0x0:0:200:100:0"},
-	}
-	r.client.ZAdd(r.formatKey("blocks:matured"), members...)
+	r.client.ZAdd(r.formatKey("blocks:immature"), block(0, 100, 100, false))
+	r.client.ZAdd(r.formatKey("blocks:matured"), block(1, 50, 100, false), block(2, 100, 100, true), block(3, 200, 100, false))
 
 	stats, _ := r.CollectLuckStats([]int{1, 2, 5, 10})
 	expectedStats := map[string]interface{}{
 		"1": map[string]float64{
-			"luck": 1, "uncleRate": 1, "orphanRate": 0,
+			"luck": 1, "orphanRate": 0,
 		},
 		"2": map[string]float64{
-			"luck": 0.75, "uncleRate": 0.5, "orphanRate": 0,
+			"luck": 0.75, "orphanRate": 0,
 		},
 		"4": map[string]float64{
-			"luck": 1.125, "uncleRate": 0.5, "orphanRate": 0.25,
+			"luck": 1.125, "orphanRate": 0.25,
 		},
 	}
 
 	if !reflect.DeepEqual(stats, expectedStats) {
-		t.Error("Stats != expected stats")
+		t.Errorf("Stats %v != expected stats", stats)
 	}
 }
 
@@ -327,3 +329,335 @@ func reset() {
 		r.client.Del(k)
 	}
 }
+
+func TestStratumSessionResume(t *testing.T) {
+	reset()
+
+	ss := &StratumSession{ExtraNonce1: "00010002", ExtraNonce2Size: 4, Target: "00ff", Login: "x", Id: "rig", Authorized: true, Node: "pool1"}
+	err := r.WriteStratumSession("sid", ss, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, _ := r.TakeStratumSession("sid")
+	if !reflect.DeepEqual(ss, resumed) {
+		t.Errorf("Invalid resumed session: %v", resumed)
+	}
+	resumed, _ = r.TakeStratumSession("sid")
+	if resumed != nil {
+		t.Error("Session must be resumed only once")
+	}
+
+	_ = r.LeaseExtraNonce("00010002", "pool1", time.Minute)
+	leased, _ := r.IsExtraNonceLeased("00010002")
+	if !leased {
+		t.Error("Extranonce must be leased")
+	}
+}
+
+func TestPPLNSWindowSnapshot(t *testing.T) {
+	reset()
+
+	r.WriteShare("x", "1", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0, ShareAccounting{PPLNSShares: 2})
+	r.WriteShare("bitcoincash:qy", "1", []string{"0x0", "0x1", "0x0"}, 20, 1008, 0, ShareAccounting{PPLNSShares: 2})
+	r.WriteBlock("z", "1", []string{"0x1", "0x0", "0x0"}, "", 30, 100, 1008, 0, 0, "node", "", 0, ShareAccounting{PPLNSShares: 2})
+
+	window, err := r.GetPPLNSShares(1008, "0x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PPLNSShare{{Login: "z", Diff: 30}, {Login: "bitcoincash:qy", Diff: 20}}
+	if !reflect.DeepEqual(window, expected) {
+		t.Errorf("Unexpected PPLNS window snapshot %v", window)
+	}
+}
+
+func TestPPSCredit(t *testing.T) {
+	reset()
+
+	acc := ShareAccounting{Credit: 750}
+	r.WriteShare("x", "1", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0, acc)
+	r.WriteShare("x", "1", []string{"0x0", "0x1", "0x0"}, 10, 1008, 0, acc)
+
+	balance, _ := r.GetBalance("x")
+	if balance != 1 {
+		t.Errorf("Whole satoshis of the credit must go to balance, got %v", balance)
+	}
+	credit, _ := r.client.HGet(r.formatKey("miners", "x"), "ppsCredit").Int64()
+	if credit != 500 {
+		t.Errorf("Fraction of the credit must be kept, got %v", credit)
+	}
+	reserve, _ := r.client.HGet(r.formatKey("finances"), "reserve").Int64()
+	if reserve != -1 {
+		t.Errorf("Settled credits must be drawn from the reserve, got %v", reserve)
+	}
+	entries, _ := r.GetLedger(0, 10)
+	if len(entries) != 1 || entries[0].Kind != EntryPPSCredit || entries[0].Postings[1].Amount != 1 {
+		t.Errorf("Unexpected ledger %+v", entries)
+	}
+}
+
+func TestRoundScores(t *testing.T) {
+	reset()
+
+	acc := ShareAccounting{ScoreDecay: time.Minute}
+	r.WriteShare("x", "1", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0, acc)
+	r.WriteShare("y", "1", []string{"0x0", "0x1", "0x0"}, 20, 1008, 0, acc)
+	r.WriteBlock("x", "1", []string{"0x1", "0x0", "0x0"}, "", 30, 100, 1008, 0, 0, "node", "", 0, acc)
+
+	scores, err := r.GetRoundScores(1008, "0x1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := r.GetRoundShareLog(1008, "0x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 3 || log[2].Login != "x" || log[2].Diff != 30 {
+		t.Fatalf("Unexpected share log %v", log)
+	}
+	rebuilt := ScoresFromShareLog(log, time.Minute)
+	ratio := scores["x"] / scores["y"]
+	if math.Abs(ratio-rebuilt["x"]/rebuilt["y"]) > 1e-9 {
+		t.Errorf("Scores must be reconstructable from the share log: %v vs %v", scores, rebuilt)
+	}
+}
+
+func TestWritePayments(t *testing.T) {
+	reset()
+
+	login := "bitcoincash:qy"
+	r.client.HSet(r.formatKey("miners", login), "balance", "1000")
+	r.client.HSet(r.formatKey("miners", "x"), "balance", "500")
+	r.LockPayouts("batch", 1500)
+	r.UpdateBalance(login, 1000)
+	r.UpdateBalance("x", 500)
+
+	pending := r.GetPendingPayments()
+	if len(pending) != 2 {
+		t.Fatal("Must return pending payments")
+	}
+	payees, _ := r.GetPayees()
+	if !StringInSlice(login, payees) {
+		t.Errorf("Cashaddr login must be a payee: %v", payees)
+	}
+
+	r.WritePayments("0x0", map[string]int64{login: 1000, "x": 500})
+	if len(r.GetPendingPayments()) != 0 {
+		t.Error("Must remove pending payments")
+	}
+	locked, _ := r.IsPayoutsLocked()
+	if locked {
+		t.Error("Must release lock")
+	}
+	result := r.client.HGetAllMap(r.formatKey("finances")).Val()
+	if result["paid"] != "1500" || result["pending"] != "0" {
+		t.Errorf("Unexpected pool finances %v", result)
+	}
+	payments := convertPaymentsResults(r.client.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, -1).Val())
+	for _, p := range payments {
+		if p["address"] == login && p["amount"] != int64(1000) {
+			t.Errorf("Unexpected cashaddr payment %v", p)
+		}
+	}
+}
+
+func TestPayoutBatch(t *testing.T) {
+	reset()
+
+	login := "bc1qy"
+	r.client.HSet(r.formatKey("miners", login), "balance", "1000")
+	r.LockPayouts("batch", 1000)
+	r.UpdateBalance(login, 1000)
+
+	batch := &PayoutBatch{Id: "1-abcdef01", TxId: "abcdef01", Inputs: []string{"aa:0", "bb:1"}, Payments: map[string]int64{login: 1000}}
+	if err := r.WritePayoutBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WritePayoutBatch(batch); err == nil {
+		t.Error("Must not write a second batch")
+	}
+	if err := r.SubmitSignedPsbt("2-00000000", "signed"); err == nil {
+		t.Error("Must reject a signature of another batch")
+	}
+	r.SubmitSignedPsbt(batch.Id, "signed")
+	pending, _ := r.GetPayoutBatch()
+	if pending == nil || pending.SignedPsbt != "signed" {
+		t.Fatalf("Must store the signed PSBT: %v", pending)
+	}
+
+	r.AbandonPayoutBatch(pending)
+	if balance, _ := r.GetBalance(login); balance != 1000 {
+		t.Errorf("Must credit back the balance, got %v", balance)
+	}
+	if locked, _ := r.IsPayoutsLocked(); locked {
+		t.Error("Must release lock")
+	}
+	abandoned, _ := r.GetAbandonedBatches()
+	if len(abandoned[batch.Id]) != 2 {
+		t.Errorf("Must remember inputs of the abandoned batch: %v", abandoned)
+	}
+
+	r.LockPayouts("batch", 1000)
+	r.UpdateBalance(login, 1000)
+	next := &PayoutBatch{Id: "2-abcdef02", TxId: "abcdef02", Inputs: []string{"aa:0"}, Payments: map[string]int64{login: 1000}, Conflicts: []string{batch.Id}}
+	r.WritePayoutBatch(next)
+	r.CompletePayoutBatch("abcdef02", next)
+	if pending, _ := r.GetPayoutBatch(); pending != nil {
+		t.Error("Must remove the completed batch")
+	}
+	if abandoned, _ := r.GetAbandonedBatches(); len(abandoned) != 0 {
+		t.Errorf("Must forget conflicted batches: %v", abandoned)
+	}
+	result := r.client.HGetAllMap(r.formatKey("finances")).Val()
+	if result["paid"] != "1000" || result["pending"] != "0" {
+		t.Errorf("Unexpected pool finances %v", result)
+	}
+}
+
+func TestPayoutThreshold(t *testing.T) {
+	reset()
+
+	if threshold, _ := r.GetPayoutThreshold("x"); threshold != 0 {
+		t.Errorf("Unset threshold must be 0, got %v", threshold)
+	}
+	r.SetPayoutThreshold("x", 2000)
+	if threshold, _ := r.GetPayoutThreshold("x"); threshold != 2000 {
+		t.Errorf("Unexpected threshold %v", threshold)
+	}
+	r.SetPayoutThreshold("x", 0)
+	if threshold, _ := r.GetPayoutThreshold("x"); threshold != 0 {
+		t.Errorf("Threshold must be reset, got %v", threshold)
+	}
+
+	if schedule, _ := r.GetPayoutSchedule(); schedule != nil {
+		t.Error("Schedule must be nil before payouts run")
+	}
+	r.WritePayoutSchedule(&PayoutSchedule{Next: 100, Threshold: 5000, MinThreshold: 1000})
+	schedule, _ := r.GetPayoutSchedule()
+	if schedule == nil || schedule.Next != 100 {
+		t.Fatalf("Unexpected schedule %v", schedule)
+	}
+	if schedule.PayeeThreshold(0) != 5000 || schedule.PayeeThreshold(500) != 5000 || schedule.PayeeThreshold(2000) != 2000 {
+		t.Error("Custom thresholds below the pool minimum must be ignored")
+	}
+}
+
+func TestLightningPayment(t *testing.T) {
+	reset()
+
+	r.client.HSet(r.formatKey("miners", "x"), "balance", "3000")
+	r.SetLightningDestination("x", "x@pool.com")
+	r.SetLightningDestination("y", "")
+	dests, _ := r.GetLightningDestinations([]string{"x", "y"})
+	if len(dests) != 1 || dests["x"] != "x@pool.com" {
+		t.Errorf("Unexpected destinations %v", dests)
+	}
+
+	r.LockPayouts("x", 2000)
+	r.UpdateBalance("x", 2000)
+	err := r.WriteLightningPayment("x", "aa", 2000, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest, _ := r.GetLightningDestination("x"); dest != "" {
+		t.Errorf("Paid invoice must be removed, got %v", dest)
+	}
+	if locked, _ := r.IsPayoutsLocked(); locked {
+		t.Error("Payouts must be unlocked")
+	}
+	miner, _ := r.client.HGetAllMap(r.formatKey("miners", "x")).Result()
+	if miner["balance"] != "1000" || miner["pending"] != "0" || miner["paid"] != "2000" {
+		t.Errorf("Unexpected miner balances %v", miner)
+	}
+	stats, _ := r.GetMinerStats("x", 10)
+	payments := stats["payments"].([]map[string]interface{})
+	if len(payments) != 1 || payments[0]["lightning"] != true || payments[0]["status"] != PaymentConfirmed {
+		t.Errorf("Unexpected payments %v", payments)
+	}
+}
+
+func TestMinerSettings(t *testing.T) {
+	reset()
+
+	challenge, _, err := r.IssueChallenge("x", time.Minute)
+	if err != nil || len(challenge) != 32 {
+		t.Fatalf("Unexpected challenge %q: %v", challenge, err)
+	}
+	if again, expires, _ := r.IssueChallenge("x", time.Minute); again != challenge || expires < time.Now().Unix() {
+		t.Errorf("Live challenge %q must be kept, got %q expiring %v", challenge, again, expires)
+	}
+	if taken, _ := r.TakeChallenge("x", challenge); !taken {
+		t.Errorf("Challenge %q must be taken", challenge)
+	}
+	if taken, _ := r.TakeChallenge("x", challenge); taken {
+		t.Error("Challenge must be single use")
+	}
+
+	r.client.HSet(r.formatKey("miners", "x"), "balance", "3000")
+	threshold, webhook, email := int64(2000), "https://miner.example/hook", "miner@example.com"
+	err = r.UpdateMinerSettings("x", &MinerSettings{Threshold: &threshold, Webhook: &webhook, Email: &email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleared := ""
+	r.UpdateMinerSettings("x", &MinerSettings{Email: &cleared})
+	miner, _ := r.client.HGetAllMap(r.formatKey("miners", "x")).Result()
+	if miner["threshold"] != "2000" || miner["webhook"] != webhook || len(miner["email"]) > 0 || miner["balance"] != "3000" {
+		t.Errorf("Unexpected miner settings %v", miner)
+	}
+	stats, _ := r.GetMinerStats("x", 10)
+	if _, ok := stats["stats"].(map[string]interface{})["webhook"]; ok {
+		t.Error("Webhook must not be public")
+	}
+}
+
+func TestReplacePaymentTx(t *testing.T) {
+	reset()
+
+	login := "bc1qy"
+	r.WritePayments("aa", map[string]int64{login: 1000})
+	txs, _ := r.GetUnconfirmedPayments()
+	if len(txs) != 1 || txs[0].TxId != "aa" || txs[0].Status != PaymentPending {
+		t.Fatalf("Must track the payout tx, got %v", txs)
+	}
+
+	replacement, err := r.ReplacePaymentTx(txs[0], "bb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, _ = r.GetUnconfirmedPayments()
+	if len(txs) != 1 || txs[0].TxId != "bb" || txs[0].Replaces[0] != "aa" {
+		t.Fatalf("Must track the replacement instead, got %v", txs)
+	}
+	stats, _ := r.GetMinerStats(login, 10)
+	payments := stats["payments"].([]map[string]interface{})
+	if len(payments) != 1 || payments[0]["tx"] != "bb" || payments[0]["status"] != PaymentPending {
+		t.Errorf("Payments must move to the replacement, got %v", payments)
+	}
+	old, _ := r.GetPaymentTxs([]string{"aa"})
+	if old["aa"].Status != PaymentReplaced || old["aa"].ReplacedBy != "bb" {
+		t.Errorf("Unexpected replaced tx %v", old["aa"])
+	}
+
+	replacement.Status = PaymentConfirmed
+	replacement.Confirmations = 6
+	r.UpdatePaymentTx(replacement)
+	if txs, _ = r.GetUnconfirmedPayments(); len(txs) != 0 {
+		t.Errorf("Confirmed tx must not be tracked, got %v", txs)
+	}
+}
+
+func TestReconcileUTXOs(t *testing.T) {
+	reset()
+
+	r.ReconcileUTXOs([]*UTXO{{TxId: "aa", Vout: 0, Value: 1000, Height: 10, Coinbase: true}, {TxId: "bb", Vout: 1, Value: 500}}, nil)
+	utxos, _ := r.GetUTXOs()
+	if len(utxos) != 2 {
+		t.Fatalf("Unexpected UTXOs %v", utxos)
+	}
+	r.ReconcileUTXOs(nil, []string{"aa:0"})
+	utxos, _ = r.GetUTXOs()
+	if len(utxos) != 1 || utxos[0].Outpoint() != "bb:1" {
+		t.Errorf("Spent UTXO must be removed, got %v", utxos)
+	}
+}
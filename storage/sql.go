@@ -0,0 +1,1653 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	. "github.com/PowPool/btcpool/util"
+)
+
+// SQL database keeping blocks, credits, balances and payments. The binary registers the
+// "postgres" driver for production and "sqlite3" for tests and single node pools
+type SQLConfig struct {
+	Enabled bool   `json:"enabled"`
+	Driver  string `json:"driver"`
+	// Connection string, the database file for sqlite3
+	DSN          string `json:"dsn"`
+	DSNEncrypted string `json:"dsnEncrypted"`
+	MaxOpenConns int    `json:"maxOpenConns"`
+}
+
+// SQL database shared by all pools, their rows are keyed by the pool prefix
+type SQLDB struct {
+	db     *sql.DB
+	driver string
+}
+
+// SERIAL is replaced by the auto increment key of the driver
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS miners (
+		pool TEXT NOT NULL,
+		login TEXT NOT NULL,
+		balance BIGINT NOT NULL DEFAULT 0,
+		immature BIGINT NOT NULL DEFAULT 0,
+		pending BIGINT NOT NULL DEFAULT 0,
+		paid BIGINT NOT NULL DEFAULT 0,
+		pps_credit BIGINT NOT NULL DEFAULT 0,
+		threshold BIGINT NOT NULL DEFAULT 0,
+		lightning TEXT NOT NULL DEFAULT '',
+		webhook TEXT NOT NULL DEFAULT '',
+		email TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (pool, login)
+	)`,
+	`CREATE TABLE IF NOT EXISTS finances (
+		pool TEXT PRIMARY KEY,
+		balance BIGINT NOT NULL DEFAULT 0,
+		immature BIGINT NOT NULL DEFAULT 0,
+		pending BIGINT NOT NULL DEFAULT 0,
+		paid BIGINT NOT NULL DEFAULT 0,
+		total_mined BIGINT NOT NULL DEFAULT 0,
+		reserve BIGINT NOT NULL DEFAULT 0,
+		pps_credited BIGINT NOT NULL DEFAULT 0,
+		last_credit_height BIGINT NOT NULL DEFAULT 0,
+		last_credit_hash TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS blocks (
+		id SERIAL,
+		pool TEXT NOT NULL,
+		stage TEXT NOT NULL,
+		height BIGINT NOT NULL,
+		hash TEXT NOT NULL,
+		state TEXT NOT NULL,
+		record TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS blocks_stage ON blocks (pool, stage, height)`,
+	`CREATE TABLE IF NOT EXISTS immature_credits (
+		pool TEXT NOT NULL,
+		height BIGINT NOT NULL,
+		hash TEXT NOT NULL,
+		login TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		PRIMARY KEY (pool, height, hash, login)
+	)`,
+	`CREATE TABLE IF NOT EXISTS credits (
+		pool TEXT NOT NULL,
+		height BIGINT NOT NULL,
+		hash TEXT NOT NULL,
+		login TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		PRIMARY KEY (pool, height, hash, login)
+	)`,
+	`CREATE TABLE IF NOT EXISTS payments (
+		id SERIAL,
+		pool TEXT NOT NULL,
+		tx TEXT NOT NULL,
+		login TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		ts BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS payments_login ON payments (pool, login, ts)`,
+	`CREATE INDEX IF NOT EXISTS payments_tx ON payments (pool, tx)`,
+	`CREATE TABLE IF NOT EXISTS pending_payments (
+		pool TEXT NOT NULL,
+		login TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		ts BIGINT NOT NULL,
+		PRIMARY KEY (pool, login, amount)
+	)`,
+	`CREATE TABLE IF NOT EXISTS payment_txs (
+		pool TEXT NOT NULL,
+		txid TEXT NOT NULL,
+		status TEXT NOT NULL,
+		sent BIGINT NOT NULL,
+		record TEXT NOT NULL,
+		PRIMARY KEY (pool, txid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS abandoned_batches (
+		pool TEXT NOT NULL,
+		id TEXT NOT NULL,
+		inputs TEXT NOT NULL,
+		PRIMARY KEY (pool, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS utxos (
+		pool TEXT NOT NULL,
+		outpoint TEXT NOT NULL,
+		height BIGINT NOT NULL,
+		coinbase BOOLEAN NOT NULL,
+		record TEXT NOT NULL,
+		PRIMARY KEY (pool, outpoint)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ledger (
+		id SERIAL,
+		pool TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		ref TEXT NOT NULL,
+		note TEXT NOT NULL,
+		ts BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS ledger_ref ON ledger (pool, kind, ref)`,
+	`CREATE TABLE IF NOT EXISTS postings (
+		entry_id BIGINT NOT NULL,
+		seq INTEGER NOT NULL,
+		account TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		PRIMARY KEY (entry_id, seq)
+	)`,
+	// Payouts lock, pending batch, schedule and solvency
+	`CREATE TABLE IF NOT EXISTS pool_state (
+		pool TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (pool, name)
+	)`,
+}
+
+func OpenSQL(cfg *SQLConfig) (*SQLDB, error) {
+	dsn := cfg.DSN
+	switch cfg.Driver {
+	case "postgres":
+	case "sqlite3":
+		// Writers take the lock when they begin, a deferred transaction could fail to upgrade it
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_txlock=immediate&_busy_timeout=5000"
+	default:
+		return nil, fmt.Errorf("unsupported SQL driver %q", cfg.Driver)
+	}
+	db, err := sql.Open(cfg.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Driver == "sqlite3" {
+		// SQLite has a single writer, and an in-memory database lives as long as its connection
+		db.SetMaxOpenConns(1)
+	} else if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	s := &SQLDB{db: db, driver: cfg.Driver}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLDB) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLDB) migrate() error {
+	serial := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	if s.driver == "postgres" {
+		serial = "BIGSERIAL PRIMARY KEY"
+	}
+	for _, stmt := range sqlSchema {
+		_, err := s.db.Exec(strings.Replace(stmt, "SERIAL", serial, 1))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queries are written with ? placeholders, PostgreSQL numbers them
+func (s *SQLDB) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// Scan every row and close them, no other statement may run on the connection while rows are open
+func scanRows(rows *sql.Rows, err error, scan func() error) error {
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = scan()
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Pool storage keeping the money in SQL, shares, rounds, stats and node state stay in the rounds backend.
+// Every change of balances commits in one SQL transaction
+type SQLBackend struct {
+	RoundsBackend
+	db   *SQLDB
+	pool string
+}
+
+// pool keys the rows of the pool, the Redis prefix of the pool is used
+func NewSQLBackend(db *SQLDB, pool string, rounds RoundsBackend) (*SQLBackend, error) {
+	s := &SQLBackend{RoundsBackend: rounds, db: db, pool: pool}
+	_, err := s.exec("INSERT INTO finances (pool) VALUES (?) ON CONFLICT DO NOTHING", pool)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLBackend) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.db.Query(s.db.rebind(query), args...)
+}
+
+func (s *SQLBackend) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.db.QueryRow(s.db.rebind(query), args...)
+}
+
+// Returns the number of rows changed
+func (s *SQLBackend) exec(query string, args ...interface{}) (int64, error) {
+	result, err := s.db.db.Exec(s.db.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SQL transaction keeping its first error, statements after it are skipped like in a MULTI block
+type sqlTx struct {
+	tx   *sql.Tx
+	db   *SQLDB
+	pool string
+	err  error
+}
+
+// Run fn in a transaction, it is rolled back if fn or a statement failed
+func (s *SQLBackend) transact(fn func(t *sqlTx) error) error {
+	tx, err := s.db.db.Begin()
+	if err != nil {
+		return err
+	}
+	t := &sqlTx{tx: tx, db: s.db, pool: s.pool}
+	err = fn(t)
+	if t.err != nil {
+		err = t.err
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the number of rows changed
+func (t *sqlTx) exec(query string, args ...interface{}) int64 {
+	if t.err != nil {
+		return 0
+	}
+	result, err := t.tx.Exec(t.db.rebind(query), args...)
+	if err != nil {
+		t.err = err
+		return 0
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		t.err = err
+	}
+	return n
+}
+
+func (t *sqlTx) query(query string, args ...interface{}) (*sql.Rows, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.tx.Query(t.db.rebind(query), args...)
+}
+
+// Add to an account of the miner, the miner row is created on the first credit
+func (t *sqlTx) addMiner(login, account string, amount int64) {
+	t.exec("INSERT INTO miners (pool, login, "+account+") VALUES (?, ?, ?) ON CONFLICT (pool, login) DO UPDATE SET "+
+		account+" = miners."+account+" + excluded."+account, t.pool, login, amount)
+}
+
+func (t *sqlTx) addFinances(account string, amount int64) {
+	t.exec("UPDATE finances SET "+account+" = "+account+" + ? WHERE pool = ?", amount, t.pool)
+}
+
+// Set a miner setting, empty values are reset without creating the miner
+func (t *sqlTx) setMiner(login, column string, value interface{}, empty bool) {
+	if empty {
+		t.exec("UPDATE miners SET "+column+" = ? WHERE pool = ? AND login = ?", value, t.pool, login)
+		return
+	}
+	t.exec("INSERT INTO miners (pool, login, "+column+") VALUES (?, ?, ?) ON CONFLICT (pool, login) DO UPDATE SET "+
+		column+" = excluded."+column, t.pool, login, value)
+}
+
+func (t *sqlTx) setState(name, value string) {
+	t.exec("INSERT INTO pool_state (pool, name, value) VALUES (?, ?, ?) ON CONFLICT (pool, name) DO UPDATE SET value = excluded.value",
+		t.pool, name, value)
+}
+
+func (t *sqlTx) deleteState(name string) {
+	t.exec("DELETE FROM pool_state WHERE pool = ? AND name = ?", t.pool, name)
+}
+
+func (s *SQLBackend) getState(name string) (string, error) {
+	var value string
+	err := s.queryRow("SELECT value FROM pool_state WHERE pool = ? AND name = ?", s.pool, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (s *SQLBackend) setState(name, value string) error {
+	return s.transact(func(t *sqlTx) error {
+		t.setState(name, value)
+		return nil
+	})
+}
+
+// Insert a state only if it is not set yet, returns false if it was
+func (s *SQLBackend) addState(name, value string) (bool, error) {
+	n, err := s.exec("INSERT INTO pool_state (pool, name, value) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", s.pool, name, value)
+	return n > 0, err
+}
+
+func (t *sqlTx) writeLedger(kind, ref, note string, postings ...Posting) {
+	postings = nonZeroPostings(postings)
+	if len(postings) == 0 || t.err != nil {
+		return
+	}
+	var id int64
+	t.err = t.tx.QueryRow(t.db.rebind("INSERT INTO ledger (pool, kind, ref, note, ts) VALUES (?, ?, ?, ?, ?) RETURNING id"),
+		t.pool, kind, ref, note, MakeTimestamp()/1000).Scan(&id)
+	for i, p := range postings {
+		t.exec("INSERT INTO postings (entry_id, seq, account, amount) VALUES (?, ?, ?, ?)", id, i, p.Account, p.Amount)
+	}
+}
+
+// Move an amount of a miner between two of their accounts
+func (t *sqlTx) writeTransfer(kind, ref, login, from, to string, amount int64) {
+	t.addMiner(login, from, -amount)
+	t.addMiner(login, to, amount)
+	t.addFinances(from, -amount)
+	t.addFinances(to, amount)
+	t.writeLedger(kind, ref, "",
+		Posting{Account: MinerAccount(from, login), Amount: -amount},
+		Posting{Account: MinerAccount(to, login), Amount: amount})
+}
+
+// Latest entry of a kind with the ref, nil if there is none
+func (t *sqlTx) findLedgerEntry(kind, ref string) *LedgerEntry {
+	if t.err != nil {
+		return nil
+	}
+	var id int64
+	entry := &LedgerEntry{}
+	err := t.tx.QueryRow(t.db.rebind("SELECT id, kind, ref, note, ts FROM ledger WHERE pool = ? AND kind = ? AND ref = ? ORDER BY id DESC LIMIT 1"),
+		t.pool, kind, ref).Scan(&id, &entry.Kind, &entry.Ref, &entry.Note, &entry.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		t.err = err
+		return nil
+	}
+	rows, err := t.query("SELECT account, amount FROM postings WHERE entry_id = ? ORDER BY seq", id)
+	var p Posting
+	t.err = scanRows(rows, err, func() error {
+		err := rows.Scan(&p.Account, &p.Amount)
+		entry.Postings = append(entry.Postings, p)
+		return err
+	})
+	return entry
+}
+
+// Logins of a credit map in order, rows are always locked in the same order
+func sortedLogins(amounts map[string]int64) []string {
+	logins := make([]string, 0, len(amounts))
+	for login := range amounts {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	return logins
+}
+
+// Credit a share to the miner with PPS in millisatoshi, whole satoshis go from the reserve to the balance
+func (t *sqlTx) creditShare(login string, credit int64) {
+	t.exec("INSERT INTO miners (pool, login, pps_credit) VALUES (?, ?, ?) ON CONFLICT (pool, login) DO UPDATE SET pps_credit = miners.pps_credit + excluded.pps_credit",
+		t.pool, login, credit)
+	if t.err != nil {
+		return
+	}
+	var total int64
+	t.err = t.tx.QueryRow(t.db.rebind("SELECT pps_credit FROM miners WHERE pool = ? AND login = ?"), t.pool, login).Scan(&total)
+	amount := total / 1000
+	if t.err != nil || amount < 1 {
+		return
+	}
+	t.exec("UPDATE miners SET pps_credit = pps_credit - ? WHERE pool = ? AND login = ?", amount*1000, t.pool, login)
+	t.exec("UPDATE finances SET pps_credited = pps_credited + ?, reserve = reserve - ? WHERE pool = ?", amount, amount, t.pool)
+	t.addMiner(login, AccountBalance, amount)
+	t.addFinances(AccountBalance, amount)
+	t.writeLedger(EntryPPSCredit, "", "",
+		Posting{Account: AccountReserve, Amount: -amount},
+		Posting{Account: MinerAccount(AccountBalance, login), Amount: amount})
+}
+
+// PPS credits wait in the rounds backend until FlushCredits settles them
+func (s *SQLBackend) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration,
+	acc ShareAccounting) (bool, error) {
+	acc.pendingCredit = true
+	return s.RoundsBackend.WriteShare(login, id, params, diff, height, window, acc)
+}
+
+// The candidate is inserted before its round is closed, it is deleted again if the round couldn't be closed
+func (s *SQLBackend) WriteBlock(login, id string, params []string, hash string, diff, roundDiff int64, height uint64,
+	coinBaseValue int64, blkTotalFee int64, node, coinBaseTag string, window time.Duration, acc ShareAccounting) (bool, error) {
+	exist, err := s.RoundsBackend.checkPoWExist(height, params)
+	if err != nil || exist {
+		return exist, err
+	}
+	block := newCandidate(login, id, params, hash, roundDiff, height, coinBaseValue, blkTotalFee, node, coinBaseTag)
+	var rowId int64
+	err = s.queryRow("INSERT INTO blocks (pool, stage, height, hash, state, record) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		s.pool, "candidates", block.Height, block.Hash, block.State, block.key()).Scan(&rowId)
+	if err != nil {
+		return false, err
+	}
+	acc.pendingCredit = true
+	err = s.RoundsBackend.writeRound(block, diff, window, acc)
+	if err != nil {
+		if _, derr := s.exec("DELETE FROM blocks WHERE id = ?", rowId); derr != nil {
+			Error.Printf("Failed to delete candidate %v of an unclosed round: %v", block.RoundKey(), derr)
+		}
+		return false, err
+	}
+	_, err = s.exec("UPDATE blocks SET record = ? WHERE id = ?", block.key(), rowId)
+	if err != nil {
+		Error.Printf("Failed to write the total shares of candidate %v: %v", block.RoundKey(), err)
+	}
+	return false, err
+}
+
+// Settle the pending PPS credits in one transaction. A batch is settled once, a batch taken again because
+// clearing it failed is only cleared
+func (s *SQLBackend) FlushCredits() error {
+	batch, credits, err := s.RoundsBackend.takeCredits()
+	if err != nil || len(batch) == 0 {
+		return err
+	}
+	err = s.applyCredits(batch, credits)
+	if err != nil {
+		return err
+	}
+	return s.RoundsBackend.clearCredits(batch)
+}
+
+func (s *SQLBackend) applyCredits(batch string, credits map[string]int64) error {
+	return s.transact(func(t *sqlTx) error {
+		t.exec("INSERT INTO pool_state (pool, name, value) VALUES (?, ?, '') ON CONFLICT DO NOTHING", t.pool, "credits:batch")
+		// Concurrent flushes of the batch wait on the row, only the first one changes it
+		if t.exec("UPDATE pool_state SET value = ? WHERE pool = ? AND name = ? AND value <> ?",
+			batch, t.pool, "credits:batch", batch) == 0 {
+			return nil
+		}
+		for _, login := range sortedLogins(credits) {
+			t.creditShare(login, credits[login])
+		}
+		return nil
+	})
+}
+
+// Blocks of a stage between the heights as sorted set rows, newest first if reverse
+func (s *SQLBackend) blockRows(stage string, min, max int64, reverse bool, limit int64) ([]redis.Z, error) {
+	query := "SELECT height, record FROM blocks WHERE pool = ? AND stage = ? AND height >= ? AND height <= ? ORDER BY height, id"
+	if reverse {
+		query = "SELECT height, record FROM blocks WHERE pool = ? AND stage = ? AND height >= ? AND height <= ? ORDER BY height DESC, id DESC"
+	}
+	if limit > 0 {
+		query += " LIMIT " + strconv.FormatInt(limit, 10)
+	}
+	rows, err := s.query(query, s.pool, stage, min, max)
+	var result []redis.Z
+	var height int64
+	var record string
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&height, &record)
+		result = append(result, redis.Z{Score: float64(height), Member: record})
+		return err
+	})
+	return result, err
+}
+
+func (s *SQLBackend) GetCandidates(maxHeight int64) ([]*BlockData, error) {
+	rows, err := s.blockRows("candidates", 0, maxHeight, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	return convertCandidateResults(rows), nil
+}
+
+func (s *SQLBackend) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
+	rows, err := s.blockRows("immature", 0, maxHeight, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	return convertBlockResults(rows), nil
+}
+
+func (s *SQLBackend) GetMaturedBlocks(minHeight int64) ([]*BlockData, error) {
+	rows, err := s.blockRows("matured", minHeight, math.MaxInt64, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	return convertBlockResults(rows), nil
+}
+
+func (s *SQLBackend) GetBlocksAt(height int64) ([]*BlockData, error) {
+	stages := []struct {
+		name    string
+		pending bool
+	}{
+		{"candidates", true},
+		{"immature", true},
+		{"matured", false},
+	}
+	var result []*BlockData
+	for _, stage := range stages {
+		rows, err := s.blockRows(stage.name, height, height, false, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range convertBlockResults(rows) {
+			block.pending = stage.pending
+			result = append(result, block)
+		}
+	}
+	return result, nil
+}
+
+// Move a block read as member to another stage, false if it is not in one of the from stages any more
+func (t *sqlTx) moveBlock(member string, block *BlockData, to string, from ...string) bool {
+	args := []interface{}{to, block.Height, block.Hash, block.State, block.key(), t.pool, member}
+	for _, stage := range from {
+		args = append(args, stage)
+	}
+	return t.exec("UPDATE blocks SET stage = ?, height = ?, hash = ?, state = ?, record = ? WHERE pool = ? AND record = ? AND stage IN ("+
+		placeholders(len(from))+")", args...) > 0
+}
+
+// Remove and return credits of a block
+func (t *sqlTx) takeCredits(table string, height int64, hash string) map[string]int64 {
+	credits := make(map[string]int64)
+	rows, err := t.query("DELETE FROM "+table+" WHERE pool = ? AND height = ? AND hash = ? RETURNING login, amount", t.pool, height, hash)
+	var login string
+	var amount int64
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&login, &amount)
+		credits[login] = amount
+		return err
+	})
+	if t.err == nil {
+		t.err = err
+	}
+	return credits
+}
+
+// Take back the immature credits of a block, returns their postings and total
+func (t *sqlTx) takeImmatureCredits(block *BlockData) ([]Posting, int64) {
+	credits := t.takeCredits("immature_credits", block.RoundHeight, block.Hash)
+	total := int64(0)
+	var postings []Posting
+	for _, login := range sortedLogins(credits) {
+		amount := credits[login]
+		total += amount
+		t.addMiner(login, AccountImmature, -amount)
+		postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: -amount})
+	}
+	t.addFinances(AccountImmature, -total)
+	return postings, total
+}
+
+// The block is settled in SQL first, its round follows it
+func (s *SQLBackend) followRound(block *BlockData) {
+	err := s.RoundsBackend.moveRound(block)
+	if err != nil {
+		Error.Printf("Failed to move round %v to height %v: %v", block.RoundKey(), block.Height, err)
+	}
+}
+
+func (s *SQLBackend) dropRound(block *BlockData) {
+	err := s.RoundsBackend.deleteRound(block)
+	if err != nil {
+		Error.Printf("Failed to delete round %v: %v", block.RoundKey(), err)
+	}
+}
+
+func (s *SQLBackend) GetImmatureCredits(block *BlockData) (map[string]int64, error) {
+	rows, err := s.query("SELECT login, amount FROM immature_credits WHERE pool = ? AND height = ? AND hash = ?",
+		s.pool, block.RoundHeight, block.Hash)
+	result := make(map[string]int64)
+	var login string
+	var amount int64
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&login, &amount)
+		result[login] = amount
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *SQLBackend) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
+	member := block.member
+	block.Transition(BlockImmature)
+	err := s.transact(func(t *sqlTx) error {
+		if !t.moveBlock(member, block, "immature", "candidates") {
+			return fmt.Errorf("block %v is not a candidate", block.RoundKey())
+		}
+		total := int64(0)
+		var postings []Posting
+		for _, login := range sortedLogins(roundRewards) {
+			amount := roundRewards[login]
+			total += amount
+			t.addMiner(login, AccountImmature, amount)
+			t.exec("INSERT INTO immature_credits (pool, height, hash, login, amount) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+				t.pool, block.Height, block.Hash, login, amount)
+			postings = append(postings, Posting{Account: MinerAccount(AccountImmature, login), Amount: amount})
+		}
+		t.addFinances(AccountImmature, total)
+		postings = append(postings, Posting{Account: AccountBlocks, Amount: -total})
+		t.writeLedger(EntryImmature, join(block.Height, block.Hash), "", postings...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.followRound(block)
+	return nil
+}
+
+// reserve is the part of the block revenue kept for the pool risk reserve
+func (s *SQLBackend) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64, reserve int64) error {
+	member := block.member
+	block.Transition(BlockMatured)
+	err := s.transact(func(t *sqlTx) error {
+		if !t.moveBlock(member, block, "matured", "immature") {
+			return fmt.Errorf("block %v is not immature", block.RoundKey())
+		}
+		postings, totalImmature := t.takeImmatureCredits(block)
+
+		total := int64(0)
+		for _, login := range sortedLogins(roundRewards) {
+			amount := roundRewards[login]
+			total += amount
+			t.addMiner(login, AccountBalance, amount)
+			t.exec("INSERT INTO credits (pool, height, hash, login, amount) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+				t.pool, block.Height, block.Hash, login, amount)
+			postings = append(postings, Posting{Account: MinerAccount(AccountBalance, login), Amount: amount})
+		}
+		// Immature credits go back to the block, which pays balances, reserve and the pool fee
+		revenue := block.RewardInSatoshi()
+		if block.ExtraReward != nil {
+			revenue += block.ExtraReward.Int64()
+		}
+		postings = append(sortPostings(postings),
+			Posting{Account: AccountBlocks, Amount: totalImmature - revenue},
+			Posting{Account: AccountReserve, Amount: reserve},
+			Posting{Account: AccountPoolFee, Amount: revenue - total - reserve})
+		t.writeLedger(EntryCredit, join(block.Height, block.Hash), "", postings...)
+		for _, utxo := range block.CoinBaseOutputs {
+			t.writeUTXO(utxo)
+		}
+		t.exec("UPDATE finances SET balance = balance + ?, total_mined = total_mined + ?, reserve = reserve + ?, "+
+			"last_credit_height = ?, last_credit_hash = ? WHERE pool = ?",
+			total, block.RewardInSatoshi(), reserve, block.Height, block.Hash, t.pool)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.dropRound(block)
+	return nil
+}
+
+func (s *SQLBackend) WriteOrphan(block *BlockData) error {
+	member := block.member
+	block.Transition(BlockOrphaned)
+	err := s.transact(func(t *sqlTx) error {
+		if !t.moveBlock(member, block, "matured", "immature") {
+			return fmt.Errorf("block %v is not immature", block.RoundKey())
+		}
+		postings, totalImmature := t.takeImmatureCredits(block)
+		postings = append(postings, Posting{Account: AccountBlocks, Amount: totalImmature})
+		t.writeLedger(EntryOrphan, join(block.Height, block.Hash), "", postings...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.dropRound(block)
+	return nil
+}
+
+func (s *SQLBackend) WritePendingOrphans(blocks []*BlockData) error {
+	err := s.transact(func(t *sqlTx) error {
+		for _, block := range blocks {
+			member := block.member
+			block.Transition(BlockOrphaned)
+			if !t.moveBlock(member, block, "immature", "candidates") {
+				return fmt.Errorf("block %v is not a candidate", block.RoundKey())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		s.followRound(block)
+	}
+	return nil
+}
+
+// Take back the credits of a matured block that left the main chain, balances already paid out go negative.
+// Returns the total taken from miner balances
+func (s *SQLBackend) WriteReorg(block *BlockData) (int64, error) {
+	ref := join(block.Height, block.Hash)
+	member := block.member
+	total := int64(0)
+	block.Transition(BlockOrphaned)
+	err := s.transact(func(t *sqlTx) error {
+		if !t.moveBlock(member, block, "matured", "matured") {
+			return fmt.Errorf("block %v is not matured", block.RoundKey())
+		}
+		credit := t.findLedgerEntry(EntryCredit, ref)
+		minerCredits := t.takeCredits("credits", block.Height, block.Hash)
+		var credits map[string]string
+		if credit == nil {
+			// Matured before the ledger, only the miner credits are known
+			credits = make(map[string]string)
+			for login, amount := range minerCredits {
+				credits[login] = strconv.FormatInt(amount, 10)
+			}
+		}
+		var postings []Posting
+		var reserve int64
+		postings, total, reserve = reorgPostings(credit, credits)
+		for _, p := range postings {
+			if kind, login, ok := ParseMinerAccount(p.Account); ok && kind == AccountBalance {
+				t.addMiner(login, AccountBalance, p.Amount)
+			}
+		}
+		t.exec("DELETE FROM utxos WHERE pool = ? AND coinbase = ? AND height = ?", t.pool, true, block.Height)
+		t.exec("UPDATE finances SET balance = balance - ?, total_mined = total_mined - ?, reserve = reserve - ? WHERE pool = ?",
+			total, block.RewardInSatoshi(), reserve, t.pool)
+		t.writeLedger(EntryReorg, ref, "block left the main chain", postings...)
+		return nil
+	})
+	return total, err
+}
+
+// Move a candidate or immature block back to the candidates, its immature credits are taken back.
+// The unlocker checks it again and credits its round anew
+func (s *SQLBackend) RequeueBlock(block *BlockData) error {
+	member := block.member
+	block.Reward = nil
+	block.ExtraReward = nil
+	block.Transition(BlockCandidate)
+	return s.transact(func(t *sqlTx) error {
+		if !t.moveBlock(member, block, "candidates", "candidates", "immature") {
+			return fmt.Errorf("block %v is neither candidate nor immature", block.RoundKey())
+		}
+		postings, totalImmature := t.takeImmatureCredits(block)
+		postings = append(postings, Posting{Account: AccountBlocks, Amount: totalImmature})
+		t.writeLedger(EntryRequeue, join(block.Height, block.Hash), "round credited anew", postings...)
+		return nil
+	})
+}
+
+// Blocks are always written as records, there is nothing to migrate
+func (s *SQLBackend) MigrateBlocks() (int, error) {
+	return 0, nil
+}
+
+func (s *SQLBackend) IsMinerExists(login string) (bool, error) {
+	var n int64
+	err := s.queryRow("SELECT COUNT(*) FROM miners WHERE pool = ? AND login = ?", s.pool, login).Scan(&n)
+	if err != nil || n > 0 {
+		return n > 0, err
+	}
+	// Miners who only submitted shares are known to the rounds backend
+	return s.RoundsBackend.IsMinerExists(login)
+}
+
+func (s *SQLBackend) GetPayees() ([]string, error) {
+	rows, err := s.query("SELECT login FROM miners WHERE pool = ?", s.pool)
+	var result []string
+	var login string
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&login)
+		result = append(result, login)
+		return err
+	})
+	return result, err
+}
+
+// Column of the miner row, value is left unchanged if the miner has none
+func (s *SQLBackend) minerColumn(login, column string, value interface{}) error {
+	err := s.queryRow("SELECT "+column+" FROM miners WHERE pool = ? AND login = ?", s.pool, login).Scan(value)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+func (s *SQLBackend) GetBalance(login string) (int64, error) {
+	var balance int64
+	err := s.minerColumn(login, "balance", &balance)
+	return balance, err
+}
+
+func (s *SQLBackend) GetOwedBalances() (int64, int64, int64, error) {
+	var balance, immature, pending int64
+	err := s.queryRow("SELECT COALESCE(SUM(balance), 0), COALESCE(SUM(immature), 0), COALESCE(SUM(pending), 0) FROM miners WHERE pool = ?",
+		s.pool).Scan(&balance, &immature, &pending)
+	return balance, immature, pending, err
+}
+
+// Deduct miner's balance for payment
+func (s *SQLBackend) UpdateBalance(login string, amount int64) error {
+	return s.transact(func(t *sqlTx) error {
+		t.exec("INSERT INTO pending_payments (pool, login, amount, ts) VALUES (?, ?, ?, ?) ON CONFLICT (pool, login, amount) DO UPDATE SET ts = excluded.ts",
+			t.pool, login, amount, MakeTimestamp()/1000)
+		t.writeTransfer(EntryPayout, "", login, AccountBalance, AccountPending, amount)
+		return nil
+	})
+}
+
+func (s *SQLBackend) RollbackBalance(login string, amount int64) error {
+	return s.transact(func(t *sqlTx) error {
+		t.exec("DELETE FROM pending_payments WHERE pool = ? AND login = ? AND amount = ?", t.pool, login, amount)
+		t.writeTransfer(EntryRollback, "", login, AccountPending, AccountBalance, amount)
+		return nil
+	})
+}
+
+// Credit or debit a miner balance by hand, e.g. to settle a failed payment
+func (s *SQLBackend) AdjustBalance(login string, amount int64, note string) error {
+	return s.transact(func(t *sqlTx) error {
+		t.addMiner(login, AccountBalance, amount)
+		t.addFinances(AccountBalance, amount)
+		t.writeLedger(EntryAdjustment, "", note,
+			Posting{Account: MinerAccount(AccountBalance, login), Amount: amount},
+			Posting{Account: AccountAdjustments, Amount: -amount})
+		return nil
+	})
+}
+
+func (s *SQLBackend) GetPayoutThreshold(login string) (int64, error) {
+	var threshold int64
+	err := s.minerColumn(login, "threshold", &threshold)
+	return threshold, err
+}
+
+func (s *SQLBackend) SetPayoutThreshold(login string, threshold int64) error {
+	return s.transact(func(t *sqlTx) error {
+		t.setMiner(login, "threshold", threshold, threshold == 0)
+		return nil
+	})
+}
+
+func (s *SQLBackend) GetLightningDestination(login string) (string, error) {
+	var dest string
+	err := s.minerColumn(login, "lightning", &dest)
+	return dest, err
+}
+
+func (s *SQLBackend) SetLightningDestination(login, dest string) error {
+	return s.transact(func(t *sqlTx) error {
+		t.setMiner(login, "lightning", dest, len(dest) == 0)
+		return nil
+	})
+}
+
+func (s *SQLBackend) GetLightningDestinations(logins []string) (map[string]string, error) {
+	wanted := make(map[string]bool)
+	for _, login := range logins {
+		wanted[login] = true
+	}
+	rows, err := s.query("SELECT login, lightning FROM miners WHERE pool = ? AND lightning <> ''", s.pool)
+	result := make(map[string]string)
+	var login, dest string
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&login, &dest)
+		if wanted[login] {
+			result[login] = dest
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *SQLBackend) UpdateMinerSettings(login string, settings *MinerSettings) error {
+	fields := settings.fields()
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	return s.transact(func(t *sqlTx) error {
+		for _, field := range names {
+			value := fields[field]
+			if field == "threshold" {
+				t.setMiner(login, field, parseInt64(value), len(value) == 0)
+			} else {
+				t.setMiner(login, field, value, len(value) == 0)
+			}
+		}
+		return nil
+	})
+}
+
+// Ledger entries from start on, at most limit of them
+func (s *SQLBackend) GetLedger(start, limit int64) ([]*LedgerEntry, error) {
+	rows, err := s.query("SELECT id, kind, ref, note, ts FROM ledger WHERE pool = ? ORDER BY id LIMIT ? OFFSET ?", s.pool, limit, start)
+	result := []*LedgerEntry{}
+	ids := make(map[int64]*LedgerEntry)
+	var id int64
+	err = scanRows(rows, err, func() error {
+		entry := &LedgerEntry{Id: start + int64(len(result))}
+		err := rows.Scan(&id, &entry.Kind, &entry.Ref, &entry.Note, &entry.Timestamp)
+		ids[id] = entry
+		result = append(result, entry)
+		return err
+	})
+	if err != nil || len(result) == 0 {
+		return result, err
+	}
+
+	// Entries of other pools fall between the ids of the pool
+	first, last := int64(math.MaxInt64), int64(0)
+	for id := range ids {
+		if id < first {
+			first = id
+		}
+		if id > last {
+			last = id
+		}
+	}
+	rows, err = s.query("SELECT entry_id, account, amount FROM postings WHERE entry_id >= ? AND entry_id <= ? ORDER BY entry_id, seq", first, last)
+	var p Posting
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&id, &p.Account, &p.Amount)
+		if entry, ok := ids[id]; ok {
+			entry.Postings = append(entry.Postings, p)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Balances of all accounts summed up from the postings
+func (s *SQLBackend) LedgerBalances() (map[string]int64, error) {
+	rows, err := s.query("SELECT p.account, SUM(p.amount) FROM postings p JOIN ledger l ON l.id = p.entry_id WHERE l.pool = ? GROUP BY p.account", s.pool)
+	result := make(map[string]int64)
+	var account string
+	var amount int64
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&account, &amount)
+		result[account] = amount
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *SQLBackend) WriteNetworkFee(txId, note string, fee int64) error {
+	return s.transact(func(t *sqlTx) error {
+		if t.findLedgerEntry(EntryFee, txId) == nil {
+			t.writeLedger(EntryFee, txId, note, networkFeePostings(fee)...)
+		}
+		return nil
+	})
+}
+
+// Miner accounts of all miners by login
+func (s *SQLBackend) minerAccounts(q func(string, ...interface{}) (*sql.Rows, error)) (map[string]map[string]int64, []string, error) {
+	rows, err := q("SELECT login, immature, balance, pending, paid FROM miners WHERE pool = ? ORDER BY login", s.pool)
+	result := make(map[string]map[string]int64)
+	var logins []string
+	var login string
+	var immature, balance, pending, paid int64
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&login, &immature, &balance, &pending, &paid)
+		result[login] = map[string]int64{AccountImmature: immature, AccountBalance: balance, AccountPending: pending, AccountPaid: paid}
+		logins = append(logins, login)
+		return err
+	})
+	return result, logins, err
+}
+
+// Record balances of a pool that ran without ledger, does nothing once the ledger has entries
+func (s *SQLBackend) OpenLedger() error {
+	return s.transact(func(t *sqlTx) error {
+		var n int64
+		err := t.tx.QueryRow(t.db.rebind("SELECT COUNT(*) FROM ledger WHERE pool = ?"), t.pool).Scan(&n)
+		if err != nil || n > 0 {
+			return err
+		}
+		miners, logins, err := s.minerAccounts(t.query)
+		if err != nil {
+			return err
+		}
+		var postings []Posting
+		total := int64(0)
+		for _, login := range logins {
+			for _, account := range minerAccounts {
+				amount := miners[login][account]
+				if amount != 0 {
+					postings = append(postings, Posting{Account: MinerAccount(account, login), Amount: amount})
+					total += amount
+				}
+			}
+		}
+		if len(postings) == 0 {
+			return nil
+		}
+		postings = append(postings, Posting{Account: AccountOpening, Amount: -total})
+		t.writeLedger(EntryOpening, "", "balances before the ledger", postings...)
+		return nil
+	})
+}
+
+// Compare the ledger with the miner rows and the pool finances
+func (s *SQLBackend) ReconcileLedger() ([]LedgerDrift, error) {
+	balances, err := s.LedgerBalances()
+	if err != nil {
+		return nil, err
+	}
+	miners, logins, err := s.minerAccounts(s.query)
+	if err != nil {
+		return nil, err
+	}
+	// Miners whose rows are gone still count
+	for account := range balances {
+		if _, login, ok := ParseMinerAccount(account); ok && miners[login] == nil {
+			miners[login] = make(map[string]int64)
+			logins = append(logins, login)
+		}
+	}
+
+	var drifts []LedgerDrift
+	totals := make(map[string]int64)
+	for _, login := range logins {
+		for _, account := range minerAccounts {
+			ledger := balances[MinerAccount(account, login)]
+			actual := miners[login][account]
+			totals[account] += ledger
+			if ledger != actual {
+				drifts = append(drifts, LedgerDrift{Account: MinerAccount(account, login), Ledger: ledger, Actual: actual})
+			}
+		}
+	}
+
+	finances := make(map[string]int64)
+	var balance, immature, pending, paid int64
+	err = s.queryRow("SELECT balance, immature, pending, paid FROM finances WHERE pool = ?", s.pool).Scan(&balance, &immature, &pending, &paid)
+	if err != nil {
+		return nil, err
+	}
+	finances[AccountBalance], finances[AccountImmature], finances[AccountPending], finances[AccountPaid] = balance, immature, pending, paid
+	for _, account := range minerAccounts {
+		if totals[account] != finances[account] {
+			drifts = append(drifts, LedgerDrift{Account: "finances:" + account, Ledger: totals[account], Actual: finances[account]})
+		}
+	}
+	return drifts, nil
+}
+
+func (s *SQLBackend) LockPayouts(login string, amount int64) error {
+	ok, err := s.addState("payments:lock", join(login, amount))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Unable to acquire lock '%s'", join(s.pool, "payments", "lock"))
+	}
+	return nil
+}
+
+func (s *SQLBackend) UnlockPayouts() error {
+	return s.transact(func(t *sqlTx) error {
+		t.deleteState("payments:lock")
+		t.deleteState("payments:inflight")
+		return nil
+	})
+}
+
+func (s *SQLBackend) WriteInFlightPayment(payment *InFlightPayment) error {
+	data, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+	return s.setState("payments:inflight", string(data))
+}
+
+func (s *SQLBackend) GetInFlightPayment() (*InFlightPayment, error) {
+	data, err := s.getState("payments:inflight")
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var payment *InFlightPayment
+	err = json.Unmarshal([]byte(data), &payment)
+	return payment, err
+}
+
+func (s *SQLBackend) IsPayoutsLocked() (bool, error) {
+	lock, err := s.getState("payments:lock")
+	return len(lock) > 0, err
+}
+
+func (s *SQLBackend) GetPendingPayments() []*PendingPayment {
+	rows, err := s.query("SELECT login, amount, ts FROM pending_payments WHERE pool = ? ORDER BY ts DESC", s.pool)
+	var result []*PendingPayment
+	err = scanRows(rows, err, func() error {
+		payment := &PendingPayment{}
+		result = append(result, payment)
+		return rows.Scan(&payment.Address, &payment.Amount, &payment.Timestamp)
+	})
+	if err != nil {
+		Error.Printf("Failed to get pending payments: %v", err)
+		return nil
+	}
+	return result
+}
+
+// Move a paid amount of the miner from pending to paid
+func (t *sqlTx) writePayment(txHash, login string, amount, ts int64) {
+	t.exec("INSERT INTO payments (pool, tx, login, amount, ts) VALUES (?, ?, ?, ?, ?)", t.pool, txHash, login, amount, ts)
+	t.exec("DELETE FROM pending_payments WHERE pool = ? AND login = ? AND amount = ?", t.pool, login, amount)
+	t.writeTransfer(EntryPaid, txHash, login, AccountPending, AccountPaid, amount)
+}
+
+func (s *SQLBackend) WritePayment(login, txHash string, amount int64) error {
+	return s.transact(func(t *sqlTx) error {
+		t.writePayment(txHash, login, amount, MakeTimestamp()/1000)
+		t.deleteState("payments:lock")
+		return nil
+	})
+}
+
+// Record the payments batched in one transaction and release the payouts lock
+func (s *SQLBackend) WritePayments(txHash string, payments map[string]int64) error {
+	return s.transact(func(t *sqlTx) error {
+		t.writePayments(txHash, payments)
+		return nil
+	})
+}
+
+func (t *sqlTx) writePayments(txHash string, payments map[string]int64) {
+	ts := MakeTimestamp() / 1000
+	for _, login := range sortedLogins(payments) {
+		t.writePayment(txHash, login, payments[login], ts)
+	}
+	t.deleteState("payments:lock")
+
+	// Watch the tx until it is confirmed
+	t.writePaymentTx(&PaymentTx{TxId: txHash, Payments: payments, Sent: ts, Status: PaymentPending})
+}
+
+// Record a settled Lightning payment keyed by its payment hash, the routing fee is paid by the pool
+func (s *SQLBackend) WriteLightningPayment(login, paymentHash string, amount, fee int64, clearDestination bool) error {
+	ts := MakeTimestamp() / 1000
+	return s.transact(func(t *sqlTx) error {
+		t.writePayment(paymentHash, login, amount, ts)
+		t.writeLedger(EntryFee, paymentHash, "Lightning routing fee", networkFeePostings(fee)...)
+		// Invoices are single use
+		if clearDestination {
+			t.setMiner(login, "lightning", "", true)
+		}
+		t.deleteState("payments:lock")
+		t.deleteState("payments:inflight")
+		t.writePaymentTx(&PaymentTx{
+			TxId:      paymentHash,
+			Payments:  map[string]int64{login: amount},
+			Sent:      ts,
+			Status:    PaymentConfirmed,
+			Lightning: true,
+			Fee:       fee,
+		})
+		return nil
+	})
+}
+
+func (t *sqlTx) writePaymentTx(ptx *PaymentTx) {
+	data, _ := json.Marshal(ptx)
+	t.exec("INSERT INTO payment_txs (pool, txid, status, sent, record) VALUES (?, ?, ?, ?, ?) "+
+		"ON CONFLICT (pool, txid) DO UPDATE SET status = excluded.status, sent = excluded.sent, record = excluded.record",
+		t.pool, ptx.TxId, ptx.Status, ptx.Sent, string(data))
+}
+
+func scanPaymentTxs(rows *sql.Rows, err error) ([]*PaymentTx, error) {
+	var result []*PaymentTx
+	var data string
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&data)
+		if err != nil {
+			return err
+		}
+		var ptx *PaymentTx
+		err = json.Unmarshal([]byte(data), &ptx)
+		result = append(result, ptx)
+		return err
+	})
+	return result, err
+}
+
+// Payout txs not yet confirmed deep enough, ordered by the time they were sent
+func (s *SQLBackend) GetUnconfirmedPayments() ([]*PaymentTx, error) {
+	rows, err := s.query("SELECT record FROM payment_txs WHERE pool = ? AND status = ? ORDER BY sent", s.pool, PaymentPending)
+	return scanPaymentTxs(rows, err)
+}
+
+// Tracked payout txs by id, unknown ids are left out
+func (s *SQLBackend) GetPaymentTxs(txIds []string) (map[string]*PaymentTx, error) {
+	result := make(map[string]*PaymentTx)
+	if len(txIds) == 0 {
+		return result, nil
+	}
+	args := []interface{}{s.pool}
+	for _, txId := range txIds {
+		args = append(args, txId)
+	}
+	rows, err := s.query("SELECT record FROM payment_txs WHERE pool = ? AND txid IN ("+placeholders(len(txIds))+")", args...)
+	txs, err := scanPaymentTxs(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	for _, ptx := range txs {
+		result[ptx.TxId] = ptx
+	}
+	return result, nil
+}
+
+func (s *SQLBackend) UpdatePaymentTx(ptx *PaymentTx) error {
+	return s.transact(func(t *sqlTx) error {
+		t.writePaymentTx(ptx)
+		return nil
+	})
+}
+
+// Move the payments of a fee bumped tx to its replacement and track the replacement instead
+func (s *SQLBackend) ReplacePaymentTx(ptx *PaymentTx, txHash string) (*PaymentTx, error) {
+	replacement := ptx.replace(txHash)
+	err := s.transact(func(t *sqlTx) error {
+		t.exec("UPDATE payments SET tx = ?, ts = ? WHERE pool = ? AND tx = ?", txHash, ptx.Sent, t.pool, ptx.TxId)
+		t.writePaymentTx(ptx)
+		t.writePaymentTx(replacement)
+		return nil
+	})
+	return replacement, err
+}
+
+func (s *SQLBackend) WritePayoutBatch(batch *PayoutBatch) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	ok, err := s.addState("payments:batch", string(data))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("another payout batch is pending")
+	}
+	return nil
+}
+
+func (s *SQLBackend) GetPayoutBatch() (*PayoutBatch, error) {
+	data, err := s.getState("payments:batch")
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var batch *PayoutBatch
+	err = json.Unmarshal([]byte(data), &batch)
+	return batch, err
+}
+
+// Attach the signed PSBT to the pending batch, the payouts processor broadcasts it
+func (s *SQLBackend) SubmitSignedPsbt(id, psbt string) error {
+	return s.updatePayoutBatch(id, func(batch *PayoutBatch) {
+		batch.SignedPsbt = psbt
+		batch.Failed = ""
+	})
+}
+
+// Drop the signed PSBT of the pending batch with the reason it failed, the batch waits for a new one
+func (s *SQLBackend) FailSignedPsbt(id, reason string) error {
+	return s.updatePayoutBatch(id, func(batch *PayoutBatch) {
+		batch.SignedPsbt = ""
+		batch.Failed = reason
+	})
+}
+
+func (s *SQLBackend) updatePayoutBatch(id string, update func(batch *PayoutBatch)) error {
+	data, err := s.getState("payments:batch")
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("no pending payout batch")
+	}
+	var batch PayoutBatch
+	err = json.Unmarshal([]byte(data), &batch)
+	if err != nil {
+		return err
+	}
+	if batch.Id != id {
+		return fmt.Errorf("payout batch %s is not pending", id)
+	}
+	update(&batch)
+	updated, err := json.Marshal(&batch)
+	if err != nil {
+		return err
+	}
+	// The batch must not have changed since it was read
+	n, err := s.exec("UPDATE pool_state SET value = ? WHERE pool = ? AND name = ? AND value = ?", string(updated), s.pool,
+		"payments:batch", data)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("payout batch %s is not pending", id)
+	}
+	return nil
+}
+
+// Record the payments of a broadcast batch, drop the batch and the abandoned batches it conflicted with
+func (s *SQLBackend) CompletePayoutBatch(txHash string, batch *PayoutBatch) error {
+	return s.transact(func(t *sqlTx) error {
+		t.writePayments(txHash, batch.Payments)
+		t.deleteState("payments:batch")
+		for _, id := range batch.Conflicts {
+			t.exec("DELETE FROM abandoned_batches WHERE pool = ? AND id = ?", t.pool, id)
+		}
+		return nil
+	})
+}
+
+// Credit back the balances of a batch that was never broadcast and remember its inputs,
+// the next batch must spend one of them so the two can't both confirm
+func (s *SQLBackend) AbandonPayoutBatch(batch *PayoutBatch) error {
+	return s.transact(func(t *sqlTx) error {
+		for _, login := range sortedLogins(batch.Payments) {
+			amount := batch.Payments[login]
+			t.exec("DELETE FROM pending_payments WHERE pool = ? AND login = ? AND amount = ?", t.pool, login, amount)
+			t.writeTransfer(EntryRollback, batch.Id, login, AccountPending, AccountBalance, amount)
+		}
+		t.exec("INSERT INTO abandoned_batches (pool, id, inputs) VALUES (?, ?, ?) ON CONFLICT (pool, id) DO UPDATE SET inputs = excluded.inputs",
+			t.pool, batch.Id, strings.Join(batch.Inputs, ","))
+		t.deleteState("payments:batch")
+		t.deleteState("payments:lock")
+		return nil
+	})
+}
+
+func (s *SQLBackend) GetAbandonedBatches() (map[string][]string, error) {
+	rows, err := s.query("SELECT id, inputs FROM abandoned_batches WHERE pool = ?", s.pool)
+	result := make(map[string][]string)
+	var id, inputs string
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&id, &inputs)
+		result[id] = strings.Split(inputs, ",")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *SQLBackend) WritePayoutSchedule(schedule *PayoutSchedule) error {
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	return s.setState("payments:schedule", string(data))
+}
+
+func (s *SQLBackend) GetPayoutSchedule() (*PayoutSchedule, error) {
+	data, err := s.getState("payments:schedule")
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var schedule *PayoutSchedule
+	err = json.Unmarshal([]byte(data), &schedule)
+	return schedule, err
+}
+
+func (s *SQLBackend) WriteSolvency(solvency *Solvency) error {
+	data, err := json.Marshal(solvency)
+	if err != nil {
+		return err
+	}
+	return s.setState("finances:solvency", string(data))
+}
+
+func (s *SQLBackend) GetSolvency() (*Solvency, error) {
+	data, err := s.getState("finances:solvency")
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var solvency *Solvency
+	err = json.Unmarshal([]byte(data), &solvency)
+	return solvency, err
+}
+
+func (t *sqlTx) writeUTXO(utxo *UTXO) {
+	data, _ := json.Marshal(utxo)
+	t.exec("INSERT INTO utxos (pool, outpoint, height, coinbase, record) VALUES (?, ?, ?, ?, ?) ON CONFLICT (pool, outpoint) DO UPDATE SET record = excluded.record",
+		t.pool, utxo.Outpoint(), utxo.Height, utxo.Coinbase, string(data))
+}
+
+func (s *SQLBackend) GetUTXOs() ([]*UTXO, error) {
+	rows, err := s.query("SELECT record FROM utxos WHERE pool = ? ORDER BY outpoint", s.pool)
+	var result []*UTXO
+	var data string
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&data)
+		if err != nil {
+			return err
+		}
+		var utxo *UTXO
+		err = json.Unmarshal([]byte(data), &utxo)
+		result = append(result, utxo)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Track new wallet outputs and forget spent ones
+func (s *SQLBackend) ReconcileUTXOs(add []*UTXO, remove []string) error {
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+	return s.transact(func(t *sqlTx) error {
+		for _, utxo := range add {
+			t.writeUTXO(utxo)
+		}
+		for _, outpoint := range remove {
+			t.exec("DELETE FROM utxos WHERE pool = ? AND outpoint = ?", t.pool, outpoint)
+		}
+		return nil
+	})
+}
+
+// Latest payments of a miner, or of the pool with their payees if login is empty, and how many there are
+func (s *SQLBackend) payments(login string, limit int64) ([]map[string]interface{}, int64, error) {
+	where, args := "pool = ?", []interface{}{s.pool}
+	if len(login) > 0 {
+		where += " AND login = ?"
+		args = append(args, login)
+	}
+	var total int64
+	err := s.queryRow("SELECT COUNT(*) FROM payments WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	query := "SELECT tx, login, amount, ts FROM payments WHERE " + where + " ORDER BY ts DESC, id DESC"
+	if limit > 0 {
+		query += " LIMIT " + strconv.FormatInt(limit, 10)
+	}
+	rows, err := s.query(query, args...)
+	var payments []map[string]interface{}
+	var tx, payee string
+	var amount, ts int64
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&tx, &payee, &amount, &ts)
+		payment := map[string]interface{}{"timestamp": ts, "tx": tx, "amount": amount}
+		if len(login) == 0 {
+			payment["address"] = payee
+		}
+		payments = append(payments, payment)
+		return err
+	})
+	if err == nil {
+		err = annotatePayments(s, payments)
+	}
+	return payments, total, err
+}
+
+// Stats of the rounds backend with the balances and payments of the miner
+func (s *SQLBackend) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
+	stats, err := s.RoundsBackend.GetMinerStats(login, maxPayments)
+	if err != nil {
+		return nil, err
+	}
+	var balance, immature, pending, paid, ppsCredit, threshold int64
+	err = s.queryRow("SELECT balance, immature, pending, paid, pps_credit, threshold FROM miners WHERE pool = ? AND login = ?",
+		s.pool, login).Scan(&balance, &immature, &pending, &paid, &ppsCredit, &threshold)
+	if err == nil {
+		fields := map[string]string{
+			"balance":  strconv.FormatInt(balance, 10),
+			"immature": strconv.FormatInt(immature, 10),
+			"pending":  strconv.FormatInt(pending, 10),
+			"paid":     strconv.FormatInt(paid, 10),
+		}
+		if ppsCredit != 0 {
+			fields["ppsCredit"] = strconv.FormatInt(ppsCredit, 10)
+		}
+		if threshold > 0 {
+			fields["threshold"] = strconv.FormatInt(threshold, 10)
+		}
+		miner := stats["stats"].(map[string]interface{})
+		for k, v := range convertStringMap(fields) {
+			miner[k] = v
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	stats["payments"], stats["paymentsTotal"], err = s.payments(login, maxPayments)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Stats of the rounds backend with the blocks, payments and reserve of the pool
+func (s *SQLBackend) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+	stats, err := s.RoundsBackend.CollectStats(smallWindow, maxBlocks, maxPayments)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.query("SELECT stage, COUNT(*) FROM blocks WHERE pool = ? GROUP BY stage", s.pool)
+	totals := make(map[string]int64)
+	var stage string
+	var n int64
+	err = scanRows(rows, err, func() error {
+		err := rows.Scan(&stage, &n)
+		totals[stage] = n
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := s.blockRows("candidates", 0, math.MaxInt64, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	immature, err := s.blockRows("immature", 0, math.MaxInt64, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	matured, err := s.blockRows("matured", 0, math.MaxInt64, true, maxBlocks)
+	if err != nil {
+		return nil, err
+	}
+	stats["candidates"] = convertCandidateResults(candidates)
+	stats["candidatesTotal"] = totals["candidates"]
+	stats["immature"] = convertBlockResults(immature)
+	stats["immatureTotal"] = totals["immature"]
+	stats["matured"] = convertBlockResults(matured)
+	stats["maturedTotal"] = totals["matured"]
+
+	stats["payments"], stats["paymentsTotal"], err = s.payments("", maxPayments)
+	if err != nil {
+		return nil, err
+	}
+	var reserve int64
+	err = s.queryRow("SELECT reserve FROM finances WHERE pool = ?", s.pool).Scan(&reserve)
+	if err != nil {
+		return nil, err
+	}
+	stats["reserve"] = reserve
+	return stats, nil
+}
+
+func (s *SQLBackend) CollectLuckStats(windows []int) (map[string]interface{}, error) {
+	immature, err := s.blockRows("immature", 0, math.MaxInt64, true, 0)
+	if err != nil {
+		return make(map[string]interface{}), err
+	}
+	matured, err := s.blockRows("matured", 0, math.MaxInt64, true, int64(windows[len(windows)-1]))
+	if err != nil {
+		return make(map[string]interface{}), err
+	}
+	return luckStats(convertBlockResults(immature, matured), windows), nil
+}
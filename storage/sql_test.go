@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newSQLiteBackend(t *testing.T) *SQLBackend {
+	db, err := OpenSQL(&SQLConfig{Driver: "sqlite3", DSN: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSQLBackend(db, "test", NewMemoryBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSQLiteBackendConformance(t *testing.T) {
+	testBackend(t, func() Backend { return newSQLiteBackend(t) })
+}
+
+// Runs against the database in BTCPOOL_TEST_POSTGRES, its rows of the test pool are deleted
+func TestPostgresBackendConformance(t *testing.T) {
+	dsn := os.Getenv("BTCPOOL_TEST_POSTGRES")
+	if len(dsn) == 0 {
+		t.Skip("BTCPOOL_TEST_POSTGRES is not set")
+	}
+	db, err := OpenSQL(&SQLConfig{Driver: "postgres", DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testBackend(t, func() Backend {
+		db.db.Exec("DELETE FROM postings WHERE entry_id IN (SELECT id FROM ledger WHERE pool = 'test')")
+		for _, table := range []string{"miners", "finances", "blocks", "immature_credits", "credits", "payments",
+			"pending_payments", "payment_txs", "abandoned_batches", "utxos", "ledger", "pool_state"} {
+			db.db.Exec("DELETE FROM " + table + " WHERE pool = 'test'")
+		}
+		b, err := NewSQLBackend(db, "test", NewMemoryBackend())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	})
+}
+
+func TestSQLRebind(t *testing.T) {
+	query := "UPDATE miners SET balance = ? WHERE pool = ? AND login = ?"
+	if q := (&SQLDB{driver: "sqlite3"}).rebind(query); q != query {
+		t.Errorf("Unexpected sqlite3 query %q", q)
+	}
+	expected := "UPDATE miners SET balance = $1 WHERE pool = $2 AND login = $3"
+	if q := (&SQLDB{driver: "postgres"}).rebind(query); q != expected {
+		t.Errorf("Unexpected postgres query %q", q)
+	}
+}
+
+func TestSQLBackendFailedTransaction(t *testing.T) {
+	b := newSQLiteBackend(t)
+	block := writeTestBlock(t, b, 100, "aa", "0x1")
+	block.Reward = big.NewInt(5000)
+	if err := b.WriteImmatureBlock(block, map[string]int64{"x": 3000}); err != nil {
+		t.Fatal(err)
+	}
+	// Moved by the first write, the second must change nothing
+	if err := b.WriteImmatureBlock(block, map[string]int64{"x": 3000}); err == nil {
+		t.Fatal("Block must be written immature once")
+	}
+	if _, immature, _, _ := b.GetOwedBalances(); immature != 3000 {
+		t.Errorf("Failed transaction must be rolled back, immature %v", immature)
+	}
+	if entries, _ := b.GetLedger(0, 10); len(entries) != 1 {
+		t.Errorf("Unexpected ledger %+v", entries)
+	}
+}
+
+func TestSQLBackendCredits(t *testing.T) {
+	b := newSQLiteBackend(t)
+	b.WriteShare("x", "1", []string{"0x1", "0x0", "0x0"}, 10, 100, time.Hour, ShareAccounting{Credit: 750})
+	b.WriteShare("x", "1", []string{"0x1", "0x1", "0x0"}, 10, 100, time.Hour, ShareAccounting{Credit: 750})
+	if balance, _ := b.GetBalance("x"); balance != 0 {
+		t.Errorf("PPS credits must wait for the flush, balance %v", balance)
+	}
+	// A batch settled before it could be cleared is taken again
+	batch, credits, _ := b.RoundsBackend.takeCredits()
+	if err := b.applyCredits(batch, credits); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.FlushCredits(); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := b.GetBalance("x"); balance != 1 {
+		t.Errorf("Batch must be settled once, balance %v", balance)
+	}
+	b.WriteShare("x", "1", []string{"0x1", "0x2", "0x0"}, 10, 100, time.Hour, ShareAccounting{Credit: 500})
+	if err := b.FlushCredits(); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := b.GetBalance("x"); balance != 2 {
+		t.Errorf("Unexpected balance %v", balance)
+	}
+	if batch, _, _ := b.RoundsBackend.takeCredits(); len(batch) != 0 {
+		t.Errorf("Settled batch %v must be cleared", batch)
+	}
+	if entries, _ := b.GetLedger(0, 10); len(entries) != 2 {
+		t.Errorf("Unexpected ledger %+v", entries)
+	}
+}
+
+func TestSQLBackendPools(t *testing.T) {
+	db, err := OpenSQL(&SQLConfig{Driver: "sqlite3", DSN: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := NewSQLBackend(db, "a", NewMemoryBackend())
+	b, _ := NewSQLBackend(db, "b", NewMemoryBackend())
+	a.AdjustBalance("x", 1000, "test")
+	b.AdjustBalance("x", 2000, "test")
+	b.AdjustBalance("y", 500, "test")
+	a.AdjustBalance("x", 100, "test")
+
+	if balance, _ := a.GetBalance("x"); balance != 1100 {
+		t.Errorf("Unexpected balance %v", balance)
+	}
+	entries, _ := a.GetLedger(0, 10)
+	if len(entries) != 2 || entries[1].Postings[0].Amount != 100 || len(entries[1].Postings) != 2 {
+		t.Errorf("Unexpected ledger %+v", entries)
+	}
+	if payees, _ := a.GetPayees(); len(payees) != 1 {
+		t.Errorf("Unexpected payees %v", payees)
+	}
+	stats, _ := b.CollectStats(time.Minute, 10, 10)
+	if stats["reserve"].(int64) != 0 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
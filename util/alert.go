@@ -0,0 +1,53 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type AlertConfig struct {
+	Webhook string `json:"webhook"`
+	Timeout string `json:"timeout"`
+}
+
+type alertMessage struct {
+	Subject   string `json:"subject"`
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+var alertWebhook string
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+func InitAlert(cfg *AlertConfig) {
+	alertWebhook = cfg.Webhook
+	if len(cfg.Timeout) > 0 {
+		alertClient = &http.Client{Timeout: MustParseDuration(cfg.Timeout)}
+	}
+}
+
+// Logs the alert and, if a webhook is configured, posts it in the background
+func RaiseAlert(subject string, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	Error.Printf("ALERT [%s]: %s", subject, msg)
+
+	if len(alertWebhook) == 0 {
+		return
+	}
+	data, err := json.Marshal(&alertMessage{Subject: subject, Message: msg, Timestamp: MakeTimestamp() / 1000})
+	if err != nil {
+		Error.Printf("Failed to encode alert: %v", err)
+		return
+	}
+	go func(url string) {
+		resp, err := alertClient.Post(url, "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			Error.Printf("Failed to deliver alert to webhook: %v", err)
+			return
+		}
+		_ = resp.Body.Close()
+	}(alertWebhook)
+}
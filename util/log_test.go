@@ -1,9 +1,14 @@
 package util
 
-import "testing"
+import (
+	"path/filepath"
+	"testing"
+)
 
 func TestLog(t *testing.T) {
-	InitLog("info.log", "error.log", "share.log", "block.log", 40)
+	dir := t.TempDir()
+	InitLog(filepath.Join(dir, "info.log"), filepath.Join(dir, "error.log"),
+		filepath.Join(dir, "share.log"), filepath.Join(dir, "block.log"), 40)
 	Debug.Println("debug")
 	Error.Println("error")
 	ShareLog.Println("share")
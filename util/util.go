@@ -3,10 +3,12 @@ package util
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/mutalisk999/bitcoin-lib/src/base58"
 	"github.com/mutalisk999/bitcoin-lib/src/bigint"
 	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	gomath "math"
 	"math/big"
 	"regexp"
 	"strconv"
@@ -88,6 +90,28 @@ func FormatRatReward(reward *big.Rat) string {
 	return reward.FloatString(8)
 }
 
+func BTCToSatoshi(value float64) int64 {
+	satoshi, _ := new(big.Float).Mul(big.NewFloat(value), new(big.Float).SetInt(BTC)).Float64()
+	return int64(gomath.Round(satoshi))
+}
+
+// Exact RPC amount of a satoshi value, e.g. "0.00100000"
+func SatoshiToAmount(satoshi int64) string {
+	return new(big.Rat).SetFrac(big.NewInt(satoshi), BTC).FloatString(8)
+}
+
+func AmountToSatoshi(amount string) (int64, error) {
+	value, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return 0, errors.New("invalid amount " + amount)
+	}
+	value.Mul(value, new(big.Rat).SetInt(BTC))
+	if !value.IsInt() {
+		return 0, errors.New("amount " + amount + " is not a whole number of satoshi")
+	}
+	return value.Num().Int64(), nil
+}
+
 func StringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
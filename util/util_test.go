@@ -18,3 +18,19 @@ func TestHash256StratumFormat(t *testing.T) {
 	txIdStratumHex, _ := Hash256StratumFormat(txIdHex)
 	fmt.Println("txIdStratumHex:", txIdStratumHex)
 }
+
+func TestSatoshiAmount(t *testing.T) {
+	if amount := SatoshiToAmount(123456789); amount != "1.23456789" {
+		t.Errorf("Unexpected amount %v", amount)
+	}
+	if amount := SatoshiToAmount(1000); amount != "0.00001000" {
+		t.Errorf("Unexpected amount %v", amount)
+	}
+	satoshi, err := AmountToSatoshi("21.0001")
+	if err != nil || satoshi != 2100010000 {
+		t.Errorf("Unexpected satoshi %v: %v", satoshi, err)
+	}
+	if _, err = AmountToSatoshi("0.000000001"); err == nil {
+		t.Error("Fractional satoshi must be rejected")
+	}
+}